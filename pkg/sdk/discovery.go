@@ -0,0 +1,110 @@
+package sdk
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Discovery subjects. Plugins publish an Announcement on the announce subject
+// when they start, then on the heartbeat subject every heartbeat interval, and
+// send it in reply to health checks. The subjects are followed by the name of
+// the plugin.
+const (
+	AnnounceSubjectPrefix  = "surroundhome.plugins.announce."
+	HeartbeatSubjectPrefix = "surroundhome.plugins.heartbeat."
+	HealthSubjectPrefix    = "surroundhome.plugins.health."
+)
+
+// ListSubject is answered by the surserver plugin registry with the list of
+// the known plugins.
+const ListSubject = "surroundhome.plugins.list"
+
+// Version and Description of the plugin, announced and reported by the NATS
+// micro services API. Version must follow SemVer; set it before calling Run,
+// or at build time with -ldflags "-X github.com/lstep/surroundhome/pkg/sdk.Version=1.2.3".
+var (
+	Version     = "0.0.0-dev"
+	Description string
+)
+
+// Announcement describes a running plugin.
+type Announcement struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	// ID of the instance in the NATS micro services API
+	ID        string     `json:"id"`
+	PID       int        `json:"pid,omitempty"`
+	Endpoints []Endpoint `json:"endpoints"`
+	Started   time.Time  `json:"started"`
+	Time      time.Time  `json:"time"`
+	// Interval between heartbeats, e.g. "10s"
+	Interval string `json:"interval"`
+}
+
+// Endpoint is a subject a plugin handles.
+type Endpoint struct {
+	Subject     string `json:"subject"`
+	Description string `json:"description,omitempty"`
+	// JSON schemas of the messages and of the responses, if documented
+	Request  map[string]any `json:"request,omitempty"`
+	Response map[string]any `json:"response,omitempty"`
+}
+
+// addService registers the plugin with the NATS micro services API, so it
+// answers $SRV.PING, $SRV.INFO and $SRV.STATS, and subscribes the handlers.
+//
+// Handlers are plain subscriptions rather than micro endpoints: endpoints join
+// a queue group, while every plugin handling a subject must get its messages,
+// and they hide the *nats.Msg handlers respond with. The endpoints are
+// described by the announcements instead.
+func addService(nc *nats.Conn, name string, handlers []MsgHandler) (micro.Service, error) {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:        name,
+		Version:     Version,
+		Description: Description,
+		Metadata:    map[string]string{"pid": fmt.Sprint(os.Getpid())},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, handler := range handlers {
+		if _, err := nc.Subscribe(handler.Subject, handler.Handler); err != nil {
+			svc.Stop()
+			return nil, fmt.Errorf("error subscribing to %s: %w", handler.Subject, err)
+		}
+	}
+
+	return svc, nil
+}
+
+// announcement returns the Announcement of the plugin.
+func announcement(svc micro.Service, handlers []MsgHandler, interval time.Duration) Announcement {
+	info := svc.Info()
+	endpoints := make([]Endpoint, 0, len(handlers))
+	for _, handler := range handlers {
+		endpoints = append(endpoints, Endpoint{
+			Subject:     handler.Subject,
+			Description: handler.Description,
+			Request:     handler.Request,
+			Response:    handler.Response,
+		})
+	}
+
+	return Announcement{
+		Name:        info.Name,
+		Version:     info.Version,
+		Description: info.Description,
+		ID:          info.ID,
+		PID:         os.Getpid(),
+		Endpoints:   endpoints,
+		Started:     svc.Stats().Started,
+		Time:        time.Now(),
+		Interval:    interval.String(),
+	}
+}
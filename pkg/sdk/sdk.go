@@ -0,0 +1,272 @@
+// Package sdk runs external surroundhome plugins: processes that connect to
+// NATS and handle messages, usually launched by surserver.
+//
+// A plugin declares its own flags with pflag and its defaults with viper, then
+// hands its message handlers to Run:
+//
+//	func main() {
+//		pflag.String("api-url", "http://localhost:8000", "URL of the API")
+//		if err := sdk.Run("my-plugin", sdk.MsgHandler{Subject: "my.subject", Handler: handle}); err != nil {
+//			os.Exit(1)
+//		}
+//	}
+//
+// Settings are read, by order of precedence, from the command line flags, the
+// environment variables prefixed by the plugin name (e.g. MY_PLUGIN_API_URL,
+// unless the plugin set another prefix with viper.SetEnvPrefix), the NATS URL
+// passed by surserver in SURROUNDHOME_NATS_URL, the config passed by surserver
+// in SURROUNDHOME_PLUGIN_CONFIG, the <name>-config.yaml file of the working
+// directory and the defaults. Secret references such as
+// ${env:VAR} are resolved, see package secrets. Handlers read the settings
+// with viper.
+package sdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lstep/surroundhome/pkg/secrets"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Environment variables set by the surserver plugin supervisor
+const (
+	NATSURLEnv      = "SURROUNDHOME_NATS_URL"
+	PluginNameEnv   = "SURROUNDHOME_PLUGIN_NAME"
+	PluginConfigEnv = "SURROUNDHOME_PLUGIN_CONFIG"
+)
+
+// Settings read by Run, on top of the ones of the plugin
+const (
+	NATSURLKey           = "nats-url"
+	NATSCredsKey         = "nats-creds"
+	NATSTokenKey         = "nats-token"
+	LogLevelKey          = "log-level"
+	HeartbeatIntervalKey = "heartbeat-interval"
+)
+
+// How long draining the NATS connection may take on shutdown
+const drainTimeout = 30 * time.Second
+
+// MsgHandler handles the messages published to Subject, like the MsgHandler
+// of surserver modules.
+type MsgHandler struct {
+	Subject string
+	Handler func(msg *nats.Msg)
+	// Description, Request and Response document the handler in the plugin
+	// announcements. Request and Response are the JSON schemas of the messages
+	// and of the responses, nil when undocumented.
+	Description string
+	Request     map[string]any
+	Response    map[string]any
+}
+
+var conn *nats.Conn
+
+// Deprecated names of settings, see Alias
+var aliases = make(map[string]string)
+
+// Alias makes alias a deprecated name of the setting key: when key is not set,
+// it takes the value of alias. Call it before Run.
+func Alias(alias, key string) {
+	aliases[alias] = key
+}
+
+// Conn returns the NATS connection of the plugin, once Run connected it.
+func Conn() *nats.Conn {
+	return conn
+}
+
+// Run loads the config of the plugin, connects to NATS, subscribes the
+// handlers, announces the plugin and publishes heartbeats until it receives
+// SIGINT or SIGTERM. It then drains the NATS connection, so the messages being
+// handled are not lost.
+//
+// The plugin is also registered with the NATS micro services API, so it shows
+// up in "nats micro ls".
+func Run(name string, handlers ...MsgHandler) error {
+	// surserver may run several instances of a plugin under different names
+	if instance := os.Getenv(PluginNameEnv); instance != "" {
+		name = instance
+	}
+
+	if err := loadConfig(name); err != nil {
+		slog.Error("error loading config", "plugin", name, "error", err)
+		return err
+	}
+	logger := slog.Default().With("plugin", name)
+
+	nc, err := connect(name, logger)
+	if err != nil {
+		logger.Error("error connecting to NATS", "url", viper.GetString(NATSURLKey), "error", err)
+		return err
+	}
+	conn = nc
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	logger.Info("connected to NATS", "url", nc.ConnectedUrlRedacted())
+
+	for _, handler := range handlers {
+		logger.Info("subscribing to NATS subject", "subject", handler.Subject)
+	}
+	svc, err := addService(nc, name, handlers)
+	if err != nil {
+		logger.Error("error registering plugin", "error", err)
+		nc.Close()
+		return err
+	}
+
+	interval := viper.GetDuration(HeartbeatIntervalKey)
+	heartbeat := func() []byte {
+		data, _ := json.Marshal(announcement(svc, handlers, interval))
+		return data
+	}
+	if _, err := nc.Subscribe(HealthSubjectPrefix+name, func(msg *nats.Msg) {
+		_ = msg.Respond(heartbeat())
+	}); err != nil {
+		nc.Close()
+		return fmt.Errorf("error subscribing to health checks: %w", err)
+	}
+
+	// Set up signal handling for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	logger.Info("running")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if err := nc.Publish(AnnounceSubjectPrefix+name, heartbeat()); err != nil {
+		logger.Warn("error publishing announcement", "error", err)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := nc.Publish(HeartbeatSubjectPrefix+name, heartbeat()); err != nil {
+				logger.Warn("error publishing heartbeat", "error", err)
+			}
+		case <-closed:
+			return errors.New("NATS connection closed")
+		case sig := <-sigChan:
+			logger.Info("received signal, initiating graceful shutdown", "signal", sig)
+			if err := svc.Stop(); err != nil {
+				logger.Error("error stopping service", "error", err)
+			}
+			if err := nc.Drain(); err != nil {
+				logger.Error("error draining NATS connection", "error", err)
+				return err
+			}
+			<-closed
+			logger.Info("stopped")
+			return nil
+		}
+	}
+}
+
+// loadConfig loads the settings of the plugin into the global viper instance,
+// and configures the default logger.
+func loadConfig(name string) error {
+	pflag.String(NATSURLKey, nats.DefaultURL, "NATS server URL")
+	pflag.String(NATSCredsKey, "", "NATS credentials file")
+	pflag.String(NATSTokenKey, "", "NATS authentication token")
+	pflag.String(LogLevelKey, "info", "Minimum level of the logs: debug, info, warn or error")
+	pflag.Duration(HeartbeatIntervalKey, 10*time.Second, "Interval between heartbeats")
+	if !pflag.Parsed() {
+		pflag.Parse()
+	}
+	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
+		return err
+	}
+
+	if viper.GetEnvPrefix() == "" {
+		viper.SetEnvPrefix(strings.ReplaceAll(name, "-", "_"))
+	}
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+
+	// The NATS URL given by surserver wins over the config files, a flag or
+	// the variable of the plugin still win. It is bound first rather than
+	// relying on viper to look up automatic variables before bound ones.
+	pluginEnv := strings.ToUpper(viper.GetEnvPrefix() + "_" + NATSURLKey)
+	if err := viper.BindEnv(NATSURLKey, pluginEnv, NATSURLEnv); err != nil {
+		return err
+	}
+
+	viper.SetConfigName(name + "-config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return fmt.Errorf("error reading config file: %w", err)
+		}
+	}
+
+	if raw := os.Getenv(PluginConfigEnv); raw != "" {
+		var config map[string]any
+		if err := json.Unmarshal([]byte(raw), &config); err != nil {
+			return fmt.Errorf("invalid %s: %w", PluginConfigEnv, err)
+		}
+		if err := viper.MergeConfigMap(config); err != nil {
+			return err
+		}
+	}
+
+	// Replace ${env:...}, ${file:...} and ${secret:...} references by their value
+	if err := secrets.ResolveViper(viper.GetViper()); err != nil {
+		return fmt.Errorf("error resolving secrets: %w", err)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(viper.GetString(LogLevelKey))); err != nil {
+		return fmt.Errorf("invalid %s: %w", LogLevelKey, err)
+	}
+	// JSON logs keep their level and attributes once collected by surserver
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+
+	for alias, key := range aliases {
+		if viper.IsSet(alias) && !viper.IsSet(key) {
+			slog.Warn("deprecated setting, use the new name", "plugin", name, "setting", alias, "new_name", key)
+			viper.Set(key, viper.Get(alias))
+		}
+	}
+
+	slog.Info("loaded config", "plugin", name, "file", viper.ConfigFileUsed())
+	return nil
+}
+
+// connect connects to NATS, reconnecting forever when the connection is lost.
+func connect(name string, logger *slog.Logger) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2 * time.Second),
+		nats.DrainTimeout(drainTimeout),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// err is nil when the connection is closed on purpose
+			if err != nil {
+				logger.Warn("disconnected from NATS", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logger.Info("reconnected to NATS", "url", nc.ConnectedUrlRedacted())
+		}),
+	}
+	if creds := viper.GetString(NATSCredsKey); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	if token := viper.GetString(NATSTokenKey); token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+
+	return nats.Connect(viper.GetString(NATSURLKey), opts...)
+}
@@ -0,0 +1,58 @@
+package sdk
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func TestNATSURLPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{
+			name: "default",
+			want: "nats://127.0.0.1:4222",
+		},
+		{
+			name: "surserver",
+			env:  map[string]string{NATSURLEnv: "nats://surserver:4222"},
+			want: "nats://surserver:4222",
+		},
+		{
+			name: "plugin variable",
+			env:  map[string]string{NATSURLEnv: "nats://surserver:4222", "MY_PLUGIN_NATS_URL": "nats://plugin:4222"},
+			want: "nats://plugin:4222",
+		},
+		{
+			name: "flag",
+			env:  map[string]string{NATSURLEnv: "nats://surserver:4222", "MY_PLUGIN_NATS_URL": "nats://plugin:4222"},
+			args: []string{"--nats-url", "nats://flag:4222"},
+			want: "nats://flag:4222",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			viper.Reset()
+			pflag.CommandLine = pflag.NewFlagSet("my-plugin", pflag.ContinueOnError)
+			if err := loadConfig("my-plugin"); err != nil {
+				t.Fatal(err)
+			}
+			if err := pflag.CommandLine.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := viper.GetString(NATSURLKey); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
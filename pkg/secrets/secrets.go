@@ -0,0 +1,145 @@
+// Package secrets resolves secret references found in configuration values,
+// so credentials don't have to be written in plain text in config files.
+//
+// A reference is written ${<source>:<name>}, where source is one of:
+//   - env: the value of an environment variable, e.g. ${env:OBS_AUTH_KEY}
+//   - file: the content of a file, without its trailing newline, e.g. ${file:/run/secrets/obs}
+//   - secret: an entry of the encrypted secrets store, e.g. ${secret:obs-auth-key}
+//
+// Resolved values are remembered so they can be redacted from logs with Redact.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Placeholder replacing secret values in redacted text
+const Redacted = "[REDACTED]"
+
+var (
+	ErrUnknownSource = errors.New("unknown secret source")
+	ErrNotFound      = errors.New("secret not found")
+)
+
+var refRe = regexp.MustCompile(`\$\{(env|file|secret):([^}]+)\}`)
+
+var (
+	revealedLock sync.RWMutex
+	revealed     = make(map[string]bool)
+)
+
+// Resolve replaces the secret references found in s by their value.
+func Resolve(s string) (string, error) {
+	var resolveErr error
+	out := refRe.ReplaceAllStringFunc(s, func(ref string) string {
+		m := refRe.FindStringSubmatch(ref)
+		value, err := lookup(m[1], m[2])
+		if err != nil {
+			resolveErr = fmt.Errorf("error resolving %s: %w", ref, err)
+			return ref
+		}
+		remember(value)
+		return value
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+	return out, nil
+}
+
+// ResolveAll returns a copy of v, a tree of maps, lists and strings as decoded
+// from a config file, with the secret references of its strings resolved.
+func ResolveAll(v any) (any, error) {
+	switch value := v.(type) {
+	case string:
+		return Resolve(value)
+	case map[string]any:
+		out := make(map[string]any, len(value))
+		for key, item := range value {
+			resolved, err := ResolveAll(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			out[key] = resolved
+		}
+		return out, nil
+	case []any:
+		out := make([]any, len(value))
+		for i, item := range value {
+			resolved, err := ResolveAll(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// ResolveViper resolves the secret references of the settings of v.
+func ResolveViper(v *viper.Viper) error {
+	for key, value := range v.AllSettings() {
+		resolved, err := ResolveAll(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if !reflect.DeepEqual(resolved, value) {
+			v.Set(key, resolved)
+		}
+	}
+	return nil
+}
+
+// Redact replaces the secret values resolved so far that appear in s.
+func Redact(s string) string {
+	revealedLock.RLock()
+	defer revealedLock.RUnlock()
+
+	for value := range revealed {
+		s = strings.ReplaceAll(s, value, Redacted)
+	}
+	return s
+}
+
+func remember(value string) {
+	// Short values would redact too much unrelated text
+	if len(value) < 4 {
+		return
+	}
+	revealedLock.Lock()
+	revealed[value] = true
+	revealedLock.Unlock()
+}
+
+func lookup(source, name string) (string, error) {
+	switch source {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%w: environment variable %s is not set", ErrNotFound, name)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "secret":
+		store, err := OpenStore(DefaultStorePath(), DefaultKeyPath())
+		if err != nil {
+			return "", err
+		}
+		return store.Get(name)
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownSource, source)
+}
@@ -0,0 +1,186 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Environment variables locating the encrypted secrets store and its key
+const (
+	StorePathEnv = "SURROUNDHOME_SECRETS_FILE"
+	KeyPathEnv   = "SURROUNDHOME_SECRETS_KEY_FILE"
+	// The key itself, base64 encoded, takes precedence over the key file
+	KeyEnv = "SURROUNDHOME_SECRETS_KEY"
+)
+
+const (
+	keySize    = 32
+	nonceSize  = 24
+	fileHeader = "surroundhome-secrets:v1:"
+)
+
+var ErrDecrypt = errors.New("unable to decrypt secrets store, wrong key?")
+
+// DefaultStorePath returns the path of the secrets store, secrets.enc unless
+// set by SURROUNDHOME_SECRETS_FILE.
+func DefaultStorePath() string {
+	if path := os.Getenv(StorePathEnv); path != "" {
+		return path
+	}
+	return "secrets.enc"
+}
+
+// DefaultKeyPath returns the path of the key of the secrets store, secrets.key
+// unless set by SURROUNDHOME_SECRETS_KEY_FILE.
+func DefaultKeyPath() string {
+	if path := os.Getenv(KeyPathEnv); path != "" {
+		return path
+	}
+	return "secrets.key"
+}
+
+// Store is a local file of secrets encrypted with NaCl secretbox
+// (XSalsa20-Poly1305) using a 32 bytes key.
+type Store struct {
+	path    string
+	key     [keySize]byte
+	secrets map[string]string
+}
+
+// GenerateKey writes a new random key to path. It refuses to overwrite an
+// existing key, as the secrets encrypted with it would be lost.
+func GenerateKey(path string) error {
+	var key [keySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(base64.StdEncoding.EncodeToString(key[:]) + "\n")
+	return err
+}
+
+// OpenStore opens the store at path. A missing store is empty.
+func OpenStore(path, keyPath string) (*Store, error) {
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{path: path, key: key, secrets: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(string(data)), fileHeader)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a secrets store", path)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < nonceSize {
+		return nil, fmt.Errorf("%s is corrupted", path)
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed[:nonceSize])
+	plain, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, &s.key)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	if err := json.Unmarshal(plain, &s.secrets); err != nil {
+		return nil, fmt.Errorf("%s is corrupted: %w", path, err)
+	}
+
+	return s, nil
+}
+
+func loadKey(path string) ([keySize]byte, error) {
+	var key [keySize]byte
+
+	encoded := os.Getenv(KeyEnv)
+	if encoded == "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return key, fmt.Errorf("error reading secrets key: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != keySize {
+		return key, fmt.Errorf("secrets key must be %d base64 encoded bytes", keySize)
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// Get returns the secret called name.
+func (s *Store) Get(name string) (string, error) {
+	value, ok := s.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return value, nil
+}
+
+// Set adds or replaces a secret. Call Save to persist it.
+func (s *Store) Set(name, value string) {
+	s.secrets[name] = value
+}
+
+// Delete removes a secret. Call Save to persist it.
+func (s *Store) Delete(name string) error {
+	if _, ok := s.secrets[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	delete(s.secrets, name)
+	return nil
+}
+
+// Names returns the sorted names of the secrets.
+func (s *Store) Names() []string {
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Save encrypts the secrets with a fresh nonce and writes the store.
+func (s *Store) Save() error {
+	plain, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	sealed := secretbox.Seal(nonce[:], plain, &nonce, &s.key)
+
+	// Write then rename, so a failure never leaves a truncated store
+	tmp := s.path + ".tmp"
+	content := fileHeader + base64.StdEncoding.EncodeToString(sealed) + "\n"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -7,11 +7,10 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/lstep/surroundhome/pkg/sdk"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -21,78 +20,16 @@ const (
 	authKey = "auth-key"
 )
 
-func initConfig() {
-	// Set up command line flags
+func main() {
+	// Set up command line flags, read along with the settings of the SDK
 	pflag.String("obsidian-api-url", "http://localhost:27123", "Obsidian API URL")
 	pflag.String(authKey, "", "Authentication key for Obsidian API")
-	pflag.String("nats-address", "nats://localhost:4222", "NATS server address")
-	pflag.Parse()
-
-	// Bind flags to viper
-	viper.BindPFlags(pflag.CommandLine)
-
-	// Set up environment variables
+	pflag.String("nats-address", "", "Deprecated, use --nats-url")
+	sdk.Alias("nats-address", sdk.NATSURLKey)
 	viper.SetEnvPrefix("OBS")
-	viper.AutomaticEnv()
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-
-	// Set up config file
-	viper.SetConfigName("obs-new-discoveries-config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
-
-	slog.Info("looking for config file", "path", viper.ConfigFileUsed())
-
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-			slog.Error("error reading config file", "error", err)
-		} else {
-			slog.Info("config file not found", "error", err)
-		}
-	} else {
-		slog.Info("using config file", "path", viper.ConfigFileUsed())
-	}
-
-	// Print current configuration
-	slog.Info("current configuration",
-		"obsidian-api-url", viper.GetString("obsidian-api-url"),
-		"nats-address", viper.GetString("nats-address"),
-		"auth-key", viper.GetString(authKey))
-
-	// Set default values
-	viper.SetDefault("obsidian-api-url", "http://localhost:27123")
-	viper.SetDefault("nats-address", "nats://localhost:4222")
-}
-
-func main() {
-	// Configure slog with JSON handler and debug level
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelDebug,
-	})))
-
-	initConfig()
-
-	nc, err := nats.Connect(viper.GetString("nats-address"))
-	if err != nil {
-		panic(err)
-	}
-	defer nc.Close()
-
-	slog.Info("connected to NATS, running...")
-
-	nc.Subscribe("memorize", handleMemorizeMessage)
-
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	// Wait for termination signal
-	sig := <-sigChan
-	slog.Info("received signal, initiating graceful shutdown", "signal", sig)
 
-	// Perform cleanup
-	if err := nc.Drain(); err != nil {
-		slog.Error("error draining NATS connection", "error", err)
+	if err := sdk.Run("obs-new-discoveries", sdk.MsgHandler{Subject: "memorize", Handler: handleMemorizeMessage}); err != nil {
+		os.Exit(1)
 	}
 }
 
@@ -1,12 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/lstep/surroundhome/pkg/secrets"
 	"github.com/lstep/surroundhome/surserver/internal/app"
-	"github.com/lstep/surroundhome/surserver/internal/mods/rest-nats"
+	"github.com/lstep/surroundhome/surserver/internal/mods/rules"
+	"github.com/nats-io/nats.go"
+
+	// Modules register themselves with the app, link them in here
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/devices"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/presence"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/registry"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/rest-nats"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/scenes"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/scheduler"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/state"
+	_ "github.com/lstep/surroundhome/surserver/internal/mods/webhook"
 )
 
 func main() {
@@ -14,6 +34,16 @@ func main() {
 }
 
 func Run(args []string) int {
+	if len(args) > 0 && args[0] == "config" {
+		return runConfig(args[1:])
+	}
+	if len(args) > 0 && args[0] == "secrets" {
+		return runSecrets(args[1:])
+	}
+	if len(args) > 0 && args[0] == "rules" {
+		return runRules(args[1:])
+	}
+
 	// Define flags
 	flagSet := flag.NewFlagSet("surserver", flag.ExitOnError)
 	configPath := flagSet.String("c", "config.yaml", "Path to configuration file")
@@ -29,17 +59,38 @@ func Run(args []string) int {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// Instantiate the modules found in the config
+	modules, err := app.NewModules(config)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
 	myApp := app.New(*config)
 
 	// Add modules
-	myApp.AddModule(&rest.RestModule{})
+	for _, module := range modules {
+		myApp.AddModule(module)
+	}
 
 	if err := myApp.Start(); err != nil {
 		log.Fatalf("Failed to start app: %v", err)
 	}
 
+	// Apply changes of the config file without restarting
+	if err := myApp.WatchConfig(*configPath); err != nil {
+		log.Printf("Failed to watch config file: %v", err)
+	}
+
+	// Stop on SIGINT or SIGTERM too, so plugins are not left running
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
 	// Wait for app to stop
-	<-myApp.StopApp
+	select {
+	case <-myApp.StopApp:
+	case sig := <-sigChan:
+		log.Printf("Received %s, stopping", sig)
+	}
 
 	if err := myApp.Stop(); err != nil {
 		log.Printf("Failed to stop app: %v", err)
@@ -47,3 +98,400 @@ func Run(args []string) int {
 
 	return 0
 }
+
+// runConfig implements the "config" subcommands.
+func runConfig(args []string) int {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "dump") {
+		fmt.Fprintln(os.Stderr, "Usage: surserver config validate|dump [-c config.yaml]")
+		return 2
+	}
+
+	flagSet := flag.NewFlagSet("surserver config "+args[0], flag.ExitOnError)
+	configPath := flagSet.String("c", "config.yaml", "Path to configuration file")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	config, err := app.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	if args[0] == "dump" {
+		out, err := config.Dump()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+			return 1
+		}
+		fmt.Println("# Effective configuration, merged from:")
+		for _, file := range config.Files() {
+			fmt.Printf("#   %s\n", file)
+		}
+		os.Stdout.Write(out)
+		return 0
+	}
+
+	modules, err := app.NewModules(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	byName := make(map[string]app.Module)
+	for _, module := range modules {
+		byName[module.Name()] = module
+	}
+
+	if err := config.Validate(byName); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: configuration is valid\n", *configPath)
+	return 0
+}
+
+const rulesUsage = `Usage: surserver rules check [-c config.yaml] [file...]
+       surserver rules simulate [-c config.yaml] -events file.jsonl|-stream name [options] [file...]
+
+check: check rules files for syntax and type errors, without connecting to anything.
+
+simulate: replay recorded events through the rules, reporting the rules they
+match and what their actions would publish, request and call, without running
+them. Events files hold one JSON event per line:
+
+  {"subject": "sensors.kitchen.temp", "payload": {"value": 27}}
+
+Without files, both use the rules and the rules files of the rules modules of the config.`
+
+// runRules implements the "rules" subcommands.
+func runRules(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "simulate") {
+		fmt.Fprintln(os.Stderr, rulesUsage)
+		return 2
+	}
+	if args[0] == "simulate" {
+		return runSimulate(args[1:])
+	}
+
+	flagSet := flag.NewFlagSet("surserver rules check", flag.ExitOnError)
+	configPath := flagSet.String("c", "config.yaml", "Path to configuration file")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if files := flagSet.Args(); len(files) > 0 {
+		checked, err := rules.LoadFiles(files)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%d rules checked\n", len(checked))
+		return 0
+	}
+
+	config, modules, err := loadRulesModules(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+
+	status := 0
+	for _, name := range modules {
+		if err := rules.Check(name, config.Modules[name].Config); err != nil {
+			fmt.Fprintf(os.Stderr, "modules.%s: %v\n", name, err)
+			status = 1
+		} else {
+			fmt.Printf("modules.%s: rules are valid\n", name)
+		}
+	}
+	return status
+}
+
+// loadRulesModules loads a config and returns the names of its rules modules.
+func loadRulesModules(configPath string) (*app.Config, []string, error) {
+	config, err := app.LoadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	modules, err := app.NewModules(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for _, module := range modules {
+		if _, ok := module.(*rules.RulesModule); ok {
+			names = append(names, module.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no rules module")
+	}
+	return config, names, nil
+}
+
+// runSimulate implements "rules simulate".
+func runSimulate(args []string) int {
+	flagSet := flag.NewFlagSet("surserver rules simulate", flag.ExitOnError)
+	configPath := flagSet.String("c", "config.yaml", "Path to configuration file")
+	eventsPath := flagSet.String("events", "", "Events file to replay, - for stdin")
+	stream := flagSet.String("stream", "", "JetStream stream whose messages are replayed")
+	server := flagSet.String("server", "", "NATS server of the stream (default: nats.url of the config)")
+	filter := flagSet.String("filter", "", "Only replay the messages of the stream on these subjects")
+	since := flagSet.String("since", "", "Only replay the messages of the stream since then, a duration such as 24h or a RFC 3339 time")
+	limit := flagSet.Int("limit", 0, "Maximum number of messages of the stream to replay")
+	ruleNames := flagSet.String("rules", "", "Comma separated names of the rules to simulate (default: all)")
+	disabled := flagSet.Bool("disabled", false, "Simulate disabled rules too")
+	asJSON := flagSet.Bool("json", false, "Print the report as JSON")
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+	if (*eventsPath == "") == (*stream == "") {
+		fmt.Fprintln(os.Stderr, "Exactly one of -events or -stream is required")
+		return 2
+	}
+
+	opts := rules.SimulateOptions{Disabled: *disabled}
+	if *ruleNames != "" {
+		opts.Rules = strings.Split(*ruleNames, ",")
+	}
+	streamOpts := rules.StreamOptions{Stream: *stream, Filter: *filter, Limit: *limit}
+	if *since != "" {
+		start, err := rules.ParseSince(*since, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		streamOpts.Since = start
+	}
+
+	// The config is needed for its rules and the URL of NATS
+	files := flagSet.Args()
+	var config *app.Config
+	var modules []string
+	var err error
+	switch {
+	case len(files) == 0:
+		config, modules, err = loadRulesModules(*configPath)
+	case *stream != "" && *server == "":
+		config, err = app.LoadConfig(*configPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+		return 1
+	}
+	if *server == "" && config != nil {
+		*server = config.NATS.URL
+	}
+
+	var js nats.JetStreamContext
+	if *stream != "" {
+		nc, err := nats.Connect(*server, nats.Name("surserver-rules-simulate"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to NATS at %s: %v\n", *server, err)
+			return 1
+		}
+		defer nc.Close()
+		if js, err = nc.JetStream(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	// Each simulation reads the events from the start
+	simulate := func(run func(rules.EventReader) (*rules.SimulationReport, error)) (*rules.SimulationReport, error) {
+		if js != nil {
+			reader, err := rules.NewStreamReader(js, streamOpts)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return run(reader)
+		}
+		if *eventsPath == "-" {
+			return run(rules.NewFileReader(os.Stdin))
+		}
+		file, err := os.Open(*eventsPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return run(rules.NewFileReader(file))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if len(files) > 0 {
+		report, err := simulate(func(events rules.EventReader) (*rules.SimulationReport, error) {
+			return rules.SimulateFiles(ctx, files, opts, events)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return printReport("", report, *asJSON)
+	}
+
+	status := 0
+	for _, name := range modules {
+		report, err := simulate(func(events rules.EventReader) (*rules.SimulationReport, error) {
+			return rules.SimulateConfig(ctx, name, config.Modules[name].Config, opts, events)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "modules.%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		if printReport("modules."+name+": ", report, *asJSON) != 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// printReport prints a simulation report, each line starting with prefix.
+func printReport(prefix string, report *rules.SimulationReport, asJSON bool) int {
+	if asJSON {
+		out, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(string(out))
+		return 0
+	}
+
+	for _, run := range report.Runs {
+		at := ""
+		if run.Time != nil {
+			at = run.Time.Format(time.RFC3339) + " "
+		}
+		fmt.Printf("%s%s%s fired rule %s\n", prefix, at, run.Subject, run.Rule)
+		for _, action := range run.Actions {
+			switch action.Type {
+			case "delay":
+				fmt.Printf("    delay %s\n", action.Delay)
+			case "http":
+				fmt.Printf("    http %s %s %s\n", action.Method, action.URL, compact(action.Payload))
+			case "timer":
+				fmt.Printf("    timer %s after %s: %s %s\n", action.Key, action.Delay, action.Subject, compact(action.Payload))
+			case "cancel_timer":
+				fmt.Printf("    cancel timer %s\n", action.Key)
+			default:
+				fmt.Printf("    %s %s %s\n", action.Type, action.Subject, compact(action.Payload))
+			}
+		}
+		if run.Error != "" {
+			fmt.Printf("    error: %s\n", run.Error)
+		}
+	}
+
+	fmt.Printf("%sreplayed %d events, %d runs\n", prefix, report.Events, len(report.Runs))
+	for _, rule := range report.Rules {
+		enabled := ""
+		if !rule.Enabled {
+			enabled = " (disabled)"
+		}
+		fmt.Printf("%s  %s%s: %d matched, %d failed\n", prefix, rule.Name, enabled, rule.Matched, rule.Failed)
+	}
+	fmt.Printf("%sstate: %s\n", prefix, compact(report.State))
+	return 0
+}
+
+// compact returns v as compact JSON, or nothing when it is null.
+func compact(v any) string {
+	if v == nil {
+		return ""
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(out)
+}
+
+const secretsUsage = `Usage: surserver secrets <command> [arguments]
+
+Manage the encrypted secrets store, referenced in config files as ${secret:<name>}.
+The store and its key are located with SURROUNDHOME_SECRETS_FILE (default: secrets.enc)
+and SURROUNDHOME_SECRETS_KEY_FILE (default: secrets.key).
+
+Commands:
+  init                 generate the key of the store
+  set <name> [value]   add or replace a secret, read from stdin if value is omitted
+  get <name>           print a secret
+  list                 list the names of the secrets
+  rm <name>            remove a secret`
+
+// runSecrets implements the "secrets" subcommands.
+func runSecrets(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, secretsUsage)
+		return 2
+	}
+
+	storePath, keyPath := secrets.DefaultStorePath(), secrets.DefaultKeyPath()
+
+	if args[0] == "init" {
+		if err := secrets.GenerateKey(keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to generate key: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Key written to %s, keep it out of version control\n", keyPath)
+		return 0
+	}
+
+	store, err := secrets.OpenStore(storePath, keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open secrets store: %v\n", err)
+		return 1
+	}
+
+	switch {
+	case args[0] == "set" && (len(args) == 2 || len(args) == 3):
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		} else {
+			// Reading from stdin keeps the value out of the shell history
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				fmt.Fprintf(os.Stderr, "Failed to read secret: %v\n", err)
+				return 1
+			}
+			value = strings.TrimRight(line, "\r\n")
+		}
+		store.Set(args[1], value)
+		if err := store.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save secrets store: %v\n", err)
+			return 1
+		}
+	case args[0] == "get" && len(args) == 2:
+		value, err := store.Get(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(value)
+	case args[0] == "list" && len(args) == 1:
+		for _, name := range store.Names() {
+			fmt.Println(name)
+		}
+	case args[0] == "rm" && len(args) == 2:
+		if err := store.Delete(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := store.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save secrets store: %v\n", err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, secretsUsage)
+		return 2
+	}
+
+	return 0
+}
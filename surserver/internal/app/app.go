@@ -2,21 +2,56 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	natsserver "github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 )
 
+// DefaultRequestTimeout is the timeout used by Publisher.Request.
+const DefaultRequestTimeout = 15 * time.Second
+
 type HTTPHandler struct {
 	Method  string
 	Path    string
 	Handler http.HandlerFunc
+	// Auth requires the caller to authenticate. The handler can then get the
+	// caller with PrincipalFromContext.
+	Auth bool
+	// Maximum size in bytes of the bodies read to verify signed requests,
+	// 1 MB when zero
+	MaxBodySize int64
+	// Before runs before the caller is authenticated, e.g. to throttle it
+	// before its body is read. It rejects the request by writing the response
+	// and returning false.
+	Before func(w http.ResponseWriter, r *http.Request) bool
+	// Summary, Request and Response document the handler in the OpenAPI document.
+	// Request and Response are the JSON schemas of the bodies, nil when there is none.
+	Summary  string
+	Request  Schema
+	Response Schema
+	// Status of the successful responses, http.StatusOK when zero
+	Status int
+}
+
+// WriteJSON writes v as the JSON body of the response, with status.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
 }
 
 type MsgHandler struct {
@@ -25,7 +60,9 @@ type MsgHandler struct {
 }
 
 type Publisher struct {
-	nc *nats.Conn
+	nc       *nats.Conn
+	timers   *Timers
+	subjects *subjectResolvers
 }
 
 func (p *Publisher) Publish(subject string, data []byte) error {
@@ -37,11 +74,69 @@ func (p *Publisher) Publish(subject string, data []byte) error {
 }
 
 func (p *Publisher) Request(subject string, data []byte) (*nats.Msg, error) {
+	return p.RequestWithTimeout(subject, data, DefaultRequestTimeout)
+}
+
+// RequestWithTimeout sends a request and waits at most timeout for the response.
+func (p *Publisher) RequestWithTimeout(subject string, data []byte, timeout time.Duration) (*nats.Msg, error) {
 	msg := &nats.Msg{
 		Subject: subject,
 		Data:    data,
 	}
-	return p.nc.RequestMsg(msg, time.Duration(15)*time.Second)
+	return p.nc.RequestMsg(msg, timeout)
+}
+
+// JetStream returns a JetStream context of the connection. Modules using it
+// should depend on CapabilityJetStream.
+func (p *Publisher) JetStream(opts ...nats.JSOpt) (nats.JetStreamContext, error) {
+	return p.nc.JetStream(opts...)
+}
+
+// KeyValue returns the JetStream key-value bucket config.Bucket, creating it
+// with config if it doesn't exist.
+func (p *Publisher) KeyValue(config nats.KeyValueConfig) (nats.KeyValue, error) {
+	js, err := p.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(config.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		return js.CreateKeyValue(&config)
+	}
+	return kv, err
+}
+
+// Timers returns the timers of the app, to publish messages after delays.
+func (p *Publisher) Timers() *Timers {
+	return p.timers
+}
+
+// RequestMany sends a request and returns every response received within
+// timeout, for requests answered by several services such as $SRV.INFO.
+func (p *Publisher) RequestMany(subject string, data []byte, timeout time.Duration) ([]*nats.Msg, error) {
+	inbox := nats.NewInbox()
+	sub, err := p.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := p.nc.PublishRequest(subject, inbox, data); err != nil {
+		return nil, err
+	}
+
+	var responses []*nats.Msg
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if errors.Is(err, nats.ErrTimeout) {
+			return responses, nil
+		}
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, msg)
+	}
 }
 
 type Module interface {
@@ -51,27 +146,80 @@ type Module interface {
 	MsgHandlers(pub Publisher) []MsgHandler
 }
 
+// Stopper is implemented by modules working in the background, e.g. on
+// timers. Stop is called when the module is disabled, removed or replaced by
+// a new instance as its config changed, and when the app stops, while NATS is
+// still connected. The module may be initialized again afterwards.
+type Stopper interface {
+	Stop()
+}
+
+// StateKeeper is implemented by modules keeping state across config changes.
+// When the config of a module changes, a new instance is initialized with it,
+// and takes over the state of the previous instance, once stopped, with
+// KeepState.
+type StateKeeper interface {
+	KeepState(previous Module)
+}
+
 type App struct {
 	config     Config
 	nc         *nats.Conn
 	ns         *natsserver.Server
 	httpServer *http.Server
-	httpRouter *http.ServeMux
+	// The router is rebuilt and swapped when the configuration is reloaded
+	httpRouter atomic.Pointer[http.ServeMux]
+	auth       *authenticator
+	routes     []route
 	modules    map[string]Module
-	logger     *slog.Logger
-	ready      bool
-	readyLock  sync.RWMutex
-	StopApp    chan bool
+	// Capabilities available to modules, known once connected to NATS
+	caps    map[Capability]bool
+	plugins *supervisor
+	// Modules that have been initialized, by name
+	active    map[string]*activeModule
+	logger    *slog.Logger
+	logLevel  *slog.LevelVar
+	ready     bool
+	readyLock sync.RWMutex
+	// Protects config, auth, routes and active against reloads
+	mu sync.RWMutex
+	// Serializes reloads, parts of which run without mu
+	reloadMu   sync.Mutex
+	configPath string
+	lastReload *ReloadReport
+	stopWatch  chan struct{}
+	// Watches the config files and the files of the modules, see FilesProvider
+	watcher      *fsnotify.Watcher
+	watchedFiles []string
+	timers       *Timers
+	subjects     subjectResolvers
+	StopApp      chan bool
+}
+
+// activeModule is a running module along with the config it was initialized with.
+type activeModule struct {
+	config ModuleConfig
+	// Digest of the files read with the config, see FilesProvider
+	files string
+	subs  []*nats.Subscription
 }
 
 func New(config Config) *App {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	logLevel := new(slog.LevelVar)
+	if err := logLevel.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		logLevel.Set(slog.LevelInfo)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	// Modules log through the default logger, so they follow the configured level
+	slog.SetDefault(logger)
+
 	return &App{
-		config:     config,
-		httpRouter: http.NewServeMux(),
-		logger:     logger,
-		modules:    make(map[string]Module),
-		StopApp:    make(chan bool),
+		config:   config,
+		logger:   logger,
+		logLevel: logLevel,
+		modules:  make(map[string]Module),
+		active:   make(map[string]*activeModule),
+		StopApp:  make(chan bool),
 	}
 }
 
@@ -84,58 +232,71 @@ func (a *App) AddModule(module Module) {
 func (a *App) Start() error {
 	a.logger.Info("Starting app", "name", a.config.Name)
 
+	if err := a.config.Validate(a.modules); err != nil {
+		return err
+	}
+
 	// 1 - Start NATS and/or initiate NATS connection
 	a.logger.Info("Setting up NATS", "embedded", a.config.NATS.Embedded)
 	if err := a.startNats(); err != nil {
 		return err
 	}
 
-	// 2 - Bootstrap modules
-	pub := Publisher{nc: a.nc}
+	auth, err := newAuthenticator(a.config.Auth)
+	if err != nil {
+		return fmt.Errorf("error setting up authentication: %w", err)
+	}
+	a.auth = auth
 
-	for name, module := range a.modules {
-		// 2.a - Skip any module that has been explicitly disabled
-		// TODO: Validate use case to decide modules should be explicitly enabled or explicitly disabled
-		modConfig, exists := a.config.Modules[name]
-		if exists && !modConfig.Enabled {
+	// 2 - Bootstrap modules
+	// 2.a - Skip disabled modules, and check the enabled ones have what they require
+	for _, name := range mapKeys(a.modules) {
+		if !a.config.ModuleEnabled(name) {
 			a.logger.Warn("Skipping disabled module", "module", name)
-			continue
 		}
-
-		a.logger.Info("Initializing module...", "module", name)
-
-		// 2.a - Initialize module
-		if err := module.Init(modConfig.Config); err != nil {
-			a.logger.Error("Failed to initialize module", "module", name, "error", err)
+	}
+	order, err := startOrder(&a.config, a.modules)
+	if err != nil {
+		return err
+	}
+	a.caps = a.capabilities()
+	for _, name := range order {
+		if err := a.checkCapabilities(name, a.modules[name]); err != nil {
 			return err
 		}
+	}
+	a.timers = a.newTimers()
 
-		// 2.b - Register NATS subscribers for module
-		for _, handler := range module.MsgHandlers(pub) {
-			a.logger.Info("Subscribing to NATS subject", "subject", handler.Subject, "module", name)
-			a.nc.Subscribe(handler.Subject, handler.Handler)
-		}
-
-		// 2.c - Register HTTP handlers for module
-		for _, handler := range module.HTTPHandlers(pub) {
-			// Prefix the module name to the handler path
-			namespacedPath := "/" + name + handler.Path
-			a.logger.Info("Registering HTTP handler", "path", namespacedPath, "module", name)
-			a.httpRouter.HandleFunc(namespacedPath, handler.Handler)
+	// 2.b - Initialize modules, after the modules they depend on, and register their NATS subscribers
+	for _, name := range order {
+		if err := a.startModule(name, a.modules[name], a.config.Modules[name]); err != nil {
+			return err
 		}
 	}
+	// 2.c - Restore the pending timers, once the modules handle their messages
+	if err := a.timers.restore(); err != nil {
+		a.logger.Error("Failed to restore the pending timers", "error", err)
+	}
 
-	// 3 - Register health and readiness endpoints
-	a.logger.Info("Registering health and readiness endpoints")
-	a.httpRouter.HandleFunc("/healthz", a.healthzHandler)
-	a.httpRouter.HandleFunc("/readiness", a.readinessHandler)
-
-	// 4 - Start HTTP server
+	// 3 - Register the HTTP handlers of the modules, and the health, readiness and documentation endpoints
+	a.buildRouter()
+
+	// 4 - Start HTTP server. The plugins are only started once it listens, as
+	// nothing would stop them if it failed
+	a.plugins = newSupervisor(a.config.NATS.URL, a.logger)
+	if !a.config.HTTP.Enabled {
+		a.logger.Warn("HTTP server is disabled")
+		a.plugins.apply(a.config.Plugins, nil)
+		a.markReady()
+		return nil
+	}
 	serverErr := make(chan error, 1)
 	go func() {
 		a.httpServer = &http.Server{
-			Addr:    fmt.Sprintf(":%d", a.config.HTTP.Port),
-			Handler: a.httpRouter,
+			Addr: fmt.Sprintf(":%d", a.config.HTTP.Port),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				a.httpRouter.Load().ServeHTTP(w, r)
+			}),
 		}
 		a.logger.Info("Starting HTTP server...", "port", a.config.HTTP.Port)
 		if err := a.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -155,24 +316,51 @@ func (a *App) Start() error {
 		// If no error after 200ms, server likely started successfully
 	}
 
-	// Mark the app as ready
+	// 5 - Start the plugin executables
+	a.plugins.apply(a.config.Plugins, nil)
+
+	a.markReady()
+
+	return nil
+
+}
+
+// markReady marks the app as ready
+func (a *App) markReady() {
 	a.readyLock.Lock()
 	a.ready = true
 	a.readyLock.Unlock()
 
 	a.logger.Info("App is ready")
-
-	return nil
-
 }
 
 // Stop gracefully shuts down the application.
 func (a *App) Stop() error {
 	a.logger.Info("Stopping app...")
 
+	// Stop watching the config file
+	if a.stopWatch != nil {
+		close(a.stopWatch)
+	}
+
 	// Stop HTTP server
 	a.stopHttpServer()
 
+	// Stop plugins, while they can still drain their NATS connection
+	if a.plugins != nil {
+		a.plugins.stop()
+	}
+
+	// Stop the modules working in the background
+	a.mu.Lock()
+	for _, name := range mapKeys(a.active) {
+		a.stopModule(name)
+	}
+	a.mu.Unlock()
+	if a.timers != nil {
+		a.timers.stop()
+	}
+
 	// Stop NATS
 	a.stopNats()
 
@@ -248,22 +436,219 @@ func (a *App) stopHttpServer() {
 	}
 }
 
+func (a *App) publisher() Publisher {
+	return Publisher{nc: a.nc, timers: a.timers, subjects: &a.subjects}
+}
+
+// newTimers returns the timers of the app, kept in a JetStream bucket when
+// available.
+func (a *App) newTimers() *Timers {
+	if !a.caps[CapabilityJetStream] {
+		a.logger.Warn("JetStream is not available, pending timers are lost when stopping")
+		return newTimers(a.nc, nil, a.logger)
+	}
+	pub := a.publisher()
+	kv, err := pub.KeyValue(nats.KeyValueConfig{Bucket: TimersBucket, Description: "Pending timers"})
+	if err != nil {
+		a.logger.Error("Failed to open the bucket of the timers, pending timers are lost when stopping", "bucket", TimersBucket, "error", err)
+		kv = nil
+	}
+	return newTimers(a.nc, kv, a.logger)
+}
+
+// startModule initializes a module and subscribes its NATS handlers. The
+// module is stopped when they can't all be subscribed.
+func (a *App) startModule(name string, module Module, modConfig ModuleConfig) error {
+	files := filesDigest(module, modConfig.Config)
+	if err := a.initModule(name, module, modConfig); err != nil {
+		return err
+	}
+	return a.activateModule(name, module, modConfig, files)
+}
+
+// restartModule replaces a running module by a new instance initialized with
+// modConfig. The running module is only stopped once the new instance is
+// initialized, and keeps running otherwise.
+func (a *App) restartModule(name string, modConfig ModuleConfig) error {
+	module := newModule(name, modConfig)
+	files := filesDigest(module, modConfig.Config)
+	if err := a.initModule(name, module, modConfig); err != nil {
+		return err
+	}
+
+	previous := a.modules[name]
+	a.stopModule(name)
+	if keeper, ok := module.(StateKeeper); ok {
+		keeper.KeepState(previous)
+	}
+	a.modules[name] = module
+	return a.activateModule(name, module, modConfig, files)
+}
+
+func (a *App) initModule(name string, module Module, modConfig ModuleConfig) error {
+	a.logger.Info("Initializing module...", "module", name)
+	if err := module.Init(modConfig.Config); err != nil {
+		a.logger.Error("Failed to initialize module", "module", name, "error", err)
+		return err
+	}
+	return nil
+}
+
+// activateModule registers an initialized module and subscribes its NATS
+// handlers.
+func (a *App) activateModule(name string, module Module, modConfig ModuleConfig, files string) error {
+	if resolver, ok := module.(SubjectResolver); ok {
+		if a.subjects.add(resolver) {
+			a.logger.Warn("Subject scheme resolved by several modules, using the last one", "scheme", resolver.SubjectScheme(), "module", name)
+		}
+	}
+
+	// Drop the subscriptions of a previous initialization
+	if current, ok := a.active[name]; ok {
+		unsubscribe(current.subs)
+	}
+
+	active := &activeModule{config: modConfig, files: files}
+	a.active[name] = active
+	for _, handler := range module.MsgHandlers(a.publisher()) {
+		a.logger.Info("Subscribing to NATS subject", "subject", handler.Subject, "module", name)
+		sub, err := a.nc.Subscribe(handler.Subject, handler.Handler)
+		if err != nil {
+			// Half subscribed, the module is stopped rather than reported active
+			a.stopModule(name)
+			return fmt.Errorf("error subscribing module %s to %s: %w", name, handler.Subject, err)
+		}
+		active.subs = append(active.subs, sub)
+	}
+
+	return nil
+}
+
+// stopModule unsubscribes the NATS handlers of a module and stops it if it
+// is a Stopper. Its HTTP handlers are gone once the router is rebuilt.
+func (a *App) stopModule(name string) {
+	if current, ok := a.active[name]; ok {
+		a.logger.Info("Stopping module...", "module", name)
+		unsubscribe(current.subs)
+		if resolver, ok := a.modules[name].(SubjectResolver); ok {
+			a.subjects.remove(resolver)
+		}
+		if stopper, ok := a.modules[name].(Stopper); ok {
+			stopper.Stop()
+		}
+		delete(a.active, name)
+	}
+}
+
+func unsubscribe(subs []*nats.Subscription) {
+	for _, sub := range subs {
+		_ = sub.Unsubscribe()
+	}
+}
+
+// buildRouter registers the HTTP handlers of the active modules and the
+// builtin endpoints on a new router, and swaps it with the current one.
+func (a *App) buildRouter() {
+	router := http.NewServeMux()
+	a.routes = nil
+
+	names := make([]string, 0, len(a.active))
+	for name := range a.active {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		for _, handler := range a.modules[name].HTTPHandlers(a.publisher()) {
+			// Prefix the module name to the handler path
+			handler.Path = "/" + name + handler.Path
+			a.handle(router, name, handler)
+		}
+	}
+
+	for _, handler := range a.builtinHandlers() {
+		a.handle(router, "", handler)
+	}
+
+	a.httpRouter.Store(router)
+}
+
+// handle registers an HTTP handler on router and records it for the OpenAPI document.
+func (a *App) handle(router *http.ServeMux, module string, handler HTTPHandler) {
+	a.logger.Info("Registering HTTP handler", "method", handler.Method, "path", handler.Path, "auth", handler.Auth, "module", module)
+	pattern := handler.Path
+	if handler.Method != "" {
+		pattern = handler.Method + " " + handler.Path
+	}
+	h := handler.Handler
+	if handler.Auth {
+		h = a.auth.middleware(h, handler.MaxBodySize)
+	}
+	if before := handler.Before; before != nil {
+		next := h
+		h = func(w http.ResponseWriter, r *http.Request) {
+			if before(w, r) {
+				next(w, r)
+			}
+		}
+	}
+	router.HandleFunc(pattern, h)
+	a.routes = append(a.routes, route{module: module, HTTPHandler: handler})
+}
+
+func (a *App) builtinHandlers() []HTTPHandler {
+	text := Schema{"type": "string"}
+	return []HTTPHandler{
+		{Method: "GET", Path: "/healthz", Handler: a.healthzHandler, Summary: "Health check", Response: text},
+		{Method: "GET", Path: "/readiness", Handler: a.readinessHandler, Summary: "Readiness probe", Response: text},
+		{Method: "GET", Path: "/openapi.json", Handler: a.openAPIHandler, Summary: "OpenAPI document", Response: Schema{"type": "object"}},
+		{Method: "GET", Path: "/docs", Handler: docsHandler, Summary: "API documentation page", Response: text},
+		{Method: "GET", Path: "/admin/reload", Handler: a.reloadStatusHandler, Auth: true, Summary: "Report of the last configuration reload", Response: reloadReportSchema},
+		{Method: "POST", Path: "/admin/reload", Handler: a.reloadHandler, Auth: true, Summary: "Reload the configuration file", Response: reloadReportSchema},
+		{Method: "GET", Path: "/timers", Handler: a.timersHandler, Auth: true, Summary: "List the pending timers, the next due first", Response: Schema{"type": "array", "items": timerSchema}},
+		{Method: "GET", Path: "/timers/{key}", Handler: a.timerHandler, Auth: true, Summary: "Get a pending timer", Response: timerSchema},
+		{Method: "DELETE", Path: "/timers/{key}", Handler: a.cancelTimerHandler, Auth: true, Summary: "Cancel a pending timer", Status: http.StatusNoContent},
+	}
+}
+
 // healthzHandler handles health checks
 func (a *App) healthzHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("OK"))
 }
 
-// readinessHandler handles readiness probes
+// readinessHandler handles readiness probes. The app is not ready while a
+// plugin is not running, the status of each plugin follows on its own line.
 func (a *App) readinessHandler(w http.ResponseWriter, r *http.Request) {
 	a.readyLock.RLock()
-	defer a.readyLock.RUnlock()
+	ready := a.ready
+	a.readyLock.RUnlock()
+
+	var statuses []PluginStatus
+	if a.plugins != nil {
+		statuses = a.plugins.statuses()
+	}
+
+	var body strings.Builder
+	for _, status := range statuses {
+		// Other plugins in backoff only degrade what they provide
+		if status.Required && status.State != PluginRunning {
+			ready = false
+		}
+		fmt.Fprintf(&body, "\nplugin %s: %s since %s, %d restarts", status.Name, status.State, status.Since.Format(time.RFC3339), status.Restarts)
+		if status.Required {
+			body.WriteString(", required")
+		}
+		if status.LastError != "" {
+			fmt.Fprintf(&body, ", last error: %s", status.LastError)
+		}
+	}
 
-	if a.ready {
+	if ready {
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("READY"))
+		_, _ = w.Write([]byte("READY" + body.String()))
 	} else {
 		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("NOT READY"))
+		_, _ = w.Write([]byte("NOT READY" + body.String()))
 	}
 }
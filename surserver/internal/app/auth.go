@@ -0,0 +1,315 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used by the authentication schemes
+const (
+	APIKeyHeader          = "X-API-Key"
+	SignatureKeyIDHeader  = "X-Signature-Key-Id"
+	SignatureTimeHeader   = "X-Signature-Timestamp"
+	SignatureHeader       = "X-Signature"
+	maxSignedRequestBytes = 1 << 20 // 1MB
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrBodyTooLarge    = errors.New("request body too large")
+)
+
+// Principal is the authenticated caller of an HTTP handler.
+type Principal struct {
+	// Name of the API key, HMAC key id or JWT subject
+	Name string
+	// Method is the scheme used to authenticate: "api_key", "hmac" or "jwt"
+	Method string
+	// Subjects the principal may access, with NATS wildcards
+	Topics []string
+}
+
+// Allows reports whether the principal may access subject.
+func (p *Principal) Allows(subject string) bool {
+	for _, pattern := range p.Topics {
+		if SubjectMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal authenticated by the app, if the
+// handler requires authentication.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+type authenticator struct {
+	config    AuthConfig
+	apiKeys   []apiKey
+	jwtPubKey *rsa.PublicKey
+}
+
+type apiKey struct {
+	hash []byte
+	APIKeyConfig
+}
+
+func newAuthenticator(config AuthConfig) (*authenticator, error) {
+	a := &authenticator{config: config}
+
+	for _, key := range config.APIKeys {
+		hexHash, ok := strings.CutPrefix(key.Hash, "sha256:")
+		if !ok {
+			return nil, fmt.Errorf("api key %q: hash must be of the form sha256:<hex>", key.Name)
+		}
+		hash, err := hex.DecodeString(hexHash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %q: invalid sha256 hash", key.Name)
+		}
+		a.apiKeys = append(a.apiKeys, apiKey{hash: hash, APIKeyConfig: key})
+	}
+
+	if config.JWT.PublicKeyFile != "" {
+		pubKey, err := loadRSAPublicKey(config.JWT.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading JWT public key: %w", err)
+		}
+		a.jwtPubKey = pubKey
+	}
+
+	return a, nil
+}
+
+// middleware rejects requests without valid credentials and stores the
+// principal in the request context. Signed requests are rejected when their
+// body is larger than maxBodySize, maxSignedRequestBytes when zero.
+func (a *authenticator) middleware(next http.HandlerFunc, maxBodySize int64) http.HandlerFunc {
+	if maxBodySize <= 0 {
+		maxBodySize = maxSignedRequestBytes
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r, maxBodySize)
+		if errors.Is(err, ErrBodyTooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="surserver"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}
+}
+
+func (a *authenticator) authenticate(r *http.Request, maxBodySize int64) (*Principal, error) {
+	switch {
+	case r.Header.Get(APIKeyHeader) != "":
+		return a.authenticateAPIKey(r.Header.Get(APIKeyHeader))
+	case r.Header.Get(SignatureHeader) != "":
+		return a.authenticateHMAC(r, maxBodySize)
+	case strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "):
+		return a.authenticateJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}
+	return nil, ErrUnauthenticated
+}
+
+func (a *authenticator) authenticateAPIKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	for _, k := range a.apiKeys {
+		if subtle.ConstantTimeCompare(sum[:], k.hash) == 1 {
+			return &Principal{Name: k.Name, Method: "api_key", Topics: k.Topics}, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// authenticateHMAC verifies a signed request. The signature is the hex encoded
+// HMAC-SHA256 of "<method>\n<path>\n<timestamp>\n<body>" using the key secret.
+// Bodies larger than maxBodySize are not read.
+func (a *authenticator) authenticateHMAC(r *http.Request, maxBodySize int64) (*Principal, error) {
+	keyID := r.Header.Get(SignatureKeyIDHeader)
+	var key *HMACKeyConfig
+	for i := range a.config.HMAC.Keys {
+		if a.config.HMAC.Keys[i].ID == keyID {
+			key = &a.config.HMAC.Keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrUnauthenticated
+	}
+
+	timestamp := r.Header.Get(SignatureTimeHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if skew := time.Since(time.Unix(unix, 0)).Abs(); skew > a.config.HMAC.MaxSkew {
+		return nil, ErrUnauthenticated
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256="))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	// The body is part of the signature: read it and hand a copy to the handler
+	if r.ContentLength > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.Path, timestamp)
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrUnauthenticated
+	}
+
+	return &Principal{Name: key.ID, Method: "hmac", Topics: key.Topics}, nil
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Topics    []string `json:"topics"`
+}
+
+// audience accepts both the string and the array forms of the "aud" claim.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*aud = multiple
+	return nil
+}
+
+func (a *authenticator) authenticateJWT(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm is fixed by the configuration, never chosen by the token
+	switch {
+	case header.Alg == "HS256" && a.config.JWT.Secret != "":
+		mac := hmac.New(sha256.New, []byte(a.config.JWT.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, ErrInvalidToken
+		}
+	case header.Alg == "RS256" && a.jwtPubKey != nil:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(a.jwtPubKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, ErrInvalidToken
+		}
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || now >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, ErrInvalidToken
+	}
+	if a.config.JWT.Issuer != "" && claims.Issuer != a.config.JWT.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if a.config.JWT.Audience != "" && !slices.Contains(claims.Audience, a.config.JWT.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{Name: claims.Subject, Method: "jwt", Topics: claims.Topics}, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaKey, nil
+}
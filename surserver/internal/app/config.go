@@ -1,10 +1,18 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/lstep/surroundhome/pkg/secrets"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
 // Config defines the application configuration.configuration.
@@ -13,9 +21,25 @@ type Config struct {
 	Name    string                  `mapstructure:"name"`
 	NATS    NATSConfig              `mapstructure:"nats"`
 	HTTP    HTTPConfig              `mapstructure:"http"`
+	Auth    AuthConfig              `mapstructure:"auth"`
+	Log     LogConfig               `mapstructure:"log"`
 	Modules map[string]ModuleConfig `mapstructure:"modules"`
+	// Whether modules missing from Modules, or without an enabled key, are enabled
+	// or disabled. Default: enabled
+	ModulesDefault string `mapstructure:"modules_default"`
+	// Plugin executables run, and restarted, by surserver, by name
+	Plugins map[string]PluginConfig `mapstructure:"plugins"`
+
+	// Settings as read from the files, to detect unknown keys
+	raw map[string]any
+	// Files the configuration was read from, in merge order
+	files []string
 }
 
+// ConfDir is the directory, next to the config file, whose *.yaml files are
+// merged into the configuration. Each of them defines one or more modules.
+const ConfDir = "conf.d"
+
 // NATSConfig holds NATS-specific configuration
 type NATSConfig struct {
 	// URL of the NATS server. Optional. Ignored if Embedded is true
@@ -31,16 +55,91 @@ type NATSConfig struct {
 
 // HTTPConfig holds HTTP-specific configuration
 type HTTPConfig struct {
-	Port int `mapstructure:"port"`
+	// Should the HTTP server be started? Modules requiring it can't be enabled otherwise. Default: true
+	Enabled bool `mapstructure:"enabled"`
+	Port    int  `mapstructure:"port"`
+}
+
+// LogConfig holds logging configuration
+type LogConfig struct {
+	// Minimum level of the logs: debug, info, warn or error. Default: info
+	Level string `mapstructure:"level"`
+}
+
+// AuthConfig holds the credentials accepted by HTTP handlers that require authentication.
+type AuthConfig struct {
+	APIKeys []APIKeyConfig `mapstructure:"api_keys"`
+	HMAC    HMACConfig     `mapstructure:"hmac"`
+	JWT     JWTConfig      `mapstructure:"jwt"`
+}
+
+// APIKeyConfig defines a static API key, sent in the X-API-Key header.
+type APIKeyConfig struct {
+	Name string `mapstructure:"name"`
+	// SHA-256 of the key, as "sha256:<hex>". Generate it with: echo -n "<key>" | sha256sum
+	Hash string `mapstructure:"hash"`
+	// Subjects the key may access. NATS wildcards are allowed. Empty means none.
+	Topics []string `mapstructure:"topics"`
+}
+
+// HMACConfig defines the keys used to sign requests.
+type HMACConfig struct {
+	// Maximum difference between the request timestamp and the server clock. Default: 5m
+	MaxSkew time.Duration   `mapstructure:"max_skew"`
+	Keys    []HMACKeyConfig `mapstructure:"keys"`
+}
+
+// HMACKeyConfig defines a shared secret used to sign requests.
+type HMACKeyConfig struct {
+	ID     string   `mapstructure:"id"`
+	Secret string   `mapstructure:"secret"`
+	Topics []string `mapstructure:"topics"`
+}
+
+// JWTConfig defines how bearer tokens are verified. Set either Secret (HS256) or
+// PublicKeyFile (RS256). The allowed topics are read from the "topics" claim.
+type JWTConfig struct {
+	Secret        string `mapstructure:"secret"`
+	PublicKeyFile string `mapstructure:"public_key_file"`
+	// Expected "iss" claim. Optional.
+	Issuer string `mapstructure:"issuer"`
+	// Expected "aud" claim. Optional.
+	Audience string `mapstructure:"audience"`
+}
+
+// PluginConfig defines a plugin executable run by surserver. The plugin gets the
+// NATS URL, its name and its config, as JSON, from the SURROUNDHOME_NATS_URL,
+// SURROUNDHOME_PLUGIN_NAME and SURROUNDHOME_PLUGIN_CONFIG environment variables.
+type PluginConfig struct {
+	// Path of the executable
+	Command string   `mapstructure:"command"`
+	Args    []string `mapstructure:"args"`
+	// Working directory. Default: the one of surserver
+	Dir string `mapstructure:"dir"`
+	// Additional environment variables. Names are upper-cased.
+	Env    map[string]string `mapstructure:"env"`
+	Config map[string]any    `mapstructure:"config"`
+	// Delay before restarting the plugin when it exits, doubled on each
+	// consecutive restart up to MaxBackoff. Default: 1s and 1m
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+	// surserver is not ready while a required plugin isn't running
+	Required bool `mapstructure:"required"`
 }
 
 // ModuleConfig defines the configuration for each module
 type ModuleConfig struct {
-	Enabled bool           `mapstructure:"enabled"`
+	// Registered type of the module, see Register. Default: the name of the module
+	Type string `mapstructure:"type"`
+	// Unset means Config.ModulesDefault applies
+	Enabled *bool          `mapstructure:"enabled"`
 	Config  map[string]any `mapstructure:"config"`
 }
 
-// LoadConfig loads the configuration from file and environment variables
+// LoadConfig loads the configuration from file, the files of the ConfDir
+// directory next to it and environment variables, and resolves the secret
+// references it contains (see package secrets).
+// The result must be checked with Config.Validate.
 func LoadConfig(configPath string) (*Config, error) {
 	v := viper.New()
 
@@ -50,7 +149,11 @@ func LoadConfig(configPath string) (*Config, error) {
 	v.SetDefault("nats.private", false)
 	v.SetDefault("nats.logging", true)
 	v.SetDefault("nats.url", nats.DefaultURL)
+	v.SetDefault("http.enabled", true)
 	v.SetDefault("http.port", 8080)
+	v.SetDefault("modules_default", ModulesEnabled)
+	v.SetDefault("log.level", "info")
+	v.SetDefault("auth.hmac.max_skew", "5m")
 
 	// Configuration file settings
 	v.SetConfigFile(configPath)
@@ -68,12 +171,169 @@ func LoadConfig(configPath string) (*Config, error) {
 		// Config file not found; ignore error if desired
 	}
 
+	files, err := mergeConfDir(v, filepath.Join(filepath.Dir(configPath), ConfDir))
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace ${env:...}, ${file:...} and ${secret:...} references by their value
+	if err := secrets.ResolveViper(v); err != nil {
+		return nil, fmt.Errorf("error resolving secrets: %w", err)
+	}
+
 	var config Config
 	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("unable to decode config: %w", err)
 	}
 
-	fmt.Printf("Config: %+v\n", config)
+	config.raw = v.AllSettings()
+	config.files = append([]string{configPath}, files...)
+
+	if err := config.restoreKeyCase(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
+
+// restoreKeyCase gives back their case to the keys of the module and plugin
+// configs, lowercased by viper, as payloads and state keys are sent as they
+// are written.
+func (c *Config) restoreKeyCase() error {
+	for _, file := range c.files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading config file %s: %w", file, err)
+		}
+		var raw struct {
+			Modules map[string]struct {
+				Config map[string]any `yaml:"config"`
+			} `yaml:"modules"`
+			Plugins map[string]struct {
+				Config map[string]any `yaml:"config"`
+			} `yaml:"plugins"`
+		}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("error reading config file %s: %w", file, err)
+		}
+
+		for name, module := range raw.Modules {
+			name = strings.ToLower(name)
+			if current, ok := c.Modules[name]; ok && module.Config != nil {
+				current.Config, _ = withKeyCase(current.Config, module.Config).(map[string]any)
+				c.Modules[name] = current
+			}
+		}
+		for name, plugin := range raw.Plugins {
+			name = strings.ToLower(name)
+			if current, ok := c.Plugins[name]; ok && plugin.Config != nil {
+				current.Config, _ = withKeyCase(current.Config, plugin.Config).(map[string]any)
+				c.Plugins[name] = current
+			}
+		}
+	}
+	return nil
+}
+
+// withKeyCase returns value, a setting decoded by viper, with the keys of its
+// maps written as in raw, the same setting as read from the file.
+func withKeyCase(value, raw any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		rawMap, _ := raw.(map[string]any)
+		keys := make(map[string]string, len(rawMap))
+		for key := range rawMap {
+			keys[strings.ToLower(key)] = key
+		}
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			rawKey, ok := keys[key]
+			if !ok {
+				rawKey = key
+			}
+			out[rawKey] = withKeyCase(item, rawMap[rawKey])
+		}
+		return out
+	case []any:
+		rawItems, _ := raw.([]any)
+		out := make([]any, len(v))
+		for i, item := range v {
+			var rawItem any
+			if i < len(rawItems) {
+				rawItem = rawItems[i]
+			}
+			out[i] = withKeyCase(item, rawItem)
+		}
+		return out
+	}
+	return value
+}
+
+// mergeConfDir merges the *.yaml files of dir into v, in lexical order, and
+// returns their paths. They may only define modules, and a module defined in
+// two files is an error rather than silently overridden.
+func mergeConfDir(v *viper.Viper, dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+
+	sources := make(map[string]string)
+	if base, ok := v.Get("modules").(map[string]any); ok {
+		for name := range base {
+			sources[name] = v.ConfigFileUsed()
+		}
+	}
+
+	for _, file := range files {
+		fv := viper.New()
+		fv.SetConfigFile(file)
+		fv.SetConfigType("yaml")
+		if err := fv.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %w", file, err)
+		}
+
+		settings := fv.AllSettings()
+		for key := range settings {
+			if key != "modules" {
+				return nil, fmt.Errorf("%s: unexpected key %q, files of %s may only define modules", file, key, ConfDir)
+			}
+		}
+		modules, ok := settings["modules"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: modules must be a map of module names to their settings", file)
+		}
+		for _, name := range mapKeys(modules) {
+			if previous, ok := sources[name]; ok {
+				return nil, fmt.Errorf("module %s is defined in both %s and %s", name, previous, file)
+			}
+			sources[name] = file
+		}
+
+		if err := v.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("error merging config file %s: %w", file, err)
+		}
+	}
+
+	return files, nil
+}
+
+// Files returns the paths of the files the configuration was read from, in
+// merge order: the config file, then the files of ConfDir.
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// Dump returns the effective configuration as YAML, after merging the files
+// and environment variables, with the secret values redacted.
+func (c *Config) Dump() ([]byte, error) {
+	out, err := yaml.Marshal(c.raw)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(secrets.Redact(string(out))), nil
+}
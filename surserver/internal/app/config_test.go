@@ -0,0 +1,71 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigKeyCase(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "config.yaml"), `
+modules:
+  rules:
+    config:
+      state:
+        awayMode: false
+      rules:
+        - name: r
+          actions:
+            - publish:
+                subject: lights.on
+                payload: {roomName: kitchen, Level: {maxValue: 80}}
+plugins:
+  obs:
+    command: obs
+    config:
+      apiURL: http://localhost
+`)
+	write(filepath.Join(dir, ConfDir, "scheduler.yaml"), `
+modules:
+  Scheduler:
+    config:
+      jobs:
+        - name: j
+          payload: {jobName: j}
+`)
+
+	config, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	rules := config.Modules["rules"].Config
+	if got, want := rules["state"], map[string]any{"awayMode": false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got state %v, want %v", got, want)
+	}
+	action := rules["rules"].([]any)[0].(map[string]any)["actions"].([]any)[0].(map[string]any)
+	wantPayload := map[string]any{"roomName": "kitchen", "Level": map[string]any{"maxValue": 80}}
+	if got := action["publish"].(map[string]any)["payload"]; !reflect.DeepEqual(got, wantPayload) {
+		t.Errorf("got payload %v, want %v", got, wantPayload)
+	}
+
+	job := config.Modules["scheduler"].Config["jobs"].([]any)[0].(map[string]any)
+	if got, want := job["payload"], map[string]any{"jobName": "j"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got job payload %v, want %v", got, want)
+	}
+
+	if got, want := config.Plugins["obs"].Config, map[string]any{"apiURL": "http://localhost"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got plugin config %v, want %v", got, want)
+	}
+}
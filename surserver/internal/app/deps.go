@@ -0,0 +1,165 @@
+package app
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Values of Config.ModulesDefault
+const (
+	ModulesEnabled  = "enabled"
+	ModulesDisabled = "disabled"
+)
+
+// Capability is a feature of the app that modules can require.
+type Capability string
+
+const (
+	// CapabilityJetStream is available when the NATS server has JetStream enabled
+	CapabilityJetStream Capability = "jetstream"
+	// CapabilityHTTP is available unless the HTTP server is disabled
+	CapabilityHTTP Capability = "http"
+)
+
+// Dependencies lists what a module needs to be initialized.
+type Dependencies struct {
+	// Modules that must be enabled too. They are initialized first.
+	Modules      []string
+	Capabilities []Capability
+}
+
+// DependencyProvider is implemented by modules that depend on other modules or
+// on capabilities of the app. Modules are initialized in dependency order, and
+// the app refuses to start when a dependency is missing.
+type DependencyProvider interface {
+	Dependencies() Dependencies
+}
+
+func dependenciesOf(module Module) Dependencies {
+	if provider, ok := module.(DependencyProvider); ok {
+		return provider.Dependencies()
+	}
+	return Dependencies{}
+}
+
+// ModuleEnabled reports whether the module called name is enabled, either
+// explicitly in its config or by the modules_default policy.
+func (c *Config) ModuleEnabled(name string) bool {
+	if modConfig, ok := c.Modules[name]; ok && modConfig.Enabled != nil {
+		return *modConfig.Enabled
+	}
+	return c.ModulesDefault != ModulesDisabled
+}
+
+// checkDependencies reports the enabled modules whose dependencies can't be
+// met. JetStream is only known once connected, see App.checkCapabilities.
+func (c *Config) checkDependencies(errs *ValidationErrors, modules map[string]Module) {
+	for _, name := range mapKeys(modules) {
+		if !c.ModuleEnabled(name) {
+			continue
+		}
+		path := "modules." + name
+		deps := dependenciesOf(modules[name])
+
+		for _, dep := range deps.Modules {
+			switch {
+			case modules[dep] == nil:
+				errs.add(path, "requires module %s, which is not configured", dep)
+			case !c.ModuleEnabled(dep):
+				errs.add(path, "requires module %s, which is disabled: enable it with modules.%s.enabled: true, or disable %s", dep, dep, name)
+			}
+		}
+		if slices.Contains(deps.Capabilities, CapabilityHTTP) && !c.HTTP.Enabled {
+			errs.add(path, "requires the HTTP server, which is disabled by http.enabled: false")
+		}
+	}
+
+	if _, err := startOrder(c, modules); err != nil {
+		errs.add("modules", "%v", err)
+	}
+}
+
+// startOrder returns the enabled modules, each after the modules it depends
+// on, and by name otherwise.
+func startOrder(c *Config, modules map[string]Module) ([]string, error) {
+	pending := make(map[string][]string)
+	for name, module := range modules {
+		if !c.ModuleEnabled(name) {
+			continue
+		}
+		pending[name] = nil
+		for _, dep := range dependenciesOf(module).Modules {
+			if modules[dep] != nil && c.ModuleEnabled(dep) {
+				pending[name] = append(pending[name], dep)
+			}
+		}
+	}
+
+	order := make([]string, 0, len(pending))
+	for len(pending) > 0 {
+		next := ""
+		for _, name := range mapKeys(pending) {
+			if !slices.ContainsFunc(pending[name], func(dep string) bool { _, ok := pending[dep]; return ok }) {
+				next = name
+				break
+			}
+		}
+		if next == "" {
+			return nil, fmt.Errorf("dependency cycle between modules %s", strings.Join(mapKeys(pending), ", "))
+		}
+		order = append(order, next)
+		delete(pending, next)
+	}
+
+	return order, nil
+}
+
+// capabilities returns the capabilities available to modules. It must be
+// called once connected to NATS.
+func (a *App) capabilities() map[Capability]bool {
+	caps := map[Capability]bool{
+		CapabilityHTTP: a.config.HTTP.Enabled,
+	}
+
+	// The embedded server always runs JetStream, a remote one may not
+	if a.config.NATS.Embedded {
+		caps[CapabilityJetStream] = true
+	} else if js, err := a.nc.JetStream(); err == nil {
+		if _, err := js.AccountInfo(); err == nil {
+			caps[CapabilityJetStream] = true
+		}
+	}
+
+	return caps
+}
+
+// checkCapabilities returns an error if module requires a capability that is
+// not available.
+func (a *App) checkCapabilities(name string, module Module) error {
+	for _, capability := range dependenciesOf(module).Capabilities {
+		if a.caps[capability] {
+			continue
+		}
+		switch capability {
+		case CapabilityJetStream:
+			return fmt.Errorf("module %s requires JetStream, which is not enabled on the NATS server at %s", name, a.config.NATS.URL)
+		case CapabilityHTTP:
+			return fmt.Errorf("module %s requires the HTTP server, which is disabled by http.enabled: false", name)
+		default:
+			return fmt.Errorf("module %s requires unknown capability %q", name, capability)
+		}
+	}
+	return nil
+}
+
+// inactiveDependency returns the first module the module called name depends
+// on that is not running, if any.
+func (a *App) inactiveDependency(name string) string {
+	for _, dep := range dependenciesOf(a.modules[name]).Modules {
+		if _, ok := a.active[dep]; !ok {
+			return dep
+		}
+	}
+	return ""
+}
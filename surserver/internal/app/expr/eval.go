@@ -0,0 +1,616 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Maximum length of the regular expressions built when evaluating matches
+const maxPatternSize = 1024
+
+// scope holds the environment, and the lambda parameters bound on top of it.
+type scope struct {
+	env map[string]any
+	// Lambda parameter
+	name   string
+	value  any
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (any, bool) {
+	for ; s.parent != nil; s = s.parent {
+		if s.name == name {
+			return s.value, true
+		}
+	}
+	value, ok := s.env[name]
+	return value, ok
+}
+
+type evaluator struct {
+	limits Limits
+	steps  int
+}
+
+func newEvaluator(limits Limits) *evaluator {
+	if limits.Steps <= 0 {
+		limits.Steps = DefaultLimits.Steps
+	}
+	if limits.Size <= 0 {
+		limits.Size = DefaultLimits.Size
+	}
+	return &evaluator{limits: limits}
+}
+
+func (ev *evaluator) eval(n node, sc *scope) (any, error) {
+	ev.steps++
+	if ev.steps > ev.limits.Steps {
+		return nil, &Error{Pos: n.pos(), Msg: fmt.Sprintf("evaluation takes more than %d steps", ev.limits.Steps), Err: ErrLimit}
+	}
+
+	switch n := n.(type) {
+	case *literal:
+		return n.value, nil
+
+	case *ident, *member, *index:
+		value, _, err := ev.lookup(n, sc)
+		return value, err
+
+	case *list:
+		items := make([]any, len(n.items))
+		for i, item := range n.items {
+			value, err := ev.eval(item, sc)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return ev.sized(n, items)
+
+	case *object:
+		o := make(map[string]any, len(n.keys))
+		for i, key := range n.keys {
+			value, err := ev.eval(n.values[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			o[key] = value
+		}
+		return ev.sized(n, o)
+
+	case *unary:
+		x, err := ev.eval(n.x, sc)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			b, err := truth(n.x, x)
+			return !b, err
+		}
+		number, ok := toNumber(x)
+		if !ok {
+			return nil, errorf(n, "- requires a number, found %s", describe(x))
+		}
+		return -number, nil
+
+	case *binary:
+		return ev.binary(n, sc)
+
+	case *conditional:
+		cond, err := ev.eval(n.cond, sc)
+		if err != nil {
+			return nil, err
+		}
+		b, err := truth(n.cond, cond)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return ev.eval(n.then, sc)
+		}
+		return ev.eval(n.otherwise, sc)
+
+	case *exists:
+		_, found, err := ev.lookup(n.path, sc)
+		return found, err
+
+	case *call:
+		if n.fn.lambda {
+			return ev.lambdaCall(n, sc)
+		}
+		args := make([]any, len(n.args))
+		for i, arg := range n.args {
+			value, err := ev.eval(arg, sc)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		// Results too large fail before being built
+		if n.fn.size != nil && n.fn.size(args, ev.limits.Size) > ev.limits.Size {
+			return nil, ev.tooLarge(n)
+		}
+		value, err := n.fn.fn(args)
+		if err != nil {
+			return nil, errorf(n, "%s: %v", n.name, err)
+		}
+		return ev.sized(n, value)
+	}
+
+	return nil, errorf(n, "unexpected lambda")
+}
+
+// lookup returns the value of a path, and whether it was found. Other nodes
+// are evaluated and always found.
+func (ev *evaluator) lookup(n node, sc *scope) (any, bool, error) {
+	switch n := n.(type) {
+	case *ident:
+		value, ok := sc.lookup(n.name)
+		return value, ok, nil
+
+	case *member:
+		x, found, err := ev.lookup(n.x, sc)
+		if err != nil || !found {
+			return nil, false, err
+		}
+		o, ok := x.(map[string]any)
+		if !ok {
+			return nil, false, nil
+		}
+		value, ok := o[n.key]
+		return value, ok, nil
+
+	case *index:
+		x, found, err := ev.lookup(n.x, sc)
+		if err != nil {
+			return nil, false, err
+		}
+		i, err := ev.eval(n.index, sc)
+		if err != nil || !found {
+			return nil, false, err
+		}
+		switch x := x.(type) {
+		case []any:
+			f, ok := toNumber(i)
+			if !ok || f != math.Trunc(f) {
+				return nil, false, errorf(n.index, "list index must be an integer, found %s", describe(i))
+			}
+			// Negative indexes count from the end
+			index := int(f)
+			if index < 0 {
+				index += len(x)
+			}
+			if index < 0 || index >= len(x) {
+				return nil, false, nil
+			}
+			return x[index], true, nil
+		case map[string]any:
+			key, ok := i.(string)
+			if _, isNumber := toNumber(i); isNumber {
+				key, ok = String(i), true
+			}
+			if !ok {
+				return nil, false, errorf(n.index, "object key must be a string, found %s", describe(i))
+			}
+			value, ok := x[key]
+			return value, ok, nil
+		}
+		return nil, false, nil
+	}
+
+	value, err := ev.eval(n, sc)
+	return value, true, err
+}
+
+func (ev *evaluator) binary(n *binary, sc *scope) (any, error) {
+	x, err := ev.eval(n.x, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Operators that may not evaluate their second operand
+	switch n.op {
+	case "&&", "||":
+		b, err := truth(n.x, x)
+		if err != nil || b == (n.op == "||") {
+			return b, err
+		}
+		y, err := ev.eval(n.y, sc)
+		if err != nil {
+			return nil, err
+		}
+		return truth(n.y, y)
+	case "??":
+		if x != nil {
+			return x, nil
+		}
+		return ev.eval(n.y, sc)
+	}
+
+	y, err := ev.eval(n.y, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return Equal(x, y), nil
+	case "!=":
+		return !Equal(x, y), nil
+	case "<", "<=", ">", ">=":
+		c, ok := compare(x, y)
+		if !ok {
+			return nil, errorf(n, "%s can't compare %s with %s", n.op, describe(x), describe(y))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "in":
+		return in(n, x, y)
+	case "contains":
+		return in(n, y, x)
+	case "matches":
+		return matches(n, x, y)
+	case "+":
+		return ev.add(n, x, y)
+	}
+
+	a, okA := toNumber(x)
+	b, okB := toNumber(y)
+	if !okA || !okB {
+		return nil, errorf(n, "%s requires numbers, found %s and %s", n.op, describe(x), describe(y))
+	}
+	var result float64
+	switch n.op {
+	case "-":
+		result = a - b
+	case "*":
+		result = a * b
+	case "/", "%":
+		if b == 0 {
+			return nil, errorf(n, "division by zero")
+		}
+		if n.op == "/" {
+			result = a / b
+		} else {
+			result = math.Mod(a, b)
+		}
+	}
+	return finite(n, result)
+}
+
+// add adds numbers, or concatenates strings and lists. Numbers and booleans
+// added to strings are formatted.
+func (ev *evaluator) add(n *binary, x, y any) (any, error) {
+	_, xIsString := x.(string)
+	_, yIsString := y.(string)
+	if xIsString || yIsString {
+		a, okA := scalarString(x)
+		b, okB := scalarString(y)
+		if okA && okB {
+			if len(a)+len(b) > ev.limits.Size {
+				return nil, ev.tooLarge(n)
+			}
+			return a + b, nil
+		}
+	}
+
+	if a, ok := x.([]any); ok {
+		if b, ok := y.([]any); ok {
+			if len(a)+len(b) > ev.limits.Size {
+				return nil, ev.tooLarge(n)
+			}
+			return ev.sized(n, append(append(make([]any, 0, len(a)+len(b)), a...), b...))
+		}
+	}
+
+	a, okA := toNumber(x)
+	b, okB := toNumber(y)
+	if !okA || !okB {
+		return nil, errorf(n, "+ can't add %s and %s", describe(x), describe(y))
+	}
+	return finite(n, a+b)
+}
+
+// lambdaCall evaluates map, filter, any and all.
+func (ev *evaluator) lambdaCall(n *call, sc *scope) (any, error) {
+	x, err := ev.eval(n.args[0], sc)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := x.([]any)
+	if !ok && x != nil {
+		return nil, errorf(n, "%s: expected a list, found %s", n.name, describe(x))
+	}
+
+	fn := n.args[1].(*lambda)
+	out := make([]any, 0, len(items))
+	size := 0
+	for _, item := range items {
+		value, err := ev.eval(fn.body, &scope{name: fn.param, value: item, parent: sc})
+		if err != nil {
+			return nil, err
+		}
+		if n.name == "map" {
+			// The values are counted as they are built, not once all of them were
+			if size += 1 + sizeOf(value, ev.limits.Size); size > ev.limits.Size {
+				return nil, ev.tooLarge(n)
+			}
+			out = append(out, value)
+			continue
+		}
+		b, err := truth(fn.body, value)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case n.name == "filter" && b:
+			out = append(out, item)
+		case n.name == "any" && b:
+			return true, nil
+		case n.name == "all" && !b:
+			return false, nil
+		}
+	}
+
+	switch n.name {
+	case "any":
+		return false, nil
+	case "all":
+		return true, nil
+	}
+	return out, nil
+}
+
+// sized returns value unless it is larger than the size limit, see sizeOf.
+func (ev *evaluator) sized(n node, value any) (any, error) {
+	if sizeOf(value, ev.limits.Size) > ev.limits.Size {
+		return nil, ev.tooLarge(n)
+	}
+	return value, nil
+}
+
+func (ev *evaluator) tooLarge(n node) error {
+	return &Error{Pos: n.pos(), Msg: fmt.Sprintf("value larger than %d", ev.limits.Size), Err: ErrLimit}
+}
+
+// sizeOf returns the size of value: the length of strings, and for lists and
+// objects their number of items plus the sizes of their items and keys. It
+// stops counting once the size is larger than limit.
+func sizeOf(value any, limit int) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []any:
+		size := len(v)
+		for _, item := range v {
+			if size > limit {
+				break
+			}
+			size += sizeOf(item, limit-size)
+		}
+		return size
+	case map[string]any:
+		size := len(v)
+		for key, item := range v {
+			if size > limit {
+				break
+			}
+			size += len(key) + sizeOf(item, limit-size-len(key))
+		}
+		return size
+	}
+	return 0
+}
+
+// in reports whether x is an item of the list y, a key of the object y or a
+// substring of the string y.
+func in(n *binary, x, y any) (bool, error) {
+	switch y := y.(type) {
+	case nil:
+		return false, nil
+	case []any:
+		for _, item := range y {
+			if Equal(x, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		key, ok := x.(string)
+		if !ok {
+			return false, errorf(n, "object keys are strings, found %s", describe(x))
+		}
+		_, found := y[key]
+		return found, nil
+	case string:
+		s, ok := x.(string)
+		if !ok {
+			return false, errorf(n, "a string can only contain a string, found %s", describe(x))
+		}
+		return strings.Contains(y, s), nil
+	}
+	return false, errorf(n, "%s requires a list, an object or a string, found %s", n.op, describe(y))
+}
+
+func matches(n *binary, x, y any) (bool, error) {
+	s, ok := x.(string)
+	if !ok {
+		return false, errorf(n, "matches requires a string, found %s", describe(x))
+	}
+	re := n.re
+	if re == nil {
+		pattern, ok := y.(string)
+		if !ok {
+			return false, errorf(n.y, "matches requires a regular expression string, found %s", describe(y))
+		}
+		if len(pattern) > maxPatternSize {
+			return false, &Error{Pos: n.y.pos(), Msg: fmt.Sprintf("regular expression longer than %d", maxPatternSize), Err: ErrLimit}
+		}
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return false, errorf(n.y, "invalid regular expression: %v", err)
+		}
+	}
+	return re.MatchString(s), nil
+}
+
+// truth returns the value of a condition. Null is false.
+func truth(n node, value any) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	}
+	return false, errorf(n, "expected a bool, found %s", describe(value))
+}
+
+func finite(n node, f float64) (any, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, errorf(n, "number out of range")
+	}
+	return f, nil
+}
+
+func errorf(n node, format string, args ...any) error {
+	return &Error{Pos: n.pos(), Msg: fmt.Sprintf(format, args...)}
+}
+
+// compare returns the order of two numbers or two strings.
+func compare(x, y any) (int, bool) {
+	if a, ok := toNumber(x); ok {
+		b, ok := toNumber(y)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	}
+	a, okA := x.(string)
+	b, okB := y.(string)
+	if !okA || !okB {
+		return 0, false
+	}
+	return strings.Compare(a, b), true
+}
+
+// Equal reports whether two decoded JSON values are equal. Numbers may be
+// integers, as found in values decoded from configs.
+func Equal(a, b any) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !Equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// String formats a value as text: strings as they are, numbers without
+// exponent, null as an empty string, lists and objects as JSON.
+func String(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	if n, ok := toNumber(value); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// scalarString formats strings, numbers and booleans.
+func scalarString(value any) (string, bool) {
+	switch value.(type) {
+	case string, bool:
+		return String(value), true
+	}
+	if _, ok := toNumber(value); ok {
+		return String(value), true
+	}
+	return "", false
+}
+
+func toNumber(value any) (float64, bool) {
+	if f, ok := value.(float64); ok {
+		return f, true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// describe returns the type of a value as shown in error messages.
+func describe(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a bool"
+	case string:
+		return "a string"
+	case []any:
+		return "a list"
+	case map[string]any:
+		return "an object"
+	}
+	if _, ok := toNumber(value); ok {
+		return "a number"
+	}
+	return fmt.Sprintf("a %T", value)
+}
@@ -0,0 +1,216 @@
+package expr
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var env = map[string]any{
+	"payload": map[string]any{
+		"value": 21.5,
+		"name":  "Kitchen",
+		"null":  nil,
+		"lights": []any{
+			map[string]any{"name": "a", "on": true},
+			map[string]any{"name": "b", "on": false},
+			map[string]any{"name": "c", "on": true},
+		},
+	},
+	"tokens": []any{"sensor", "kitchen", "temperature"},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want any
+	}{
+		// Paths
+		{`payload.value`, 21.5},
+		{`payload["name"]`, "Kitchen"},
+		{`tokens[1]`, "kitchen"},
+		{`tokens[-1]`, "temperature"},
+		{`tokens.0`, "sensor"},
+		{`payload.lights[0].name`, "a"},
+
+		// Missing paths are null, exists tells them apart from null values
+		{`payload.missing`, nil},
+		{`payload.value.deeper`, nil},
+		{`tokens[10]`, nil},
+		{`nope.a.b`, nil},
+		{`exists(payload.value)`, true},
+		{`exists(payload.null)`, true},
+		{`exists(payload.missing)`, false},
+		{`exists(payload.value.deeper)`, false},
+		{`exists(tokens[2])`, true},
+		{`exists(tokens[3])`, false},
+		{`exists(nope)`, false},
+		{`payload.null == null`, true},
+		{`payload.missing == null`, true},
+
+		// ??
+		{`payload.missing ?? "default"`, "default"},
+		{`payload.null ?? 1`, 1.0},
+		{`payload.value ?? 1`, 21.5},
+		{`false ?? true`, false},
+		{`payload.missing ?? payload.null ?? 3`, 3.0},
+
+		// Lambdas
+		{`map(payload.lights, l => l.name)`, []any{"a", "b", "c"}},
+		{`map(filter(payload.lights, l => l.on), l => upper(l.name))`, []any{"A", "C"}},
+		{`any(payload.lights, l => !l.on)`, true},
+		{`all(payload.lights, l => l.on)`, false},
+		{`all([], x => x)`, true},
+		{`map(tokens, t => map([1, 2], n => t + n))[0]`, []any{"sensor1", "sensor2"}},
+		{`map([1, 2], payload => payload * 2)`, []any{2.0, 4.0}},
+		{`map(payload.missing, x => x)`, []any{}},
+
+		// Operators and functions
+		{`(payload.value - 32) * 5 / 9 < 0`, true},
+		{`"kit" in lower(payload.name)`, true},
+		{`tokens contains "kitchen"`, true},
+		{`payload.name matches "^K"`, true},
+		{`payload.value > 20 ? "warm" : "cold"`, "warm"},
+		{`{room: tokens[1], on: len(filter(payload.lights, l => l.on))}`, map[string]any{"room": "kitchen", "on": 2.0}},
+		{`join(split("a,b,c", ","), "-")`, "a-b-c"},
+		{`replace("aaa", "a", "bb")`, "bbbbbb"},
+		{`replace("ab", "", "-")`, "-a-b-"},
+		{`round(2.345, 2)`, 2.35},
+		{`max(3, 9, 4)`, 9.0},
+		{`keys({b: 1, a: 2})`, []any{"a", "b"}},
+		{`merge({a: 1, b: 1}, {b: 2})`, map[string]any{"a": 1.0, "b": 2.0}},
+		{`string([1, "a"])`, `[1,"a"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got, err := MustCompile(tt.src).Eval(env)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if !Equal(got, tt.want) {
+				t.Errorf("got %s, want %#v", String(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		// Expected message, starting with the column
+		want string
+	}{
+		{`payload.name - 1`, "column 14: "},
+		{`1 / 0`, "column 3: "},
+		{`tokens["a"] + 1`, "column 8: list index must be an integer"},
+		{`{a: 1}[true]`, "column 8: object key must be a string"},
+		{`len(1)`, "column 1: len: expected a string, a list or an object"},
+		{`payload.value && true`, "column 9: expected a bool"},
+		{`map(payload.lights, l => l.name * 2)`, "column 33: "},
+		{`payload.name matches tokens[0] + "("`, "column 32: invalid regular expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := MustCompile(tt.src).Eval(env)
+			var exprErr *Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("got error %v, want an *Error", err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got %q, want %q", err, tt.want)
+			}
+			if errors.Is(err, ErrLimit) {
+				t.Errorf("got %v, want no ErrLimit", err)
+			}
+		})
+	}
+}
+
+func TestBool(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{src: `payload.value > 20`, want: true},
+		{src: `payload.missing`, want: false},
+		{src: `payload.name`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := MustCompile(tt.src).Bool(env)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Bool(%q) = %v, %v, want %v, error %v", tt.src, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	big := strings.Repeat("x", 20<<10)
+	env := map[string]any{
+		"s":    big,
+		"list": []any{big, big, big},
+	}
+	// Lists sharing big items
+	shared := make([]any, 100)
+	for i := range shared {
+		shared[i] = env["list"]
+	}
+	env["shared"] = shared
+
+	tests := []struct {
+		src    string
+		limits Limits
+		// Whether the evaluation exceeds the limits
+		exceeds bool
+	}{
+		{src: `len(replace(s, "", s))`, exceeds: true},
+		{src: `len(replace(s, "x", "yy"))`},
+		{src: `len(replace(s, "x", s))`, exceeds: true},
+		{src: `len(split(s, ""))`, exceeds: false},
+		{src: `len(split(s, ""))`, limits: Limits{Size: 20 << 10}, exceeds: true},
+		{src: `len(join(list, s))`, limits: Limits{Size: 100 << 10}, exceeds: false},
+		{src: `len(join(list, s + s))`, limits: Limits{Size: 100 << 10}, exceeds: true},
+		{src: `len(join(shared, ""))`, exceeds: true},
+		{src: `len(map(list, x => x + "y"))`, limits: Limits{Size: 100 << 10}, exceeds: false},
+		{src: `len(map(list, x => x + x))`, limits: Limits{Size: 100 << 10}, exceeds: true},
+		{src: `len(map(shared, x => x))`, exceeds: true},
+		{src: `len([list, list, list, list])`, limits: Limits{Size: 200 << 10}, exceeds: true},
+		{src: `len({a: list, b: s})`, limits: Limits{Size: 100 << 10}, exceeds: false},
+		{src: `len(list + list)`, limits: Limits{Size: 100 << 10}, exceeds: true},
+		{src: `len(s + s)`, limits: Limits{Size: 30 << 10}, exceeds: true},
+		{src: `len(shared)`},
+		{src: `len(filter(shared, x => true))`, limits: Limits{Steps: 1000}},
+		{src: `len(filter(shared, x => true))`, limits: Limits{Steps: 100}, exceeds: true},
+		{src: `len(map(split(replace(s, "x", "x,"), ","), x => x + "y"))`, exceeds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := MustCompile(tt.src).EvalWithLimits(env, tt.limits)
+			if tt.exceeds != errors.Is(err, ErrLimit) {
+				t.Fatalf("got error %v, want limit exceeded %v", err, tt.exceeds)
+			}
+			if !tt.exceeds && err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+		})
+	}
+}
+
+func TestLimitsAllocation(t *testing.T) {
+	// The result of replace must be refused before being built, it would be
+	// 400 MB
+	env := map[string]any{"s": strings.Repeat("x", 20<<10)}
+	e := MustCompile(`len(replace(s, "", s))`)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := e.Eval(env)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, ErrLimit) {
+		t.Fatalf("got error %v, want ErrLimit", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes, want less than 1 MB", allocated)
+	}
+}
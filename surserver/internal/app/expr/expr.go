@@ -0,0 +1,160 @@
+// Package expr evaluates small expressions on decoded JSON documents. Configs
+// use them to test conditions, compute values and reshape payloads.
+//
+// An expression reads the names of its environment, e.g. with payload and
+// state:
+//
+//	payload.value > state.threshold && state.mode == "home"
+//	{room: tokens[1], celsius: (payload.value - 32) * 5 / 9}
+//	map(filter(payload.lights, l => l.on), l => upper(l.name))
+//
+// Operators, by increasing precedence:
+//
+//	c ? a : b                 a when c is true, b otherwise
+//	a ?? b                    a unless it is null, b otherwise
+//	a || b, a or b
+//	a && b, a and b
+//	!a, not a                 (not binds looser than comparisons)
+//	== != < <= > >= in contains matches
+//	+ -                       + also concatenates strings and lists
+//	* / %
+//	-a, !a
+//	a.key, a[index], a["key"], f(args)
+//
+// Literals are numbers, "strings" or 'strings', true, false, null, [lists]
+// and {key: value} objects. Missing keys, out of range indexes and keys of
+// values that aren't objects are null; exists(path) tells them apart from null
+// values. Numbers of paths may also be written a.0 as in JSON paths.
+//
+// Expressions are sandboxed: they only read their environment, call the
+// functions of this package, and their evaluation is bounded by Limits.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrLimit is wrapped by the errors of evaluations exceeding their Limits.
+var ErrLimit = errors.New("expression limit exceeded")
+
+// Error is an error found in an expression, at a byte offset of its source.
+type Error struct {
+	Pos int
+	Msg string
+	// ErrLimit when an evaluation exceeded its limits
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Limits bounds the evaluation of an expression. Zero fields use the value of
+// DefaultLimits.
+type Limits struct {
+	// Maximum number of evaluation steps, about one per operator, value and
+	// lambda call
+	Steps int
+	// Maximum length of the strings, lists and objects built by the expression
+	Size int
+}
+
+var DefaultLimits = Limits{Steps: 10000, Size: 1 << 20}
+
+// Maximum nesting of parentheses, lists, objects and calls
+const maxDepth = 64
+
+// Expr is a compiled expression, safe for concurrent use.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses an expression. When names are given, the expression may only
+// refer to them, other names being reported as errors. Otherwise unknown names
+// are null when evaluated.
+func Compile(src string, names ...string) (*Expr, error) {
+	p := newParser(src, 0)
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.tok; tok.kind != tokEOF {
+		return nil, &Error{Pos: tok.pos, Msg: "unexpected " + tok.describe()}
+	}
+	if len(names) > 0 {
+		if err := checkNames(root, names, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// CompileAt compiles the expression found at offset start of src, which may
+// go on after it, as expressions embedded in other languages do. It returns
+// the offset of what follows the expression. Error positions are offsets in
+// src.
+func CompileAt(src string, start int) (*Expr, int, error) {
+	p := newParser(src, start)
+	root, err := p.parse()
+	if err != nil {
+		return nil, 0, err
+	}
+	end := p.tok.pos
+	return &Expr{src: strings.TrimSpace(src[start:end]), root: root}, end, nil
+}
+
+// MustCompile is like Compile but panics on errors.
+func MustCompile(src string, names ...string) *Expr {
+	e, err := Compile(src, names...)
+	if err != nil {
+		panic(fmt.Sprintf("expr: compiling %q: %v", src, err))
+	}
+	return e
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression on env with the default limits.
+func (e *Expr) Eval(env map[string]any) (any, error) {
+	return e.EvalWithLimits(env, DefaultLimits)
+}
+
+// EvalWithLimits evaluates the expression on env within limits.
+func (e *Expr) EvalWithLimits(env map[string]any, limits Limits) (any, error) {
+	return newEvaluator(limits).eval(e.root, &scope{env: env})
+}
+
+// Bool evaluates a condition on env. Null is false, values other than
+// booleans are errors.
+func (e *Expr) Bool(env map[string]any) (bool, error) {
+	value, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	return truth(e.root, value)
+}
+
+// checkNames reports the first name of n that is neither one of names nor a
+// lambda parameter in bound.
+func checkNames(n node, names, bound []string) error {
+	var err error
+	walk(n, bound, func(n node, bound []string) {
+		id, ok := n.(*ident)
+		if !ok || err != nil || slices.Contains(names, id.name) || slices.Contains(bound, id.name) {
+			return
+		}
+		err = &Error{Pos: id.p, Msg: fmt.Sprintf("unknown name %q, known names are: %s", id.name, strings.Join(names, ", "))}
+	})
+	return err
+}
@@ -0,0 +1,143 @@
+package expr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		src  string
+		want any
+	}{
+		{`1 + 2 * 3`, 7.0},
+		{`(1 + 2) * 3`, 9.0},
+		{`10 - 4 - 3`, 3.0},
+		{`2 * 3 % 4`, 2.0},
+		{`-2 * 3`, -6.0},
+		{`1 + 2 == 3`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`not 1 == 2`, true},
+		{`!false && false`, false},
+		{`null ?? 1 + 1`, 2.0},
+		{`false || null ?? true`, false},
+		{`null ?? false || true`, true},
+		{`true ? 1 : 2 ?? 3`, 1.0},
+		{`false ? 1 : true ? 2 : 3`, 2.0},
+		{`"a" + "b" in ["ab"]`, true},
+		{`[1, 2] + [3]`, []any{1.0, 2.0, 3.0}},
+		{`{a: {b: [1, 2]}}.a.b[1]`, 2.0},
+		{`{a: [10, 20]}.a.1`, 20.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := Compile(tt.src)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			got, err := e.Eval(nil)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if !Equal(got, tt.want) {
+				t.Errorf("got %s, want %v", String(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src   string
+		names []string
+		// Expected message, starting with the column
+		want string
+	}{
+		{src: `1 +`, want: "column 4: "},
+		{src: `(1 + 2`, want: "column 7: "},
+		{src: `1 2`, want: "column 3: unexpected "},
+		{src: `a.`, want: "column 3: "},
+		{src: `"abc`, want: "column 1: "},
+		{src: `1 @ 2`, want: "column 3: "},
+		{src: `nope(1)`, want: "column 1: "},
+		{src: `len(1, 2)`, want: "column 1: "},
+		{src: `x => x`, want: "column 3: "},
+		{src: `payload.name matches "("`, want: "column 22: invalid regular expression"},
+		{src: `payload.a + other`, names: []string{"payload"}, want: `column 13: unknown name "other"`},
+		{src: `map(payload, x => x + y)`, names: []string{"payload"}, want: `column 23: unknown name "y"`},
+		{src: strings.Repeat("(", maxDepth+1) + "1" + strings.Repeat(")", maxDepth+1), want: "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Compile(tt.src, tt.names...)
+			var exprErr *Error
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("got error %v, want an *Error", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileNames(t *testing.T) {
+	for _, src := range []string{`payload.a`, `map(payload, x => x.a)`, `exists(payload.a)`, `{payload: 1}`} {
+		if _, err := Compile(src, "payload"); err != nil {
+			t.Errorf("Compile(%q): %v", src, err)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	env := map[string]any{"payload": map[string]any{"room": "kitchen", "value": 21.5, "tags": []any{"a", "b"}}}
+	tests := []struct {
+		src  string
+		want any
+	}{
+		{`plain text`, "plain text"},
+		{`{{ payload.value }}`, 21.5},
+		{`{{ payload.tags }}`, []any{"a", "b"}},
+		{`room {{ upper(payload.room) }}: {{ payload.value }}`, "room KITCHEN: 21.5"},
+		{`{{ payload.missing }}!`, "!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.src)
+			if err != nil {
+				t.Fatalf("ParseTemplate: %v", err)
+			}
+			got, err := tmpl.Render(env)
+			if err != nil {
+				t.Fatalf("Render: %v", err)
+			}
+			if !Equal(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTemplate(`a {{ 1 + }} b`); err == nil || !strings.HasPrefix(err.Error(), "column 10: ") {
+		t.Errorf("got error %v, want one at column 10", err)
+	}
+}
+
+func TestCompileAt(t *testing.T) {
+	src := `if payload.a.0 > 1 and not state['mode'] == "x" then publish`
+	e, end, err := CompileAt(src, 3)
+	if err != nil {
+		t.Fatalf("CompileAt: %v", err)
+	}
+	if got := src[end:]; got != "then publish" {
+		t.Errorf("got rest %q, want %q", got, "then publish")
+	}
+	if got, want := e.Tree().String(), `((payload.a[0] > 1) && !(state["mode"] == "x"))`; got != want {
+		t.Errorf("got tree %s, want %s", got, want)
+	}
+
+	if _, _, err := CompileAt(src, 15); err == nil || !strings.HasPrefix(err.Error(), "column 16: ") {
+		t.Errorf("got error %v, want one at column 16", err)
+	}
+}
@@ -0,0 +1,327 @@
+package expr
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// function is a function expressions can call.
+type function struct {
+	// Number of arguments, max < 0 for variadic functions
+	min, max int
+	// The second argument is a lambda, called by the evaluator for each item
+	// of the first one
+	lambda bool
+	usage  string
+	fn     func(args []any) (any, error)
+	// Size of the result, see sizeOf, for functions whose results may be
+	// much larger than their arguments. It is checked against limit before
+	// calling fn, may stop counting once larger than limit, and must accept
+	// arguments of any type.
+	size func(args []any, limit int) int
+}
+
+// Functions of expressions. map, filter, any and all take a list and a lambda.
+var functions = map[string]*function{
+	"len": {min: 1, max: 1, usage: "len(string|list|object)", fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return 0.0, nil
+		case string:
+			return float64(utf8.RuneCountInString(v)), nil
+		case []any:
+			return float64(len(v)), nil
+		case map[string]any:
+			return float64(len(v)), nil
+		}
+		return nil, typeError("a string, a list or an object", args[0])
+	}},
+	"lower": {min: 1, max: 1, usage: "lower(string)", fn: stringFunc(strings.ToLower)},
+	"upper": {min: 1, max: 1, usage: "upper(string)", fn: stringFunc(strings.ToUpper)},
+	"trim":  {min: 1, max: 1, usage: "trim(string)", fn: stringFunc(strings.TrimSpace)},
+	"split": {min: 2, max: 2, usage: "split(string, separator)", size: splitSize, fn: func(args []any) (any, error) {
+		s, sep, err := twoStrings(args)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.Split(s, sep)
+		out := make([]any, len(parts))
+		for i, part := range parts {
+			out[i] = part
+		}
+		return out, nil
+	}},
+	"join": {min: 2, max: 2, usage: "join(list, separator)", size: joinSize, fn: func(args []any) (any, error) {
+		items, ok := args[0].([]any)
+		if !ok {
+			return nil, typeError("a list", args[0])
+		}
+		sep, ok := args[1].(string)
+		if !ok {
+			return nil, typeError("a string separator", args[1])
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = String(item)
+		}
+		return strings.Join(parts, sep), nil
+	}},
+	"replace": {min: 3, max: 3, usage: "replace(string, old, new)", size: replaceSize, fn: func(args []any) (any, error) {
+		var s [3]string
+		for i, arg := range args {
+			str, ok := arg.(string)
+			if !ok {
+				return nil, typeError("strings", arg)
+			}
+			s[i] = str
+		}
+		return strings.ReplaceAll(s[0], s[1], s[2]), nil
+	}},
+	"starts_with": {min: 2, max: 2, usage: "starts_with(string, prefix)", fn: func(args []any) (any, error) {
+		s, prefix, err := twoStrings(args)
+		return strings.HasPrefix(s, prefix), err
+	}},
+	"ends_with": {min: 2, max: 2, usage: "ends_with(string, suffix)", fn: func(args []any) (any, error) {
+		s, suffix, err := twoStrings(args)
+		return strings.HasSuffix(s, suffix), err
+	}},
+	"string": {min: 1, max: 1, usage: "string(value)", fn: func(args []any) (any, error) {
+		return String(args[0]), nil
+	}},
+	"number": {min: 1, max: 1, usage: "number(string|number|bool)", fn: func(args []any) (any, error) {
+		switch v := args[0].(type) {
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			return n, nil
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+		if n, ok := toNumber(args[0]); ok {
+			return n, nil
+		}
+		return nil, typeError("a string, a number or a bool", args[0])
+	}},
+	"round": {min: 1, max: 2, usage: "round(number[, decimals])", fn: func(args []any) (any, error) {
+		n, ok := toNumber(args[0])
+		if !ok {
+			return nil, typeError("a number", args[0])
+		}
+		scale := 1.0
+		if len(args) == 2 {
+			decimals, ok := toNumber(args[1])
+			if !ok || decimals < 0 || decimals > 15 || decimals != math.Trunc(decimals) {
+				return nil, fmt.Errorf("decimals must be an integer between 0 and 15")
+			}
+			scale = math.Pow(10, decimals)
+		}
+		return math.Round(n*scale) / scale, nil
+	}},
+	"floor": {min: 1, max: 1, usage: "floor(number)", fn: numberFunc(math.Floor)},
+	"ceil":  {min: 1, max: 1, usage: "ceil(number)", fn: numberFunc(math.Ceil)},
+	"abs":   {min: 1, max: 1, usage: "abs(number)", fn: numberFunc(math.Abs)},
+	"min":   {min: 1, max: -1, usage: "min(number, ...) or min(list)", fn: extremum(-1)},
+	"max":   {min: 1, max: -1, usage: "max(number, ...) or max(list)", fn: extremum(1)},
+	"keys": {min: 1, max: 1, usage: "keys(object)", fn: func(args []any) (any, error) {
+		o, ok := args[0].(map[string]any)
+		if !ok {
+			return nil, typeError("an object", args[0])
+		}
+		keys := make([]any, 0, len(o))
+		for _, key := range slices.Sorted(maps.Keys(o)) {
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}},
+	"values": {min: 1, max: 1, usage: "values(object)", fn: func(args []any) (any, error) {
+		o, ok := args[0].(map[string]any)
+		if !ok {
+			return nil, typeError("an object", args[0])
+		}
+		values := make([]any, 0, len(o))
+		for _, key := range slices.Sorted(maps.Keys(o)) {
+			values = append(values, o[key])
+		}
+		return values, nil
+	}},
+	"merge": {min: 1, max: -1, usage: "merge(object, ...), later keys win", fn: func(args []any) (any, error) {
+		out := make(map[string]any)
+		for _, arg := range args {
+			o, ok := arg.(map[string]any)
+			if !ok && arg != nil {
+				return nil, typeError("objects", arg)
+			}
+			maps.Copy(out, o)
+		}
+		return out, nil
+	}},
+	"pick": {min: 2, max: -1, usage: "pick(object, key, ...)", fn: func(args []any) (any, error) {
+		o, keys, err := objectAndKeys(args)
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]any, len(keys))
+		for _, key := range keys {
+			if value, ok := o[key]; ok {
+				out[key] = value
+			}
+		}
+		return out, nil
+	}},
+	"omit": {min: 2, max: -1, usage: "omit(object, key, ...)", fn: func(args []any) (any, error) {
+		o, keys, err := objectAndKeys(args)
+		if err != nil {
+			return nil, err
+		}
+		out := maps.Clone(o)
+		if out == nil {
+			out = make(map[string]any)
+		}
+		for _, key := range keys {
+			delete(out, key)
+		}
+		return out, nil
+	}},
+	"map":    {min: 2, max: 2, lambda: true, usage: "map(list, x => value)"},
+	"filter": {min: 2, max: 2, lambda: true, usage: "filter(list, x => condition)"},
+	"any":    {min: 2, max: 2, lambda: true, usage: "any(list, x => condition)"},
+	"all":    {min: 2, max: 2, lambda: true, usage: "all(list, x => condition)"},
+}
+
+// splitSize returns the size of the list of split: its number of parts plus
+// their lengths.
+func splitSize(args []any, limit int) int {
+	s, sep, err := twoStrings(args)
+	if err != nil {
+		return 0
+	}
+	if sep == "" {
+		return utf8.RuneCountInString(s) + len(s)
+	}
+	count := strings.Count(s, sep)
+	return count + 1 + len(s) - count*len(sep)
+}
+
+// joinSize returns the length of the string of join. Lists and objects are
+// counted with sizeOf, their JSON being a bit longer.
+func joinSize(args []any, limit int) int {
+	items, ok := args[0].([]any)
+	sep, okSep := args[1].(string)
+	if !ok || !okSep || len(items) == 0 {
+		return 0
+	}
+	size := (len(items) - 1) * len(sep)
+	for _, item := range items {
+		if size > limit {
+			break
+		}
+		switch item.(type) {
+		case []any, map[string]any:
+			size += sizeOf(item, limit-size)
+		default:
+			size += len(String(item))
+		}
+	}
+	return size
+}
+
+// replaceSize returns the length of the string of replace.
+func replaceSize(args []any, limit int) int {
+	s, okS := args[0].(string)
+	old, okOld := args[1].(string)
+	replacement, okNew := args[2].(string)
+	if !okS || !okOld || !okNew {
+		return 0
+	}
+	// An empty old string matches before each rune and at the end
+	count := utf8.RuneCountInString(s) + 1
+	if old != "" {
+		count = strings.Count(s, old)
+	}
+	return len(s) + count*(len(replacement)-len(old))
+}
+
+func stringFunc(fn func(string) string) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, typeError("a string", args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+func numberFunc(fn func(float64) float64) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		n, ok := toNumber(args[0])
+		if !ok {
+			return nil, typeError("a number", args[0])
+		}
+		return fn(n), nil
+	}
+}
+
+// extremum returns min (sign -1) or max (sign 1) of numbers or of a list of numbers.
+func extremum(sign float64) func([]any) (any, error) {
+	return func(args []any) (any, error) {
+		if list, ok := args[0].([]any); ok && len(args) == 1 {
+			if len(list) == 0 {
+				return nil, nil
+			}
+			args = list
+		}
+		var best float64
+		for i, arg := range args {
+			n, ok := toNumber(arg)
+			if !ok {
+				return nil, typeError("numbers", arg)
+			}
+			if i == 0 || (n-best)*sign > 0 {
+				best = n
+			}
+		}
+		return best, nil
+	}
+}
+
+func twoStrings(args []any) (string, string, error) {
+	a, okA := args[0].(string)
+	b, okB := args[1].(string)
+	if !okA {
+		return "", "", typeError("a string", args[0])
+	}
+	if !okB {
+		return "", "", typeError("a string", args[1])
+	}
+	return a, b, nil
+}
+
+func objectAndKeys(args []any) (map[string]any, []string, error) {
+	o, ok := args[0].(map[string]any)
+	if !ok && args[0] != nil {
+		return nil, nil, typeError("an object", args[0])
+	}
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		key, ok := arg.(string)
+		if !ok {
+			return nil, nil, typeError("string keys", arg)
+		}
+		keys = append(keys, key)
+	}
+	return o, keys, nil
+}
+
+func typeError(expected string, found any) error {
+	return fmt.Errorf("expected %s, found %s", expected, describe(found))
+}
@@ -0,0 +1,182 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	// Operators and punctuation, the text of the token tells which
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	// Source text, unquoted for strings
+	text string
+	num  float64
+	// Byte offset in the source
+	pos int
+}
+
+// describe returns the token as shown in error messages.
+func (t token) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// Operators, longest first
+var puncts = []string{"??", "==", "!=", "<=", ">=", "&&", "||", "=>", "<", ">", "+", "-", "*", "/", "%", "!", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}"}
+
+// lexer reads the tokens of an expression on demand, so an expression can end
+// before the end of its source, as in templates.
+type lexer struct {
+	src string
+	i   int
+	// Set after a dot, where a number is an index: a.0.b is not a.(0.0).b
+	afterDot bool
+}
+
+func (l *lexer) next() (token, error) {
+	for l.i < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.i += size
+	}
+
+	afterDot := l.afterDot
+	l.afterDot = false
+	start := l.i
+	if l.i >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.src[l.i:])
+	switch {
+	case r == '"' || r == '\'':
+		return l.string(r)
+
+	case isDigit(l.src[l.i]):
+		l.skipDigits()
+		if !afterDot {
+			if l.i+1 < len(l.src) && l.src[l.i] == '.' && isDigit(l.src[l.i+1]) {
+				l.i++
+				l.skipDigits()
+			}
+			if l.i < len(l.src) && (l.src[l.i] == 'e' || l.src[l.i] == 'E') {
+				end := l.i + 1
+				if end < len(l.src) && (l.src[end] == '+' || l.src[end] == '-') {
+					end++
+				}
+				if end < len(l.src) && isDigit(l.src[end]) {
+					l.i = end
+					l.skipDigits()
+				}
+			}
+		}
+		text := l.src[start:l.i]
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return token{}, &Error{Pos: start, Msg: fmt.Sprintf("invalid number %q", text)}
+		}
+		return token{kind: tokNumber, text: text, num: n, pos: start}, nil
+
+	case r == '_' || unicode.IsLetter(r):
+		l.i += size
+		for l.i < len(l.src) {
+			r, size := utf8.DecodeRuneInString(l.src[l.i:])
+			if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			l.i += size
+		}
+		return token{kind: tokIdent, text: l.src[start:l.i], pos: start}, nil
+	}
+
+	for _, punct := range puncts {
+		if strings.HasPrefix(l.src[l.i:], punct) {
+			l.i += len(punct)
+			l.afterDot = punct == "."
+			return token{kind: tokPunct, text: punct, pos: start}, nil
+		}
+	}
+	return token{}, &Error{Pos: start, Msg: fmt.Sprintf("unexpected character %q", r)}
+}
+
+// string reads a string quoted with quote, with the escapes of Go strings.
+func (l *lexer) string(quote rune) (token, error) {
+	start := l.i
+	end := l.i + 1
+	for end < len(l.src) && rune(l.src[end]) != quote && l.src[end] != '\n' {
+		if l.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(l.src) || rune(l.src[end]) != quote {
+		return token{}, &Error{Pos: start, Msg: "unterminated string"}
+	}
+
+	text, err := Unquote(l.src[start : end+1])
+	if err != nil {
+		return token{}, &Error{Pos: start, Msg: "invalid string: " + err.Error()}
+	}
+	l.i = end + 1
+	return token{kind: tokString, text: text, pos: start}, nil
+}
+
+// Unquote returns the value of a string literal of expressions, quoted with
+// " or ' and with the escapes of Go strings.
+func Unquote(literal string) (string, error) {
+	if len(literal) < 2 || (literal[0] != '"' && literal[0] != '\'') || literal[len(literal)-1] != literal[0] {
+		return "", strconv.ErrSyntax
+	}
+	body := literal[1 : len(literal)-1]
+	if literal[0] == '\'' {
+		// Requote as a Go string
+		var b strings.Builder
+		for i := 0; i < len(body); i++ {
+			switch {
+			case body[i] == '\\' && i+1 < len(body) && body[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case body[i] == '\\' && i+1 < len(body):
+				b.WriteString(body[i : i+2])
+				i++
+			case body[i] == '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte(body[i])
+			}
+		}
+		body = b.String()
+	}
+	return strconv.Unquote(`"` + body + `"`)
+}
+
+func (l *lexer) skipDigits() {
+	for l.i < len(l.src) && isDigit(l.src[l.i]) {
+		l.i++
+	}
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,496 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// Nodes of the syntax tree, p is the offset of the node in the source
+type (
+	node interface {
+		pos() int
+	}
+
+	literal struct {
+		p int
+		// string, float64, bool or nil
+		value any
+	}
+
+	ident struct {
+		p    int
+		name string
+	}
+
+	// member is a.key
+	member struct {
+		p   int
+		x   node
+		key string
+	}
+
+	// index is a[index]
+	index struct {
+		p        int
+		x, index node
+	}
+
+	list struct {
+		p     int
+		items []node
+	}
+
+	object struct {
+		p      int
+		keys   []string
+		values []node
+	}
+
+	unary struct {
+		p  int
+		op string
+		x  node
+	}
+
+	binary struct {
+		p    int
+		op   string
+		x, y node
+		// matches with a literal pattern, compiled once
+		re *regexp.Regexp
+	}
+
+	conditional struct {
+		p                     int
+		cond, then, otherwise node
+	}
+
+	exists struct {
+		p    int
+		path node
+	}
+
+	call struct {
+		p    int
+		name string
+		fn   *function
+		args []node
+	}
+
+	// lambda is x => body, only allowed as an argument of some functions
+	lambda struct {
+		p     int
+		param string
+		body  node
+	}
+)
+
+func (n *literal) pos() int     { return n.p }
+func (n *ident) pos() int       { return n.p }
+func (n *member) pos() int      { return n.p }
+func (n *index) pos() int       { return n.p }
+func (n *list) pos() int        { return n.p }
+func (n *object) pos() int      { return n.p }
+func (n *unary) pos() int       { return n.p }
+func (n *binary) pos() int      { return n.p }
+func (n *conditional) pos() int { return n.p }
+func (n *exists) pos() int      { return n.p }
+func (n *call) pos() int        { return n.p }
+func (n *lambda) pos() int      { return n.p }
+
+// Names that are operators or literals
+var keywords = []string{"true", "false", "null", "and", "or", "not", "in", "contains", "matches"}
+
+var comparisons = []string{"==", "!=", "<", "<=", ">", ">=", "in", "contains", "matches"}
+
+// parseError stops the parsing of an expression.
+type parseError struct {
+	err *Error
+}
+
+type parser struct {
+	lex lexer
+	// Current token
+	tok   token
+	depth int
+}
+
+// newParser returns a parser reading an expression from offset start of src.
+func newParser(src string, start int) *parser {
+	return &parser{lex: lexer{src: src, i: start}}
+}
+
+// parse parses an expression. The parser is left on the first token after it.
+func (p *parser) parse() (n node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			n, err = nil, perr.err
+		}
+	}()
+
+	p.advance()
+	return p.parseExpr(), nil
+}
+
+func (p *parser) parseExpr() node {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		p.fail(p.tok.pos, "expression nested too deeply")
+	}
+
+	cond := p.parseCoalesce()
+	if tok := p.tok; p.acceptPunct("?") {
+		then := p.parseExpr()
+		p.expectPunct(":")
+		return &conditional{p: tok.pos, cond: cond, then: then, otherwise: p.parseExpr()}
+	}
+	return cond
+}
+
+func (p *parser) parseCoalesce() node {
+	left := p.parseOr()
+	for tok := p.tok; p.acceptPunct("??"); tok = p.tok {
+		left = &binary{p: tok.pos, op: "??", x: left, y: p.parseOr()}
+	}
+	return left
+}
+
+func (p *parser) parseOr() node {
+	left := p.parseAnd()
+	for tok := p.tok; p.acceptPunct("||") || p.acceptKeyword("or"); tok = p.tok {
+		left = &binary{p: tok.pos, op: "||", x: left, y: p.parseAnd()}
+	}
+	return left
+}
+
+func (p *parser) parseAnd() node {
+	left := p.parseNot()
+	for tok := p.tok; p.acceptPunct("&&") || p.acceptKeyword("and"); tok = p.tok {
+		left = &binary{p: tok.pos, op: "&&", x: left, y: p.parseNot()}
+	}
+	return left
+}
+
+func (p *parser) parseNot() node {
+	if tok := p.tok; p.acceptKeyword("not") {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxDepth {
+			p.fail(tok.pos, "expression nested too deeply")
+		}
+		return &unary{p: tok.pos, op: "!", x: p.parseNot()}
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() node {
+	left := p.parseSum()
+	tok := p.tok
+	if (tok.kind != tokPunct && tok.kind != tokIdent) || !slices.Contains(comparisons, tok.text) {
+		return left
+	}
+	p.advance()
+	n := &binary{p: tok.pos, op: tok.text, x: left, y: p.parseSum()}
+
+	if pattern, ok := n.y.(*literal); ok && n.op == "matches" {
+		s, ok := pattern.value.(string)
+		if !ok {
+			p.fail(pattern.p, "matches requires a regular expression string")
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			p.fail(pattern.p, "invalid regular expression: %v", err)
+		}
+		n.re = re
+	}
+
+	if next := p.tok; (next.kind == tokPunct || next.kind == tokIdent) && slices.Contains(comparisons, next.text) {
+		p.fail(next.pos, "comparisons can't be chained, use parentheses")
+	}
+	return n
+}
+
+func (p *parser) parseSum() node {
+	left := p.parseProduct()
+	for {
+		tok := p.tok
+		if !p.acceptPunct("+") && !p.acceptPunct("-") {
+			return left
+		}
+		left = &binary{p: tok.pos, op: tok.text, x: left, y: p.parseProduct()}
+	}
+}
+
+func (p *parser) parseProduct() node {
+	left := p.parseUnary()
+	for {
+		tok := p.tok
+		if !p.acceptPunct("*") && !p.acceptPunct("/") && !p.acceptPunct("%") {
+			return left
+		}
+		left = &binary{p: tok.pos, op: tok.text, x: left, y: p.parseUnary()}
+	}
+}
+
+func (p *parser) parseUnary() node {
+	tok := p.tok
+	if !p.acceptPunct("-") && !p.acceptPunct("!") {
+		return p.parsePostfix(p.parsePrimary())
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		p.fail(tok.pos, "expression nested too deeply")
+	}
+	x := p.parseUnary()
+	if n, ok := x.(*literal); ok && tok.text == "-" {
+		if f, ok := n.value.(float64); ok {
+			return &literal{p: tok.pos, value: -f}
+		}
+	}
+	return &unary{p: tok.pos, op: tok.text, x: x}
+}
+
+// parsePostfix parses the keys and indexes following x.
+func (p *parser) parsePostfix(x node) node {
+	for {
+		tok := p.tok
+		switch {
+		case p.acceptPunct("."):
+			key := p.tok
+			switch key.kind {
+			case tokIdent:
+				x = &member{p: key.pos, x: x, key: key.text}
+			case tokNumber:
+				x = &index{p: key.pos, x: x, index: &literal{p: key.pos, value: key.num}}
+			default:
+				p.fail(key.pos, "expected a key after \".\", found %s", key.describe())
+			}
+			p.advance()
+		case p.acceptPunct("["):
+			i := p.parseExpr()
+			p.expectPunct("]")
+			x = &index{p: tok.pos, x: x, index: i}
+		default:
+			return x
+		}
+	}
+}
+
+func (p *parser) parsePrimary() node {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		p.advance()
+		return &literal{p: tok.pos, value: tok.num}
+
+	case tokString:
+		p.advance()
+		return &literal{p: tok.pos, value: tok.text}
+
+	case tokIdent:
+		switch tok.text {
+		case "true", "false":
+			p.advance()
+			return &literal{p: tok.pos, value: tok.text == "true"}
+		case "null":
+			p.advance()
+			return &literal{p: tok.pos, value: nil}
+		}
+		if slices.Contains(keywords, tok.text) {
+			break
+		}
+		p.advance()
+		if !p.acceptPunct("(") {
+			return &ident{p: tok.pos, name: tok.text}
+		}
+		if tok.text == "exists" {
+			return p.parseExists(tok)
+		}
+		return p.parseCall(tok)
+
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			p.advance()
+			x := p.parseExpr()
+			p.expectPunct(")")
+			return x
+
+		case "[":
+			p.advance()
+			l := &list{p: tok.pos}
+			for !p.acceptPunct("]") {
+				l.items = append(l.items, p.parseExpr())
+				if !p.acceptPunct(",") {
+					p.expectPunct("]")
+					break
+				}
+			}
+			return l
+
+		case "{":
+			p.advance()
+			o := &object{p: tok.pos}
+			for !p.acceptPunct("}") {
+				key := p.tok
+				if key.kind != tokIdent && key.kind != tokString {
+					p.fail(key.pos, "expected a key, found %s", key.describe())
+				}
+				if slices.Contains(o.keys, key.text) {
+					p.fail(key.pos, "duplicate key %q", key.text)
+				}
+				p.advance()
+				p.expectPunct(":")
+				o.keys = append(o.keys, key.text)
+				o.values = append(o.values, p.parseExpr())
+				if !p.acceptPunct(",") {
+					p.expectPunct("}")
+					break
+				}
+			}
+			return o
+		}
+	}
+
+	p.fail(tok.pos, "expected a value, found %s", tok.describe())
+	return nil
+}
+
+// parseExists parses exists(path), once past its parenthesis.
+func (p *parser) parseExists(name token) node {
+	path := p.parseExpr()
+	if !isPath(path) {
+		p.fail(path.pos(), "exists requires a path, e.g. exists(payload.value)")
+	}
+	p.expectPunct(")")
+	return &exists{p: name.pos, path: path}
+}
+
+// parseCall parses the arguments of a function call, once past its parenthesis.
+func (p *parser) parseCall(name token) node {
+	fn, ok := functions[name.text]
+	if !ok {
+		p.fail(name.pos, "unknown function %s", name.text)
+	}
+
+	c := &call{p: name.pos, name: name.text, fn: fn}
+	for !p.acceptPunct(")") {
+		if fn.lambda && len(c.args) == 1 {
+			c.args = append(c.args, p.parseLambda())
+		} else {
+			c.args = append(c.args, p.parseExpr())
+		}
+		if !p.acceptPunct(",") {
+			p.expectPunct(")")
+			break
+		}
+	}
+
+	if len(c.args) < fn.min || (fn.max >= 0 && len(c.args) > fn.max) {
+		p.fail(name.pos, "wrong number of arguments, usage: %s", fn.usage)
+	}
+	return c
+}
+
+func (p *parser) parseLambda() node {
+	param := p.tok
+	if param.kind != tokIdent || slices.Contains(keywords, param.text) {
+		p.fail(param.pos, "expected a lambda such as x => x.value, found %s", param.describe())
+	}
+	p.advance()
+	p.expectPunct("=>")
+	return &lambda{p: param.pos, param: param.text, body: p.parseExpr()}
+}
+
+// isPath reports whether n is a name followed by keys and indexes.
+func isPath(n node) bool {
+	switch n := n.(type) {
+	case *ident:
+		return true
+	case *member:
+		return isPath(n.x)
+	case *index:
+		return isPath(n.x)
+	}
+	return false
+}
+
+func (p *parser) advance() {
+	tok, err := p.lex.next()
+	if err != nil {
+		panic(parseError{err.(*Error)})
+	}
+	p.tok = tok
+}
+
+func (p *parser) acceptPunct(punct string) bool {
+	if p.tok.kind == tokPunct && p.tok.text == punct {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.tok.kind == tokIdent && p.tok.text == keyword {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectPunct(punct string) {
+	if !p.acceptPunct(punct) {
+		p.fail(p.tok.pos, "expected %q, found %s", punct, p.tok.describe())
+	}
+}
+
+func (p *parser) fail(at int, format string, args ...any) {
+	panic(parseError{&Error{Pos: at, Msg: fmt.Sprintf(format, args...)}})
+}
+
+// walk calls fn with every node of the tree rooted at n, and the lambda
+// parameters bound where the node is.
+func walk(n node, bound []string, fn func(node, []string)) {
+	fn(n, bound)
+	switch n := n.(type) {
+	case *member:
+		walk(n.x, bound, fn)
+	case *index:
+		walk(n.x, bound, fn)
+		walk(n.index, bound, fn)
+	case *list:
+		for _, item := range n.items {
+			walk(item, bound, fn)
+		}
+	case *object:
+		for _, value := range n.values {
+			walk(value, bound, fn)
+		}
+	case *unary:
+		walk(n.x, bound, fn)
+	case *binary:
+		walk(n.x, bound, fn)
+		walk(n.y, bound, fn)
+	case *conditional:
+		walk(n.cond, bound, fn)
+		walk(n.then, bound, fn)
+		walk(n.otherwise, bound, fn)
+	case *exists:
+		walk(n.path, bound, fn)
+	case *call:
+		for _, arg := range n.args {
+			walk(arg, bound, fn)
+		}
+	case *lambda:
+		walk(n.body, append(slices.Clip(bound), n.param), fn)
+	}
+}
@@ -0,0 +1,101 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a string with embedded expressions between {{ and }}, e.g.
+// "{{ payload.value }} degrees in {{ upper(tokens[1]) }}".
+type Template struct {
+	src   string
+	parts []Part
+}
+
+// Part is a piece of a template, either literal text or an expression.
+type Part struct {
+	Text string
+	Expr *Expr
+}
+
+// ParseTemplate parses a template. Names restrict the names its expressions
+// may refer to, as with Compile. Error positions are offsets in src.
+func ParseTemplate(src string, names ...string) (*Template, error) {
+	t := &Template{src: src}
+	rest := 0
+	for rest < len(src) {
+		start := strings.Index(src[rest:], "{{")
+		if start < 0 {
+			t.parts = append(t.parts, Part{Text: src[rest:]})
+			break
+		}
+		start += rest
+		if start > rest {
+			t.parts = append(t.parts, Part{Text: src[rest:start]})
+		}
+
+		p := newParser(src, start+2)
+		root, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		end := p.tok.pos
+		if p.tok.kind != tokPunct || !strings.HasPrefix(src[end:], "}}") {
+			return nil, &Error{Pos: end, Msg: fmt.Sprintf("expected \"}}\" after the expression, found %s", p.tok.describe())}
+		}
+		if len(names) > 0 {
+			if err := checkNames(root, names, nil); err != nil {
+				return nil, err
+			}
+		}
+		t.parts = append(t.parts, Part{Expr: &Expr{src: strings.TrimSpace(src[start+2 : end]), root: root}})
+		rest = end + 2
+	}
+	return t, nil
+}
+
+// String returns the source of the template.
+func (t *Template) String() string {
+	return t.src
+}
+
+// Parts returns the literal texts and expressions of the template, in order.
+func (t *Template) Parts() []Part {
+	return t.parts
+}
+
+// IsLiteral reports whether the template has no expression.
+func (t *Template) IsLiteral() bool {
+	for _, part := range t.parts {
+		if part.Expr != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Render evaluates the expressions of the template on env with the default
+// limits. A template made of a single expression returns its value, keeping
+// its type, others return a string where values are formatted with String.
+func (t *Template) Render(env map[string]any) (any, error) {
+	if len(t.parts) == 1 && t.parts[0].Expr != nil {
+		return t.parts[0].Expr.Eval(env)
+	}
+
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.Expr == nil {
+			b.WriteString(part.Text)
+			continue
+		}
+		value, err := part.Expr.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(String(value))
+		if b.Len() > DefaultLimits.Size {
+			return nil, &Error{Pos: part.Expr.root.pos(), Msg: fmt.Sprintf("value larger than %d", DefaultLimits.Size), Err: ErrLimit}
+		}
+	}
+	return b.String(), nil
+}
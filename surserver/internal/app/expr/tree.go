@@ -0,0 +1,147 @@
+package expr
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NodeKind is the kind of a Node.
+type NodeKind int
+
+const (
+	LiteralNode NodeKind = iota
+	NameNode
+	// a.key
+	MemberNode
+	// a[index]
+	IndexNode
+	ListNode
+	ObjectNode
+	UnaryNode
+	BinaryNode
+	// c ? a : b
+	ConditionalNode
+	// exists(path)
+	ExistsNode
+	CallNode
+	// x => body, as an argument of a call
+	LambdaNode
+)
+
+// Node is a node of the syntax tree of an expression, for the languages
+// embedding expressions to check them.
+type Node struct {
+	Kind NodeKind
+	// Byte offset in the source: that of the key of members, of the bracket of
+	// indexes, of the operator of unary, binary and conditional nodes
+	Pos int
+	// Literals: string, float64, bool or nil
+	Value any
+	// Names, keys of members, functions of calls and parameters of lambdas
+	Name string
+	// Unary and binary operators, "!", "&&" and "||" standing for not, and
+	// and or
+	Op string
+	// Keys of objects, in order
+	Keys []string
+	// Operands: the object and index of indexes, the items of lists, the
+	// values of objects, the condition and both values of conditionals, the
+	// arguments of calls, and the only operand of other nodes
+	Children []*Node
+}
+
+// Tree returns the syntax tree of the expression.
+func (e *Expr) Tree() *Node {
+	return tree(e.root)
+}
+
+func tree(n node) *Node {
+	t := &Node{Pos: n.pos()}
+	switch n := n.(type) {
+	case *literal:
+		t.Kind, t.Value = LiteralNode, n.value
+	case *ident:
+		t.Kind, t.Name = NameNode, n.name
+	case *member:
+		t.Kind, t.Name, t.Children = MemberNode, n.key, trees(n.x)
+	case *index:
+		t.Kind, t.Children = IndexNode, trees(n.x, n.index)
+	case *list:
+		t.Kind, t.Children = ListNode, trees(n.items...)
+	case *object:
+		t.Kind, t.Keys, t.Children = ObjectNode, n.keys, trees(n.values...)
+	case *unary:
+		t.Kind, t.Op, t.Children = UnaryNode, n.op, trees(n.x)
+	case *binary:
+		t.Kind, t.Op, t.Children = BinaryNode, n.op, trees(n.x, n.y)
+	case *conditional:
+		t.Kind, t.Children = ConditionalNode, trees(n.cond, n.then, n.otherwise)
+	case *exists:
+		t.Kind, t.Children = ExistsNode, trees(n.path)
+	case *call:
+		t.Kind, t.Name, t.Children = CallNode, n.name, trees(n.args...)
+	case *lambda:
+		t.Kind, t.Name, t.Children = LambdaNode, n.param, trees(n.body)
+	}
+	return t
+}
+
+func trees(nodes ...node) []*Node {
+	out := make([]*Node, len(nodes))
+	for i, n := range nodes {
+		out[i] = tree(n)
+	}
+	return out
+}
+
+// String returns the node as an expression, binary and conditional nodes
+// being parenthesized.
+func (n *Node) String() string {
+	switch n.Kind {
+	case LiteralNode:
+		switch value := n.Value.(type) {
+		case string:
+			return strconv.Quote(value)
+		case float64:
+			return strconv.FormatFloat(value, 'g', -1, 64)
+		case bool:
+			return strconv.FormatBool(value)
+		}
+		return "null"
+	case NameNode:
+		return n.Name
+	case MemberNode:
+		return n.Children[0].String() + "." + n.Name
+	case IndexNode:
+		return n.Children[0].String() + "[" + n.Children[1].String() + "]"
+	case ListNode:
+		return "[" + joinNodes(n.Children) + "]"
+	case ObjectNode:
+		fields := make([]string, len(n.Keys))
+		for i, key := range n.Keys {
+			fields[i] = strconv.Quote(key) + ": " + n.Children[i].String()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case UnaryNode:
+		return n.Op + n.Children[0].String()
+	case BinaryNode:
+		return "(" + n.Children[0].String() + " " + n.Op + " " + n.Children[1].String() + ")"
+	case ConditionalNode:
+		return "(" + n.Children[0].String() + " ? " + n.Children[1].String() + " : " + n.Children[2].String() + ")"
+	case ExistsNode:
+		return "exists(" + n.Children[0].String() + ")"
+	case CallNode:
+		return n.Name + "(" + joinNodes(n.Children) + ")"
+	case LambdaNode:
+		return n.Name + " => " + n.Children[0].String()
+	}
+	return "null"
+}
+
+func joinNodes(nodes []*Node) string {
+	texts := make([]string, len(nodes))
+	for i, n := range nodes {
+		texts[i] = n.String()
+	}
+	return strings.Join(texts, ", ")
+}
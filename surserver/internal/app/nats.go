@@ -3,8 +3,8 @@ package app
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	natsserver "github.com/nats-io/nats-server/v2/server"
@@ -18,8 +18,10 @@ func startEmbeddedNatsServer(appName string, opts NATSConfig) (*natsserver.Serve
 	}
 
 	serverOpts := &natsserver.Options{
-		ServerName:      fmt.Sprintf("%s-nats-server", appName),
-		DontListen:      opts.Private,
+		ServerName: fmt.Sprintf("%s-nats-server", appName),
+		DontListen: opts.Private,
+		// Signals are handled by surserver, which stops the plugins first
+		NoSigs:          true,
 		JetStream:       true,
 		JetStreamDomain: appName,
 		Host:            host,
@@ -45,16 +47,24 @@ func startEmbeddedNatsServer(appName string, opts NATSConfig) (*natsserver.Serve
 	return ns, nil
 }
 
-func splitHostPort(url string) (string, int, error) {
-	address := strings.Split(url, "//")[1]
-	host, portStr, err := net.SplitHostPort(address)
+// splitHostPort returns the host and port of a NATS URL such as nats://127.0.0.1:4222
+func splitHostPort(natsURL string) (string, int, error) {
+	u, err := url.Parse(natsURL)
 	if err != nil {
-		return "", 0, err
+		return "", 0, fmt.Errorf("invalid NATS URL %q: %w", natsURL, err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return "", 0, fmt.Errorf("invalid NATS URL %q: scheme must be nats or tls", natsURL)
 	}
 
-	port, err := strconv.Atoi(portStr)
+	host, portStr, err := net.SplitHostPort(u.Host)
 	if err != nil {
-		return "", 0, err
+		return "", 0, fmt.Errorf("invalid NATS URL %q: %w", natsURL, err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid NATS URL %q: invalid port", natsURL)
 	}
 
 	return host, port, nil
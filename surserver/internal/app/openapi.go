@@ -0,0 +1,209 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON schema, as embedded in the OpenAPI document.
+type Schema map[string]any
+
+// route is a registered HTTP handler, kept to build the OpenAPI document.
+type route struct {
+	module string
+	HTTPHandler
+}
+
+var pathParamRe = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)(\.\.\.)?\}`)
+
+// openAPIDocument builds an OpenAPI 3 document describing the registered routes.
+func (a *App) openAPIDocument() map[string]any {
+	paths := make(map[string]map[string]any)
+
+	for _, r := range a.routes {
+		// OpenAPI has no remainder wildcard: "{name...}" is documented as "{name}"
+		path := pathParamRe.ReplaceAllString(r.Path, "{$1}")
+		method := strings.ToLower(r.Method)
+		if method == "" {
+			method = "get"
+		}
+
+		operation := map[string]any{
+			"summary":     r.Summary,
+			"operationId": operationID(method, r.Path),
+			"responses":   responsesFor(r.HTTPHandler),
+		}
+		if r.module != "" {
+			operation["tags"] = []string{r.module}
+		}
+
+		var params []map[string]any
+		for _, m := range pathParamRe.FindAllStringSubmatch(r.Path, -1) {
+			param := map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   Schema{"type": "string"},
+			}
+			if m[2] != "" {
+				param["description"] = "Remainder of the path, may contain slashes"
+			}
+			params = append(params, param)
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+
+		if r.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": r.Request}},
+			}
+		}
+
+		if r.Auth {
+			operation["security"] = []map[string][]string{
+				{"apiKey": {}},
+				{"signature": {}},
+				{"bearer": {}},
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][method] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   a.config.Name,
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"apiKey":    map[string]any{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"signature": map[string]any{"type": "apiKey", "in": "header", "name": SignatureHeader},
+				"bearer":    map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+func responsesFor(handler HTTPHandler) map[string]any {
+	ok := map[string]any{"description": "Success"}
+	if handler.Response != nil {
+		contentType := "application/json"
+		if handler.Response["type"] == "string" {
+			contentType = "text/plain"
+		}
+		ok["content"] = map[string]any{contentType: map[string]any{"schema": handler.Response}}
+	}
+
+	status := handler.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	responses := map[string]any{strconv.Itoa(status): ok}
+	if handler.Request != nil {
+		responses["400"] = map[string]any{"description": "Invalid request"}
+	}
+	if handler.Auth {
+		responses["401"] = map[string]any{"description": "Missing or invalid credentials"}
+		responses["403"] = map[string]any{"description": "Forbidden"}
+	}
+	return responses
+}
+
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return !isAlphaNum(r) }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func isAlphaNum(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// openAPIHandler serves the OpenAPI document
+func (a *App) openAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	a.mu.RLock()
+	doc := a.openAPIDocument()
+	a.mu.RUnlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(doc)
+}
+
+// docsHandler serves a page rendering the OpenAPI document
+func docsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(docsPage))
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API documentation</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; color: #222; }
+.op { border: 1px solid #ddd; border-radius: 4px; margin: 1em 0; padding: 0.5em 1em; }
+.method { display: inline-block; min-width: 4em; font-weight: bold; text-transform: uppercase; }
+.path { font-family: monospace; font-size: 1.1em; }
+.tag { color: #888; float: right; }
+.lock { color: #b60; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1 id="title">API documentation</h1>
+<p>Raw document: <a href="/openapi.json">/openapi.json</a></p>
+<div id="ops"></div>
+<script>
+fetch("/openapi.json").then(r => r.json()).then(doc => {
+  document.getElementById("title").textContent = doc.info.title + " API";
+  const ops = document.getElementById("ops");
+  Object.keys(doc.paths).sort().forEach(path => {
+    Object.entries(doc.paths[path]).forEach(([method, op]) => {
+      const div = document.createElement("div");
+      div.className = "op";
+      const head = document.createElement("div");
+      head.innerHTML = '<span class="method"></span> <span class="path"></span> <span class="lock"></span><span class="tag"></span><p class="summary"></p>';
+      head.querySelector(".method").textContent = method;
+      head.querySelector(".path").textContent = path;
+      head.querySelector(".lock").textContent = op.security ? "(authenticated)" : "";
+      head.querySelector(".tag").textContent = (op.tags || []).join(", ");
+      head.querySelector(".summary").textContent = op.summary || "";
+      div.appendChild(head);
+      const schemas = [];
+      if (op.requestBody) schemas.push(["Request", op.requestBody.content["application/json"].schema]);
+      Object.entries(op.responses).forEach(([code, resp]) => {
+        Object.values(resp.content || {}).forEach(c => schemas.push(["Response " + code, c.schema]));
+      });
+      schemas.forEach(([label, schema]) => {
+        const title = document.createElement("strong");
+        title.textContent = label;
+        const pre = document.createElement("pre");
+        pre.textContent = JSON.stringify(schema, null, 2);
+        div.appendChild(title);
+        div.appendChild(pre);
+      });
+      ops.appendChild(div);
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,340 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lstep/surroundhome/pkg/secrets"
+)
+
+// Environment variables passed to plugins
+const (
+	PluginNATSURLEnv = "SURROUNDHOME_NATS_URL"
+	PluginNameEnv    = "SURROUNDHOME_PLUGIN_NAME"
+	// Config of the plugin, as JSON
+	PluginConfigEnv = "SURROUNDHOME_PLUGIN_CONFIG"
+)
+
+const (
+	defaultPluginBackoff    = time.Second
+	defaultPluginMaxBackoff = time.Minute
+	// How long a plugin has to exit once asked to, before being killed
+	pluginStopTimeout = 10 * time.Second
+)
+
+// States of a plugin process
+const (
+	PluginStarting = "starting"
+	PluginRunning  = "running"
+	// Waiting to be restarted after exiting or failing to start
+	PluginBackoff = "backoff"
+	PluginStopped = "stopped"
+)
+
+// PluginStatus describes a plugin process.
+type PluginStatus struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	PID      int       `json:"pid,omitempty"`
+	Restarts int       `json:"restarts"`
+	Since    time.Time `json:"since"`
+	Required bool      `json:"required"`
+	// Why the plugin last exited, if it did
+	LastError string `json:"last_error,omitempty"`
+}
+
+// plugin supervises the process of a plugin, restarting it until stopped.
+type plugin struct {
+	name    string
+	config  PluginConfig
+	natsURL string
+	logger  *slog.Logger
+
+	mu     sync.Mutex
+	status PluginStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// supervisor runs the plugins of the configuration.
+type supervisor struct {
+	natsURL string
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	plugins map[string]*plugin
+}
+
+func newSupervisor(natsURL string, logger *slog.Logger) *supervisor {
+	return &supervisor{
+		natsURL: natsURL,
+		logger:  logger,
+		plugins: make(map[string]*plugin),
+	}
+}
+
+// apply starts, restarts and stops plugins so that the supervisor runs the
+// plugins of configs, and reports what it did.
+func (s *supervisor) apply(configs map[string]PluginConfig, report *ReloadReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stopped := make(map[string]bool)
+	for _, name := range mapKeys(s.plugins) {
+		p := s.plugins[name]
+		if config, ok := configs[name]; ok && reflect.DeepEqual(config, p.config) {
+			continue
+		}
+		p.stop()
+		delete(s.plugins, name)
+		stopped[name] = true
+	}
+
+	for _, name := range mapKeys(configs) {
+		if _, ok := s.plugins[name]; ok {
+			continue
+		}
+		p := &plugin{
+			name:    name,
+			config:  configs[name],
+			natsURL: s.natsURL,
+			logger:  s.logger.With("plugin", name),
+		}
+		p.start()
+		s.plugins[name] = p
+		if report != nil && stopped[name] {
+			report.applied("plugins.%s: restarted", name)
+		} else if report != nil {
+			report.applied("plugins.%s: started", name)
+		}
+		delete(stopped, name)
+	}
+
+	if report != nil {
+		for _, name := range mapKeys(stopped) {
+			report.applied("plugins.%s: stopped", name)
+		}
+	}
+}
+
+// stop stops every plugin.
+func (s *supervisor) stop() {
+	s.apply(nil, nil)
+}
+
+// statuses returns the status of the plugins, sorted by name.
+func (s *supervisor) statuses() []PluginStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]PluginStatus, 0, len(s.plugins))
+	for _, name := range mapKeys(s.plugins) {
+		statuses = append(statuses, s.plugins[name].getStatus())
+	}
+	return statuses
+}
+
+func (p *plugin) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	p.setStatus(PluginStarting, 0, nil)
+	go p.supervise(ctx)
+}
+
+// stop asks the plugin to exit and waits for it.
+func (p *plugin) stop() {
+	p.cancel()
+	<-p.done
+}
+
+// supervise runs the plugin until ctx is canceled, restarting it with an
+// exponential backoff whenever it exits.
+func (p *plugin) supervise(ctx context.Context) {
+	defer close(p.done)
+
+	backoff := p.config.backoff()
+	for {
+		startedAt := time.Now()
+		err := p.run(ctx)
+		if ctx.Err() != nil {
+			p.setStatus(PluginStopped, 0, nil)
+			p.logger.Info("Plugin stopped")
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+
+		// A plugin that ran for a while is restarted promptly
+		if time.Since(startedAt) > p.config.maxBackoff() {
+			backoff = p.config.backoff()
+		}
+		p.setStatus(PluginBackoff, 0, err)
+		p.logger.Error("Plugin exited, restarting", "error", err, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			p.setStatus(PluginStopped, 0, err)
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, p.config.maxBackoff())
+
+		p.mu.Lock()
+		p.status.Restarts++
+		p.mu.Unlock()
+	}
+}
+
+// run starts the plugin process and waits for it to exit.
+func (p *plugin) run(ctx context.Context) error {
+	pluginConfig, err := json.Marshal(p.config.Config)
+	if err != nil {
+		return fmt.Errorf("error encoding config: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, p.config.Command, p.config.Args...)
+	cmd.Dir = p.config.Dir
+	cmd.Env = append(os.Environ(),
+		PluginNATSURLEnv+"="+p.natsURL,
+		PluginNameEnv+"="+p.name,
+		PluginConfigEnv+"="+string(pluginConfig),
+	)
+	for _, key := range mapKeys(p.config.Env) {
+		cmd.Env = append(cmd.Env, strings.ToUpper(key)+"="+p.config.Env[key])
+	}
+	// Let the plugin drain its NATS connection before killing it
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = pluginStopTimeout
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	p.logger.Info("Starting plugin", "command", p.config.Command)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.setStatus(PluginRunning, cmd.Process.Pid, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go p.forwardLogs(&wg, stdout, "stdout")
+	go p.forwardLogs(&wg, stderr, "stderr")
+	wg.Wait()
+
+	return cmd.Wait()
+}
+
+// Maximum length of the lines of output of plugins, longer lines are dropped
+const maxLogLineSize = 1024 * 1024
+
+// forwardLogs writes the lines of output to the surserver logger, until the
+// output is closed.
+func (p *plugin) forwardLogs(wg *sync.WaitGroup, output io.Reader, stream string) {
+	defer wg.Done()
+
+	reader := bufio.NewReaderSize(output, 64*1024)
+	var line []byte
+	size := 0
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		// Lines too long are still read, not to block the plugin on a full pipe
+		size += len(chunk)
+		if size <= maxLogLineSize {
+			line = append(line, chunk...)
+		}
+		if isPrefix {
+			continue
+		}
+		if size > maxLogLineSize {
+			p.logger.Warn("Dropped a line of output too long", "stream", stream, "size", size)
+		} else {
+			p.logLine(secrets.Redact(string(line)), stream)
+		}
+		line, size = line[:0], 0
+	}
+}
+
+// logLine writes a line of output to the surserver logger. Lines logged as
+// JSON by slog, like the plugins of this repository do, keep their level,
+// message and attributes.
+func (p *plugin) logLine(line, stream string) {
+	var record map[string]any
+	if json.Unmarshal([]byte(line), &record) == nil {
+		var level slog.Level
+		levelText, _ := record[slog.LevelKey].(string)
+		if level.UnmarshalText([]byte(levelText)) == nil {
+			msg, _ := record[slog.MessageKey].(string)
+			attrs := []any{"stream", stream}
+			for _, key := range mapKeys(record) {
+				// The logger of the plugin already has its name
+				if key != slog.LevelKey && key != slog.MessageKey && key != slog.TimeKey && key != "plugin" {
+					attrs = append(attrs, key, record[key])
+				}
+			}
+			p.logger.Log(context.Background(), level, msg, attrs...)
+			return
+		}
+	}
+
+	p.logger.Info(line, "stream", stream)
+}
+
+func (p *plugin) setStatus(state string, pid int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.status.Name = p.name
+	p.status.State = state
+	p.status.PID = pid
+	p.status.Since = time.Now()
+	if err != nil {
+		p.status.LastError = err.Error()
+	}
+}
+
+func (p *plugin) getStatus() PluginStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := p.status
+	status.Required = p.config.Required
+	return status
+}
+
+func (c PluginConfig) backoff() time.Duration {
+	if c.Backoff > 0 {
+		return c.Backoff
+	}
+	return defaultPluginBackoff
+}
+
+func (c PluginConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return max(c.MaxBackoff, c.backoff())
+	}
+	return max(defaultPluginMaxBackoff, c.backoff())
+}
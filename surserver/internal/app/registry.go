@@ -0,0 +1,98 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Factory creates an instance of a module type, called name. The instance must
+// return name from Module.Name.
+type Factory func(name string) Module
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+// Register makes a module type available to the configuration. It is meant to
+// be called from the init function of the package of the module, which is then
+// linked in with a blank import. Registering a type twice panics.
+func Register(moduleType string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if factory == nil {
+		panic("app: Register factory is nil for module type " + moduleType)
+	}
+	if _, dup := registry[moduleType]; dup {
+		panic("app: Register called twice for module type " + moduleType)
+	}
+	registry[moduleType] = factory
+}
+
+// ModuleTypes returns the sorted names of the registered module types.
+func ModuleTypes() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	return mapKeys(registry)
+}
+
+// NewModules instantiates the modules of the configuration, sorted by name.
+//
+// Each entry of Modules is an instance of the type given by its type key, which
+// defaults to the name of the entry, so the same type can be instantiated
+// several times under different names. Registered types without an entry are
+// not instantiated, so that no endpoint is served without being configured.
+func NewModules(config *Config) ([]Module, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	types := make(map[string]string)
+	for name, modConfig := range config.Modules {
+		types[name] = modConfig.moduleType(name)
+	}
+
+	var errs ValidationErrors
+	modules := make([]Module, 0, len(types))
+	known := mapKeys(registry)
+	for _, name := range mapKeys(types) {
+		factory, ok := registry[types[name]]
+		if !ok {
+			path := "modules." + name
+			if config.Modules[name].Type != "" {
+				path += ".type"
+			}
+			msg := fmt.Sprintf("unknown module type %q, known types are: %s", types[name], strings.Join(known, ", "))
+			if suggestion := closest(types[name], known); suggestion != "" {
+				msg = fmt.Sprintf("unknown module type %q, did you mean %q?", types[name], suggestion)
+			}
+			errs.add(path, "%s", msg)
+			continue
+		}
+		modules = append(modules, factory(name))
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return modules, nil
+}
+
+// newModule instantiates the module configured under name, whose type must
+// be registered.
+func newModule(name string, modConfig ModuleConfig) Module {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	return registry[modConfig.moduleType(name)](name)
+}
+
+// moduleType returns the type of the module configured under name.
+func (c ModuleConfig) moduleType(name string) string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return name
+}
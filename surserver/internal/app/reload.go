@@ -0,0 +1,403 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes of the config file are applied once it has been quiet for that long,
+// as editors often write a file in several steps.
+const reloadDebounce = 500 * time.Millisecond
+
+// ReloadReport describes the outcome of a configuration reload.
+type ReloadReport struct {
+	Time     time.Time `json:"time"`
+	Applied  []string  `json:"applied"`
+	Rejected []string  `json:"rejected"`
+	// Error is set when the new configuration could not be loaded at all
+	Error string `json:"error,omitempty"`
+}
+
+var reloadReportSchema = Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"time":     Schema{"type": "string", "format": "date-time"},
+		"applied":  Schema{"type": "array", "items": Schema{"type": "string"}},
+		"rejected": Schema{"type": "array", "items": Schema{"type": "string"}},
+		"error":    Schema{"type": "string"},
+	},
+}
+
+// FilesProvider is implemented by modules that read files named in their
+// config. The files are watched along with the config files, and the module
+// is reinitialized when one of them changes.
+type FilesProvider interface {
+	// ConfigFiles returns the paths of the files read with config. They may be
+	// glob patterns, but only in their last element.
+	ConfigFiles(config map[string]any) []string
+}
+
+func (r *ReloadReport) applied(format string, args ...any) {
+	r.Applied = append(r.Applied, fmt.Sprintf(format, args...))
+}
+
+func (r *ReloadReport) rejected(format string, args ...any) {
+	r.Rejected = append(r.Rejected, fmt.Sprintf(format, args...))
+}
+
+// WatchConfig reloads the configuration whenever the file at path, a file of
+// the ConfDir directory next to it, or a file of a FilesProvider module changes.
+func (a *App) WatchConfig(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	confDir := filepath.Join(filepath.Dir(path), ConfDir)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating config watcher: %w", err)
+	}
+	// Watch the directory rather than the file, to survive editors replacing it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("error watching config file: %w", err)
+	}
+	// The directory is watched once it is created otherwise
+	if err := watcher.Add(confDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		watcher.Close()
+		return fmt.Errorf("error watching %s: %w", confDir, err)
+	}
+
+	a.mu.Lock()
+	a.configPath = path
+	a.stopWatch = make(chan struct{})
+	stop := a.stopWatch
+	a.watcher = watcher
+	a.watchModuleFiles()
+	a.mu.Unlock()
+
+	a.logger.Info("Watching config file for changes", "path", path)
+
+	go func() {
+		defer watcher.Close()
+		var debounce *time.Timer
+		for {
+			select {
+			case <-stop:
+				if debounce != nil {
+					debounce.Stop()
+				}
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(event.Name)
+				if name == confDir && event.Has(fsnotify.Create) {
+					if err := watcher.Add(confDir); err != nil {
+						a.logger.Error("Failed to watch config directory", "path", confDir, "error", err)
+					}
+				}
+				switch {
+				case name == path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename):
+				// Removing a file of the directory removes its modules
+				case name == confDir || (filepath.Dir(name) == confDir && filepath.Ext(name) == ".yaml"):
+				case a.isModuleFile(name):
+				default:
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(reloadDebounce, func() { a.Reload() })
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				a.logger.Error("Config watcher failed", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload loads the config files again and applies what changed.
+func (a *App) Reload() ReloadReport {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	a.mu.RLock()
+	path := a.configPath
+	a.mu.RUnlock()
+
+	if path == "" {
+		report := ReloadReport{Time: time.Now(), Error: "config file is not watched"}
+		a.recordReload(report)
+		return report
+	}
+
+	a.logger.Info("Reloading config", "path", path)
+	config, err := LoadConfig(path)
+	var modules map[string]Module
+	if err == nil {
+		modules, err = a.instantiate(config)
+	}
+	if err == nil {
+		err = config.Validate(modules)
+	}
+	if err != nil {
+		report := ReloadReport{Time: time.Now(), Error: err.Error()}
+		a.recordReload(report)
+		return report
+	}
+
+	return a.applyConfig(*config, modules)
+}
+
+// instantiate returns the modules of config, reusing the current instances of
+// the modules whose type did not change.
+func (a *App) instantiate(config *Config) (map[string]Module, error) {
+	instances, err := NewModules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	modules := make(map[string]Module, len(instances))
+	for _, module := range instances {
+		name := module.Name()
+		if current, ok := a.modules[name]; ok && reflect.TypeOf(current) == reflect.TypeOf(module) {
+			module = current
+		}
+		modules[name] = module
+	}
+	return modules, nil
+}
+
+// applyConfig applies a new configuration, and its modules, to the running
+// app. Settings that can't change at runtime are rejected and keep their
+// current value.
+func (a *App) applyConfig(config Config, modules map[string]Module) ReloadReport {
+	a.mu.Lock()
+	report := ReloadReport{Time: time.Now()}
+	current := a.config
+
+	// These are only read on start
+	if config.Name != current.Name {
+		report.rejected("name: requires a restart")
+		config.Name = current.Name
+	}
+	if config.NATS != current.NATS {
+		report.rejected("nats: requires a restart")
+		config.NATS = current.NATS
+	}
+	if config.HTTP != current.HTTP {
+		report.rejected("http: requires a restart")
+		config.HTTP = current.HTTP
+	}
+
+	if config.Log != current.Log {
+		if err := a.logLevel.UnmarshalText([]byte(config.Log.Level)); err != nil {
+			report.rejected("log.level: %v", err)
+			config.Log = current.Log
+		} else {
+			report.applied("log.level: %s", a.logLevel.Level())
+		}
+	}
+
+	if !reflect.DeepEqual(config.Auth, current.Auth) {
+		if auth, err := newAuthenticator(config.Auth); err != nil {
+			report.rejected("auth: %v", err)
+			config.Auth = current.Auth
+		} else {
+			a.auth = auth
+			report.applied("auth: updated")
+		}
+	}
+
+	// Applied once unlocked, stopping plugins takes a while
+	pluginsChanged := !reflect.DeepEqual(config.Plugins, current.Plugins)
+
+	// Drop the modules removed from the config, or replaced by another type
+	for _, name := range mapKeys(a.modules) {
+		if modules[name] == a.modules[name] {
+			continue
+		}
+		if _, isActive := a.active[name]; isActive {
+			a.stopModule(name)
+		}
+		report.applied("modules.%s: removed", name)
+	}
+	a.modules = modules
+
+	// Stop the disabled modules first, then start the enabled ones in dependency
+	// order. Validate made sure no enabled module depends on a disabled one.
+	for _, name := range mapKeys(a.modules) {
+		if _, isActive := a.active[name]; isActive && !config.ModuleEnabled(name) {
+			a.stopModule(name)
+			report.applied("modules.%s: disabled", name)
+		}
+	}
+
+	order, _ := startOrder(&config, a.modules)
+	for _, name := range order {
+		modConfig := config.Modules[name]
+		running, isActive := a.active[name]
+
+		switch {
+		case !isActive:
+			if dep := a.inactiveDependency(name); dep != "" {
+				report.rejected("modules.%s: module %s is not running", name, dep)
+				continue
+			}
+			if err := a.checkCapabilities(name, a.modules[name]); err != nil {
+				report.rejected("modules.%s: %v", name, err)
+				continue
+			}
+			if err := a.startModule(name, a.modules[name], modConfig); err != nil {
+				report.rejected("modules.%s: %v", name, err)
+				continue
+			}
+			report.applied("modules.%s: enabled", name)
+		case !reflect.DeepEqual(running.config, modConfig) || running.files != filesDigest(a.modules[name], modConfig.Config):
+			if err := a.restartModule(name, modConfig); err != nil {
+				if _, isActive := a.active[name]; !isActive {
+					report.rejected("modules.%s: %v, module stopped", name, err)
+					continue
+				}
+				report.rejected("modules.%s: %v", name, err)
+				// Keep track of the config the module is actually running with
+				if config.Modules == nil {
+					config.Modules = make(map[string]ModuleConfig)
+				}
+				config.Modules[name] = running.config
+				continue
+			}
+			report.applied("modules.%s: reinitialized", name)
+		}
+	}
+
+	a.config = config
+	a.buildRouter()
+	a.watchModuleFiles()
+	a.mu.Unlock()
+
+	if pluginsChanged {
+		a.plugins.apply(config.Plugins, &report)
+	}
+	a.recordReload(report)
+	return report
+}
+
+// watchModuleFiles watches the directories of the files of the active
+// modules. It must be called with a.mu held.
+func (a *App) watchModuleFiles() {
+	if a.watcher == nil {
+		return
+	}
+
+	a.watchedFiles = nil
+	for _, name := range mapKeys(a.active) {
+		provider, ok := a.modules[name].(FilesProvider)
+		if !ok {
+			continue
+		}
+		for _, pattern := range provider.ConfigFiles(a.active[name].config.Config) {
+			pattern, err := filepath.Abs(pattern)
+			if err != nil {
+				continue
+			}
+			a.watchedFiles = append(a.watchedFiles, pattern)
+			// Adding a directory already watched does nothing
+			if err := a.watcher.Add(filepath.Dir(pattern)); err != nil {
+				a.logger.Error("Failed to watch module files", "module", name, "path", pattern, "error", err)
+			}
+		}
+	}
+}
+
+// isModuleFile reports whether path is one of the files of the active modules.
+func (a *App) isModuleFile(path string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return slices.ContainsFunc(a.watchedFiles, func(pattern string) bool {
+		matched, _ := filepath.Match(pattern, path)
+		return matched
+	})
+}
+
+// filesDigest returns a digest of the files module reads with config, empty
+// if it reads none.
+func filesDigest(module Module, config map[string]any) string {
+	provider, ok := module.(FilesProvider)
+	if !ok {
+		return ""
+	}
+
+	hash := sha256.New()
+	for _, pattern := range provider.ConfigFiles(config) {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			data, err := os.ReadFile(match)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(hash, "%s\x00%d\x00", match, len(data))
+			hash.Write(data)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (a *App) recordReload(report ReloadReport) {
+	a.mu.Lock()
+	a.lastReload = &report
+	a.mu.Unlock()
+
+	switch {
+	case report.Error != "":
+		a.logger.Error("Config reload failed", "error", report.Error)
+	case len(report.Rejected) > 0:
+		a.logger.Warn("Config reloaded with rejected changes", "applied", report.Applied, "rejected", report.Rejected)
+	default:
+		a.logger.Info("Config reloaded", "applied", report.Applied)
+	}
+}
+
+// reloadStatusHandler reports the last configuration reload
+func (a *App) reloadStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	a.mu.RLock()
+	report := a.lastReload
+	a.mu.RUnlock()
+
+	if report == nil {
+		http.Error(w, "No reload yet", http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, http.StatusOK, report)
+}
+
+// reloadHandler reloads the configuration and reports what was applied
+func (a *App) reloadHandler(w http.ResponseWriter, _ *http.Request) {
+	report := a.Reload()
+	status := http.StatusOK
+	if report.Error != "" {
+		status = http.StatusUnprocessableEntity
+	}
+	WriteJSON(w, status, report)
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"regexp"
+	"strings"
+)
+
+// publishSubjectPattern matches the subjects messages can be published to,
+// see ValidPublishSubject.
+const publishSubjectPattern = `^[^$*>\s][^*>\s]*$`
+
+var publishSubjectRe = regexp.MustCompile(publishSubjectPattern)
+
+// ValidPublishSubject reports whether messages can be published to subject:
+// it has no wildcards nor whitespace, and isn't one of the system and
+// JetStream API subjects starting with "$". Configs check it with the
+// "subject" validate rule.
+func ValidPublishSubject(subject string) bool {
+	return publishSubjectRe.MatchString(subject)
+}
+
+// SubjectMatches reports whether subject matches pattern using the NATS
+// wildcard rules: "*" matches exactly one token and a trailing ">" matches
+// one or more tokens.
+func SubjectMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" {
+			return i == len(patternTokens)-1 && len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if token != "*" && token != subjectTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// SubjectsOverlap reports whether a subject could match both patterns a and
+// b, following the wildcard rules of SubjectMatches.
+func SubjectsOverlap(a, b string) bool {
+	aTokens := strings.Split(a, ".")
+	bTokens := strings.Split(b, ".")
+
+	for i := 0; i < len(aTokens) || i < len(bTokens); i++ {
+		switch {
+		case i < len(aTokens) && aTokens[i] == ">":
+			return i < len(bTokens)
+		case i < len(bTokens) && bTokens[i] == ">":
+			return i < len(aTokens)
+		case i >= len(aTokens) || i >= len(bTokens):
+			return false
+		case aTokens[i] != "*" && bTokens[i] != "*" && aTokens[i] != bTokens[i]:
+			return false
+		}
+	}
+	return true
+}
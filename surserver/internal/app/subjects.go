@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+var ErrUnknownSubjectScheme = errors.New("unknown subject scheme")
+
+// SubjectResolver is implemented by modules naming subjects, such as the
+// devices of a registry. References of the form <scheme>:<name>, e.g.
+// device:lamp, are resolved by the enabled module whose SubjectScheme is
+// scheme, see Publisher.ResolveSubject.
+type SubjectResolver interface {
+	SubjectScheme() string
+	// ResolveSubject returns the subject named name
+	ResolveSubject(name string) (string, error)
+}
+
+// Subject references: a scheme made of lowercase letters, then a name
+var subjectRefRe = regexp.MustCompile(`^([a-z]+):(.+)$`)
+
+// subjectResolvers are the resolvers of the enabled modules, by scheme.
+type subjectResolvers struct {
+	mu      sync.RWMutex
+	schemes map[string]SubjectResolver
+}
+
+func (r *subjectResolvers) add(resolver SubjectResolver) (replaced bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemes == nil {
+		r.schemes = make(map[string]SubjectResolver)
+	}
+	previous, ok := r.schemes[resolver.SubjectScheme()]
+	r.schemes[resolver.SubjectScheme()] = resolver
+	return ok && previous != resolver
+}
+
+func (r *subjectResolvers) remove(resolver SubjectResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemes[resolver.SubjectScheme()] == resolver {
+		delete(r.schemes, resolver.SubjectScheme())
+	}
+}
+
+// resolve returns the subject of ref, or ref itself when it is a subject.
+func (r *subjectResolvers) resolve(ref string) (string, error) {
+	match := subjectRefRe.FindStringSubmatch(ref)
+	if match == nil {
+		return ref, nil
+	}
+	r.mu.RLock()
+	resolver, ok := r.schemes[match[1]]
+	r.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w %q in %s", ErrUnknownSubjectScheme, match[1], ref)
+	}
+	subject, err := resolver.ResolveSubject(match[2])
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", ref, err)
+	}
+	return subject, nil
+}
+
+// ResolveSubject returns the subject referenced by ref, such as device:lamp,
+// see SubjectResolver. Other subjects are returned as they are.
+func (p *Publisher) ResolveSubject(ref string) (string, error) {
+	if p.subjects == nil {
+		return ref, nil
+	}
+	return p.subjects.resolve(ref)
+}
@@ -0,0 +1,386 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// TimersBucket is the JetStream key-value bucket keeping the pending timers.
+const TimersBucket = "timers"
+
+var (
+	ErrInvalidTimer  = errors.New("invalid timer")
+	ErrTimerNotFound = errors.New("timer not found")
+)
+
+// Keys of timers, which are keys of the bucket too
+var timerKeyRe = regexp.MustCompile(`^[-/_=a-zA-Z0-9]+(\.[-/_=a-zA-Z0-9]+)*$`)
+
+// Timer publishes a message when it is due.
+type Timer struct {
+	Key     string    `json:"key"`
+	Subject string    `json:"subject"`
+	Data    []byte    `json:"data,omitempty"`
+	Due     time.Time `json:"due"`
+	Created time.Time `json:"created"`
+}
+
+var timerSchema = Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"key":     Schema{"type": "string"},
+		"subject": Schema{"type": "string"},
+		"payload": Schema{},
+		"due":     Schema{"type": "string", "format": "date-time"},
+		"created": Schema{"type": "string", "format": "date-time"},
+	},
+}
+
+// Timers publishes messages after delays. Timers have keys, scheduling a
+// timer replaces the pending timer with the same key, so they can be
+// canceled and rescheduled, e.g. to turn a light off 10 minutes after the
+// last motion.
+//
+// Pending timers are kept in the TimersBucket bucket when JetStream is
+// available and restored when the app starts: the timers due while it was
+// stopped fire then.
+type Timers struct {
+	nc     *nats.Conn
+	kv     nats.KeyValue
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	pending map[string]*pendingTimer
+	stopped bool
+}
+
+type pendingTimer struct {
+	Timer
+	timer *time.Timer
+	// Revision of the timer in the bucket
+	revision uint64
+}
+
+// stopTimer stops the timer, not started once the timers are stopped.
+func (p *pendingTimer) stopTimer() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// newTimers returns the timers of the app, kept in kv unless it is nil.
+func newTimers(nc *nats.Conn, kv nats.KeyValue, logger *slog.Logger) *Timers {
+	return &Timers{nc: nc, kv: kv, logger: logger, pending: make(map[string]*pendingTimer)}
+}
+
+// Schedule publishes data to subject after a delay, replacing the pending
+// timer with the same key.
+func (t *Timers) Schedule(key, subject string, data []byte, after time.Duration) error {
+	if !timerKeyRe.MatchString(key) {
+		return fmt.Errorf("%w: key %q may only contain letters, digits and -/_=. characters", ErrInvalidTimer, key)
+	}
+	// System and JetStream API subjects can't be published to
+	if !ValidPublishSubject(subject) {
+		return fmt.Errorf("%w: invalid subject %q", ErrInvalidTimer, subject)
+	}
+	if after < 0 {
+		return fmt.Errorf("%w: negative delay %s", ErrInvalidTimer, after)
+	}
+
+	now := time.Now()
+	return t.set(Timer{Key: key, Subject: subject, Data: data, Due: now.Add(after), Created: now})
+}
+
+// Reschedule moves the pending timer with key to fire after a delay from now.
+func (t *Timers) Reschedule(key string, after time.Duration) error {
+	if after < 0 {
+		return fmt.Errorf("%w: negative delay %s", ErrInvalidTimer, after)
+	}
+	timer, ok := t.Get(key)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTimerNotFound, key)
+	}
+	timer.Due = time.Now().Add(after)
+	return t.set(timer)
+}
+
+// Cancel cancels the pending timer with key, reporting whether there was one.
+func (t *Timers) Cancel(key string) (bool, error) {
+	t.mu.Lock()
+	pending, ok := t.pending[key]
+	if ok {
+		pending.stopTimer()
+		delete(t.pending, key)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	if err := t.deleteKept(pending); err != nil {
+		return true, fmt.Errorf("deleting timer %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Get returns the pending timer with key.
+func (t *Timers) Get(key string) (Timer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending, ok := t.pending[key]
+	if !ok {
+		return Timer{}, false
+	}
+	return pending.Timer, true
+}
+
+// List returns the pending timers, the next due first.
+func (t *Timers) List() []Timer {
+	t.mu.Lock()
+	timers := make([]Timer, 0, len(t.pending))
+	for _, pending := range t.pending {
+		timers = append(timers, pending.Timer)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(timers, func(a, b Timer) int {
+		if c := a.Due.Compare(b.Due); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return timers
+}
+
+// set keeps timer and arms it, replacing the pending timer with its key.
+func (t *Timers) set(timer Timer) error {
+	var revision uint64
+	if t.kv != nil {
+		data, err := json.Marshal(timer)
+		if err != nil {
+			return err
+		}
+		if revision, err = t.kv.Put(timer.Key, data); err != nil {
+			return fmt.Errorf("keeping timer %s: %w", timer.Key, err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.arm(timer, revision)
+	return nil
+}
+
+// arm starts timer, unless the pending timer with its key was kept at a
+// later revision. It must be called with t.mu held.
+func (t *Timers) arm(timer Timer, revision uint64) {
+	if previous, ok := t.pending[timer.Key]; ok {
+		// Scheduled again since, the bucket holds the later timer
+		if t.kv != nil && previous.revision > revision {
+			return
+		}
+		previous.stopTimer()
+	}
+	pending := &pendingTimer{Timer: timer, revision: revision}
+	t.pending[timer.Key] = pending
+	if t.stopped {
+		return
+	}
+	pending.timer = time.AfterFunc(time.Until(timer.Due), func() { t.fire(pending) })
+}
+
+// fire publishes the message of a timer, unless it was canceled or replaced.
+func (t *Timers) fire(pending *pendingTimer) {
+	t.mu.Lock()
+	current := t.pending[pending.Key] == pending
+	if current {
+		delete(t.pending, pending.Key)
+	}
+	t.mu.Unlock()
+	if !current {
+		return
+	}
+
+	t.logger.Debug("timer fired", "key", pending.Key, "subject", pending.Subject)
+	if err := t.nc.Publish(pending.Subject, pending.Data); err != nil {
+		t.logger.Error("failed to publish timer", "key", pending.Key, "subject", pending.Subject, "error", err)
+	}
+	if err := t.deleteKept(pending); err != nil {
+		t.logger.Warn("failed to delete fired timer", "key", pending.Key, "error", err)
+	}
+}
+
+// deleteKept deletes a timer which is no longer pending from the bucket,
+// unless it was scheduled again since.
+func (t *Timers) deleteKept(pending *pendingTimer) error {
+	if t.kv == nil {
+		return nil
+	}
+	err := t.kv.Delete(pending.Key, nats.LastRevision(pending.revision))
+	// The key was written at a later revision
+	if errors.Is(err, nats.ErrKeyExists) {
+		return nil
+	}
+	return err
+}
+
+// restore arms the timers kept in the bucket, except those scheduled since
+// the app started.
+func (t *Timers) restore() error {
+	if t.kv == nil {
+		return nil
+	}
+	keys, err := t.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		entry, err := t.kv.Get(key)
+		if err != nil {
+			t.logger.Warn("failed to restore timer", "key", key, "error", err)
+			continue
+		}
+		var timer Timer
+		if err := json.Unmarshal(entry.Value(), &timer); err != nil {
+			t.logger.Warn("invalid timer", "key", key, "error", err)
+			continue
+		}
+
+		t.mu.Lock()
+		if _, ok := t.pending[key]; !ok {
+			t.logger.Info("restoring timer", "key", key, "subject", timer.Subject, "due", timer.Due)
+			t.arm(timer, entry.Revision())
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// stop stops firing timers. They are still pending, and kept in the bucket.
+func (t *Timers) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	for _, pending := range t.pending {
+		pending.stopTimer()
+	}
+}
+
+// Debounce returns a message handler calling handler with the last message
+// of each subject once no message was received on that subject for d, e.g. to
+// react once a sensor settled.
+func Debounce(d time.Duration, handler func(msg *nats.Msg)) func(msg *nats.Msg) {
+	var mu sync.Mutex
+	timers := make(map[string]*time.Timer)
+	return func(msg *nats.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		if previous, ok := timers[msg.Subject]; ok {
+			previous.Stop()
+		}
+		var timer *time.Timer
+		timer = time.AfterFunc(d, func() {
+			mu.Lock()
+			current := timers[msg.Subject] == timer
+			if current {
+				delete(timers, msg.Subject)
+			}
+			mu.Unlock()
+			if current {
+				handler(msg)
+			}
+		})
+		timers[msg.Subject] = timer
+	}
+}
+
+// Throttle returns a message handler calling handler with the first message
+// of each subject, then dropping the messages of that subject for d.
+func Throttle(d time.Duration, handler func(msg *nats.Msg)) func(msg *nats.Msg) {
+	var mu sync.Mutex
+	last := make(map[string]time.Time)
+	return func(msg *nats.Msg) {
+		now := time.Now()
+		mu.Lock()
+		if at, ok := last[msg.Subject]; ok && now.Sub(at) < d {
+			mu.Unlock()
+			return
+		}
+		// Forget the subjects no longer throttled, wildcards may match many
+		if len(last) >= 1024 {
+			for subject, at := range last {
+				if now.Sub(at) >= d {
+					delete(last, subject)
+				}
+			}
+		}
+		last[msg.Subject] = now
+		mu.Unlock()
+		handler(msg)
+	}
+}
+
+// timerView is a timer as described by the HTTP endpoints, with its payload
+// decoded.
+type timerView struct {
+	Timer
+	Payload any `json:"payload,omitempty"`
+}
+
+func viewTimer(timer Timer) timerView {
+	view := timerView{Timer: timer}
+	view.Timer.Data = nil
+	if len(timer.Data) > 0 {
+		if err := json.Unmarshal(timer.Data, &view.Payload); err != nil {
+			view.Payload = string(timer.Data)
+		}
+	}
+	return view
+}
+
+func (a *App) timersHandler(w http.ResponseWriter, _ *http.Request) {
+	timers := a.timers.List()
+	views := make([]timerView, 0, len(timers))
+	for _, timer := range timers {
+		views = append(views, viewTimer(timer))
+	}
+	WriteJSON(w, http.StatusOK, views)
+}
+
+func (a *App) timerHandler(w http.ResponseWriter, r *http.Request) {
+	timer, ok := a.timers.Get(r.PathValue("key"))
+	if !ok {
+		http.Error(w, "Unknown timer", http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, http.StatusOK, viewTimer(timer))
+}
+
+func (a *App) cancelTimerHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	found, err := a.timers.Cancel(key)
+	switch {
+	case err != nil:
+		a.logger.Error("failed to cancel timer", "key", key, "error", err)
+		http.Error(w, "Error canceling timer", http.StatusInternalServerError)
+	case !found:
+		http.Error(w, "Unknown timer", http.StatusNotFound)
+	default:
+		a.logger.Info("timer canceled", "key", key, "remote_addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
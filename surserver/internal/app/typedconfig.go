@@ -0,0 +1,294 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeConfig decodes the ModuleConfig.Config map of a module into a struct
+// of type T, starting from defaults.
+//
+// Fields are mapped with their `mapstructure` tags. Any setting found outside
+// lists and maps can be overridden by an environment variable named after the
+// module and the path of the setting, e.g. SURSERVER_MODULES_BRIDGE_RATE_LIMIT_PER_IP_RATE
+// for rate_limit.per_ip.rate of the bridge module.
+//
+// The result is checked against the `validate` struct tags, a comma separated
+// list of: required, min=<n>, max=<n>, oneof=<a b c>, subject (see
+// ValidPublishSubject) and pattern=<regexp>, which must come last. Every problem is reported as ValidationErrors.
+func DecodeConfig[T any](module string, config map[string]any, defaults T) (T, error) {
+	cfg := defaults
+	t := reflect.TypeOf(cfg)
+	if t.Kind() != reflect.Struct {
+		return cfg, fmt.Errorf("config of module %s must be a struct, got %s", module, t)
+	}
+
+	config = withEnvOverrides(envPrefix(module), t, config)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		// Environment variables are strings
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           &cfg,
+	})
+	if err != nil {
+		return cfg, err
+	}
+	if err := decoder.Decode(config); err != nil {
+		return cfg, fmt.Errorf("unable to decode config of module %s: %w", module, err)
+	}
+
+	var errs ValidationErrors
+	validateStruct(&errs, reflect.ValueOf(cfg), "modules."+module+".config")
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+
+	return cfg, nil
+}
+
+func envPrefix(module string) string {
+	return "SURSERVER_MODULES_" + strings.ToUpper(strings.ReplaceAll(module, "-", "_")) + "_"
+}
+
+// withEnvOverrides returns a copy of config where the settings of t found in
+// the environment are replaced by their value.
+func withEnvOverrides(prefix string, t reflect.Type, config map[string]any) map[string]any {
+	out := maps.Clone(config)
+	if out == nil {
+		out = make(map[string]any)
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := fieldKey(field)
+		if key == "" {
+			continue
+		}
+		envName := prefix + strings.ToUpper(key)
+		// Settings keep the case they are written with
+		for written := range out {
+			if strings.EqualFold(written, key) {
+				key = written
+				break
+			}
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			nested, _ := out[key].(map[string]any)
+			out[key] = withEnvOverrides(envName+"_", field.Type, nested)
+			continue
+		}
+		if value, ok := os.LookupEnv(envName); ok {
+			out[key] = value
+		}
+	}
+
+	return out
+}
+
+func fieldKey(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	key, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+	if key == "-" {
+		return ""
+	}
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return key
+}
+
+// validateStruct checks the `validate` tags of the fields of v.
+func validateStruct(errs *ValidationErrors, v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == durationType {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			key := fieldKey(field)
+			if key == "" {
+				continue
+			}
+			fieldPath := joinPath(path, key)
+			checkRules(errs, v.Field(i), field.Tag.Get("validate"), fieldPath)
+			validateStruct(errs, v.Field(i), fieldPath)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			validateStruct(errs, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			validateStruct(errs, iter.Value(), joinPath(path, fmt.Sprint(iter.Key())))
+		}
+	}
+}
+
+func checkRules(errs *ValidationErrors, v reflect.Value, tag, path string) {
+	for _, rule := range splitRules(tag) {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if v.IsZero() {
+				errs.add(path, "is required")
+			}
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			n, ok := numericValue(v)
+			if !ok {
+				continue
+			}
+			if name == "min" && n < limit {
+				errs.add(path, "must be at least %s", arg)
+			}
+			if name == "max" && n > limit {
+				errs.add(path, "must be at most %s", arg)
+			}
+		case "oneof":
+			if v.Kind() == reflect.String && !v.IsZero() && !strings.Contains(" "+arg+" ", " "+v.String()+" ") {
+				errs.add(path, "%q must be one of %s", v.String(), strings.ReplaceAll(arg, " ", ", "))
+			}
+		case "subject":
+			if v.Kind() == reflect.String && !v.IsZero() && !ValidPublishSubject(v.String()) {
+				errs.add(path, "%q is not a subject messages can be published to: no wildcards, whitespace or leading $", v.String())
+			}
+		case "pattern":
+			if v.Kind() == reflect.String && !v.IsZero() && !regexp.MustCompile(arg).MatchString(v.String()) {
+				errs.add(path, "%q must match %s", v.String(), arg)
+			}
+		}
+	}
+}
+
+// splitRules splits a validate tag, keeping commas of the trailing pattern.
+func splitRules(tag string) []string {
+	if tag == "" {
+		return nil
+	}
+	before, pattern, found := strings.Cut(tag, "pattern=")
+	rules := strings.FieldsFunc(before, func(r rune) bool { return r == ',' })
+	if found {
+		rules = append(rules, "pattern="+pattern)
+	}
+	return rules
+}
+
+func numericValue(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// SchemaOf returns the JSON schema of a config struct, as used by
+// SchemaProvider, from its `mapstructure` and `validate` tags.
+func SchemaOf(v any) Schema {
+	return schemaOfType(reflect.TypeOf(v), "", nil)
+}
+
+// schemaOfType returns the schema of t. parents are the structs t is nested
+// in: a recursive struct is only described as an object below itself.
+func schemaOfType(t reflect.Type, rules string, parents []reflect.Type) Schema {
+	schema := Schema{}
+
+	switch {
+	case t == durationType:
+		schema["type"] = "string"
+		schema["format"] = "duration"
+	case t.Kind() == reflect.Pointer:
+		return schemaOfType(t.Elem(), rules, parents)
+	case t.Kind() == reflect.Struct && slices.Contains(parents, t):
+		schema["type"] = "object"
+	case t.Kind() == reflect.Struct:
+		parents = append(parents, t)
+		properties := make(map[string]any)
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := fieldKey(field)
+			if key == "" {
+				continue
+			}
+			fieldRules := field.Tag.Get("validate")
+			properties[key] = schemaOfType(field.Type, fieldRules, parents)
+			for _, rule := range splitRules(fieldRules) {
+				if rule == "required" {
+					required = append(required, key)
+				}
+			}
+		}
+		schema["type"] = "object"
+		schema["additionalProperties"] = false
+		schema["properties"] = properties
+		if required != nil {
+			schema["required"] = required
+		}
+	case t.Kind() == reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = schemaOfType(t.Elem(), "", parents)
+	case t.Kind() == reflect.Map:
+		schema["type"] = "object"
+		if items := schemaOfType(t.Elem(), "", parents); len(items) > 0 {
+			schema["additionalProperties"] = items
+		}
+	case t.Kind() == reflect.String:
+		schema["type"] = "string"
+	case t.Kind() == reflect.Bool:
+		schema["type"] = "boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema["type"] = "integer"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema["type"] = "number"
+	}
+
+	for _, rule := range splitRules(rules) {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "min", "max":
+			if limit, err := strconv.ParseFloat(arg, 64); err == nil && (schema["type"] == "integer" || schema["type"] == "number") {
+				schema[map[string]string{"min": "minimum", "max": "maximum"}[name]] = limit
+			}
+		case "oneof":
+			var enum []any
+			for _, value := range strings.Fields(arg) {
+				enum = append(enum, value)
+			}
+			schema["enum"] = enum
+		case "subject":
+			schema["pattern"] = publishSubjectPattern
+		case "pattern":
+			schema["pattern"] = arg
+		}
+	}
+
+	return schema
+}
@@ -0,0 +1,336 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaProvider is implemented by modules that declare the JSON schema of
+// their ModuleConfig.Config map. The config is validated against it before
+// the module is initialized.
+type SchemaProvider interface {
+	ConfigSchema() Schema
+}
+
+// ValidationError is a problem found in the configuration.
+type ValidationError struct {
+	// Path of the offending key, e.g. "modules.bridge.config.routes[0].subject"
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors lists every problem found in the configuration.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(lines, "\n  "))
+}
+
+func (errs *ValidationErrors) add(path, format string, args ...any) {
+	*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+var appNameRe = regexp.MustCompile(`^[a-z_-]+$`)
+
+// Validate checks the configuration, including the config of each module that
+// provides a schema, and reports every problem found.
+func (c *Config) Validate(modules map[string]Module) error {
+	var errs ValidationErrors
+
+	// Keys that don't map to any setting are most likely typos
+	if c.raw != nil {
+		checkUnknownKeys(&errs, reflect.TypeOf(*c), c.raw, "")
+	}
+
+	if !appNameRe.MatchString(c.Name) {
+		errs.add("name", "%q must only contain lowercase letters, dashes and underscores", c.Name)
+	}
+
+	if !c.NATS.Embedded || !c.NATS.Private {
+		if _, _, err := splitHostPort(c.NATS.URL); err != nil {
+			errs.add("nats.url", "%v", err)
+		}
+	}
+
+	if c.HTTP.Enabled && (c.HTTP.Port < 1 || c.HTTP.Port > 65535) {
+		errs.add("http.port", "%d is not a valid port", c.HTTP.Port)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs.add("log.level", "%q must be one of debug, info, warn or error", c.Log.Level)
+	}
+
+	if c.ModulesDefault != ModulesEnabled && c.ModulesDefault != ModulesDisabled {
+		errs.add("modules_default", "%q must be %s or %s", c.ModulesDefault, ModulesEnabled, ModulesDisabled)
+	}
+
+	if _, err := newAuthenticator(c.Auth); err != nil {
+		errs.add("auth", "%v", err)
+	}
+
+	known := make([]string, 0, len(modules))
+	for name := range modules {
+		known = append(known, name)
+	}
+	slices.Sort(known)
+
+	names := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		path := "modules." + name
+		module, ok := modules[name]
+		if !ok {
+			msg := fmt.Sprintf("unknown module, known modules are: %s", strings.Join(known, ", "))
+			if suggestion := closest(name, known); suggestion != "" {
+				msg = fmt.Sprintf("unknown module, did you mean %q?", suggestion)
+			}
+			errs.add(path, "%s", msg)
+			continue
+		}
+		if provider, ok := module.(SchemaProvider); ok {
+			validateSchema(&errs, provider.ConfigSchema(), c.Modules[name].Config, path+".config")
+		}
+	}
+
+	c.checkDependencies(&errs, modules)
+
+	for _, name := range mapKeys(c.Plugins) {
+		path := "plugins." + name
+		if c.Plugins[name].Command == "" {
+			errs.add(path+".command", "is required")
+		}
+		if c.NATS.Embedded && c.NATS.Private {
+			errs.add(path, "plugins can't connect to the embedded NATS server when nats.private is true")
+		}
+	}
+
+	if len(errs) > 0 {
+		slices.SortStableFunc(errs, func(a, b ValidationError) int { return strings.Compare(a.Path, b.Path) })
+		return errs
+	}
+	return nil
+}
+
+// checkUnknownKeys reports the keys of raw that don't match a mapstructure
+// tag of t. Maps of arbitrary values are not checked.
+func checkUnknownKeys(errs *ValidationErrors, t reflect.Type, raw any, path string) {
+	switch t.Kind() {
+	case reflect.Pointer:
+		checkUnknownKeys(errs, t.Elem(), raw, path)
+	case reflect.Struct:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			tag, _, _ := strings.Cut(t.Field(i).Tag.Get("mapstructure"), ",")
+			if tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+		for key, value := range m {
+			fieldType, ok := fields[key]
+			if !ok {
+				msg := "unknown key"
+				if suggestion := closest(key, mapKeys(fields)); suggestion != "" {
+					msg = fmt.Sprintf("unknown key, did you mean %q?", suggestion)
+				}
+				errs.add(joinPath(path, key), "%s", msg)
+				continue
+			}
+			checkUnknownKeys(errs, fieldType, value, joinPath(path, key))
+		}
+	case reflect.Slice:
+		if items, ok := raw.([]any); ok {
+			for i, item := range items {
+				checkUnknownKeys(errs, t.Elem(), item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case reflect.Map:
+		if m, ok := raw.(map[string]any); ok {
+			for key, value := range m {
+				checkUnknownKeys(errs, t.Elem(), value, joinPath(path, key))
+			}
+		}
+	}
+}
+
+// validateSchema checks value against a subset of JSON schema: type, enum,
+// properties, required, additionalProperties, items, minimum, maximum, pattern
+// and the "duration" format.
+func validateSchema(errs *ValidationErrors, schema Schema, value any, path string) {
+	if schema == nil {
+		return
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(v any) bool { return reflect.DeepEqual(v, value) }) {
+		errs.add(path, "%v is not one of %v", value, enum)
+		return
+	}
+
+	switch schema["type"] {
+	case "object":
+		m, ok := value.(map[string]any)
+		if value == nil {
+			m, ok = map[string]any{}, true
+		}
+		if !ok {
+			errs.add(path, "must be an object")
+			return
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		if required, ok := schema["required"].([]string); ok {
+			for _, key := range required {
+				if !slices.ContainsFunc(mapKeys(m), func(written string) bool { return strings.EqualFold(written, key) }) {
+					errs.add(joinPath(path, key), "is required")
+				}
+			}
+		}
+		for key, v := range m {
+			propSchema, known := properties[key].(Schema)
+			// Settings are matched regardless of case, as they are decoded
+			if !known {
+				propSchema, known = properties[strings.ToLower(key)].(Schema)
+			}
+			if !known {
+				if additional, ok := schema["additionalProperties"].(Schema); ok {
+					validateSchema(errs, additional, v, joinPath(path, key))
+				} else if schema["additionalProperties"] == false {
+					msg := "unknown key"
+					if suggestion := closest(key, mapKeys(properties)); suggestion != "" {
+						msg = fmt.Sprintf("unknown key, did you mean %q?", suggestion)
+					}
+					errs.add(joinPath(path, key), "%s", msg)
+				}
+				continue
+			}
+			validateSchema(errs, propSchema, v, joinPath(path, key))
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			errs.add(path, "must be a list")
+			return
+		}
+		itemSchema, _ := schema["items"].(Schema)
+		for i, item := range items {
+			validateSchema(errs, itemSchema, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			errs.add(path, "must be a string")
+			return
+		}
+		if schema["format"] == "duration" {
+			if _, err := time.ParseDuration(s); err != nil {
+				errs.add(path, "%q is not a valid duration (e.g. 10s, 5m, 1h30m)", s)
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			errs.add(path, "%q must match %s", s, pattern)
+		}
+	case "integer", "number":
+		n, ok := toFloat(value)
+		if !ok || (schema["type"] == "integer" && n != math.Trunc(n)) {
+			errs.add(path, "must be a %s", schema["type"])
+			return
+		}
+		if minimum, ok := toFloat(schema["minimum"]); ok && n < minimum {
+			errs.add(path, "must be at least %v", schema["minimum"])
+		}
+		if maximum, ok := toFloat(schema["maximum"]); ok && n > maximum {
+			errs.add(path, "must be at most %v", schema["maximum"])
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs.add(path, "must be a boolean")
+		}
+	}
+}
+
+func toFloat(value any) (float64, bool) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		// Environment variables are always strings
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// closest returns the candidate nearest to s, if it is close enough to be a typo.
+func closest(s string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := levenshtein(s, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
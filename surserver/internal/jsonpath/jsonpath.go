@@ -0,0 +1,85 @@
+// Package jsonpath extracts values from decoded JSON documents using dotted
+// paths such as "repository.owner.login" or "items[0].name".
+package jsonpath
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("invalid JSON path")
+
+// Get returns the value found at path in doc, as decoded by encoding/json.
+// An empty path returns doc itself.
+func Get(doc any, path string) (any, bool) {
+	segments, err := Parse(path)
+	if err != nil {
+		return nil, false
+	}
+
+	current := doc
+	for _, segment := range segments {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// Parse splits path into its segments. "a.b[0].c" and "a.b.0.c" are equivalent.
+func Parse(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	var segments []string
+	for _, part := range strings.Split(path, ".") {
+		name, rest, _ := strings.Cut(part, "[")
+		if name == "" && rest == "" {
+			return nil, fmt.Errorf("%w: empty segment in %q", ErrInvalidPath, path)
+		}
+		if name != "" {
+			segments = append(segments, name)
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			if !ok || index == "" {
+				return nil, fmt.Errorf("%w: unterminated index in %q", ErrInvalidPath, path)
+			}
+			segments = append(segments, index)
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+
+	return segments, nil
+}
+
+// String formats a scalar value found in a document as text.
+func String(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
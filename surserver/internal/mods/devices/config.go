@@ -0,0 +1,28 @@
+package devices
+
+import (
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+// devicesConfig is the module configuration as found in ModuleConfig.Config.
+type devicesConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section
+	Auth bool `mapstructure:"auth"`
+	// JetStream key-value bucket keeping the devices, created if needed
+	Bucket string `mapstructure:"bucket" validate:"pattern=^[A-Za-z0-9_-]+$"`
+	// Prefix of the subjects of the NATS API: <subject>.list, <subject>.get.<id>,
+	// <subject>.put.<id> and <subject>.delete.<id>. Empty to disable it.
+	Subject string `mapstructure:"subject" validate:"subject"`
+}
+
+func parseConfig(name string, config map[string]any) (devicesConfig, error) {
+	return app.DecodeConfig(name, config, devicesConfig{
+		Bucket:  "devices",
+		Subject: "devices",
+	})
+}
+
+// ConfigSchema describes the devices configuration.
+func (m *DevicesModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(devicesConfig{})
+}
@@ -0,0 +1,108 @@
+package devices
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+var (
+	ErrInvalidDevice = errors.New("invalid device")
+	ErrUnknownDevice = errors.New("unknown device")
+)
+
+// Capabilities of devices, telling what they understand
+const (
+	// Turned on and off with {"on": true} on its command subject
+	CapabilitySwitch = "switch"
+	// Brightness set from 0 to 100 with {"level": 50} on its command subject
+	CapabilityDimmer = "dimmer"
+	// Publishes its measures on its state subject
+	CapabilitySensor = "sensor"
+)
+
+var capabilities = []string{CapabilitySwitch, CapabilityDimmer, CapabilitySensor}
+
+// Bindings of the subjects of devices
+const (
+	// Where commands are sent, referenced by device:<id>
+	BindingCommand = "command"
+	// Where the device publishes its state, referenced by device:<id>:state
+	BindingState = "state"
+)
+
+var (
+	// IDs are keys of the bucket, and don't contain the : of references
+	deviceIDRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	bindingRe  = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// Device is a device of the home and the NATS subjects it is reached through.
+type Device struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	Room         string   `json:"room,omitempty"`
+	Type         string   `json:"type,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Subjects by binding, e.g. command and state
+	Subjects map[string]string `json:"subjects,omitempty"`
+	// Anything else worth knowing, e.g. the model or the IP address
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Updated    time.Time      `json:"updated"`
+}
+
+var deviceSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"id":           app.Schema{"type": "string", "pattern": deviceIDRe.String()},
+		"name":         app.Schema{"type": "string"},
+		"room":         app.Schema{"type": "string"},
+		"type":         app.Schema{"type": "string"},
+		"capabilities": app.Schema{"type": "array", "items": app.Schema{"type": "string", "enum": []any{CapabilitySwitch, CapabilityDimmer, CapabilitySensor}}},
+		"subjects":     app.Schema{"type": "object", "additionalProperties": app.Schema{"type": "string"}},
+		"attributes":   app.Schema{"type": "object"},
+		"updated":      app.Schema{"type": "string", "format": "date-time"},
+	},
+}
+
+// validate checks the device.
+func (d Device) validate() error {
+	if !deviceIDRe.MatchString(d.ID) {
+		return fmt.Errorf("%w: id %q may only contain lowercase letters, digits, - and _", ErrInvalidDevice, d.ID)
+	}
+	for i, capability := range d.Capabilities {
+		if !slices.Contains(capabilities, capability) {
+			return fmt.Errorf("%w %s: unknown capability %q, expected one of %s", ErrInvalidDevice, d.ID, capability, strings.Join(capabilities, ", "))
+		}
+		if slices.Contains(d.Capabilities[:i], capability) {
+			return fmt.Errorf("%w %s: duplicate capability %q", ErrInvalidDevice, d.ID, capability)
+		}
+	}
+	for binding, subject := range d.Subjects {
+		if !bindingRe.MatchString(binding) {
+			return fmt.Errorf("%w %s: invalid binding %q", ErrInvalidDevice, d.ID, binding)
+		}
+		if !app.ValidPublishSubject(subject) {
+			return fmt.Errorf("%w %s: invalid %s subject %q", ErrInvalidDevice, d.ID, binding, subject)
+		}
+	}
+	return nil
+}
+
+// Filter selects devices, empty fields selecting every device.
+type Filter struct {
+	Room       string `json:"room,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Capability string `json:"capability,omitempty"`
+}
+
+func (f Filter) matches(d Device) bool {
+	return (f.Room == "" || f.Room == d.Room) &&
+		(f.Type == "" || f.Type == d.Type) &&
+		(f.Capability == "" || slices.Contains(d.Capabilities, f.Capability))
+}
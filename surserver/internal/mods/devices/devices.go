@@ -0,0 +1,460 @@
+package devices
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Maximum size of a device sent to the API
+const maxDeviceSize = 1 << 20
+
+// The devices are loaded within that delay when the module starts, before
+// rules and scenes resolve them
+const loadTimeout = 5 * time.Second
+
+var (
+	errNoBucket = errors.New("the bucket of the devices is not available")
+	// A client tried to bind or unbind a subject it may not send to
+	errForbidden = errors.New("subject not allowed")
+)
+
+func init() {
+	app.Register("devices", func(name string) app.Module { return &DevicesModule{name: name} })
+}
+
+// DevicesModule is a registry of the devices of the home, with their rooms,
+// types, capabilities and subjects, kept in a JetStream key-value bucket and
+// managed over HTTP and NATS. Rules and scenes address devices with
+// references such as device:living-room-lamp, resolved to the subject of their
+// command binding, or device:living-room-lamp:state for another binding.
+type DevicesModule struct {
+	name string
+
+	mu     sync.Mutex
+	config devicesConfig
+	kv     nats.KeyValue
+	// Devices of the bucket, kept up to date by the watcher
+	devices map[string]cachedDevice
+	// Stops watching the bucket, and the channel closed once it stopped
+	watcher nats.KeyWatcher
+	done    chan struct{}
+}
+
+// cachedDevice is a device, or nil once deleted, at a revision of the bucket.
+type cachedDevice struct {
+	device   *Device
+	revision uint64
+}
+
+func (m *DevicesModule) Name() string {
+	return m.name
+}
+
+func (m *DevicesModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityJetStream}}
+}
+
+func (m *DevicesModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	m.kv = nil
+	m.devices = make(map[string]cachedDevice)
+	return nil
+}
+
+func (m *DevicesModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the devices, filtered by the room, type and capability query parameters",
+			Response: app.Schema{"type": "array", "items": deviceSchema},
+		},
+		{
+			Method:   "GET",
+			Path:     "/{id}",
+			Handler:  m.handleGet,
+			Auth:     m.config.Auth,
+			Summary:  "Describe a device",
+			Response: deviceSchema,
+		},
+		{
+			Method:   "PUT",
+			Path:     "/{id}",
+			Handler:  m.handlePut,
+			Auth:     m.config.Auth,
+			Summary:  "Create or replace a device",
+			Request:  deviceSchema,
+			Response: deviceSchema,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/{id}",
+			Handler: m.handleDelete,
+			Auth:    m.config.Auth,
+			Summary: "Delete a device",
+			Status:  http.StatusNoContent,
+		},
+	}
+}
+
+// MsgHandlers loads the devices and keeps them up to date, then answers the
+// requests of the NATS API. Errors are reported as by the NATS micro services
+// API.
+func (m *DevicesModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	m.watch(pub)
+
+	if m.config.Subject == "" {
+		return nil
+	}
+	prefix := m.config.Subject + "."
+	return []app.MsgHandler{
+		{Subject: prefix + "list", Handler: func(msg *nats.Msg) {
+			var filter Filter
+			if len(msg.Data) > 0 {
+				if err := json.Unmarshal(msg.Data, &filter); err != nil {
+					m.respond(msg, nil, fmt.Errorf("%w: invalid filter: %v", ErrInvalidDevice, err))
+					return
+				}
+			}
+			m.respond(msg, m.list(filter), nil)
+		}},
+		{Subject: prefix + "get.*", Handler: func(msg *nats.Msg) {
+			device, err := m.get(lastToken(msg.Subject))
+			m.respond(msg, device, err)
+		}},
+		{Subject: prefix + "put.*", Handler: func(msg *nats.Msg) {
+			device, _, err := m.put(lastToken(msg.Subject), msg.Data, nil)
+			m.respond(msg, device, err)
+		}},
+		{Subject: prefix + "delete.*", Handler: func(msg *nats.Msg) {
+			m.respond(msg, nil, m.delete(lastToken(msg.Subject), nil))
+		}},
+	}
+}
+
+// watch opens the bucket and watches its devices, waiting for them to be
+// loaded.
+func (m *DevicesModule) watch(pub app.Publisher) {
+	logger := slog.With("module", m.Name())
+
+	m.mu.Lock()
+	bucket := m.config.Bucket
+	m.mu.Unlock()
+
+	kv, err := pub.KeyValue(nats.KeyValueConfig{Bucket: bucket, Description: "Devices of the registry"})
+	if err != nil {
+		logger.Error("failed to open the bucket of the devices", "bucket", bucket, "error", err)
+		return
+	}
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		logger.Error("failed to watch the devices", "bucket", bucket, "error", err)
+		return
+	}
+
+	loaded := make(chan struct{})
+	done := make(chan struct{})
+	m.mu.Lock()
+	m.kv, m.watcher, m.done = kv, watcher, done
+	m.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		for entry := range watcher.Updates() {
+			// The initial values were all received
+			if entry == nil {
+				close(loaded)
+				continue
+			}
+			var device *Device
+			if entry.Operation() == nats.KeyValuePut {
+				device = new(Device)
+				if err := json.Unmarshal(entry.Value(), device); err != nil {
+					logger.Warn("invalid device", "id", entry.Key(), "error", err)
+					continue
+				}
+			}
+			m.cache(entry.Key(), device, entry.Revision())
+		}
+	}()
+
+	select {
+	case <-loaded:
+		logger.Info("devices loaded", "devices", len(m.list(Filter{})))
+	case <-time.After(loadTimeout):
+		logger.Warn("devices still loading", "bucket", bucket)
+	}
+}
+
+// Stop stops watching the devices.
+func (m *DevicesModule) Stop() {
+	m.mu.Lock()
+	watcher, done := m.watcher, m.done
+	m.watcher, m.done = nil, nil
+	m.mu.Unlock()
+
+	if watcher != nil {
+		_ = watcher.Stop()
+		<-done
+	}
+}
+
+// cache keeps device, nil when deleted, unless a later revision is known.
+func (m *DevicesModule) cache(id string, device *Device, revision uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cached, ok := m.devices[id]; ok && cached.revision >= revision {
+		return
+	}
+	m.devices[id] = cachedDevice{device: device, revision: revision}
+}
+
+// SubjectScheme makes the module resolve the device:<id> references.
+func (m *DevicesModule) SubjectScheme() string {
+	return "device"
+}
+
+// ResolveSubject returns the subject of a binding of a device, referenced as
+// <id> for its command binding or <id>:<binding>.
+func (m *DevicesModule) ResolveSubject(name string) (string, error) {
+	id, binding, ok := strings.Cut(name, ":")
+	if !ok {
+		binding = BindingCommand
+	}
+	device, err := m.get(id)
+	if err != nil {
+		return "", err
+	}
+	subject, ok := device.Subjects[binding]
+	if !ok {
+		return "", fmt.Errorf("device %s has no %s subject", id, binding)
+	}
+	return subject, nil
+}
+
+// list returns the devices selected by filter, sorted by ID.
+func (m *DevicesModule) list(filter Filter) []Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make([]Device, 0, len(m.devices))
+	for _, cached := range m.devices {
+		if cached.device != nil && filter.matches(*cached.device) {
+			devices = append(devices, *cached.device)
+		}
+	}
+	slices.SortFunc(devices, func(a, b Device) int { return strings.Compare(a.ID, b.ID) })
+	return devices
+}
+
+// get returns the device with id.
+func (m *DevicesModule) get(id string) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cached, ok := m.devices[id]
+	if !ok || cached.device == nil {
+		return Device{}, fmt.Errorf("%w %q", ErrUnknownDevice, id)
+	}
+	return *cached.device, nil
+}
+
+// put creates or replaces the device with id from its JSON description,
+// reporting whether it was created. principal, when not nil, must be allowed
+// the subjects of the device and of the one it replaces.
+func (m *DevicesModule) put(id string, data []byte, principal *app.Principal) (Device, bool, error) {
+	var device Device
+	if err := json.Unmarshal(data, &device); err != nil {
+		return device, false, fmt.Errorf("%w: %v", ErrInvalidDevice, err)
+	}
+	if device.ID == "" {
+		device.ID = id
+	}
+	if device.ID != id {
+		return device, false, fmt.Errorf("%w: id %q doesn't match %q", ErrInvalidDevice, device.ID, id)
+	}
+	if err := device.validate(); err != nil {
+		return device, false, err
+	}
+	device.Updated = time.Now().UTC()
+
+	kv := m.bucket()
+	if kv == nil {
+		return device, false, errNoBucket
+	}
+	previous, err := m.get(id)
+	created := errors.Is(err, ErrUnknownDevice)
+	if err := allowed(principal, previous, device); err != nil {
+		return device, false, err
+	}
+
+	value, err := json.Marshal(device)
+	if err != nil {
+		return device, false, err
+	}
+	revision, err := kv.Put(id, value)
+	if err != nil {
+		return device, false, fmt.Errorf("storing device %s: %w", id, err)
+	}
+	m.cache(id, &device, revision)
+	slog.Info("device stored", "module", m.Name(), "id", id, "created", created)
+	return device, created, nil
+}
+
+// delete deletes the device with id. principal, when not nil, must be
+// allowed its subjects.
+func (m *DevicesModule) delete(id string, principal *app.Principal) error {
+	device, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	if err := allowed(principal, device); err != nil {
+		return err
+	}
+	kv := m.bucket()
+	if kv == nil {
+		return errNoBucket
+	}
+	if err := kv.Delete(id); err != nil {
+		return fmt.Errorf("deleting device %s: %w", id, err)
+	}
+	// The revision of the deletion is unknown, the watcher records it
+	m.mu.Lock()
+	cached := m.devices[id]
+	cached.device = nil
+	m.devices[id] = cached
+	m.mu.Unlock()
+	slog.Info("device deleted", "module", m.Name(), "id", id)
+	return nil
+}
+
+// allowed checks principal, when not nil, is allowed the subjects of devices.
+func allowed(principal *app.Principal, devices ...Device) error {
+	if principal == nil {
+		return nil
+	}
+	for _, device := range devices {
+		for _, binding := range slices.Sorted(maps.Keys(device.Subjects)) {
+			if subject := device.Subjects[binding]; !principal.Allows(subject) {
+				return fmt.Errorf("%w: %s", errForbidden, subject)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *DevicesModule) bucket() nats.KeyValue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kv
+}
+
+// status returns the HTTP status reporting err.
+func status(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidDevice):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnknownDevice):
+		return http.StatusNotFound
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errNoBucket):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respond answers a request of the NATS API with v encoded as JSON, or err.
+func (m *DevicesModule) respond(msg *nats.Msg, v any, err error) {
+	if msg.Reply == "" {
+		return
+	}
+	response := nats.NewMsg(msg.Reply)
+	if err != nil {
+		response.Header.Set(micro.ErrorCodeHeader, strconv.Itoa(status(err)))
+		response.Header.Set(micro.ErrorHeader, err.Error())
+	} else if v != nil {
+		response.Data, _ = json.Marshal(v)
+	}
+	if err := msg.RespondMsg(response); err != nil {
+		slog.Error("failed to respond", "module", m.Name(), "subject", msg.Subject, "error", err)
+	}
+}
+
+func (m *DevicesModule) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := Filter{Room: query.Get("room"), Type: query.Get("type"), Capability: query.Get("capability")}
+	app.WriteJSON(w, http.StatusOK, m.list(filter))
+}
+
+func (m *DevicesModule) handleGet(w http.ResponseWriter, r *http.Request) {
+	device, err := m.get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, device)
+}
+
+func (m *DevicesModule) handlePut(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDeviceSize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	principal, _ := app.PrincipalFromContext(r.Context())
+	device, created, err := m.put(r.PathValue("id"), body, principal)
+	if err != nil {
+		if status(err) == http.StatusInternalServerError {
+			slog.Error("failed to store device", "module", m.Name(), "error", err)
+		}
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	app.WriteJSON(w, code, device)
+}
+
+func (m *DevicesModule) handleDelete(w http.ResponseWriter, r *http.Request) {
+	principal, _ := app.PrincipalFromContext(r.Context())
+	if err := m.delete(r.PathValue("id"), principal); err != nil {
+		if status(err) == http.StatusInternalServerError {
+			slog.Error("failed to delete device", "module", m.Name(), "error", err)
+		}
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lastToken returns the last token of subject.
+func lastToken(subject string) string {
+	return subject[strings.LastIndex(subject, ".")+1:]
+}
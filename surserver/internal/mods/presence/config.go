@@ -0,0 +1,121 @@
+package presence
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+var ErrInvalidPerson = errors.New("invalid person")
+
+// Events telling whether anyone is home are published on <subject>.anyone
+const anyone = "anyone"
+
+// Names the geofence expression may refer to
+var geofenceNames = []string{"payload", "query", "headers"}
+
+// presenceConfig is the module configuration as found in ModuleConfig.Config.
+type presenceConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section
+	Auth bool `mapstructure:"auth"`
+	// JetStream key-value bucket keeping the presence of the people, created
+	// if needed
+	Bucket string `mapstructure:"bucket" validate:"pattern=^[A-Za-z0-9_-]+$"`
+	// Changes are published on <subject>.<person>, and whether anyone is home
+	// on <subject>.anyone
+	Subject string `mapstructure:"subject" validate:"subject"`
+	// How often the phones are looked for on the network, and how long to
+	// wait for their answer
+	ScanInterval time.Duration `mapstructure:"scan_interval" validate:"min=1"`
+	PingTimeout  time.Duration `mapstructure:"ping_timeout" validate:"min=1"`
+	// People are away once their phones weren't seen on the network for that
+	// long, phones often leaving the network while asleep
+	AwayAfter time.Duration `mapstructure:"away_after" validate:"min=0"`
+	// How long a change must last before being published, overrides applying
+	// at once
+	Debounce time.Duration `mapstructure:"debounce" validate:"min=0"`
+	// Expression of the POST /<name>/{person}/geofence webhooks, reading
+	// payload, query and headers: true when the person entered the home zone,
+	// false when they left it, null to ignore the webhook
+	Geofence string   `mapstructure:"geofence"`
+	People   []Person `mapstructure:"people"`
+
+	geofence *expr.Expr
+}
+
+// Person is someone whose presence at home is tracked.
+type Person struct {
+	Name string `mapstructure:"name" validate:"required,pattern=^[A-Za-z0-9_-]+$"`
+	// IPv4 addresses or host names of their phones, pinged and looked up in
+	// the ARP table
+	Hosts []string `mapstructure:"hosts"`
+	// MAC addresses of their phones, for addresses assigned by DHCP
+	MACs []string `mapstructure:"macs"`
+
+	macs []net.HardwareAddr
+}
+
+func parseConfig(name string, config map[string]any) (presenceConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, presenceConfig{
+		Bucket:       "presence",
+		Subject:      "presence",
+		ScanInterval: 30 * time.Second,
+		PingTimeout:  time.Second,
+		AwayAfter:    5 * time.Minute,
+		Debounce:     30 * time.Second,
+		Geofence:     "payload.home",
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.geofence, err = expr.Compile(cfg.Geofence, geofenceNames...); err != nil {
+		return cfg, fmt.Errorf("%s: geofence %q: %w", name, cfg.Geofence, err)
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.People {
+		person := &cfg.People[i]
+		if err := person.validate(); err != nil {
+			return cfg, fmt.Errorf("%w %s: %v", ErrInvalidPerson, person.Name, err)
+		}
+		if seen[person.Name] {
+			return cfg, fmt.Errorf("%w: duplicate name %q", ErrInvalidPerson, person.Name)
+		}
+		seen[person.Name] = true
+	}
+	return cfg, nil
+}
+
+// validate checks what the tags of the person fields can't express, and
+// parses the MAC addresses.
+func (p *Person) validate() error {
+	if p.Name == anyone {
+		return fmt.Errorf("%q is reserved for the events telling whether anyone is home", anyone)
+	}
+	for _, host := range p.Hosts {
+		if host == "" {
+			return errors.New("empty host")
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return fmt.Errorf("host %s: only IPv4 addresses are supported", host)
+		}
+	}
+	p.macs = nil
+	for _, s := range p.MACs {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return err
+		}
+		p.macs = append(p.macs, mac)
+	}
+	return nil
+}
+
+// ConfigSchema describes the presence configuration.
+func (m *PresenceModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(presenceConfig{})
+}
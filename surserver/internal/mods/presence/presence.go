@@ -0,0 +1,728 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+)
+
+// Maximum size of the bodies of webhooks and overrides
+const maxBodySize = 1 << 20
+
+// The presence of the people is loaded within that delay when the module
+// starts
+const loadTimeout = 5 * time.Second
+
+// How often pending changes and the end of overrides are checked
+const evaluateInterval = time.Second
+
+// Sources of the presence of people
+const (
+	// A phone of the person answered on the network
+	SourceNetwork = "network"
+	// A geofence app of the person called the webhook
+	SourceGeofence = "geofence"
+	// Someone set the presence of the person
+	SourceOverride = "override"
+)
+
+var (
+	ErrUnknownPerson   = errors.New("unknown person")
+	ErrInvalidOverride = errors.New("invalid override")
+	ErrInvalidGeofence = errors.New("invalid geofence webhook")
+)
+
+func init() {
+	app.Register("presence", func(name string) app.Module { return &PresenceModule{name: name} })
+}
+
+// PresenceModule tells whether people are home from their phones answering
+// on the network, the webhooks of geofence apps, and manual overrides. Changes
+// are published on NATS once they lasted for the debounce delay, and the
+// presence of people is kept in a JetStream key-value bucket so that restarts
+// don't publish them again.
+type PresenceModule struct {
+	name string
+
+	mu     sync.Mutex
+	config presenceConfig
+	pub    app.Publisher
+	kv     nats.KeyValue
+	people map[string]*Presence
+	// Changes waiting for the debounce delay, by person
+	pending map[string]pendingChange
+	// Whether anyone was home when last published, nil when unknown
+	anyoneHome *bool
+	// Phones not seen since the start are away after away_after
+	started time.Time
+	// Stops the scans and evaluations, and waits for them
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Presence tells whether a person is home, and what the sources reported.
+type Presence struct {
+	Person string `json:"person"`
+	// Null until a source reported the person
+	Home *bool `json:"home"`
+	// Time and source of the last change
+	Since   *time.Time `json:"since,omitempty"`
+	Source  string     `json:"source,omitempty"`
+	Signals Signals    `json:"signals"`
+}
+
+// Signals are the last reports of the sources about a person.
+type Signals struct {
+	// Last time a phone of the person answered on the network
+	NetworkSeen *time.Time `json:"network_seen,omitempty"`
+	Geofence    *Signal    `json:"geofence,omitempty"`
+	Override    *Override  `json:"override,omitempty"`
+}
+
+// Signal is a report of a source telling whether a person is home.
+type Signal struct {
+	Home bool      `json:"home"`
+	Time time.Time `json:"time"`
+}
+
+// Override sets the presence of a person, whatever the other sources report.
+type Override struct {
+	Signal
+	// Removed then, or when deleted if omitted
+	Until *time.Time `json:"until,omitempty"`
+}
+
+var signalProperties = map[string]any{
+	"home": app.Schema{"type": "boolean"},
+	"time": app.Schema{"type": "string", "format": "date-time"},
+}
+
+var presenceSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"person": app.Schema{"type": "string"},
+		"home":   app.Schema{"type": []any{"boolean", "null"}},
+		"since":  app.Schema{"type": "string", "format": "date-time"},
+		"source": app.Schema{"type": "string", "enum": []any{SourceNetwork, SourceGeofence, SourceOverride}},
+		"signals": app.Schema{
+			"type": "object",
+			"properties": map[string]any{
+				"network_seen": app.Schema{"type": "string", "format": "date-time"},
+				"geofence":     app.Schema{"type": "object", "properties": signalProperties},
+				"override": app.Schema{"type": "object", "properties": map[string]any{
+					"home":  signalProperties["home"],
+					"time":  signalProperties["time"],
+					"until": app.Schema{"type": "string", "format": "date-time"},
+				}},
+			},
+		},
+	},
+}
+
+// OverrideRequest is the body of PUT /<name>/{person}/override.
+type OverrideRequest struct {
+	Home *bool `json:"home"`
+	// Duration of the override, e.g. 2h, until deleted when omitted
+	For string `json:"for,omitempty"`
+}
+
+var overrideRequestSchema = app.Schema{
+	"type":     "object",
+	"required": []any{"home"},
+	"properties": map[string]any{
+		"home": app.Schema{"type": "boolean"},
+		"for":  app.Schema{"type": "string", "description": "Duration, e.g. 2h"},
+	},
+}
+
+// Event is published on <subject>.<person> when the presence of a person
+// changes.
+type Event struct {
+	Person string `json:"person"`
+	Home   bool   `json:"home"`
+	// Null when it wasn't known
+	Previous *bool     `json:"previous"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+}
+
+// HouseholdEvent is published on <subject>.anyone when the first person
+// arrives home, or the last one leaves.
+type HouseholdEvent struct {
+	Home bool `json:"home"`
+	// People at home
+	People []string  `json:"people"`
+	Time   time.Time `json:"time"`
+}
+
+// pendingChange is a change waiting for the debounce delay.
+type pendingChange struct {
+	home  bool
+	since time.Time
+}
+
+func (m *PresenceModule) Name() string {
+	return m.name
+}
+
+func (m *PresenceModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityJetStream}}
+}
+
+func (m *PresenceModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	m.kv = nil
+	m.people = make(map[string]*Presence)
+	for _, person := range cfg.People {
+		m.people[person.Name] = &Presence{Person: person.Name}
+	}
+	m.pending = make(map[string]pendingChange)
+	m.anyoneHome = nil
+	return nil
+}
+
+func (m *PresenceModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the people with their presence and the signals of the sources",
+			Response: app.Schema{"type": "array", "items": presenceSchema},
+		},
+		{
+			Method:   "GET",
+			Path:     "/{person}",
+			Handler:  m.handleGet,
+			Auth:     m.config.Auth,
+			Summary:  "Tell whether a person is home",
+			Response: presenceSchema,
+		},
+		{
+			Method:   "PUT",
+			Path:     "/{person}/override",
+			Handler:  m.handleOverride,
+			Auth:     m.config.Auth,
+			Summary:  "Set the presence of a person, for a while or until deleted",
+			Request:  overrideRequestSchema,
+			Response: presenceSchema,
+		},
+		{
+			Method:   "DELETE",
+			Path:     "/{person}/override",
+			Handler:  m.handleDeleteOverride,
+			Auth:     m.config.Auth,
+			Summary:  "Remove the override of the presence of a person",
+			Response: presenceSchema,
+		},
+		{
+			Method:   "POST",
+			Path:     "/{person}/geofence",
+			Handler:  m.handleGeofence,
+			Auth:     m.config.Auth,
+			Summary:  "Webhook of the geofence apps, read with the geofence expression",
+			Response: presenceSchema,
+		},
+	}
+}
+
+// MsgHandlers loads the presence of the people, then starts scanning the
+// network and publishing the changes. The module doesn't subscribe to any
+// subject.
+func (m *PresenceModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	logger := slog.With("module", m.Name())
+
+	m.mu.Lock()
+	bucket := m.config.Bucket
+	m.pub = pub
+	m.mu.Unlock()
+
+	kv, err := pub.KeyValue(nats.KeyValueConfig{Bucket: bucket, Description: "Presence of the people"})
+	if err != nil {
+		logger.Error("failed to open the bucket of the presence", "bucket", bucket, "error", err)
+	} else if err := m.load(kv); err != nil {
+		logger.Error("failed to load the presence", "bucket", bucket, "error", err)
+	}
+
+	m.start()
+	return nil
+}
+
+// load restores the presence of the people kept in the bucket.
+func (m *PresenceModule) load(kv nats.KeyValue) error {
+	watcher, err := kv.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	stored := make(map[string]Presence)
+	timeout := time.After(loadTimeout)
+	for loaded := false; !loaded; {
+		select {
+		case entry := <-watcher.Updates():
+			// The initial values were all received
+			if entry == nil {
+				loaded = true
+				break
+			}
+			var presence Presence
+			if err := json.Unmarshal(entry.Value(), &presence); err != nil {
+				slog.Warn("invalid presence", "module", m.Name(), "person", entry.Key(), "error", err)
+				continue
+			}
+			stored[entry.Key()] = presence
+		case <-timeout:
+			return fmt.Errorf("presence still loading after %s", loadTimeout)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kv = kv
+	for name, presence := range m.people {
+		if s, ok := stored[name]; ok {
+			*presence = s
+			presence.Person = name
+		}
+	}
+	if home, known := m.household(); known {
+		m.anyoneHome = &home
+	}
+	return nil
+}
+
+// start starts scanning the network and evaluating the changes.
+func (m *PresenceModule) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stop := make(chan struct{})
+	m.stop = stop
+	m.started = time.Now().UTC()
+
+	var scanned []Person
+	for _, person := range m.config.People {
+		if len(person.Hosts) > 0 || len(person.macs) > 0 {
+			scanned = append(scanned, person)
+		}
+	}
+	if len(scanned) > 0 {
+		p := &prober{timeout: m.config.PingTimeout}
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.scanLoop(p, scanned, m.config.ScanInterval, stop)
+		}()
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(evaluateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				m.evaluate(now.UTC())
+			}
+		}
+	}()
+}
+
+// scanLoop looks for the phones of people every interval until stop is
+// closed.
+func (m *PresenceModule) scanLoop(p *prober, people []Person, interval time.Duration, stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		var wg sync.WaitGroup
+		for _, person := range people {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if p.present(ctx, person) {
+					m.seen(person.Name, time.Now().UTC())
+				}
+			}()
+		}
+		wg.Wait()
+		if p.noICMP.Load() && !warned {
+			warned = true
+			slog.Warn("ICMP sockets unavailable, probing phones with TCP: allow them with net.ipv4.ping_group_range or CAP_NET_RAW", "module", m.Name())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops scanning the network and publishing changes.
+func (m *PresenceModule) Stop() {
+	m.mu.Lock()
+	stop := m.stop
+	m.stop = nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		m.wg.Wait()
+	}
+}
+
+// seen records that a phone of person answered on the network.
+func (m *PresenceModule) seen(person string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if presence, ok := m.people[person]; ok {
+		presence.Signals.NetworkSeen = &now
+	}
+}
+
+// signal records the report of the geofence or an override, and applies it.
+func (m *PresenceModule) signal(person string, update func(*Signals)) (Presence, error) {
+	m.mu.Lock()
+	presence, ok := m.people[person]
+	if !ok {
+		m.mu.Unlock()
+		return Presence{}, fmt.Errorf("%w %q", ErrUnknownPerson, person)
+	}
+	update(&presence.Signals)
+	m.mu.Unlock()
+
+	m.evaluate(time.Now().UTC())
+	return m.get(person)
+}
+
+// derive returns whether person is home according to the signals and the
+// source telling so, or nil when the signals don't tell.
+func (m *PresenceModule) derive(person Person, signals Signals, now time.Time) (*bool, string) {
+	home, away := true, false
+	if signals.Override != nil {
+		return &signals.Override.Home, SourceOverride
+	}
+	scanned := len(person.Hosts) > 0 || len(person.macs) > 0
+	seen := signals.NetworkSeen
+	if scanned && seen != nil && now.Sub(*seen) < m.config.AwayAfter {
+		return &home, SourceNetwork
+	}
+	if signals.Geofence != nil {
+		return &signals.Geofence.Home, SourceGeofence
+	}
+	// Phones not seen since the start are given away_after to answer
+	if scanned && (seen == nil || seen.Before(m.started)) {
+		seen = &m.started
+	}
+	if scanned && now.Sub(*seen) >= m.config.AwayAfter {
+		return &away, SourceNetwork
+	}
+	return nil, ""
+}
+
+// evaluate applies the changes told by the signals that lasted for the
+// debounce delay, then stores and publishes them.
+func (m *PresenceModule) evaluate(now time.Time) {
+	m.mu.Lock()
+	var changed []Presence
+	var events []Event
+	for _, person := range m.config.People {
+		presence := m.people[person.Name]
+		override := presence.Signals.Override
+		expired := override != nil && override.Until != nil && !now.Before(*override.Until)
+		if expired {
+			presence.Signals.Override = nil
+		}
+
+		home, source := m.derive(person, presence.Signals, now)
+		if home == nil || (presence.Home != nil && *presence.Home == *home) {
+			delete(m.pending, person.Name)
+			if expired {
+				changed = append(changed, *presence)
+			}
+			continue
+		}
+		// The first presence known and overrides apply at once
+		if presence.Home != nil && source != SourceOverride && m.config.Debounce > 0 {
+			pending, ok := m.pending[person.Name]
+			if !ok || pending.home != *home {
+				m.pending[person.Name] = pendingChange{home: *home, since: now}
+				continue
+			}
+			if now.Sub(pending.since) < m.config.Debounce {
+				continue
+			}
+		}
+		delete(m.pending, person.Name)
+
+		events = append(events, Event{Person: person.Name, Home: *home, Previous: presence.Home, Source: source, Time: now})
+		presence.Home, presence.Since, presence.Source = home, &now, source
+		changed = append(changed, *presence)
+	}
+
+	var household *HouseholdEvent
+	if home, known := m.household(); known && (m.anyoneHome == nil || *m.anyoneHome != home) {
+		m.anyoneHome = &home
+		household = &HouseholdEvent{Home: home, People: m.home(), Time: now}
+	}
+	kv, pub, subject := m.kv, m.pub, m.config.Subject
+	m.mu.Unlock()
+
+	logger := slog.With("module", m.Name())
+	for _, presence := range changed {
+		if kv == nil {
+			break
+		}
+		data, err := json.Marshal(presence)
+		if err == nil {
+			_, err = kv.Put(presence.Person, data)
+		}
+		if err != nil {
+			logger.Error("failed to store presence", "person", presence.Person, "error", err)
+		}
+	}
+	for _, event := range events {
+		logger.Info("presence changed", "person", event.Person, "home", event.Home, "source", event.Source)
+		publish(pub, subject+"."+event.Person, event)
+	}
+	if household != nil {
+		logger.Info("household presence changed", "home", household.Home)
+		publish(pub, subject+"."+anyone, household)
+	}
+}
+
+// household reports whether anyone is home, and whether the presence of
+// anyone is known. The lock must be held.
+func (m *PresenceModule) household() (home, known bool) {
+	for _, presence := range m.people {
+		if presence.Home != nil {
+			known = true
+			home = home || *presence.Home
+		}
+	}
+	return home, known
+}
+
+// home returns the people at home, in the order of the config. The lock must
+// be held.
+func (m *PresenceModule) home() []string {
+	people := make([]string, 0)
+	for _, person := range m.config.People {
+		if presence := m.people[person.Name]; presence.Home != nil && *presence.Home {
+			people = append(people, person.Name)
+		}
+	}
+	return people
+}
+
+func publish(pub app.Publisher, subject string, v any) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = pub.Publish(subject, data)
+	}
+	if err != nil {
+		slog.Error("failed to publish presence", "subject", subject, "error", err)
+	}
+}
+
+// list returns the presence of the people, in the order of the config.
+func (m *PresenceModule) list() []Presence {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	people := make([]Presence, 0, len(m.config.People))
+	for _, person := range m.config.People {
+		people = append(people, *m.people[person.Name])
+	}
+	return people
+}
+
+// get returns the presence of person.
+func (m *PresenceModule) get(person string) (Presence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	presence, ok := m.people[person]
+	if !ok {
+		return Presence{}, fmt.Errorf("%w %q", ErrUnknownPerson, person)
+	}
+	return *presence, nil
+}
+
+// override sets the presence of person from the JSON body of an override.
+func (m *PresenceModule) override(person string, body []byte) (Presence, error) {
+	var request OverrideRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return Presence{}, fmt.Errorf("%w: %v", ErrInvalidOverride, err)
+	}
+	if request.Home == nil {
+		return Presence{}, fmt.Errorf("%w: home is required", ErrInvalidOverride)
+	}
+	now := time.Now().UTC()
+	override := &Override{Signal: Signal{Home: *request.Home, Time: now}}
+	if request.For != "" {
+		d, err := time.ParseDuration(request.For)
+		if err != nil || d <= 0 {
+			return Presence{}, fmt.Errorf("%w: for must be a positive duration such as 2h", ErrInvalidOverride)
+		}
+		until := now.Add(d)
+		override.Until = &until
+	}
+	return m.signal(person, func(s *Signals) { s.Override = override })
+}
+
+// geofence records the report of a geofence app, read with the geofence
+// expression. Webhooks the expression ignores change nothing.
+func (m *PresenceModule) geofence(person string, r *http.Request, body []byte) (Presence, error) {
+	var payload any
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return Presence{}, fmt.Errorf("%w: %v", ErrInvalidGeofence, err)
+		}
+	}
+	query := make(map[string]any)
+	for key, values := range r.URL.Query() {
+		query[key] = values[0]
+	}
+	headers := make(map[string]any, len(r.Header))
+	for key, values := range r.Header {
+		headers[key] = values[0]
+	}
+
+	m.mu.Lock()
+	geofence := m.config.geofence
+	m.mu.Unlock()
+	value, err := geofence.Eval(map[string]any{"payload": payload, "query": query, "headers": headers})
+	if err != nil {
+		return Presence{}, fmt.Errorf("%w: %v", ErrInvalidGeofence, err)
+	}
+	switch home := value.(type) {
+	case nil:
+		return m.get(person)
+	case bool:
+		signal := &Signal{Home: home, Time: time.Now().UTC()}
+		return m.signal(person, func(s *Signals) { s.Geofence = signal })
+	default:
+		return Presence{}, fmt.Errorf("%w: the geofence expression returned %T instead of a boolean or null", ErrInvalidGeofence, value)
+	}
+}
+
+// status returns the HTTP status reporting err.
+func status(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownPerson):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidOverride), errors.Is(err, ErrInvalidGeofence):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// allowed reports whether the client may change the presence of person,
+// authenticated clients having to be allowed the subject of its events.
+func (m *PresenceModule) allowed(w http.ResponseWriter, r *http.Request, person string) bool {
+	principal, authenticated := app.PrincipalFromContext(r.Context())
+	if !authenticated {
+		return true
+	}
+	m.mu.Lock()
+	subject := m.config.Subject + "." + person
+	m.mu.Unlock()
+	if principal.Allows(subject) {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	slog.Warn("presence subject not allowed for principal", "module", m.Name(), "principal", principal.Name, "subject", subject)
+	return false
+}
+
+func (m *PresenceModule) handleList(w http.ResponseWriter, r *http.Request) {
+	app.WriteJSON(w, http.StatusOK, m.list())
+}
+
+func (m *PresenceModule) handleGet(w http.ResponseWriter, r *http.Request) {
+	presence, err := m.get(r.PathValue("person"))
+	if err != nil {
+		http.Error(w, "Unknown person", http.StatusNotFound)
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, presence)
+}
+
+func (m *PresenceModule) handleOverride(w http.ResponseWriter, r *http.Request) {
+	person := r.PathValue("person")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	if !m.allowed(w, r, person) {
+		return
+	}
+	presence, err := m.override(person, body)
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, presence)
+}
+
+func (m *PresenceModule) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	person := r.PathValue("person")
+	if !m.allowed(w, r, person) {
+		return
+	}
+	presence, err := m.signal(person, func(s *Signals) { s.Override = nil })
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, presence)
+}
+
+func (m *PresenceModule) handleGeofence(w http.ResponseWriter, r *http.Request) {
+	person := r.PathValue("person")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	if !m.allowed(w, r, person) {
+		return
+	}
+	presence, err := m.geofence(person, r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status(err))
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, presence)
+}
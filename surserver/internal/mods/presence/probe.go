@@ -0,0 +1,190 @@
+package presence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// ARP table of Linux, not available elsewhere
+const arpTable = "/proc/net/arp"
+
+// Flag of the complete entries of the ARP table
+const arpComplete = 0x2
+
+// Port of the TCP probes sent when ICMP sockets can't be opened. Hosts
+// refusing the connection answered all the same.
+const tcpProbePort = "9"
+
+// prober looks for the phones of people on the local network.
+type prober struct {
+	timeout time.Duration
+	seq     atomic.Uint32
+	// Set once ICMP sockets can't be opened, unprivileged ICMP being disabled
+	// by net.ipv4.ping_group_range and raw sockets requiring CAP_NET_RAW
+	noICMP atomic.Bool
+}
+
+// present reports whether a phone of person is on the network: one of its
+// hosts answers a ping, or its entry of the ARP table is complete after the
+// ping, phones asleep answering ARP requests only.
+func (p *prober) present(ctx context.Context, person Person) bool {
+	arp := readARP()
+	var ips []net.IP
+	for _, host := range person.Hosts {
+		ips = append(ips, resolve(ctx, host)...)
+	}
+	for _, mac := range person.macs {
+		for ip, entry := range arp {
+			if bytes.Equal(entry, mac) {
+				ips = append(ips, net.ParseIP(ip))
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		if p.ping(ip) {
+			return true
+		}
+	}
+
+	arp = readARP()
+	for _, ip := range ips {
+		if _, ok := arp[ip.String()]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the IPv4 addresses of host.
+func resolve(ctx context.Context, host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil
+	}
+	return addrs
+}
+
+// ping reports whether ip answers an ICMP echo request, or a TCP connection
+// when ICMP isn't available.
+func (p *prober) ping(ip net.IP) bool {
+	if !p.noICMP.Load() {
+		ok, err := p.echo(ip)
+		if err == nil {
+			return ok
+		}
+		p.noICMP.Store(true)
+	}
+
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort(ip.String(), tcpProbePort), p.timeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// echo sends an ICMP echo request to ip and waits for the reply. It returns
+// an error when no ICMP socket can be opened.
+func (p *prober) echo(ip net.IP) (bool, error) {
+	privileged := false
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		if conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+			return false, err
+		}
+		privileged = true
+	}
+	defer conn.Close()
+
+	// Unprivileged sockets get their ID from the kernel, which only delivers
+	// them their replies
+	id, seq := os.Getpid()&0xffff, int(p.seq.Add(1)&0xffff)
+	request := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("surroundhome")}}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if privileged {
+		dst = &net.IPAddr{IP: ip}
+	}
+	if _, err := conn.WriteTo(data, dst); err != nil {
+		return false, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(p.timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return false, nil
+		}
+		if !peerIP(peer).Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq && (!privileged || echo.ID == id) {
+			return true, nil
+		}
+	}
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// readARP returns the MAC addresses of the complete entries of the ARP table,
+// by IP address. It is empty when the table can't be read.
+func readARP() map[string]net.HardwareAddr {
+	entries := make(map[string]net.HardwareAddr)
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return entries
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil || flags&arpComplete == 0 {
+			continue
+		}
+		if mac, err := net.ParseMAC(fields[3]); err == nil {
+			entries[fields[0]] = mac
+		}
+	}
+	return entries
+}
@@ -0,0 +1,35 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+// registryConfig is the module configuration as found in ModuleConfig.Config.
+type registryConfig struct {
+	// Number of heartbeats a plugin may miss before being marked stale
+	MissedHeartbeats int `mapstructure:"missed_heartbeats" validate:"min=1"`
+	// Stale plugins are forgotten after that long without heartbeat
+	ForgetAfter time.Duration `mapstructure:"forget_after" validate:"min=0"`
+	// Also list the NATS micro services answering $SRV.INFO within that delay.
+	// 0 disables it.
+	DiscoverTimeout time.Duration `mapstructure:"discover_timeout" validate:"min=0"`
+	// The services found are listed for that long before being discovered
+	// again, in the background.
+	DiscoverInterval time.Duration `mapstructure:"discover_interval" validate:"min=0"`
+}
+
+func parseConfig(name string, config map[string]any) (registryConfig, error) {
+	return app.DecodeConfig(name, config, registryConfig{
+		MissedHeartbeats: 3,
+		ForgetAfter:      time.Hour,
+		DiscoverTimeout:  250 * time.Millisecond,
+		DiscoverInterval: 30 * time.Second,
+	})
+}
+
+// ConfigSchema describes the registry configuration.
+func (m *RegistryModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(registryConfig{})
+}
@@ -0,0 +1,316 @@
+package registry
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/pkg/sdk"
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Status of a plugin
+const (
+	StatusAlive = "alive"
+	// The plugin missed too many heartbeats
+	StatusStale = "stale"
+)
+
+// Source of a plugin entry
+const (
+	// Announced by a plugin built with the SDK
+	SourceAnnounce = "announce"
+	// Another service of the NATS micro services API, found with $SRV.INFO
+	SourceMicro = "micro"
+)
+
+// Plugin is an entry of the registry.
+type Plugin struct {
+	sdk.Announcement
+	Status   string    `json:"status"`
+	Source   string    `json:"source"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+var pluginSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"name":        app.Schema{"type": "string"},
+		"version":     app.Schema{"type": "string"},
+		"description": app.Schema{"type": "string"},
+		"id":          app.Schema{"type": "string"},
+		"pid":         app.Schema{"type": "integer"},
+		"endpoints": app.Schema{"type": "array", "items": app.Schema{
+			"type": "object",
+			"properties": map[string]any{
+				"subject":     app.Schema{"type": "string"},
+				"description": app.Schema{"type": "string"},
+				"request":     app.Schema{"type": "object"},
+				"response":    app.Schema{"type": "object"},
+			},
+		}},
+		"started":   app.Schema{"type": "string", "format": "date-time"},
+		"time":      app.Schema{"type": "string", "format": "date-time"},
+		"interval":  app.Schema{"type": "string"},
+		"status":    app.Schema{"type": "string", "enum": []any{StatusAlive, StatusStale}},
+		"source":    app.Schema{"type": "string", "enum": []any{SourceAnnounce, SourceMicro}},
+		"last_seen": app.Schema{"type": "string", "format": "date-time"},
+	},
+}
+
+func init() {
+	app.Register("registry", func(name string) app.Module { return &RegistryModule{name: name} })
+}
+
+// RegistryModule keeps track of the plugins announcing themselves over NATS,
+// see the discovery protocol of package sdk.
+type RegistryModule struct {
+	name   string
+	config registryConfig
+
+	mu sync.Mutex
+	// Announced plugins, by name. Taken over by the instance replacing the
+	// module, see KeepState.
+	plugins map[string]*Plugin
+	// NATS micro services found by the last discovery, and when
+	services   []micro.Info
+	discovered time.Time
+	// Whether a discovery is running
+	discovering bool
+}
+
+func (m *RegistryModule) Name() string {
+	return m.name
+}
+
+func (m *RegistryModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	if m.plugins == nil {
+		m.plugins = make(map[string]*Plugin)
+	}
+	return nil
+}
+
+// KeepState takes over the plugins announced to the previous instance of the
+// module.
+func (m *RegistryModule) KeepState(previous app.Module) {
+	prev, ok := previous.(*RegistryModule)
+	if !ok {
+		return
+	}
+	prev.mu.Lock()
+	plugins := maps.Clone(prev.plugins)
+	prev.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.plugins = plugins
+}
+
+func (m *RegistryModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { m.handleList(w, r, pub) },
+			Summary:  "List the known plugins",
+			Response: app.Schema{"type": "array", "items": pluginSchema},
+		},
+		{
+			Method:   "GET",
+			Path:     "/{name}",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { m.handleGet(w, r, pub) },
+			Summary:  "Describe a plugin",
+			Response: pluginSchema,
+		},
+	}
+}
+
+func (m *RegistryModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	return []app.MsgHandler{
+		{Subject: sdk.AnnounceSubjectPrefix + "*", Handler: m.handleAnnouncement},
+		{Subject: sdk.HeartbeatSubjectPrefix + "*", Handler: m.handleAnnouncement},
+		{Subject: sdk.ListSubject, Handler: func(msg *nats.Msg) {
+			data, err := json.Marshal(m.list(pub))
+			if err != nil {
+				slog.Error("failed to encode plugins", "error", err)
+				return
+			}
+			_ = msg.Respond(data)
+		}},
+	}
+}
+
+// handleAnnouncement records the announcements and heartbeats of plugins.
+func (m *RegistryModule) handleAnnouncement(msg *nats.Msg) {
+	var announcement sdk.Announcement
+	if err := json.Unmarshal(msg.Data, &announcement); err != nil || announcement.Name == "" {
+		slog.Warn("invalid plugin announcement", "subject", msg.Subject, "error", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, known := m.plugins[announcement.Name]
+	switch {
+	case !known || strings.HasPrefix(msg.Subject, sdk.AnnounceSubjectPrefix):
+		slog.Info("plugin announced", "plugin", announcement.Name, "version", announcement.Version, "id", announcement.ID)
+	case m.status(previous, time.Now()) == StatusStale:
+		slog.Info("plugin is alive again", "plugin", announcement.Name)
+	}
+
+	m.plugins[announcement.Name] = &Plugin{
+		Announcement: announcement,
+		Source:       SourceAnnounce,
+		LastSeen:     time.Now(),
+	}
+}
+
+// list returns the known plugins sorted by name, along with the other NATS
+// micro services found by the last discovery. It starts a new discovery in the
+// background when that one is older than DiscoverInterval, so the first
+// listing has no services yet.
+func (m *RegistryModule) list(pub app.Publisher) []Plugin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.config.DiscoverTimeout > 0 && !m.discovering && now.Sub(m.discovered) >= m.config.DiscoverInterval {
+		m.discovering = true
+		go m.discover(pub, m.config.DiscoverTimeout)
+	}
+
+	byName := make(map[string]Plugin, len(m.plugins))
+	for name, plugin := range m.plugins {
+		status := m.status(plugin, now)
+		if status == StatusStale && m.config.ForgetAfter > 0 && now.Sub(plugin.LastSeen) > m.config.ForgetAfter {
+			slog.Info("forgetting stale plugin", "plugin", name, "last_seen", plugin.LastSeen)
+			delete(m.plugins, name)
+			continue
+		}
+		entry := *plugin
+		entry.Status = status
+		byName[name] = entry
+	}
+
+	// Not listed anymore once discovery is disabled
+	if m.config.DiscoverTimeout > 0 {
+		for _, info := range m.services {
+			// Plugins built with the SDK answer too, their announcements say more
+			if _, ok := byName[info.Name]; ok {
+				continue
+			}
+			byName[info.Name] = fromServiceInfo(info, m.discovered)
+		}
+	}
+
+	plugins := make([]Plugin, 0, len(byName))
+	for _, name := range sortedKeys(byName) {
+		plugins = append(plugins, byName[name])
+	}
+	return plugins
+}
+
+// discover queries the NATS micro services answering $SRV.INFO within
+// timeout, and records them for list.
+func (m *RegistryModule) discover(pub app.Publisher, timeout time.Duration) {
+	msgs, err := pub.RequestMany("$SRV.INFO", nil, timeout)
+	if err != nil {
+		slog.Warn("failed to discover NATS services", "error", err)
+	}
+
+	services := make([]micro.Info, 0, len(msgs))
+	for _, msg := range msgs {
+		var info micro.Info
+		if err := json.Unmarshal(msg.Data, &info); err != nil || info.Name == "" {
+			continue
+		}
+		services = append(services, info)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.discovering = false
+	// Keep the previous services when the discovery failed, it is retried on the
+	// next listing after DiscoverInterval
+	m.discovered = time.Now()
+	if err == nil {
+		m.services = services
+	}
+}
+
+// status returns the status of plugin at now. It must be called with m.mu held.
+func (m *RegistryModule) status(plugin *Plugin, now time.Time) string {
+	interval, err := time.ParseDuration(plugin.Interval)
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if now.Sub(plugin.LastSeen) > time.Duration(m.config.MissedHeartbeats)*interval {
+		return StatusStale
+	}
+	return StatusAlive
+}
+
+// fromServiceInfo returns the entry of a NATS micro service, which answered
+// $SRV.INFO at now.
+func fromServiceInfo(info micro.Info, now time.Time) Plugin {
+	endpoints := make([]sdk.Endpoint, 0, len(info.Endpoints))
+	for _, endpoint := range info.Endpoints {
+		endpoints = append(endpoints, sdk.Endpoint{
+			Subject:     endpoint.Subject,
+			Description: endpoint.Metadata["description"],
+		})
+	}
+	return Plugin{
+		Announcement: sdk.Announcement{
+			Name:        info.Name,
+			Version:     info.Version,
+			Description: info.Description,
+			ID:          info.ID,
+			Endpoints:   endpoints,
+			Time:        now,
+		},
+		Status:   StatusAlive,
+		Source:   SourceMicro,
+		LastSeen: now,
+	}
+}
+
+func (m *RegistryModule) handleList(w http.ResponseWriter, _ *http.Request, pub app.Publisher) {
+	app.WriteJSON(w, http.StatusOK, m.list(pub))
+}
+
+func (m *RegistryModule) handleGet(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+	name := r.PathValue("name")
+	for _, plugin := range m.list(pub) {
+		if plugin.Name == name {
+			app.WriteJSON(w, http.StatusOK, plugin)
+			return
+		}
+	}
+	http.Error(w, "Unknown plugin", http.StatusNotFound)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
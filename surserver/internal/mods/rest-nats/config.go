@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+// bridgeConfig is the bridge configuration as found in ModuleConfig.Config.
+type bridgeConfig struct {
+	// Require callers to authenticate with one of the credentials of the app auth config.
+	// Each caller may only reach the subjects its credentials are scoped to.
+	Auth bool `mapstructure:"auth"`
+	// Default timeout of NATS requests, used by routes that don't set their own.
+	Timeout time.Duration `mapstructure:"timeout" validate:"min=0"`
+	// Maximum size in bytes of a request body.
+	MaxBodySize int64 `mapstructure:"max_body_size" validate:"min=1"`
+	// Default maximum number of requests in flight per subject. 0 means unlimited.
+	MaxConcurrent int             `mapstructure:"max_concurrent" validate:"min=0"`
+	RateLimit     rateLimitConfig `mapstructure:"rate_limit"`
+	Routes        []Route         `mapstructure:"routes"`
+}
+
+// rateLimitConfig holds the token bucket settings applied to each client.
+type rateLimitConfig struct {
+	PerIP bucketConfig `mapstructure:"per_ip"`
+	// Per authenticated principal, per IP address for the other clients
+	PerKey bucketConfig `mapstructure:"per_key"`
+}
+
+// bucketConfig defines a token bucket. A zero Rate disables the limit.
+type bucketConfig struct {
+	// Tokens added per second
+	Rate float64 `mapstructure:"rate" validate:"min=0"`
+	// Maximum number of tokens, i.e. the allowed burst of requests
+	Burst int `mapstructure:"burst" validate:"min=0"`
+}
+
+func defaultConfig() bridgeConfig {
+	return bridgeConfig{
+		Timeout:     15 * time.Second,
+		MaxBodySize: 1 << 20, // 1MB
+	}
+}
+
+func parseConfig(name string, config map[string]any) (bridgeConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, defaultConfig())
+	if err != nil {
+		return cfg, err
+	}
+
+	for key, bucket := range map[string]bucketConfig{"per_ip": cfg.RateLimit.PerIP, "per_key": cfg.RateLimit.PerKey} {
+		if bucket.Rate > 0 && bucket.Burst == 0 {
+			return cfg, fmt.Errorf("rate_limit.%s: burst must be positive when rate is set", key)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		if err := route.validate(); err != nil {
+			return cfg, err
+		}
+		if seen[route.Path] {
+			return cfg, fmt.Errorf("%w: duplicate path %q", ErrInvalidRoute, route.Path)
+		}
+		seen[route.Path] = true
+		if route.Timeout == 0 {
+			route.Timeout = cfg.Timeout
+		}
+		if route.MaxConcurrent == 0 {
+			route.MaxConcurrent = cfg.MaxConcurrent
+		}
+	}
+
+	return cfg, nil
+}
+
+// ConfigSchema describes the bridge configuration.
+func (m *RestModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(bridgeConfig{})
+}
@@ -0,0 +1,133 @@
+package rest
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Buckets unused for that long are forgotten
+	bucketIdleTimeout = 10 * time.Minute
+	sweepInterval     = time.Minute
+)
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiter throttles clients with one token bucket per IP address and per
+// principal, and caps the number of requests in flight per subject.
+type limiter struct {
+	config rateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*clientBucket
+	lastSweep time.Time
+	inflight  map[string]int
+}
+
+func newLimiter(config rateLimitConfig) *limiter {
+	return &limiter{
+		config:   config,
+		buckets:  make(map[string]*clientBucket),
+		inflight: make(map[string]int),
+	}
+}
+
+// allowIP consumes a token from the per IP bucket of the client, before it
+// is authenticated. When the client is over its quota, it returns false and
+// how long it should wait before retrying.
+func (l *limiter) allowIP(ip string) (bool, time.Duration) {
+	return l.take("ip:"+ip, l.config.PerIP)
+}
+
+// allowKey consumes a token from the per key bucket of the client, that of
+// its authenticated principal. Unauthenticated clients get the per key bucket
+// of their IP address, so they can't pick their own key. It returns like
+// allowIP.
+func (l *limiter) allowKey(ip, principal string) (bool, time.Duration) {
+	key := "principal:" + principal
+	if principal == "" {
+		key = "ip:" + ip
+	}
+	return l.take("key:"+key, l.config.PerKey)
+}
+
+// take consumes a token from the bucket id, unless config disables it.
+func (l *limiter) take(id string, config bucketConfig) (bool, time.Duration) {
+	if config.Rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	res := l.bucket(id, config, now).ReserveN(now, 1)
+	if wait := res.DelayFrom(now); wait > 0 {
+		// Don't charge the client for a request that is rejected
+		res.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+func (l *limiter) bucket(id string, config bucketConfig, now time.Time) *rate.Limiter {
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &clientBucket{limiter: rate.NewLimiter(rate.Limit(config.Rate), config.Burst)}
+		l.buckets[id] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for id, b := range l.buckets {
+		if now.Sub(b.lastSeen) > bucketIdleTimeout {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// acquire reserves a slot for a request on subject. max <= 0 means unlimited.
+func (l *limiter) acquire(subject string, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if max > 0 && l.inflight[subject] >= max {
+		return false
+	}
+	l.inflight[subject]++
+	return true
+}
+
+// release frees a slot reserved by acquire.
+func (l *limiter) release(subject string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight[subject]--
+	if l.inflight[subject] <= 0 {
+		delete(l.inflight, subject)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
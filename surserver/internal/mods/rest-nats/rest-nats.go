@@ -2,35 +2,79 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/lstep/surroundhome/surserver/internal/app"
 	"github.com/nats-io/nats.go"
 )
 
+func init() {
+	app.Register("bridge", func(name string) app.Module { return &RestModule{name: name} })
+}
+
 type RestModule struct {
-	// internal dependencies, e.g., connection config for an identity server
+	// Name of the instance, "bridge" unless configured with type: bridge under another name
+	name string
+
+	// Init replaces them while the handlers of the previous config serve
+	mu      sync.Mutex
+	config  bridgeConfig
+	limiter *limiter
 }
 
 func (m *RestModule) Name() string {
-	return "bridge"
+	return m.name
+}
+
+// Dependencies declares the bridge is useless without the HTTP server.
+func (m *RestModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityHTTP}}
 }
 
 func (m *RestModule) Init(config map[string]any) error {
-	// Set up your identity server connection, initialize services...
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Routes) == 0 {
+		slog.Warn(ErrNoRoutes.Error())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	m.limiter = newLimiter(cfg.RateLimit)
 	return nil
 }
+
+// HTTPHandlers registers one handler per configured route. Paths that don't
+// match any route are denied by the router.
 func (m *RestModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
-	return []app.HTTPHandler{
-		{
+	handlers := make([]app.HTTPHandler, 0, len(m.config.Routes))
+	for _, route := range m.config.Routes {
+		handlers = append(handlers, app.HTTPHandler{
 			Method:  "POST",
-			Path:    "/{topic}",
-			Handler: withPub(handleNatsProxy, pub),
-		},
+			Path:    route.Path,
+			Handler: withRoute(m.handleNatsProxy, route, pub),
+			Auth:    m.config.Auth,
+			// Signed requests are read to be authenticated
+			MaxBodySize: m.config.MaxBodySize,
+			Before:      m.throttleIP,
+			Summary:     fmt.Sprintf("Send the body as a request to the NATS subject %s and return its response", route.Subject),
+			Request:     app.Schema{"description": "Any JSON document"},
+			Response: app.Schema{
+				"description": "Response of the NATS subscriber",
+			},
+		})
 	}
+	return handlers
 }
 
 func (m *RestModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
@@ -44,33 +88,92 @@ func (m *RestModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
 	}
 }
 
-func withPub(h func(http.ResponseWriter, *http.Request, app.Publisher), pub app.Publisher) http.HandlerFunc {
+// throttleIP throttles the client by IP address, before it is authenticated
+// and its body read.
+func (m *RestModule) throttleIP(w http.ResponseWriter, r *http.Request) bool {
+	m.mu.Lock()
+	limiter := m.limiter
+	m.mu.Unlock()
+
+	if ok, wait := limiter.allowIP(clientIP(r)); !ok {
+		tooManyRequests(w, wait)
+		slog.Warn("rate limit exceeded",
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"retry_after", wait,
+		)
+		return false
+	}
+	return true
+}
+
+func withRoute(h func(http.ResponseWriter, *http.Request, Route, app.Publisher), route Route, pub app.Publisher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h(w, r, pub)
+		h(w, r, route, pub)
 	}
 }
 
-func handleNatsProxy(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+func (m *RestModule) handleNatsProxy(w http.ResponseWriter, r *http.Request, route Route, pub app.Publisher) {
 	start := time.Now()
+	m.mu.Lock()
+	config, limiter := m.config, m.limiter
+	m.mu.Unlock()
+
+	// Throttle the client by key before doing any work, it was throttled by IP
+	// address before being authenticated
+	principal, authenticated := app.PrincipalFromContext(r.Context())
+	var key string
+	if authenticated {
+		key = principal.Method + ":" + principal.Name
+	}
+	if ok, wait := limiter.allowKey(clientIP(r), key); !ok {
+		tooManyRequests(w, wait)
+		slog.Warn("rate limit exceeded",
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"retry_after", wait,
+		)
+		return
+	}
 
-	// Get topic from URL pattern
-	topic := r.PathValue("topic")
+	// Map the URL path to its topic
+	env := route.env(r)
+	topic, err := route.subjectFor(r, env)
 	slog.Info("received request",
 		"method", r.Method,
 		"path", r.URL.Path,
+		"route", route.Path,
 		"topic", topic,
 		"remote_addr", r.RemoteAddr,
 	)
 
-	if topic == "" {
-		http.Error(w, "Invalid URL path: missing topic", http.StatusBadRequest)
-		slog.Error("missing topic in URL path")
+	if err != nil {
+		http.Error(w, "Invalid URL path", http.StatusBadRequest)
+		slog.Error("invalid URL path", "error", err)
+		return
+	}
+
+	if authenticated && !principal.Allows(topic) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		slog.Warn("topic not allowed for principal",
+			"topic", topic,
+			"principal", principal.Name,
+			"auth_method", principal.Method,
+		)
 		return
 	}
 
 	// Read the request body
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxBodySize))
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			slog.Error("request body too large",
+				"limit", maxBytesErr.Limit,
+			)
+			return
+		}
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
 		slog.Error("failed to read request body",
 			"error", err,
@@ -89,19 +192,45 @@ func handleNatsProxy(w http.ResponseWriter, r *http.Request, pub app.Publisher)
 		return
 	}
 
+	if route.transform != nil {
+		env["body"] = jsonBody
+		payload, err := route.transform.Eval(env)
+		if err == nil {
+			body, err = json.Marshal(payload)
+		}
+		if err != nil {
+			http.Error(w, "Error transforming request body", http.StatusUnprocessableEntity)
+			slog.Error("failed to transform request body",
+				"route", route.Path,
+				"error", err,
+			)
+			return
+		}
+	}
+
+	if !limiter.acquire(topic, route.MaxConcurrent) {
+		tooManyRequests(w, time.Second)
+		slog.Warn("too many concurrent requests",
+			"topic", topic,
+			"max_concurrent", route.MaxConcurrent,
+		)
+		return
+	}
+	defer limiter.release(topic)
+
 	slog.Info("publishing to NATS",
 		"topic", topic,
 		"payload_size", len(body),
 	)
 
 	// Send request to NATS and wait for response
-	msg, err := pub.Request(topic, body)
+	msg, err := pub.RequestWithTimeout(topic, body, route.Timeout)
 	if err != nil {
 		if err == nats.ErrTimeout {
 			http.Error(w, "Request to NATS timed out", http.StatusGatewayTimeout)
 			slog.Error("NATS request timed out",
 				"topic", topic,
-				"timeout", time.Duration(15)*time.Second,
+				"timeout", route.Timeout,
 			)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -127,3 +256,13 @@ func handleNatsProxy(w http.ResponseWriter, r *http.Request, pub app.Publisher)
 		"duration", elapsed,
 	)
 }
+
+// tooManyRequests replies with a 429 telling the client when to retry.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,186 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+// Route maps an HTTP path to a NATS subject.
+//
+// Path uses the net/http pattern syntax: "{name}" matches a single path segment
+// and "{name...}" matches the remainder of the path. Subject may reference those
+// wildcards with "{name}"; a remainder wildcard is rewritten with its slashes
+// turned into dots, so "/lights/{rest...}" -> "home.lights.{rest}" maps
+// "/lights/kitchen/ceiling" to "home.lights.kitchen.ceiling".
+//
+// Subject may also contain templates such as "{{ lower(path.room) }}", whose
+// expressions (see package expr) read the wildcards as path, and the first
+// value of each query parameter and header as query and headers. Like
+// remainder wildcards, their value may span several tokens.
+//
+// Resolved subjects may not start with "$", nor single segment wildcards
+// contain an encoded "/".
+type Route struct {
+	Path string `mapstructure:"path" validate:"required,pattern=^/"`
+	// System and JetStream API subjects are never exposed
+	Subject string        `mapstructure:"subject" validate:"required,pattern=^[^$]"`
+	Timeout time.Duration `mapstructure:"timeout" validate:"min=0"`
+	// Maximum number of requests in flight per resolved subject. 0 uses the bridge default.
+	MaxConcurrent int `mapstructure:"max_concurrent" validate:"min=0"`
+	// Expression computing the payload sent to NATS from the JSON body of the
+	// request, read as body along with path, query and headers, e.g.
+	// "{room: path.room, level: round(body.brightness * 2.55)}". The body is
+	// sent as received when omitted.
+	Transform string `mapstructure:"transform"`
+
+	// Compiled Subject and Transform
+	subject   *expr.Template
+	transform *expr.Expr
+	// Whether the wildcards of Path match the remainder of the path, by name
+	wildcards map[string]bool
+}
+
+var (
+	ErrNoRoutes       = errors.New("no routes configured, every request will be denied")
+	ErrInvalidRoute   = errors.New("invalid route")
+	ErrInvalidSegment = errors.New("invalid path segment")
+	ErrSystemSubject  = errors.New("system subjects are not exposed")
+)
+
+// Names read by the expressions of subjects and transforms
+var (
+	subjectNames   = []string{"path", "query", "headers"}
+	transformNames = []string{"path", "query", "headers", "body"}
+)
+
+var (
+	wildcardRe = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)(\.\.\.)?\}`)
+	// A NATS subject token may not contain separators, wildcards or whitespace.
+	tokenRe = regexp.MustCompile(`^[^.*>\s]+$`)
+)
+
+// validate checks the wildcards and the expressions of the route, the fields
+// being validated by their tags, and compiles the expressions.
+func (r *Route) validate() error {
+	r.wildcards = make(map[string]bool)
+	for _, m := range wildcardRe.FindAllStringSubmatch(r.Path, -1) {
+		r.wildcards[m[1]] = m[2] != ""
+	}
+
+	subject, err := expr.ParseTemplate(r.Subject, subjectNames...)
+	if err != nil {
+		return fmt.Errorf("%w: subject %q: %w", ErrInvalidRoute, r.Subject, err)
+	}
+
+	// The subject without its wildcards and templates must be a valid literal subject
+	var literal strings.Builder
+	for _, part := range subject.Parts() {
+		if part.Expr != nil {
+			literal.WriteString("x")
+			continue
+		}
+		for _, m := range wildcardRe.FindAllStringSubmatch(part.Text, -1) {
+			if m[2] != "" {
+				return fmt.Errorf("%w: subject %q must reference wildcards as {%s}", ErrInvalidRoute, r.Subject, m[1])
+			}
+			if _, ok := r.wildcards[m[1]]; !ok {
+				return fmt.Errorf("%w: subject %q references unknown wildcard {%s}", ErrInvalidRoute, r.Subject, m[1])
+			}
+		}
+		literal.WriteString(wildcardRe.ReplaceAllString(part.Text, "x"))
+	}
+	for _, token := range strings.Split(literal.String(), ".") {
+		if !tokenRe.MatchString(token) {
+			return fmt.Errorf("%w: subject %q is not a valid literal subject", ErrInvalidRoute, r.Subject)
+		}
+	}
+	r.subject = subject
+
+	if r.Transform != "" {
+		if r.transform, err = expr.Compile(r.Transform, transformNames...); err != nil {
+			return fmt.Errorf("%w: transform %q: %w", ErrInvalidRoute, r.Transform, err)
+		}
+	}
+
+	return nil
+}
+
+// env returns the values read by the expressions of the route for req.
+func (r Route) env(req *http.Request) map[string]any {
+	path := make(map[string]any)
+	for _, m := range wildcardRe.FindAllStringSubmatch(r.Path, -1) {
+		path[m[1]] = req.PathValue(m[1])
+	}
+	query := make(map[string]any)
+	for key, values := range req.URL.Query() {
+		query[key] = values[0]
+	}
+	headers := make(map[string]any, len(req.Header))
+	for key, values := range req.Header {
+		headers[key] = values[0]
+	}
+	return map[string]any{"path": path, "query": query, "headers": headers}
+}
+
+// subjectFor computes the NATS subject for a request matched by the route.
+func (r Route) subjectFor(req *http.Request, env map[string]any) (string, error) {
+	var subject strings.Builder
+	for _, part := range r.subject.Parts() {
+		if part.Expr != nil {
+			value, err := part.Expr.Eval(env)
+			if err != nil {
+				return "", err
+			}
+			tokens, err := joinTokens(strings.Split(expr.String(value), "."))
+			if err != nil {
+				return "", err
+			}
+			subject.WriteString(tokens)
+			continue
+		}
+
+		var rewriteErr error
+		subject.WriteString(wildcardRe.ReplaceAllStringFunc(part.Text, func(s string) string {
+			name := wildcardRe.FindStringSubmatch(s)[1]
+			value := req.PathValue(name)
+
+			// Single segment wildcards may hold a "/" decoded from "%2F"
+			if !r.wildcards[name] && strings.Contains(value, "/") {
+				rewriteErr = fmt.Errorf("%w: %q", ErrInvalidSegment, value)
+				return ""
+			}
+			// Remainder wildcards span several segments, each one becoming a token
+			tokens, err := joinTokens(strings.Split(strings.Trim(value, "/"), "/"))
+			if err != nil {
+				rewriteErr = err
+			}
+			return tokens
+		}))
+		if rewriteErr != nil {
+			return "", rewriteErr
+		}
+	}
+
+	// Wildcards and templates could still resolve to $SYS or $JS.API subjects
+	if strings.HasPrefix(subject.String(), "$") {
+		return "", fmt.Errorf("%w: %q", ErrSystemSubject, subject.String())
+	}
+	return subject.String(), nil
+}
+
+// joinTokens joins tokens into a part of a subject, checking each one is a
+// valid token.
+func joinTokens(tokens []string) (string, error) {
+	for _, token := range tokens {
+		if !tokenRe.MatchString(token) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSegment, strings.Join(tokens, "."))
+		}
+	}
+	return strings.Join(tokens, "."), nil
+}
@@ -0,0 +1,759 @@
+package rules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+// Error is a problem found in a rules file.
+type Error struct {
+	File string
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
+}
+
+// Errors lists every problem found in rules files.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type kind int
+
+const (
+	kindAny kind = iota
+	kindString
+	kindNumber
+	kindBool
+	kindNull
+	kindList
+	kindObject
+)
+
+var kindNames = map[kind]string{
+	kindAny:    "any",
+	kindString: "string",
+	kindNumber: "number",
+	kindBool:   "bool",
+	kindNull:   "null",
+	kindList:   "list",
+	kindObject: "object",
+}
+
+// typ is the type of a value, as declared or inferred by the checker.
+type typ struct {
+	kind kind
+	// Lists: type of the items
+	elem *typ
+	// Objects: known keys, in declaration order. Objects without fields are
+	// not checked.
+	fields map[string]*field
+	order  []string
+}
+
+type field struct {
+	pos      pos
+	typ      *typ
+	optional bool
+}
+
+var (
+	anyType    = &typ{kind: kindAny}
+	stringType = &typ{kind: kindString}
+	numberType = &typ{kind: kindNumber}
+	boolType   = &typ{kind: kindBool}
+)
+
+func (k kind) name() string {
+	return kindNames[k]
+}
+
+func (t *typ) String() string {
+	switch t.kind {
+	case kindList:
+		return "[" + t.elem.String() + "]"
+	case kindObject:
+		if len(t.order) == 0 {
+			return "object"
+		}
+		fields := make([]string, len(t.order))
+		for i, key := range t.order {
+			optional := ""
+			if t.fields[key].optional {
+				optional = "?"
+			}
+			fields[i] = key + optional + ": " + t.fields[key].typ.String()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	default:
+		return kindNames[t.kind]
+	}
+}
+
+// compatible reports whether values of types a and b can be compared.
+func compatible(a, b *typ) bool {
+	return a.kind == kindAny || b.kind == kindAny || a.kind == kindNull || b.kind == kindNull || a.kind == b.kind
+}
+
+// checker type checks the rules of a program and compiles them to Rules.
+type checker struct {
+	prog *program
+	errs Errors
+	file string
+}
+
+func (c *checker) errorf(at pos, format string, args ...any) {
+	c.errs = append(c.errs, &Error{File: c.file, Line: at.line, Col: at.col, Msg: fmt.Sprintf(format, args...)})
+}
+
+// at returns the position of byte offset off of the file being checked.
+func (c *checker) at(off int) pos {
+	return position(c.prog.sources[c.file], off)
+}
+
+// nodePos returns the position of an expression, that of their name for paths.
+func (c *checker) nodePos(n *expr.Node) pos {
+	root := n
+	for root.Kind == expr.MemberNode || root.Kind == expr.IndexNode {
+		root = root.Children[0]
+	}
+	if root.Kind == expr.NameNode {
+		return c.at(root.Pos)
+	}
+	return c.at(n.Pos)
+}
+
+// LoadFiles parses and checks the rules files matching patterns, and returns
+// their rules. Payload and state declarations apply to the rules of every file.
+func LoadFiles(patterns []string) ([]Rule, error) {
+	prog := &program{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules files pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("rules file %s not found", pattern)
+		}
+		for _, file := range matches {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			prog.parse(file, string(src))
+		}
+	}
+	return prog.compile()
+}
+
+// compile checks the rules of the program and returns them.
+func (prog *program) compile() ([]Rule, error) {
+	c := &checker{prog: prog, errs: prog.errs}
+
+	for i, decl := range prog.payloads {
+		for _, other := range prog.payloads[:i] {
+			if other.subject == decl.subject {
+				c.file = decl.file
+				c.errorf(decl.pos, "payload of %q already declared at %s:%d", decl.subject, other.file, other.line)
+			}
+		}
+	}
+
+	rules := make([]Rule, 0, len(prog.rules))
+	for _, node := range prog.rules {
+		c.file = node.file
+		rule := c.compileRule(node)
+		for _, other := range rules {
+			if other.Name == rule.Name {
+				c.errorf(node.pos, "rule %s is already defined at %s", rule.Name, other.source)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	if len(c.errs) > 0 {
+		slices.SortStableFunc(c.errs, func(a, b *Error) int {
+			if a.File != b.File {
+				return strings.Compare(a.File, b.File)
+			}
+			if a.Line != b.Line {
+				return a.Line - b.Line
+			}
+			return a.Col - b.Col
+		})
+		return nil, c.errs
+	}
+	return rules, nil
+}
+
+// scope is what the expressions of a rule can refer to.
+type scope struct {
+	payload *typ
+	// Number of tokens of the trigger subject, -1 when it ends with >
+	tokens int
+	// Whether a request or http action ran before
+	response bool
+	// Parameters of the lambdas the expression is in
+	bound []string
+}
+
+// bind returns the scope of the body of a lambda with param.
+func (sc *scope) bind(param string) *scope {
+	inner := *sc
+	inner.bound = append(slices.Clip(sc.bound), param)
+	return &inner
+}
+
+func (c *checker) compileRule(node ruleNode) Rule {
+	errCount := len(c.errs)
+	rule := Rule{
+		Name:        node.name,
+		Description: node.description,
+		Mode:        node.mode,
+		Trigger:     Trigger{Subject: node.subject, Debounce: node.debounce, Throttle: node.throttle},
+		source:      fmt.Sprintf("%s:%d", node.file, node.line),
+	}
+	if rule.Name == "" {
+		base := strings.TrimSuffix(filepath.Base(node.file), filepath.Ext(node.file))
+		rule.Name = fmt.Sprintf("%s-%d", base, node.line)
+	}
+	if node.disabled {
+		disabled := false
+		rule.Enabled = &disabled
+	}
+
+	if node.subject == "" || strings.ContainsAny(node.subject, " \t") || strings.HasPrefix(node.subject, "$") {
+		c.errorf(node.subjectPos, "invalid subject %q", node.subject)
+	}
+
+	sc := &scope{payload: c.payloadType(node.subject), tokens: len(strings.Split(node.subject, "."))}
+	if strings.HasSuffix(node.subject, ">") {
+		sc.tokens = -1
+	}
+
+	if node.cond != nil {
+		rule.Conditions = []Condition{c.condition(node.cond, sc)}
+	}
+
+	for _, action := range node.actions {
+		rule.Actions = append(rule.Actions, c.action(action, sc))
+	}
+
+	// Same checks as the rules of the config, for what the checker doesn't cover
+	if len(c.errs) > errCount {
+		return rule
+	}
+	if err := rule.validate(); err != nil {
+		c.errorf(node.pos, "%v", strings.TrimPrefix(err.Error(), ErrInvalidRule.Error()+" "))
+	}
+	return rule
+}
+
+// payloadType returns the declared type of the payloads published to subject,
+// which may be a pattern.
+func (c *checker) payloadType(subject string) *typ {
+	for _, decl := range c.prog.payloads {
+		if decl.subject == subject || app.SubjectMatches(decl.subject, subject) {
+			return decl.typ
+		}
+	}
+	return anyType
+}
+
+// condition type checks a condition and compiles it to an expression.
+func (c *checker) condition(n *expr.Node, sc *scope) Condition {
+	c.boolean(n, sc)
+	return Condition{Expr: n.String()}
+}
+
+// boolean reports the expressions that are not conditions.
+func (c *checker) boolean(n *expr.Node, sc *scope) {
+	t := c.typeOf(n, sc)
+	if t.kind == kindBool || t.kind == kindAny || t.kind == kindNull {
+		return
+	}
+	if isPath(n) {
+		c.errorf(c.nodePos(n), "%s is a %s, not a bool: compare it to a value", n, t)
+	} else {
+		c.errorf(c.nodePos(n), "expected a condition, found a %s", t)
+	}
+}
+
+// typeOf returns the type of an expression, reporting the errors of its
+// operands.
+func (c *checker) typeOf(n *expr.Node, sc *scope) *typ {
+	switch n.Kind {
+	case expr.LiteralNode:
+		return literalType(n.Value)
+
+	case expr.NameNode, expr.MemberNode, expr.IndexNode:
+		return c.pathType(n, sc)
+
+	case expr.ListNode:
+		elem := anyType
+		for i, item := range n.Children {
+			t := c.typeOf(item, sc)
+			if i == 0 {
+				elem = t
+			} else if elem.kind != t.kind {
+				elem = anyType
+			}
+		}
+		return &typ{kind: kindList, elem: elem}
+
+	case expr.ObjectNode:
+		t := &typ{kind: kindObject, fields: make(map[string]*field, len(n.Keys))}
+		for i, key := range n.Keys {
+			t.fields[key] = &field{pos: c.nodePos(n.Children[i]), typ: c.typeOf(n.Children[i], sc)}
+			t.order = append(t.order, key)
+		}
+		return t
+
+	case expr.ExistsNode:
+		c.pathType(n.Children[0], sc)
+		return boolType
+
+	case expr.UnaryNode:
+		if n.Op == "!" {
+			c.boolean(n.Children[0], sc)
+			return boolType
+		}
+		if t := c.typeOf(n.Children[0], sc); t.kind != kindNumber && t.kind != kindAny {
+			c.errorf(c.at(n.Pos), "- requires a number, found a %s", t)
+		}
+		return numberType
+
+	case expr.BinaryNode:
+		switch n.Op {
+		case "&&", "||":
+			c.boolean(n.Children[0], sc)
+			c.boolean(n.Children[1], sc)
+			return boolType
+		case "??":
+			return either(c.typeOf(n.Children[0], sc), c.typeOf(n.Children[1], sc))
+		case "+", "-", "*", "/", "%":
+			return c.arithmetic(n, sc)
+		}
+		c.comparison(n, sc)
+		return boolType
+
+	case expr.ConditionalNode:
+		c.boolean(n.Children[0], sc)
+		return either(c.typeOf(n.Children[1], sc), c.typeOf(n.Children[2], sc))
+
+	case expr.CallNode:
+		// Functions are checked by package expr, their arguments here
+		for _, arg := range n.Children {
+			if arg.Kind == expr.LambdaNode {
+				c.typeOf(arg.Children[0], sc.bind(arg.Name))
+			} else {
+				c.typeOf(arg, sc)
+			}
+		}
+	}
+	return anyType
+}
+
+// either returns the type of the values that are of type a or b.
+func either(a, b *typ) *typ {
+	switch {
+	case a.kind == kindNull:
+		return b
+	case b.kind == kindNull || a.kind == b.kind:
+		return a
+	}
+	return anyType
+}
+
+func (c *checker) comparison(n *expr.Node, sc *scope) {
+	left, right := c.typeOf(n.Children[0], sc), c.typeOf(n.Children[1], sc)
+	l, r := n.Children[0].String(), n.Children[1].String()
+	at := c.at(n.Pos)
+
+	switch n.Op {
+	case "==", "!=":
+		if !compatible(left, right) {
+			c.errorf(at, "comparing %s (%s) with %s (%s)", l, left, r, right)
+		}
+	case ">", ">=", "<", "<=":
+		if !compatible(left, right) || (left.kind != kindAny && left.kind != kindNumber && left.kind != kindString) {
+			c.errorf(at, "%s can't compare %s (%s) with %s (%s)", n.Op, l, left, r, right)
+		}
+	case "in", "contains":
+		// x in y is y contains x
+		item, container, itemType, containerType := l, r, left, right
+		if n.Op == "contains" {
+			item, container, itemType, containerType = r, l, right, left
+		}
+		switch containerType.kind {
+		case kindList:
+			if !compatible(itemType, containerType.elem) {
+				c.errorf(at, "%s is a list of %s, it can't contain %s (%s)", container, containerType.elem, item, itemType)
+			}
+		case kindString, kindObject:
+			if itemType.kind != kindString && itemType.kind != kindAny {
+				c.errorf(at, "%s is a %s, it can only contain a string, found %s (%s)", container, containerType.kind.name(), item, itemType)
+			}
+		case kindAny:
+		default:
+			c.errorf(at, "%s requires a list, a string or an object, %s is a %s", n.Op, container, containerType)
+		}
+	case "matches":
+		if left.kind != kindString && left.kind != kindAny {
+			c.errorf(at, "matches requires a string, %s is a %s", l, left)
+		}
+		// Literal patterns are compiled by package expr
+		if n.Children[1].Kind != expr.LiteralNode && right.kind != kindString && right.kind != kindAny {
+			c.errorf(c.nodePos(n.Children[1]), "matches requires a regular expression string, %s is a %s", r, right)
+		}
+	}
+}
+
+// arithmetic returns the type of +, -, *, / and %. + also concatenates
+// strings, with numbers and booleans, and lists.
+func (c *checker) arithmetic(n *expr.Node, sc *scope) *typ {
+	left, right := c.typeOf(n.Children[0], sc), c.typeOf(n.Children[1], sc)
+	numeric := func(t *typ) bool { return t.kind == kindNumber || t.kind == kindAny }
+
+	if n.Op == "+" {
+		scalar := func(t *typ) bool {
+			return t.kind == kindString || t.kind == kindNumber || t.kind == kindBool || t.kind == kindAny
+		}
+		switch {
+		case left.kind == kindNumber && right.kind == kindNumber:
+			return numberType
+		case (left.kind == kindString && scalar(right)) || (right.kind == kindString && scalar(left)):
+			return stringType
+		case left.kind == kindList && right.kind == kindList:
+			elem := left.elem
+			if left.elem.kind != right.elem.kind {
+				elem = anyType
+			}
+			return &typ{kind: kindList, elem: elem}
+		case left.kind == kindAny || right.kind == kindAny:
+			return anyType
+		}
+		c.errorf(c.at(n.Pos), "+ adds numbers and concatenates strings or lists, found a %s and a %s", left, right)
+		return anyType
+	}
+
+	if !numeric(left) || !numeric(right) {
+		c.errorf(c.at(n.Pos), "%s requires numbers, found a %s and a %s", n.Op, left, right)
+	}
+	return numberType
+}
+
+func literalType(value any) *typ {
+	switch value.(type) {
+	case string:
+		return stringType
+	case float64:
+		return numberType
+	case bool:
+		return boolType
+	default:
+		return &typ{kind: kindNull}
+	}
+}
+
+// segment is a key or an index of a path.
+type segment struct {
+	// Byte offset of the key or index
+	off     int
+	key     string
+	index   int
+	isIndex bool
+}
+
+// isPath reports whether n is a name followed by keys and indexes.
+func isPath(n *expr.Node) bool {
+	for n.Kind == expr.MemberNode || n.Kind == expr.IndexNode {
+		n = n.Children[0]
+	}
+	return n.Kind == expr.NameNode
+}
+
+// segments returns the root of path and its segments. Segments stop before
+// the first index computed by an expression, which is reported by ok being
+// false.
+func (c *checker) segments(path *expr.Node, sc *scope) (root *expr.Node, segs []segment, ok bool) {
+	var nodes []*expr.Node
+	root = path
+	for root.Kind == expr.MemberNode || root.Kind == expr.IndexNode {
+		nodes = append(nodes, root)
+		root = root.Children[0]
+	}
+	slices.Reverse(nodes)
+
+	ok = true
+	for _, n := range nodes {
+		if n.Kind == expr.MemberNode {
+			if ok {
+				segs = append(segs, segment{off: n.Pos, key: n.Name})
+			}
+			continue
+		}
+		i := n.Children[1]
+		key, isKey := i.Value.(string)
+		index, isNumber := i.Value.(float64)
+		switch {
+		case !ok:
+		case i.Kind == expr.LiteralNode && isKey:
+			segs = append(segs, segment{off: i.Pos, key: key})
+			continue
+		case i.Kind == expr.LiteralNode && isNumber && index >= 0 && index == float64(int(index)):
+			segs = append(segs, segment{off: i.Pos, index: int(index), isIndex: true})
+			continue
+		}
+		ok = false
+		c.typeOf(i, sc)
+	}
+	return root, segs, ok
+}
+
+// pathType returns the type of the value found at path, reporting the paths
+// that can't exist.
+func (c *checker) pathType(path *expr.Node, sc *scope) *typ {
+	root, segs, ok := c.segments(path, sc)
+	if root.Kind != expr.NameNode {
+		c.typeOf(root, sc)
+		return anyType
+	}
+
+	var t *typ
+	switch {
+	case slices.Contains(sc.bound, root.Name):
+		return anyType
+	case root.Name == "subject":
+		t = stringType
+	case root.Name == "tokens":
+		t = &typ{kind: kindList, elem: stringType}
+		if len(segs) > 0 && segs[0].isIndex && sc.tokens >= 0 && segs[0].index >= sc.tokens {
+			c.errorf(c.at(segs[0].off), "the trigger subject only has %d tokens", sc.tokens)
+		}
+	case root.Name == "payload":
+		t = sc.payload
+	case root.Name == "state":
+		t = anyType
+		if c.prog.state != nil {
+			t = c.prog.state
+		}
+	case root.Name == "response":
+		if !sc.response {
+			c.errorf(c.at(root.Pos), "response is only set after a request or http action")
+		}
+		t = anyType
+	default:
+		c.errorf(c.at(root.Pos), "unknown name %q, expected subject, tokens, payload, state or response", root.Name)
+		return anyType
+	}
+
+	name := root.Name
+	for _, seg := range segs {
+		switch {
+		case t.kind == kindAny:
+			return anyType
+		case seg.isIndex && t.kind == kindList:
+			t = t.elem
+		case !seg.isIndex && t.kind == kindObject && len(t.order) == 0:
+			return anyType
+		case !seg.isIndex && t.kind == kindObject:
+			f, ok := t.fields[seg.key]
+			if !ok {
+				c.errorf(c.at(seg.off), "%s has no key %q, known keys are: %s", name, seg.key, strings.Join(t.order, ", "))
+				return anyType
+			}
+			t = f.typ
+		default:
+			c.errorf(c.at(seg.off), "%s is a %s, it can't be indexed with %s", name, t, segmentText(seg))
+			return anyType
+		}
+		name += segmentText(seg)
+	}
+	if !ok {
+		return anyType
+	}
+	return t
+}
+
+func segmentText(seg segment) string {
+	if seg.isIndex {
+		return fmt.Sprintf("[%d]", seg.index)
+	}
+	return "." + seg.key
+}
+
+// action compiles an action.
+func (c *checker) action(n actionNode, sc *scope) Action {
+	switch n.kind {
+	case "publish", "request":
+		msg := &Message{Timeout: n.timeout, Subject: c.text(n.subject, sc, "the subject")}
+		msg.Payload = c.payload(n, msg.Subject, sc)
+		if n.kind == "request" {
+			sc.response = true
+			return Action{Request: msg}
+		}
+		return Action{Publish: msg}
+
+	case "http":
+		call := &HTTPCall{Method: n.method, Timeout: n.timeout, URL: c.text(n.url, sc, "the URL")}
+		if n.body != nil {
+			call.Body, _ = c.value(n.body, sc)
+		}
+		if n.headers != nil {
+			call.Headers = make(map[string]string, len(n.headers.Keys))
+			for i, key := range n.headers.Keys {
+				call.Headers[key] = c.text(n.headers.Children[i], sc, "header "+key)
+			}
+		}
+		sc.response = true
+		return Action{HTTP: call}
+
+	case "delay":
+		if n.delay <= 0 {
+			c.errorf(n.pos, "delay must be positive")
+		}
+		return Action{Delay: n.delay}
+
+	case "timer":
+		if n.after <= 0 {
+			c.errorf(n.pos, "the delay of a timer must be positive")
+		}
+		timer := &TimerAction{Key: c.text(n.timer, sc, "the key"), After: n.after, Subject: c.text(n.subject, sc, "the subject")}
+		timer.Payload = c.payload(n, timer.Subject, sc)
+		return Action{Timer: timer}
+
+	case "cancel":
+		return Action{CancelTimer: c.text(n.timer, sc, "the key")}
+
+	default: // set
+		value, t := c.value(n.value, sc)
+		if c.prog.state != nil {
+			if f, ok := c.prog.state.fields[n.key]; !ok {
+				c.errorf(n.pos, "state has no key %q, known keys are: %s", n.key, strings.Join(c.prog.state.order, ", "))
+			} else if value != nil {
+				c.assignable(c.nodePos(n.value), "state."+n.key, f.typ, t)
+			}
+		}
+		return Action{Set: map[string]any{n.key: value}}
+	}
+}
+
+// payload compiles the payload of an action publishing to subject, nil when
+// it has none.
+func (c *checker) payload(n actionNode, subject string, sc *scope) any {
+	if n.payload == nil {
+		return nil
+	}
+	payload, payloadType := c.value(n.payload, sc)
+	// Payloads published to a declared subject must match its type
+	if !strings.Contains(subject, "{{") {
+		if declared := c.payloadType(subject); declared.kind != kindAny {
+			c.assignable(c.nodePos(n.payload), "payload of "+subject, declared, payloadType)
+		}
+	}
+	return payload
+}
+
+// value compiles a value expression. Literals, lists and objects are kept as
+// they are, other expressions become templates keeping their type.
+func (c *checker) value(n *expr.Node, sc *scope) (any, *typ) {
+	switch n.Kind {
+	case expr.LiteralNode:
+		return n.Value, literalType(n.Value)
+
+	case expr.ListNode:
+		items := make([]any, len(n.Children))
+		elem := anyType
+		for i, item := range n.Children {
+			var t *typ
+			items[i], t = c.value(item, sc)
+			if i == 0 {
+				elem = t
+			} else if elem.kind != t.kind {
+				elem = anyType
+			}
+		}
+		return items, &typ{kind: kindList, elem: elem}
+
+	case expr.ObjectNode:
+		object := make(map[string]any, len(n.Keys))
+		t := &typ{kind: kindObject, fields: make(map[string]*field, len(n.Keys))}
+		for i, key := range n.Keys {
+			var valueType *typ
+			object[key], valueType = c.value(n.Children[i], sc)
+			t.fields[key] = &field{pos: c.nodePos(n.Children[i]), typ: valueType}
+			t.order = append(t.order, key)
+		}
+		return object, t
+	}
+
+	return "{{ " + n.String() + " }}", c.typeOf(n, sc)
+}
+
+// text compiles a value that must be a string. Numbers are formatted.
+func (c *checker) text(n *expr.Node, sc *scope, what string) string {
+	value, t := c.value(n, sc)
+	s, ok := value.(string)
+	if !ok || (t.kind != kindString && t.kind != kindNumber && t.kind != kindAny) {
+		c.errorf(c.nodePos(n), "%s must be a string, found a %s", what, t)
+	}
+	return s
+}
+
+// assignable reports an error unless values of type actual can be used where
+// type expected is declared.
+func (c *checker) assignable(at pos, what string, expected, actual *typ) {
+	if err := checkAssignable(expected, actual); err != nil {
+		c.errorf(at, "%s: %v", what, err)
+	}
+}
+
+func checkAssignable(expected, actual *typ) error {
+	switch {
+	case expected.kind == kindAny || actual.kind == kindAny || actual.kind == kindNull:
+		return nil
+	case expected.kind != actual.kind:
+		return fmt.Errorf("expected %s, found %s", expected, actual)
+	case expected.kind == kindList:
+		if err := checkAssignable(expected.elem, actual.elem); err != nil {
+			return fmt.Errorf("items: %w", err)
+		}
+	case expected.kind == kindObject && len(expected.order) > 0 && actual.fields != nil:
+		for _, key := range expected.order {
+			f := expected.fields[key]
+			value, ok := actual.fields[key]
+			if !ok {
+				if !f.optional {
+					return fmt.Errorf("missing key %q", key)
+				}
+				continue
+			}
+			if err := checkAssignable(f.typ, value.typ); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		for _, key := range actual.order {
+			if _, ok := expected.fields[key]; !ok {
+				return fmt.Errorf("unknown key %q, known keys are: %s", key, strings.Join(expected.order, ", "))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package rules
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"undeclared payload", `when subject "a" if payload.value > "x" and payload.name then publish "b"`},
+		{"declared payload", "declare payload \"s.*\" {value: number, unit?: string}\nwhen subject \"s.*\" if payload.value > 20 and payload.unit == \"C\" then publish \"b\" {room: tokens[1]}"},
+		{"string concatenation", `when subject "a" then publish "b" {label: "value " + 1}`},
+		{"lists", "declare payload \"a\" {tags: [string]}\nwhen subject \"a\" if payload.tags contains \"x\" then publish \"b\""},
+		{"declared state", "declare state {mode: string}\nwhen subject \"a\" if state.mode == \"home\" then set state.mode = \"away\""},
+		{"response", `when subject "a" then request "b" timeout 2s publish "c" {answer: response.value}`},
+		{"remainder wildcard", `when subject "a.>" then publish "c" {x: tokens[5]}`},
+		{"functions", "declare payload \"a\" {items: [{name: string}], unit?: string}\nwhen subject \"a\" if (payload.unit ?? 'C') == \"C\" then publish \"b\" {names: map(payload.items, i => upper(i.name))}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileSource(tt.src); err != nil {
+				t.Errorf("compile: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "comparison of declared types",
+			src:  "declare payload \"s.*\" {value: number}\nwhen subject \"s.*\" if payload.value > \"x\" then publish \"b\"",
+			want: []string{`2:37: > can't compare payload.value (number) with "x" (string)`},
+		},
+		{
+			name: "unknown key",
+			src:  "declare payload \"s.*\" {value: number}\nwhen subject \"s.*\" if payload.valu > 1 then publish \"b\"",
+			want: []string{`2:31: payload has no key "valu", known keys are: value`},
+		},
+		{
+			name: "condition not a bool",
+			src:  "declare payload \"s\" {name: string}\nwhen subject \"s\" if payload.name then publish \"b\"",
+			want: []string{"2:21: payload.name is a string, not a bool"},
+		},
+		{
+			name: "arithmetic",
+			src:  `when subject "a" if 1 + "x" == 2 then publish "b"`,
+			want: []string{`1:29: comparing (1 + "x") (string) with 2 (number)`},
+		},
+		{
+			name: "negation",
+			src:  "declare payload \"a\" {name: string}\nwhen subject \"a\" then publish \"b\" {x: -payload.name}",
+			want: []string{`2:39: - requires a number, found a string`},
+		},
+		{
+			name: "unknown state key",
+			src:  "declare state {mode: string}\nwhen subject \"a\" then set state.mood = \"x\"",
+			want: []string{`2:23: state has no key "mood", known keys are: mode`},
+		},
+		{
+			name: "state type",
+			src:  "declare state {mode: string}\nwhen subject \"a\" then set state.mode = 1",
+			want: []string{"2:40: state.mode: expected string, found number"},
+		},
+		{
+			name: "token out of range",
+			src:  `when subject "a.b" then publish "c" {x: tokens[2]}`,
+			want: []string{"1:48: the trigger subject only has 2 tokens"},
+		},
+		{
+			name: "invalid regular expression",
+			src:  `when subject "a" if payload.name matches "(" then publish "b"`,
+			want: []string{"1:42: invalid regular expression"},
+		},
+		{
+			name: "response without request",
+			src:  `when subject "a" then publish "b" {x: response.y}`,
+			want: []string{"1:39: response is only set after a request or http action"},
+		},
+		{
+			name: "delay",
+			src:  `when subject "a" then delay 0s`,
+			want: []string{"1:23: delay must be positive"},
+		},
+		{
+			name: "duplicate rule",
+			src:  "rule r\nwhen subject \"a\" then publish \"b\"\nrule r\nwhen subject \"c\" then publish \"d\"",
+			want: []string{"3:1: rule r is already defined at test.rules:1"},
+		},
+		{
+			// Errors are sorted by position
+			name: "several errors",
+			src:  "declare state {mode: string}\nwhen subject \"a\" then set state.mode = 1\nwhen subject \"a.b\" then publish \"c\" {x: tokens[2]}",
+			want: []string{"2:40: state.mode", "3:48: the trigger subject"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErrors(t, tt.src, tt.want)
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/jsonpath"
+)
+
+// Condition operators
+const (
+	OpEq       = "eq"
+	OpNe       = "ne"
+	OpGt       = "gt"
+	OpGte      = "gte"
+	OpLt       = "lt"
+	OpLte      = "lte"
+	OpIn       = "in"
+	OpContains = "contains"
+	OpMatches  = "matches"
+	OpExists   = "exists"
+	OpMissing  = "missing"
+)
+
+// What happens when a rule fires while a previous run is still going, e.g.
+// waiting on a delay action
+const (
+	// Both runs go on
+	ModeParallel = "parallel"
+	// The new run is ignored
+	ModeSingle = "single"
+	// The previous run is canceled
+	ModeRestart = "restart"
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+// rulesConfig is the module configuration as found in ModuleConfig.Config.
+type rulesConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section
+	Auth bool `mapstructure:"auth"`
+	// Default timeout of request actions
+	RequestTimeout time.Duration `mapstructure:"request_timeout" validate:"min=0"`
+	// Default timeout of http actions
+	HTTPTimeout time.Duration `mapstructure:"http_timeout" validate:"min=0"`
+	// Initial values of the shared state, set when the key has no value yet
+	State map[string]any `mapstructure:"state"`
+	Rules []Rule         `mapstructure:"rules"`
+	// Rules files, written in the rules language (see parser.go). Glob patterns
+	// are allowed, relative paths start from the working directory. The files
+	// are reloaded when they change.
+	Files []string `mapstructure:"files"`
+}
+
+// Rule runs its actions when a message is published to its trigger subject
+// and every condition holds.
+//
+// Conditions and templates read a document made of the message subject, its
+// tokens, its JSON payload, the shared state and, once a request or http
+// action ran, its response:
+//
+//	{"subject": "sensors.kitchen.temp", "tokens": ["sensors", "kitchen", "temp"],
+//	 "payload": {"value": 27}, "state": {"mode": "home"}, "response": ...}
+//
+// Strings of actions may contain templates such as "{{ payload.value }}",
+// whose content is an expression of package expr, e.g. "{{ round(payload.value)
+// }}". A string made of a single template is replaced by the value itself,
+// keeping its type.
+type Rule struct {
+	Name        string `mapstructure:"name" validate:"required,pattern=^[A-Za-z0-9_-]+$"`
+	Description string `mapstructure:"description"`
+	// Defaults to true
+	Enabled *bool   `mapstructure:"enabled"`
+	Trigger Trigger `mapstructure:"trigger"`
+	// Every condition must hold for the actions to run
+	Conditions []Condition `mapstructure:"conditions"`
+	// Run in order, stopping at the first failure
+	Actions []Action `mapstructure:"actions" validate:"required"`
+	// One of parallel (default), single or restart
+	Mode string `mapstructure:"mode" validate:"oneof=parallel single restart"`
+
+	// Where the rule is defined, file:line for the rules of files
+	source string
+}
+
+// Trigger defines the messages a rule reacts to.
+type Trigger struct {
+	// NATS subject, wildcards allowed
+	Subject string `mapstructure:"subject" validate:"required,pattern=^[^$\\s][^\\s]*$"`
+	// Only react to the last message of a subject once none was received on
+	// it for that long, e.g. to wait for a sensor to settle
+	Debounce time.Duration `mapstructure:"debounce" validate:"min=0"`
+	// Only react to the first message of a subject, then ignore it for that
+	// long. Exclusive with debounce.
+	Throttle time.Duration `mapstructure:"throttle" validate:"min=0"`
+}
+
+// Condition compares the value found at Path with Value, evaluates Expr, or
+// combines other conditions with All, Any or Not.
+type Condition struct {
+	// JSON path in the document, e.g. payload.value or state.mode
+	Path string `mapstructure:"path"`
+	// Expression that must be true, e.g. payload.value > state.threshold
+	Expr string `mapstructure:"expr"`
+	// One of eq (default), ne, gt, gte, lt, lte, in, contains, matches, exists or missing
+	Op string `mapstructure:"op" validate:"oneof=eq ne gt gte lt lte in contains matches exists missing"`
+	// A list for in, a regular expression for matches, unused by exists and missing
+	Value any `mapstructure:"value"`
+	// Every condition holds
+	All []Condition `mapstructure:"all"`
+	// At least one condition holds
+	Any []Condition `mapstructure:"any"`
+	// The condition does not hold
+	Not *Condition `mapstructure:"not"`
+}
+
+// Action is one step of a rule. Exactly one of its fields must be set.
+type Action struct {
+	Publish *Message  `mapstructure:"publish"`
+	Request *Message  `mapstructure:"request"`
+	HTTP    *HTTPCall `mapstructure:"http"`
+	// Wait before running the next action
+	Delay time.Duration `mapstructure:"delay"`
+	// Update the shared state: key -> value, templates allowed. A null value deletes the key.
+	Set map[string]any `mapstructure:"set"`
+	// Publish a message later, replacing the pending timer with the same key
+	Timer *TimerAction `mapstructure:"timer"`
+	// Cancel the pending timer with this key, templates allowed
+	CancelTimer string `mapstructure:"cancel_timer"`
+}
+
+// TimerAction publishes a message after a delay, unless it is canceled or
+// replaced in the meantime. Timers are kept across restarts, see app.Timers.
+type TimerAction struct {
+	// Templates allowed, e.g. "hall-light-{{ tokens[1] }}"
+	Key   string        `mapstructure:"key"`
+	After time.Duration `mapstructure:"after"`
+	// Templates allowed
+	Subject string `mapstructure:"subject"`
+	// Encoded as JSON, templates allowed. The payload of the triggering message
+	// is sent when omitted.
+	Payload any `mapstructure:"payload"`
+}
+
+// Message is published, or sent as a request, to NATS.
+type Message struct {
+	// Templates allowed
+	Subject string `mapstructure:"subject"`
+	// Encoded as JSON, templates allowed. The payload of the triggering message
+	// is sent when omitted.
+	Payload any `mapstructure:"payload"`
+	// Requests only, defaults to request_timeout
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// HTTPCall is an HTTP request made by a rule. Its response is available as
+// response.status and response.body.
+type HTTPCall struct {
+	// Defaults to GET, or POST with a body
+	Method string `mapstructure:"method"`
+	// Templates allowed
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	// Encoded as JSON unless it is a string, templates allowed
+	Body any `mapstructure:"body"`
+	// Defaults to http_timeout
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// Names of the document read by conditions and templates. The response is
+// only set once a request or http action ran.
+var (
+	conditionNames = []string{"subject", "tokens", "payload", "state"}
+	templateNames  = []string{"subject", "tokens", "payload", "state", "response"}
+)
+
+func parseConfig(name string, config map[string]any) (rulesConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, rulesConfig{
+		RequestTimeout: app.DefaultRequestTimeout,
+		HTTPTimeout:    10 * time.Second,
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	seen := make(map[string]bool)
+	for _, rule := range cfg.Rules {
+		if err := rule.validate(); err != nil {
+			return cfg, err
+		}
+		if seen[rule.Name] {
+			return cfg, fmt.Errorf("%w: duplicate name %q", ErrInvalidRule, rule.Name)
+		}
+		seen[rule.Name] = true
+	}
+
+	if len(cfg.Files) > 0 {
+		fileRules, err := LoadFiles(cfg.Files)
+		if err != nil {
+			return cfg, err
+		}
+		for _, rule := range fileRules {
+			if seen[rule.Name] {
+				return cfg, fmt.Errorf("%w: %s: rule %s is also defined in the config", ErrInvalidRule, rule.source, rule.Name)
+			}
+			seen[rule.Name] = true
+		}
+		cfg.Rules = append(cfg.Rules, fileRules...)
+	}
+
+	return cfg, nil
+}
+
+// Check checks the config of a rules module, along with its rules files.
+func Check(name string, config map[string]any) error {
+	_, err := parseConfig(name, config)
+	return err
+}
+
+// ConfigFiles returns the rules files of config, so they are reloaded when
+// they change.
+func (m *RulesModule) ConfigFiles(config map[string]any) []string {
+	cfg, err := app.DecodeConfig(m.Name(), config, rulesConfig{})
+	if err != nil {
+		return nil
+	}
+	return cfg.Files
+}
+
+// IsEnabled reports whether the rule is enabled.
+func (r Rule) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// validate checks what the tags of the rule fields can't express.
+func (r Rule) validate() error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%w %s: %s", ErrInvalidRule, r.Name, fmt.Sprintf(format, args...))
+	}
+
+	for i, condition := range r.Conditions {
+		if err := condition.validate(); err != nil {
+			return fail("conditions[%d]%v", i, err)
+		}
+	}
+
+	if r.Trigger.Debounce != 0 && r.Trigger.Throttle != 0 {
+		return fail("trigger: debounce and throttle are exclusive")
+	}
+
+	for i, action := range r.Actions {
+		set := 0
+		for _, isSet := range []bool{action.Publish != nil, action.Request != nil, action.HTTP != nil, action.Delay != 0, action.Set != nil, action.Timer != nil, action.CancelTimer != ""} {
+			if isSet {
+				set++
+			}
+		}
+		if set != 1 {
+			return fail("actions[%d]: exactly one of publish, request, http, delay, set, timer or cancel_timer is required", i)
+		}
+
+		switch {
+		case action.Publish != nil || action.Request != nil:
+			msg := action.Publish
+			if msg == nil {
+				msg = action.Request
+			}
+			if msg.Subject == "" {
+				return fail("actions[%d]: subject is required", i)
+			}
+			// A rule publishing to its own trigger would fire forever
+			if action.Publish != nil && !strings.Contains(msg.Subject, "{{") && app.SubjectMatches(r.Trigger.Subject, msg.Subject) {
+				return fail("actions[%d]: publishing to %s would trigger the rule again", i, msg.Subject)
+			}
+		case action.HTTP != nil:
+			if action.HTTP.URL == "" {
+				return fail("actions[%d]: url is required", i)
+			}
+			if action.HTTP.Method != "" && strings.ContainsAny(action.HTTP.Method, " \t/") {
+				return fail("actions[%d]: invalid method %q", i, action.HTTP.Method)
+			}
+		case action.Delay < 0:
+			return fail("actions[%d]: delay must be positive", i)
+		case action.Timer != nil:
+			switch {
+			case action.Timer.Key == "":
+				return fail("actions[%d]: key is required", i)
+			case action.Timer.Subject == "":
+				return fail("actions[%d]: subject is required", i)
+			case action.Timer.After <= 0:
+				return fail("actions[%d]: after must be positive", i)
+			}
+		}
+
+		if err := checkTemplates(action); err != nil {
+			return fail("actions[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the condition, and the conditions it combines. Errors
+// start with the path of the invalid condition below this one.
+func (c Condition) validate() error {
+	set := 0
+	for _, isSet := range []bool{c.Path != "", c.Expr != "", c.All != nil, c.Any != nil, c.Not != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New(": exactly one of path, expr, all, any or not is required")
+	}
+
+	switch {
+	case c.All != nil || c.Any != nil:
+		key, conditions := "all", c.All
+		if c.Any != nil {
+			key, conditions = "any", c.Any
+		}
+		for i, condition := range conditions {
+			if err := condition.validate(); err != nil {
+				return fmt.Errorf(".%s[%d]%w", key, i, err)
+			}
+		}
+		return nil
+	case c.Not != nil:
+		if err := c.Not.validate(); err != nil {
+			return fmt.Errorf(".not%w", err)
+		}
+		return nil
+	case c.Expr != "":
+		if _, err := compileExpr(c.Expr); err != nil {
+			return fmt.Errorf(": expr %q: %w", c.Expr, err)
+		}
+		return nil
+	}
+
+	if _, err := jsonpath.Parse(c.Path); err != nil {
+		return fmt.Errorf(": %w", err)
+	}
+	switch c.Op {
+	case OpMatches:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return errors.New(": matches requires a regular expression")
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf(": %w", err)
+		}
+	case OpIn:
+		if _, ok := c.Value.([]any); !ok {
+			return errors.New(": in requires a list")
+		}
+	}
+	return nil
+}
+
+// checkTemplates checks the templates found in v.
+func checkTemplates(v any) error {
+	var err error
+	walkStrings(v, func(s string) {
+		if _, tplErr := compileTemplate(s); tplErr != nil && err == nil {
+			err = fmt.Errorf("template %q: %w", s, tplErr)
+		}
+	})
+	return err
+}
+
+// walkStrings calls fn with every string of an action or of a decoded value.
+func walkStrings(v any, fn func(string)) {
+	switch v := v.(type) {
+	case string:
+		fn(v)
+	case []any:
+		for _, item := range v {
+			walkStrings(item, fn)
+		}
+	case map[string]any:
+		for key, item := range v {
+			fn(key)
+			walkStrings(item, fn)
+		}
+	case map[string]string:
+		for key, item := range v {
+			fn(key)
+			fn(item)
+		}
+	case Action:
+		if v.Publish != nil {
+			walkStrings(*v.Publish, fn)
+		}
+		if v.Request != nil {
+			walkStrings(*v.Request, fn)
+		}
+		if v.HTTP != nil {
+			fn(v.HTTP.URL)
+			walkStrings(v.HTTP.Headers, fn)
+			walkStrings(v.HTTP.Body, fn)
+		}
+		walkStrings(v.Set, fn)
+		if v.Timer != nil {
+			fn(v.Timer.Key)
+			walkStrings(Message{Subject: v.Timer.Subject, Payload: v.Timer.Payload}, fn)
+		}
+		if v.CancelTimer != "" {
+			fn(v.CancelTimer)
+		}
+	case Message:
+		fn(v.Subject)
+		walkStrings(v.Payload, fn)
+	}
+}
+
+// method returns the HTTP method of the call.
+func (c HTTPCall) method() string {
+	switch {
+	case c.Method != "":
+		return strings.ToUpper(c.Method)
+	case c.Body != nil:
+		return http.MethodPost
+	default:
+		return http.MethodGet
+	}
+}
+
+// ConfigSchema describes the rules module configuration.
+func (m *RulesModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(rulesConfig{})
+}
@@ -0,0 +1,609 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+	"github.com/lstep/surroundhome/surserver/internal/jsonpath"
+)
+
+// Maximum size of the body of an HTTP response kept for the next actions
+const maxResponseSize = 1 << 20
+
+// Executor performs the side effects of actions. The module uses the NATS
+// connection and an HTTP client; simulations replace them.
+type Executor interface {
+	Publish(subject string, data []byte) error
+	Request(subject string, data []byte, timeout time.Duration) ([]byte, error)
+	// Do sends an HTTP request and returns the status and body of the response
+	Do(req *http.Request) (int, []byte, error)
+	// Sleep waits for d, or until ctx is done
+	Sleep(ctx context.Context, d time.Duration) error
+	// Schedule publishes a message after a delay, replacing the pending timer
+	// with the same key
+	Schedule(key, subject string, data []byte, after time.Duration) error
+	// CancelTimer cancels the pending timer with key, if any
+	CancelTimer(key string) error
+}
+
+// liveExecutor is the Executor of the running module. Subjects may be
+// references such as device:lamp, see app.SubjectResolver.
+type liveExecutor struct {
+	pub    app.Publisher
+	client *http.Client
+}
+
+func (e liveExecutor) Publish(subject string, data []byte) error {
+	subject, err := e.pub.ResolveSubject(subject)
+	if err != nil {
+		return err
+	}
+	return e.pub.Publish(subject, data)
+}
+
+func (e liveExecutor) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	subject, err := e.pub.ResolveSubject(subject)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := e.pub.RequestWithTimeout(subject, data, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+func (e liveExecutor) Do(req *http.Request) (int, []byte, error) {
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	return resp.StatusCode, body, err
+}
+
+func (e liveExecutor) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (e liveExecutor) Schedule(key, subject string, data []byte, after time.Duration) error {
+	subject, err := e.pub.ResolveSubject(subject)
+	if err != nil {
+		return err
+	}
+	return e.pub.Timers().Schedule(key, subject, data, after)
+}
+
+func (e liveExecutor) CancelTimer(key string) error {
+	_, err := e.pub.Timers().Cancel(key)
+	return err
+}
+
+// State is the state shared by the rules, read by conditions and templates
+// as "state" and updated by set actions.
+type State struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+func NewState() *State {
+	return &State{values: make(map[string]any)}
+}
+
+// Snapshot returns a copy of the state.
+func (s *State) Snapshot() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.values)
+}
+
+// Set sets key to value, or deletes it when value is nil.
+func (s *State) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == nil {
+		delete(s.values, key)
+		return
+	}
+	s.values[key] = value
+}
+
+// setDefault sets key to value unless it already has a value.
+func (s *State) setDefault(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[key]; !ok {
+		s.values[key] = value
+	}
+}
+
+// Engine evaluates rules against messages and runs their actions.
+type Engine struct {
+	rules  []Rule
+	config rulesConfig
+	state  *State
+	exec   Executor
+	logger *slog.Logger
+}
+
+// NewEngine returns an engine running the enabled rules of config.
+func NewEngine(config rulesConfig, state *State, exec Executor, logger *slog.Logger) *Engine {
+	e := &Engine{config: config, state: state, exec: exec, logger: logger}
+	for _, rule := range config.Rules {
+		if rule.IsEnabled() {
+			e.rules = append(e.rules, rule)
+		}
+	}
+	for key, value := range config.State {
+		state.setDefault(key, value)
+	}
+	return e
+}
+
+// Triggers returns the distinct triggers of the rules.
+func (e *Engine) Triggers() []Trigger {
+	var triggers []Trigger
+	for _, rule := range e.rules {
+		if !slices.Contains(triggers, rule.Trigger) {
+			triggers = append(triggers, rule.Trigger)
+		}
+	}
+	return triggers
+}
+
+// Event is a message received by the engine.
+type Event struct {
+	Subject string
+	Data    []byte
+}
+
+// Match returns the rules of trigger whose conditions hold for ev. A rule is
+// only matched by the messages received through its own trigger, so
+// overlapping triggers don't fire it twice.
+func (e *Engine) Match(trigger Trigger, ev Event) []Rule {
+	doc := e.document(ev)
+
+	var matched []Rule
+	for _, rule := range e.rules {
+		if rule.Trigger != trigger {
+			continue
+		}
+		if holds(rule.Conditions, doc) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// document returns the document conditions and templates are evaluated on.
+func (e *Engine) document(ev Event) map[string]any {
+	tokens := make([]any, 0)
+	for _, token := range strings.Split(ev.Subject, ".") {
+		tokens = append(tokens, token)
+	}
+	return map[string]any{
+		"subject": ev.Subject,
+		"tokens":  tokens,
+		"payload": decode(ev.Data),
+		"state":   e.state.Snapshot(),
+	}
+}
+
+// Run runs the actions of rule for ev, stopping at the first failure.
+func (e *Engine) Run(ctx context.Context, rule Rule, ev Event) error {
+	doc := e.document(ev)
+	for i, action := range rule.Actions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := e.runAction(ctx, action, ev, doc); err != nil {
+			return fmt.Errorf("action %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) runAction(ctx context.Context, action Action, ev Event, doc map[string]any) error {
+	switch {
+	case action.Publish != nil:
+		subject, data, err := e.message(*action.Publish, ev, doc)
+		if err != nil {
+			return err
+		}
+		e.logger.Debug("publishing", "subject", subject)
+		return e.exec.Publish(subject, data)
+
+	case action.Request != nil:
+		subject, data, err := e.message(*action.Request, ev, doc)
+		if err != nil {
+			return err
+		}
+		timeout := action.Request.Timeout
+		if timeout <= 0 {
+			timeout = e.config.RequestTimeout
+		}
+		e.logger.Debug("sending request", "subject", subject, "timeout", timeout)
+		response, err := e.exec.Request(subject, data, timeout)
+		if err != nil {
+			return fmt.Errorf("request to %s: %w", subject, err)
+		}
+		doc["response"] = decode(response)
+
+	case action.HTTP != nil:
+		return e.call(ctx, *action.HTTP, doc)
+
+	case action.Delay > 0:
+		return e.exec.Sleep(ctx, action.Delay)
+
+	case action.Set != nil:
+		state, _ := doc["state"].(map[string]any)
+		state = maps.Clone(state)
+		if state == nil {
+			state = make(map[string]any)
+		}
+		for key, value := range action.Set {
+			value, err := render(value, doc)
+			if err != nil {
+				return err
+			}
+			e.state.Set(key, value)
+			if value == nil {
+				delete(state, key)
+			} else {
+				state[key] = value
+			}
+		}
+		doc["state"] = state
+
+	case action.Timer != nil:
+		rendered, err := render(action.Timer.Key, doc)
+		if err != nil {
+			return err
+		}
+		key := expr.String(rendered)
+		subject, data, err := e.message(Message{Subject: action.Timer.Subject, Payload: action.Timer.Payload}, ev, doc)
+		if err != nil {
+			return err
+		}
+		e.logger.Debug("scheduling timer", "key", key, "subject", subject, "after", action.Timer.After)
+		return e.exec.Schedule(key, subject, data, action.Timer.After)
+
+	case action.CancelTimer != "":
+		rendered, err := render(action.CancelTimer, doc)
+		if err != nil {
+			return err
+		}
+		key := expr.String(rendered)
+		e.logger.Debug("canceling timer", "key", key)
+		return e.exec.CancelTimer(key)
+	}
+	return nil
+}
+
+// message renders the subject and payload of a message.
+func (e *Engine) message(msg Message, ev Event, doc map[string]any) (string, []byte, error) {
+	rendered, err := render(msg.Subject, doc)
+	if err != nil {
+		return "", nil, err
+	}
+	subject := expr.String(rendered)
+	// Templates must not reach the system and JetStream API subjects
+	if !app.ValidPublishSubject(subject) {
+		return "", nil, fmt.Errorf("invalid subject %q", subject)
+	}
+	if msg.Payload == nil {
+		return subject, ev.Data, nil
+	}
+	payload, err := render(msg.Payload, doc)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(payload)
+	return subject, data, err
+}
+
+// call makes an HTTP call and stores its response in doc.
+func (e *Engine) call(ctx context.Context, call HTTPCall, doc map[string]any) error {
+	timeout := call.Timeout
+	if timeout <= 0 {
+		timeout = e.config.HTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var body io.Reader
+	if call.Body != nil {
+		rendered, err := render(call.Body, doc)
+		if err != nil {
+			return err
+		}
+		switch rendered := rendered.(type) {
+		case string:
+			body = strings.NewReader(rendered)
+		default:
+			data, err := json.Marshal(rendered)
+			if err != nil {
+				return err
+			}
+			body = bytes.NewReader(data)
+		}
+	}
+
+	rendered, err := render(call.URL, doc)
+	if err != nil {
+		return err
+	}
+	url := expr.String(rendered)
+	req, err := http.NewRequestWithContext(ctx, call.method(), url, body)
+	if err != nil {
+		return err
+	}
+	if call.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range call.Headers {
+		rendered, err := render(value, doc)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(key, expr.String(rendered))
+	}
+
+	e.logger.Debug("calling", "method", req.Method, "url", url)
+	status, response, err := e.exec.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", req.Method, url, err)
+	}
+	doc["response"] = map[string]any{"status": float64(status), "body": decode(response)}
+	if status >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s: status %d", req.Method, url, status)
+	}
+	return nil
+}
+
+// decode returns data decoded as JSON, or as a string when it isn't JSON.
+func decode(data []byte) any {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return string(data)
+	}
+	return value
+}
+
+// Expressions and templates of the rules, compiled on first use
+var (
+	exprs     sync.Map
+	templates sync.Map
+)
+
+func compileExpr(src string) (*expr.Expr, error) {
+	if e, ok := exprs.Load(src); ok {
+		return e.(*expr.Expr), nil
+	}
+	e, err := expr.Compile(src, conditionNames...)
+	if err != nil {
+		return nil, err
+	}
+	exprs.Store(src, e)
+	return e, nil
+}
+
+func compileTemplate(src string) (*expr.Template, error) {
+	if t, ok := templates.Load(src); ok {
+		return t.(*expr.Template), nil
+	}
+	t, err := expr.ParseTemplate(src, templateNames...)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(src, t)
+	return t, nil
+}
+
+// render replaces the templates found in the strings of v.
+func render(v any, doc map[string]any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v, nil
+		}
+		var value any
+		t, err := compileTemplate(v)
+		if err == nil {
+			value, err = t.Render(doc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", v, err)
+		}
+		return value, nil
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			value, err := render(item, doc)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value
+		}
+		return out, nil
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			renderedKey, err := render(key, doc)
+			if err != nil {
+				return nil, err
+			}
+			value, err := render(item, doc)
+			if err != nil {
+				return nil, err
+			}
+			out[expr.String(renderedKey)] = value
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+// holds reports whether every condition holds on doc.
+func holds(conditions []Condition, doc map[string]any) bool {
+	for _, condition := range conditions {
+		if !condition.eval(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// eval reports whether the condition holds on doc.
+func (c Condition) eval(doc map[string]any) bool {
+	switch {
+	case c.All != nil:
+		return holds(c.All, doc)
+	case c.Any != nil:
+		for _, condition := range c.Any {
+			if condition.eval(doc) {
+				return true
+			}
+		}
+		return false
+	case c.Not != nil:
+		return !c.Not.eval(doc)
+	case c.Expr != "":
+		// Expressions failing to evaluate, e.g. comparing a missing value, don't hold
+		e, err := compileExpr(c.Expr)
+		if err != nil {
+			return false
+		}
+		ok, err := e.Bool(doc)
+		return err == nil && ok
+	}
+
+	value, found := jsonpath.Get(doc, c.Path)
+	return c.holds(value, found)
+}
+
+func (c Condition) holds(value any, found bool) bool {
+	switch c.Op {
+	case OpExists:
+		return found
+	case OpMissing:
+		return !found
+	}
+	if !found {
+		return false
+	}
+
+	switch c.Op {
+	case OpNe:
+		return !equal(value, c.Value)
+	case OpGt, OpGte, OpLt, OpLte:
+		return compare(c.Op, value, c.Value)
+	case OpIn:
+		list, _ := c.Value.([]any)
+		for _, item := range list {
+			if equal(value, item) {
+				return true
+			}
+		}
+		return false
+	case OpContains:
+		switch value := value.(type) {
+		case string:
+			return strings.Contains(value, jsonpath.String(c.Value))
+		case []any:
+			for _, item := range value {
+				if equal(item, c.Value) {
+					return true
+				}
+			}
+		}
+		return false
+	case OpMatches:
+		pattern, _ := c.Value.(string)
+		re, err := regexp.Compile(pattern)
+		return err == nil && re.MatchString(jsonpath.String(value))
+	default:
+		return equal(value, c.Value)
+	}
+}
+
+// equal compares values decoded from JSON with values of the config, where
+// numbers may be integers.
+func equal(a, b any) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(op string, a, b any) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		if !ok {
+			return false
+		}
+		switch op {
+		case OpGt:
+			return x > y
+		case OpGte:
+			return x >= y
+		case OpLt:
+			return x < y
+		default:
+			return x <= y
+		}
+	}
+
+	x, okA := a.(string)
+	y, okB := b.(string)
+	if !okA || !okB {
+		return false
+	}
+	switch op {
+	case OpGt:
+		return x > y
+	case OpGte:
+		return x >= y
+	case OpLt:
+		return x < y
+	default:
+		return x <= y
+	}
+}
+
+func number(v any) (float64, bool) {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
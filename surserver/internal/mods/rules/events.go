@@ -0,0 +1,186 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+)
+
+// RecordedEvent is a message replayed by simulations. Events files hold one
+// JSON event per line:
+//
+//	{"subject": "sensors.kitchen.temp", "payload": {"value": 27}, "time": "2024-06-01T12:00:00Z"}
+type RecordedEvent struct {
+	Subject string `json:"subject"`
+	// Strings are sent as is, other values encoded as JSON
+	Payload any `json:"payload"`
+	// When the message was published, optional
+	Time *time.Time `json:"time,omitempty"`
+}
+
+var recordedEventSchema = app.Schema{
+	"type":     "object",
+	"required": []any{"subject"},
+	"properties": map[string]any{
+		"subject": app.Schema{"type": "string"},
+		"payload": app.Schema{},
+		"time":    app.Schema{"type": "string", "format": "date-time"},
+	},
+}
+
+// event returns the message of the recorded event.
+func (r RecordedEvent) event() (Event, error) {
+	if s, ok := r.Payload.(string); ok {
+		return Event{Subject: r.Subject, Data: []byte(s)}, nil
+	}
+	data, err := json.Marshal(r.Payload)
+	return Event{Subject: r.Subject, Data: data}, err
+}
+
+// EventReader reads recorded events, returning io.EOF after the last one.
+type EventReader interface {
+	Next() (RecordedEvent, error)
+}
+
+// sliceReader reads the events of a slice.
+type sliceReader []RecordedEvent
+
+func (r *sliceReader) Next() (RecordedEvent, error) {
+	if len(*r) == 0 {
+		return RecordedEvent{}, io.EOF
+	}
+	ev := (*r)[0]
+	*r = (*r)[1:]
+	return ev, nil
+}
+
+// fileReader reads the events of an events file.
+type fileReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewFileReader returns a reader of the events of an events file, one JSON
+// event per line. Empty lines are ignored.
+func NewFileReader(r io.Reader) EventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBodySize)
+	return &fileReader{scanner: scanner}
+}
+
+func (r *fileReader) Next() (RecordedEvent, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := r.scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var ev RecordedEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return ev, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		if ev.Subject == "" {
+			return ev, fmt.Errorf("line %d: subject is required", r.line)
+		}
+		return ev, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return RecordedEvent{}, fmt.Errorf("line %d: %w", r.line+1, err)
+	}
+	return RecordedEvent{}, io.EOF
+}
+
+// StreamOptions selects the messages of a JetStream stream to replay.
+type StreamOptions struct {
+	Stream string
+	// Only replay the messages of these subjects, wildcards allowed. All
+	// messages of the stream when empty.
+	Filter string
+	// Only replay the messages published since then, all messages when zero
+	Since time.Time
+	// Stop after that many messages, no limit when zero
+	Limit int
+}
+
+// ParseSince parses the start of the events to replay, either a time in RFC
+// 3339 format or a duration before now, e.g. 24h.
+func ParseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid since %q: expected a duration such as 24h or a time such as 2024-06-01T12:00:00Z", s)
+	}
+	return t, nil
+}
+
+// How long to wait for the next message of a stream before assuming there
+// is none left, e.g. when the filter matches nothing
+const streamIdleTimeout = 2 * time.Second
+
+// StreamReader reads the messages of a stream with an ordered consumer,
+// which doesn't change the stream.
+type StreamReader struct {
+	sub  *nats.Subscription
+	opts StreamOptions
+	read int
+	done bool
+}
+
+// NewStreamReader returns a reader of the messages stored in a stream, from
+// the oldest to the last one stored when the reader was created.
+func NewStreamReader(js nats.JetStreamContext, opts StreamOptions) (*StreamReader, error) {
+	info, err := js.StreamInfo(opts.Stream)
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", opts.Stream, err)
+	}
+
+	subOpts := []nats.SubOpt{nats.BindStream(opts.Stream), nats.OrderedConsumer()}
+	if opts.Since.IsZero() {
+		subOpts = append(subOpts, nats.DeliverAll())
+	} else {
+		subOpts = append(subOpts, nats.StartTime(opts.Since))
+	}
+	sub, err := js.SubscribeSync(opts.Filter, subOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", opts.Stream, err)
+	}
+
+	done := info.State.Msgs == 0 || info.State.LastTime.Before(opts.Since)
+	return &StreamReader{sub: sub, opts: opts, done: done}, nil
+}
+
+func (r *StreamReader) Next() (RecordedEvent, error) {
+	if r.done || (r.opts.Limit > 0 && r.read >= r.opts.Limit) {
+		return RecordedEvent{}, io.EOF
+	}
+
+	msg, err := r.sub.NextMsg(streamIdleTimeout)
+	if errors.Is(err, nats.ErrTimeout) {
+		return RecordedEvent{}, io.EOF
+	}
+	if err != nil {
+		return RecordedEvent{}, fmt.Errorf("stream %s: %w", r.opts.Stream, err)
+	}
+	r.read++
+
+	ev := RecordedEvent{Subject: msg.Subject, Payload: decode(msg.Data)}
+	if meta, err := msg.Metadata(); err == nil {
+		ev.Time = &meta.Timestamp
+		r.done = meta.NumPending == 0
+	}
+	return ev, nil
+}
+
+// Close deletes the consumer of the reader.
+func (r *StreamReader) Close() error {
+	return r.sub.Unsubscribe()
+}
@@ -0,0 +1,194 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDuration
+	// Operators and punctuation, the text of the token tells which
+	tokPunct
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of file"
+	case tokIdent:
+		return "identifier"
+	case tokString:
+		return "string"
+	case tokNumber:
+		return "number"
+	case tokDuration:
+		return "duration"
+	default:
+		return "punctuation"
+	}
+}
+
+// pos is a position in a rules file, lines and columns start at 1.
+type pos struct {
+	line, col int
+}
+
+type token struct {
+	kind tokenKind
+	// Source text, unquoted for strings
+	text string
+	pos  pos
+	num  float64
+	dur  time.Duration
+	// Byte offset in the file
+	off int
+}
+
+// describe returns the token as shown in error messages.
+func (t token) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// Operators, longest first
+var puncts = []string{"==", "!=", ">=", "<=", "&&", "||", "??", "=>", ">", "<", "!", "(", ")", "[", "]", "{", "}", ",", ":", ".", ";", "=", "+", "-", "*", "/", "%", "?"}
+
+// lex splits src into tokens. Comments start with # and run to the end of the
+// line. It also returns the code of src, where comments and semicolons are
+// blanked out for package expr to parse the expressions.
+func lex(file string, src string) ([]token, string, error) {
+	var tokens []token
+	code := []byte(src)
+	line, col := 1, 1
+	i := 0
+
+	advance := func(n int) {
+		for _, r := range src[i : i+n] {
+			if r == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+		}
+		i += n
+	}
+
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		start := pos{line, col}
+		off := i
+
+		switch {
+		case unicode.IsSpace(r):
+			advance(size)
+
+		case r == '#':
+			end := strings.IndexByte(src[i:], '\n')
+			if end < 0 {
+				end = len(src) - i
+			}
+			copy(code[i:i+end], strings.Repeat(" ", end))
+			advance(end)
+
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(src) && rune(src[end]) != r && src[end] != '\n' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) || rune(src[end]) != r {
+				return nil, "", &Error{File: file, Line: start.line, Col: start.col, Msg: "unterminated string"}
+			}
+			text, err := expr.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, "", &Error{File: file, Line: start.line, Col: start.col, Msg: "invalid string: " + err.Error()}
+			}
+			tokens = append(tokens, token{kind: tokString, text: text, pos: start, off: off})
+			advance(end + 1 - i)
+
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(src) && (isIdentRune(rune(src[end])) || unicode.IsDigit(rune(src[end])) ||
+				(src[end] == '.' && end+1 < len(src) && unicode.IsDigit(rune(src[end+1])))) {
+				// Signed exponents, as in 1e-3
+				if (src[end] == 'e' || src[end] == 'E') && end+2 < len(src) && (src[end+1] == '+' || src[end+1] == '-') && unicode.IsDigit(rune(src[end+2])) {
+					end++
+				}
+				end++
+			}
+			text := src[i:end]
+			tok := token{text: text, pos: start, off: off}
+			if n, err := strconv.ParseFloat(text, 64); err == nil {
+				tok.kind, tok.num = tokNumber, n
+			} else if d, err := time.ParseDuration(text); err == nil {
+				tok.kind, tok.dur = tokDuration, d
+			} else {
+				return nil, "", &Error{File: file, Line: start.line, Col: start.col, Msg: fmt.Sprintf("invalid number or duration %q", text)}
+			}
+			tokens = append(tokens, tok)
+			advance(end - i)
+
+		case isIdentRune(r):
+			end := i
+			for end < len(src) {
+				r, size := utf8.DecodeRuneInString(src[end:])
+				if !isIdentRune(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:end], pos: start, off: off})
+			advance(end - i)
+
+		default:
+			matched := ""
+			for _, punct := range puncts {
+				if strings.HasPrefix(src[i:], punct) {
+					matched = punct
+					break
+				}
+			}
+			if matched == "" {
+				return nil, "", &Error{File: file, Line: start.line, Col: start.col, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+			if matched == ";" {
+				code[i] = ' '
+			}
+			tokens = append(tokens, token{kind: tokPunct, text: matched, pos: start, off: off})
+			advance(len(matched))
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: pos{line, col}, off: len(src)}), string(code), nil
+}
+
+// position returns the position of byte offset off of src.
+func position(src string, off int) pos {
+	lineStart := strings.LastIndexByte(src[:off], '\n') + 1
+	return pos{line: 1 + strings.Count(src[:off], "\n"), col: 1 + utf8.RuneCountInString(src[lineStart:off])}
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
@@ -0,0 +1,504 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+// Rules files define rules with a small language:
+//
+//	# Types of the payloads, checked by the rules using them
+//	declare payload "sensors.*.temp" {value: number, unit?: string}
+//	declare state {mode: string, cooling: bool}
+//
+//	rule cool_down "Cool the room down"
+//	mode single
+//	when subject "sensors.*.temp"
+//	if payload.value > 25 and state["mode"] == "home"
+//	then
+//	    publish "hvac.cool" {room: tokens[1], temperature: payload.value}
+//	    set state.cooling = true
+//	end
+//
+// The rule line, the mode and the end are optional:
+//
+//	when subject "doors.*" if payload.open then publish "alerts.door" {door: tokens[1]}
+//
+// The subject may be followed by debounce DURATION or throttle DURATION, see
+// Trigger.
+//
+// Actions are publish SUBJECT [PAYLOAD], request SUBJECT [PAYLOAD] [timeout
+// DURATION], http [METHOD] URL [BODY] [headers {...}] [timeout DURATION],
+// delay DURATION, set state.KEY = VALUE, timer KEY after DURATION publish
+// SUBJECT [PAYLOAD] and cancel timer KEY:
+//
+//	when subject "motion.hall" then
+//	    publish "lights.hall.on"
+//	    timer "hall-light" after 10m publish "lights.hall.off"
+//
+// Conditions and values are expressions of package expr, parsed by it and
+// type checked against the declarations. They end where the next keyword of
+// the rule starts:
+//
+//	if payload.value > state.threshold + 2 and payload.unit ?? "C" == "C"
+//	then set state.delta = round(payload.value - state.threshold)
+
+// Keywords ending the actions of a rule without end
+var ruleStarts = []string{"rule", "when", "declare", "end"}
+
+var actionKeywords = []string{"publish", "request", "http", "delay", "set", "timer", "cancel"}
+
+// Keywords that can't be names in expressions
+var reserved = []string{"rule", "mode", "disabled", "when", "if", "then", "end", "declare", "and", "or", "not", "in", "contains", "matches", "timeout", "headers", "after", "debounce", "throttle"}
+
+type ruleNode struct {
+	pos
+	file        string
+	name        string
+	description string
+	mode        string
+	disabled    bool
+	subject     string
+	subjectPos  pos
+	debounce    time.Duration
+	throttle    time.Duration
+	cond        *expr.Node
+	actions     []actionNode
+}
+
+type actionNode struct {
+	pos
+	// One of actionKeywords
+	kind    string
+	subject *expr.Node
+	payload *expr.Node
+	method  string
+	url     *expr.Node
+	body    *expr.Node
+	headers *expr.Node
+	timeout time.Duration
+	delay   time.Duration
+	key     string
+	value   *expr.Node
+	// Key and delay of timers
+	timer *expr.Node
+	after time.Duration
+}
+
+// payloadDecl declares the type of the payloads published to subject.
+type payloadDecl struct {
+	pos
+	file    string
+	subject string
+	typ     *typ
+}
+
+// program is the content of a set of rules files.
+type program struct {
+	payloads []payloadDecl
+	// Declared state keys, nil when the state is not declared
+	state *typ
+	rules []ruleNode
+	errs  Errors
+	// Code of the files, where expressions are read
+	sources map[string]string
+}
+
+// parseError stops the parsing of a rule or declaration.
+type parseError struct {
+	err *Error
+}
+
+type parser struct {
+	file   string
+	code   string
+	tokens []token
+	i      int
+}
+
+// parse adds the content of a rules file to prog.
+func (prog *program) parse(file, src string) {
+	tokens, code, err := lex(file, src)
+	if err != nil {
+		prog.errs = append(prog.errs, err.(*Error))
+		return
+	}
+	if prog.sources == nil {
+		prog.sources = make(map[string]string)
+	}
+	prog.sources[file] = code
+
+	p := &parser{file: file, code: code, tokens: tokens}
+	for p.peek().kind != tokEOF {
+		p.parseDecl(prog)
+	}
+}
+
+// parseDecl parses a declaration or a rule. On syntax errors, it records the
+// error and skips to the next rule or declaration.
+func (p *parser) parseDecl(prog *program) {
+	start := p.i
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			prog.errs = append(prog.errs, perr.err)
+			if p.i == start {
+				p.next()
+			}
+			for p.peek().kind != tokEOF && !p.atKeyword("rule", "when", "declare") {
+				p.next()
+			}
+		}
+	}()
+
+	if p.accept("declare") {
+		switch tok := p.expectIdent(); tok.text {
+		case "payload":
+			subject := p.expect(tokString)
+			prog.payloads = append(prog.payloads, payloadDecl{pos: subject.pos, file: p.file, subject: subject.text, typ: p.parseType()})
+		case "state":
+			t := p.parseType()
+			if t.kind != kindObject {
+				p.fail(tok.pos, "the state must be declared as an object")
+			}
+			if prog.state == nil {
+				prog.state = &typ{kind: kindObject, fields: map[string]*field{}}
+			}
+			for _, key := range t.order {
+				if _, ok := prog.state.fields[key]; ok {
+					p.fail(t.fields[key].pos, "state key %q is already declared", key)
+				}
+				prog.state.fields[key] = t.fields[key]
+				prog.state.order = append(prog.state.order, key)
+			}
+		default:
+			p.fail(tok.pos, "expected payload or state after declare, found %s", tok.describe())
+		}
+		return
+	}
+
+	prog.rules = append(prog.rules, p.parseRule())
+}
+
+func (p *parser) parseRule() ruleNode {
+	rule := ruleNode{pos: p.peek().pos, file: p.file}
+
+	if p.accept("rule") {
+		name := p.expectIdent()
+		rule.name = name.text
+		if p.peek().kind == tokString {
+			rule.description = p.next().text
+		}
+	}
+	for {
+		switch {
+		case p.accept("mode"):
+			mode := p.expectIdent()
+			if !slices.Contains([]string{ModeParallel, ModeSingle, ModeRestart}, mode.text) {
+				p.fail(mode.pos, "mode must be parallel, single or restart, found %s", mode.describe())
+			}
+			rule.mode = mode.text
+			continue
+		case p.accept("disabled"):
+			rule.disabled = true
+			continue
+		}
+		break
+	}
+
+	p.expectKeyword("when")
+	p.expectKeyword("subject")
+	subject := p.expect(tokString)
+	rule.subject, rule.subjectPos = subject.text, subject.pos
+	switch {
+	case p.accept("debounce"):
+		rule.debounce = p.expect(tokDuration).dur
+	case p.accept("throttle"):
+		rule.throttle = p.expect(tokDuration).dur
+	}
+
+	if p.accept("if") {
+		rule.cond = p.parseExpr()
+	}
+
+	p.expectKeyword("then")
+	for {
+		rule.actions = append(rule.actions, p.parseAction())
+		p.acceptPunct(";")
+		if p.peek().kind == tokEOF || p.atKeyword(ruleStarts...) {
+			break
+		}
+		if !p.atKeyword(actionKeywords...) {
+			tok := p.peek()
+			p.fail(tok.pos, "expected an action (%s), found %s", strings.Join(actionKeywords, ", "), tok.describe())
+		}
+	}
+	p.accept("end")
+
+	return rule
+}
+
+func (p *parser) parseAction() actionNode {
+	tok := p.expectIdent()
+	action := actionNode{pos: tok.pos, kind: tok.text}
+
+	switch tok.text {
+	case "publish", "request":
+		action.subject = p.parseExpr()
+		if p.atValue() {
+			action.payload = p.parseExpr()
+		}
+		if tok.text == "request" && p.accept("timeout") {
+			action.timeout = p.expect(tokDuration).dur
+		}
+
+	case "http":
+		if next := p.peek(); next.kind == tokIdent && next.text == strings.ToUpper(next.text) {
+			action.method = p.next().text
+			if !slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, action.method) {
+				p.fail(next.pos, "unknown HTTP method %s", next.describe())
+			}
+		}
+		action.url = p.parseExpr()
+		if p.atValue() {
+			action.body = p.parseExpr()
+		}
+		for {
+			switch {
+			case p.accept("headers"):
+				start := p.peek()
+				action.headers = p.parseExpr()
+				if action.headers.Kind != expr.ObjectNode {
+					p.fail(start.pos, "headers must be an object")
+				}
+				continue
+			case p.accept("timeout"):
+				action.timeout = p.expect(tokDuration).dur
+				continue
+			}
+			break
+		}
+
+	case "delay":
+		action.delay = p.expect(tokDuration).dur
+
+	case "set":
+		action.key = p.parseStateKey(tok)
+		p.expectPunct("=")
+		action.value = p.parseExpr()
+
+	case "timer":
+		action.timer = p.parseExpr()
+		p.expectKeyword("after")
+		action.after = p.expect(tokDuration).dur
+		p.expectKeyword("publish")
+		action.subject = p.parseExpr()
+		if p.atValue() {
+			action.payload = p.parseExpr()
+		}
+
+	case "cancel":
+		p.expectKeyword("timer")
+		action.timer = p.parseExpr()
+
+	default:
+		p.fail(tok.pos, "expected an action (%s), found %s", strings.Join(actionKeywords, ", "), tok.describe())
+	}
+
+	return action
+}
+
+// atValue reports whether the next token starts a value rather than the next
+// action, option or rule.
+func (p *parser) atValue() bool {
+	tok := p.peek()
+	switch tok.kind {
+	case tokEOF:
+		return false
+	case tokPunct:
+		return tok.text == "{" || tok.text == "[" || tok.text == "(" || tok.text == "-" || tok.text == "!"
+	case tokIdent:
+		return !p.atKeyword(append(append([]string{"timeout", "headers"}, ruleStarts...), actionKeywords...)...)
+	}
+	return true
+}
+
+// parseExpr parses the expression starting at the next token with package
+// expr, and moves past it.
+func (p *parser) parseExpr() *expr.Node {
+	e, end, err := expr.CompileAt(p.code, p.peek().off)
+	if err != nil {
+		var exprErr *expr.Error
+		if !errors.As(err, &exprErr) {
+			panic(err)
+		}
+		p.seek(exprErr.Pos)
+		p.fail(position(p.code, exprErr.Pos), "%s", exprErr.Msg)
+	}
+
+	n := e.Tree()
+	// Keywords taken as names are what follows an incomplete expression
+	if name := keywordName(n, nil); name != nil {
+		p.seek(name.Pos)
+		p.fail(position(p.code, name.Pos), "expected a value, found %q", name.Name)
+	}
+	p.seek(end)
+	if p.peek().off != end {
+		r, _ := utf8.DecodeRuneInString(p.code[end:])
+		p.fail(position(p.code, end), "unexpected %q after the expression", r)
+	}
+	return n
+}
+
+// keywordName returns the first name of n that is a keyword of rules files
+// rather than a lambda parameter in bound.
+func keywordName(n *expr.Node, bound []string) *expr.Node {
+	switch {
+	case n.Kind == expr.NameNode && !slices.Contains(bound, n.Name) &&
+		(slices.Contains(reserved, n.Name) || slices.Contains(actionKeywords, n.Name)):
+		return n
+	case n.Kind == expr.LambdaNode:
+		bound = append(slices.Clip(bound), n.Name)
+	}
+	for _, child := range n.Children {
+		if name := keywordName(child, bound); name != nil {
+			return name
+		}
+	}
+	return nil
+}
+
+// parseStateKey parses the state.KEY or state["KEY"] following set.
+func (p *parser) parseStateKey(set token) string {
+	if p.accept("state") {
+		switch {
+		case p.acceptPunct("."):
+			if key := p.next(); key.kind == tokIdent {
+				return key.text
+			}
+		case p.acceptPunct("["):
+			if key := p.next(); key.kind == tokString && p.acceptPunct("]") {
+				return key.text
+			}
+		}
+	}
+	p.fail(set.pos, "set must be followed by a state key, e.g. set state.mode = \"away\"")
+	return ""
+}
+
+// Types of declarations: string, number, bool, any, [T] and {key: T, optional?: T}
+func (p *parser) parseType() *typ {
+	tok := p.next()
+	switch {
+	case tok.kind == tokIdent:
+		for kind, name := range kindNames {
+			if name == tok.text && kind != kindNull && kind != kindList && kind != kindObject {
+				return &typ{kind: kind}
+			}
+		}
+	case tok.kind == tokPunct && tok.text == "[":
+		elem := p.parseType()
+		p.expectPunct("]")
+		return &typ{kind: kindList, elem: elem}
+	case tok.kind == tokPunct && tok.text == "{":
+		t := &typ{kind: kindObject, fields: map[string]*field{}}
+		for !p.acceptPunct("}") {
+			key := p.next()
+			if key.kind != tokIdent && key.kind != tokString {
+				p.fail(key.pos, "expected a key, found %s", key.describe())
+			}
+			if _, ok := t.fields[key.text]; ok {
+				p.fail(key.pos, "duplicate key %q", key.text)
+			}
+			optional := p.acceptPunct("?")
+			p.expectPunct(":")
+			t.fields[key.text] = &field{pos: key.pos, typ: p.parseType(), optional: optional}
+			t.order = append(t.order, key.text)
+			if !p.acceptPunct(",") {
+				p.expectPunct("}")
+				break
+			}
+		}
+		return t
+	}
+	p.fail(tok.pos, "expected a type (string, number, bool, any, [type] or {key: type}), found %s", tok.describe())
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+// seek moves to the first token at or after byte offset off.
+func (p *parser) seek(off int) {
+	for p.peek().kind != tokEOF && p.peek().off < off {
+		p.i++
+	}
+}
+
+func (p *parser) atKeyword(keywords ...string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && slices.Contains(keywords, tok.text)
+}
+
+func (p *parser) accept(keyword string) bool {
+	if p.atKeyword(keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptPunct(punct string) bool {
+	if tok := p.peek(); tok.kind == tokPunct && tok.text == punct {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind) token {
+	tok := p.next()
+	if tok.kind != kind {
+		p.fail(tok.pos, "expected a %s, found %s", kind, tok.describe())
+	}
+	return tok
+}
+
+func (p *parser) expectIdent() token {
+	return p.expect(tokIdent)
+}
+
+func (p *parser) expectKeyword(keyword string) {
+	if tok := p.next(); tok.kind != tokIdent || tok.text != keyword {
+		p.fail(tok.pos, "expected %q, found %s", keyword, tok.describe())
+	}
+}
+
+func (p *parser) expectPunct(punct string) {
+	if tok := p.next(); tok.kind != tokPunct || tok.text != punct {
+		p.fail(tok.pos, "expected %q, found %s", punct, tok.describe())
+	}
+}
+
+func (p *parser) fail(at pos, format string, args ...any) {
+	panic(parseError{&Error{File: p.file, Line: at.line, Col: at.col, Msg: fmt.Sprintf(format, args...)}})
+}
@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compileSource parses and checks src as the rules file test.rules.
+func compileSource(src string) ([]Rule, error) {
+	prog := &program{}
+	prog.parse("test.rules", src)
+	return prog.compile()
+}
+
+// checkErrors compares the errors of compiling src with want, one
+// "line:col: message" prefix per error.
+func checkErrors(t *testing.T, src string, want []string) {
+	t.Helper()
+	_, err := compileSource(src)
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got error %v, want Errors", err)
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, e := range errs {
+		if got := strings.TrimPrefix(e.Error(), "test.rules:"); !strings.HasPrefix(got, want[i]) {
+			t.Errorf("got error %q, want %q", got, want[i])
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	src := `# Comments run to the end of the line
+rule cool_down "Cool the room down"
+mode single
+when subject "sensors.*.temp" debounce 5s
+if payload.value > 25 and state["mode"] == "home"
+then
+    publish "hvac.cool" {room: tokens[1], temperature: payload.value}
+    set state.cooling = true
+end
+
+when subject "doors.*" throttle 1m if payload.open then publish "alerts.door" {door: tokens[1]}
+
+when subject "motion.hall" then
+    publish "lights.hall.on"
+    timer "hall-light" after 10m publish "lights.hall.off"
+`
+	rules, err := compileSource(src)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3", len(rules))
+	}
+
+	cool := rules[0]
+	if cool.Name != "cool_down" || cool.Description != "Cool the room down" || cool.Mode != "single" || cool.source != "test.rules:2" {
+		t.Errorf("got rule %s %q, mode %s at %s", cool.Name, cool.Description, cool.Mode, cool.source)
+	}
+	if cool.Trigger.Subject != "sensors.*.temp" || cool.Trigger.Debounce != 5*time.Second {
+		t.Errorf("got trigger %+v", cool.Trigger)
+	}
+	if len(cool.Conditions) != 1 || cool.Conditions[0].Expr != `((payload.value > 25) && (state["mode"] == "home"))` {
+		t.Errorf("got conditions %+v", cool.Conditions)
+	}
+	if len(cool.Actions) != 2 || cool.Actions[0].Publish == nil || cool.Actions[0].Publish.Subject != "hvac.cool" || cool.Actions[1].Set["cooling"] != true {
+		t.Errorf("got actions %+v", cool.Actions)
+	}
+
+	// Rules without a name are named after their file and line
+	door := rules[1]
+	if door.Name != "test-11" || door.Trigger.Throttle != time.Minute || len(door.Actions) != 1 {
+		t.Errorf("got rule %+v", door)
+	}
+
+	motion := rules[2]
+	if len(motion.Actions) != 2 || motion.Actions[1].Timer == nil {
+		t.Fatalf("got actions %+v", motion.Actions)
+	}
+	if timer := motion.Actions[1].Timer; timer.Key != "hall-light" || timer.After != 10*time.Minute || timer.Subject != "lights.hall.off" {
+		t.Errorf("got timer %+v", timer)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "unknown action",
+			src:  "when subject \"a\" then\n    publsh \"b\"\n",
+			want: []string{`2:5: expected an action (publish, request, http, delay, set, timer, cancel), found "publsh"`},
+		},
+		{
+			name: "missing operand",
+			src:  `when subject "a" if payload.x > then publish "b"`,
+			want: []string{`1:33: expected a value, found "then"`},
+		},
+		{
+			name: "expression",
+			src:  `when subject "a" if len(payload.x, 1) > 2 then publish "b"`,
+			want: []string{`1:21: wrong number of arguments`},
+		},
+		{
+			name: "unknown mode",
+			src:  "rule r \"x\"\nmode sometimes\nwhen subject \"a\" then publish \"b\"",
+			want: []string{`2:6: mode must be parallel, single or restart, found "sometimes"`},
+		},
+		{
+			name: "unknown declaration",
+			src:  "declare foo",
+			want: []string{`1:9: expected payload or state after declare, found "foo"`},
+		},
+		{
+			name: "unterminated string",
+			src:  `when subject "a" then publish "b" {x: "unterminated}`,
+			want: []string{"1:39: unterminated string"},
+		},
+		{
+			name: "duplicate key",
+			src:  `when subject "a" then publish "b" {x: 1, x: 2}`,
+			want: []string{`1:42: duplicate key "x"`},
+		},
+		{
+			// Parsing goes on with the next rule
+			name: "several errors",
+			src:  "when subject \"a\" if payload.a ==\nrule ok\nwhen subject \"c\" then publish \"d\"\nwhen subject \"e\" then bogus",
+			want: []string{
+				`2:1: expected a value, found "rule"`,
+				`4:23: expected an action`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErrors(t, tt.src, tt.want)
+		})
+	}
+}
@@ -0,0 +1,581 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+)
+
+// Maximum size of the bodies of the HTTP endpoints
+const maxBodySize = 1 << 20
+
+// Maximum number of messages of a stream replayed by the simulate endpoint
+const maxSimulatedEvents = 10000
+
+// RuleStatus describes a rule and what it did since surserver started.
+type RuleStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Subject     string `json:"subject"`
+	// file:line of the rules defined in rules files
+	Source  string `json:"source,omitempty"`
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode"`
+	// Messages that triggered the rule and satisfied its conditions
+	Matched int `json:"matched"`
+	// Runs that completed, failed, were ignored (single mode) and that are going on
+	Completed int        `json:"completed"`
+	Failed    int        `json:"failed"`
+	Skipped   int        `json:"skipped"`
+	Running   int        `json:"running"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+var ruleStatusSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"name":        app.Schema{"type": "string"},
+		"description": app.Schema{"type": "string"},
+		"subject":     app.Schema{"type": "string"},
+		"source":      app.Schema{"type": "string"},
+		"enabled":     app.Schema{"type": "boolean"},
+		"mode":        app.Schema{"type": "string", "enum": []any{ModeParallel, ModeSingle, ModeRestart}},
+		"matched":     app.Schema{"type": "integer"},
+		"completed":   app.Schema{"type": "integer"},
+		"failed":      app.Schema{"type": "integer"},
+		"skipped":     app.Schema{"type": "integer"},
+		"running":     app.Schema{"type": "integer"},
+		"last_run":    app.Schema{"type": "string", "format": "date-time"},
+		"last_error":  app.Schema{"type": "string"},
+	},
+}
+
+func init() {
+	app.Register("rules", func(name string) app.Module { return &RulesModule{name: name} })
+}
+
+// RulesModule runs the automation rules of its configuration: it subscribes
+// to their trigger subjects, checks their conditions against the messages
+// and the shared state, and runs their actions.
+type RulesModule struct {
+	name string
+
+	mu     sync.Mutex
+	config rulesConfig
+	engine *Engine
+	// Canceled when the module is stopped, stopping the runs going on
+	ctx    context.Context
+	cancel context.CancelFunc
+	runs   sync.WaitGroup
+	// Taken over by the instance replacing the module, see KeepState
+	state   *State
+	stats   map[string]*RuleStatus
+	running map[string]map[int]context.CancelFunc
+	nextRun int
+}
+
+func (m *RulesModule) Name() string {
+	return m.name
+}
+
+func (m *RulesModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.config = cfg
+	m.engine = nil
+	if m.state == nil {
+		m.state = NewState()
+		m.stats = make(map[string]*RuleStatus)
+		m.running = make(map[string]map[int]context.CancelFunc)
+	}
+	return nil
+}
+
+// Stop cancels the runs going on and waits for them to end.
+func (m *RulesModule) Stop() {
+	m.mu.Lock()
+	cancel := m.cancel
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		m.runs.Wait()
+	}
+}
+
+// KeepState takes over the shared state and the statistics of the rules of
+// the previous instance of the module.
+func (m *RulesModule) KeepState(previous app.Module) {
+	prev, ok := previous.(*RulesModule)
+	if !ok {
+		return
+	}
+	prev.mu.Lock()
+	state := prev.state
+	stats := make(map[string]*RuleStatus, len(prev.stats))
+	for name, status := range prev.stats {
+		status := *status
+		status.Running = 0
+		stats[name] = &status
+	}
+	prev.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+	m.stats = stats
+}
+
+func (m *RulesModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the rules and what they did",
+			Response: app.Schema{"type": "array", "items": ruleStatusSchema},
+		},
+		{
+			Method:   "POST",
+			Path:     "/{name}/run",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { m.handleRun(w, r, pub) },
+			Auth:     m.config.Auth,
+			Summary:  "Run the actions of a rule with the body as payload, without checking its conditions. The subject parameter gives the subject of the event, required when the trigger has wildcards",
+			Request:  app.Schema{"type": "object"},
+			Response: ruleStatusSchema,
+			Status:   http.StatusAccepted,
+		},
+		{
+			Method: "POST",
+			Path:   "/simulate",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				m.handleSimulate(pub, w, r)
+			},
+			Auth:     m.config.Auth,
+			Summary:  "Replay events or the messages of a stream through the rules, reporting what their actions would do without running them",
+			Request:  simulateRequestSchema,
+			Response: simulationReportSchema,
+		},
+		{
+			Method:   "GET",
+			Path:     "/state",
+			Handler:  m.handleGetState,
+			Auth:     m.config.Auth,
+			Summary:  "Get the state shared by the rules",
+			Response: app.Schema{"type": "object"},
+		},
+		{
+			Method:  "PUT",
+			Path:    "/state/{key}",
+			Handler: func(w http.ResponseWriter, r *http.Request) { m.handleSetState(w, r, pub) },
+			Auth:    m.config.Auth,
+			Summary: "Set a value of the shared state",
+			Request: app.Schema{},
+			Status:  http.StatusNoContent,
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/state/{key}",
+			Handler: func(w http.ResponseWriter, r *http.Request) { m.handleSetState(w, r, pub) },
+			Auth:    m.config.Auth,
+			Summary: "Delete a value of the shared state",
+			Status:  http.StatusNoContent,
+		},
+	}
+}
+
+// MsgHandlers subscribes to the trigger subjects of the enabled rules.
+func (m *RulesModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logger := slog.With("module", m.Name())
+	executor := liveExecutor{pub: pub, client: &http.Client{}}
+	m.engine = NewEngine(m.config, m.state, executor, logger)
+
+	triggers := m.engine.Triggers()
+	handlers := make([]app.MsgHandler, 0, len(triggers))
+	for _, trigger := range triggers {
+		handler := func(msg *nats.Msg) {
+			m.handleMessage(trigger, Event{Subject: msg.Subject, Data: msg.Data})
+		}
+		switch {
+		case trigger.Debounce > 0:
+			handler = app.Debounce(trigger.Debounce, handler)
+		case trigger.Throttle > 0:
+			handler = app.Throttle(trigger.Throttle, handler)
+		}
+		handlers = append(handlers, app.MsgHandler{Subject: trigger.Subject, Handler: handler})
+	}
+	return handlers
+}
+
+// handleMessage fires the rules of trigger whose conditions hold for ev.
+func (m *RulesModule) handleMessage(trigger Trigger, ev Event) {
+	m.mu.Lock()
+	engine := m.engine
+	m.mu.Unlock()
+	if engine == nil {
+		return
+	}
+
+	for _, rule := range engine.Match(trigger, ev) {
+		m.fire(engine, rule, ev)
+	}
+}
+
+// fire runs the actions of rule in the background, according to its mode.
+func (m *RulesModule) fire(engine *Engine, rule Rule, ev Event) {
+	logger := engine.logger.With("rule", rule.Name, "subject", ev.Subject)
+
+	m.mu.Lock()
+	if m.ctx.Err() != nil {
+		m.mu.Unlock()
+		logger.Debug("module stopped, ignoring message")
+		return
+	}
+	status := m.status(rule)
+	status.Matched++
+	runs := m.running[rule.Name]
+	switch {
+	case rule.Mode == ModeSingle && len(runs) > 0:
+		status.Skipped++
+		m.mu.Unlock()
+		logger.Debug("rule already running, ignoring message")
+		return
+	case rule.Mode == ModeRestart:
+		for _, cancel := range runs {
+			cancel()
+		}
+	}
+	if runs == nil {
+		runs = make(map[int]context.CancelFunc)
+		m.running[rule.Name] = runs
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	id := m.nextRun
+	m.nextRun++
+	runs[id] = cancel
+	status.Running = len(runs)
+	now := time.Now()
+	status.LastRun = &now
+	m.runs.Add(1)
+	m.mu.Unlock()
+
+	logger.Info("rule fired")
+	go func() {
+		defer m.runs.Done()
+		err := engine.Run(ctx, rule, ev)
+		canceled := ctx.Err() != nil
+		cancel()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(runs, id)
+		status.Running = len(runs)
+		switch {
+		case canceled:
+			logger.Info("rule run canceled")
+		case err != nil:
+			status.Failed++
+			status.LastError = err.Error()
+			logger.Error("rule failed", "error", err)
+		default:
+			status.Completed++
+			logger.Debug("rule completed")
+		}
+	}()
+}
+
+// status returns the status of rule. It must be called with m.mu held.
+func (m *RulesModule) status(rule Rule) *RuleStatus {
+	status, ok := m.stats[rule.Name]
+	if !ok {
+		status = &RuleStatus{Name: rule.Name}
+		m.stats[rule.Name] = status
+	}
+	status.Description = rule.Description
+	status.Subject = rule.Trigger.Subject
+	status.Source = rule.source
+	status.Enabled = rule.IsEnabled()
+	status.Mode = rule.Mode
+	if status.Mode == "" {
+		status.Mode = ModeParallel
+	}
+	return status
+}
+
+func (m *RulesModule) handleList(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	statuses := make([]RuleStatus, 0, len(m.config.Rules))
+	for _, rule := range m.config.Rules {
+		statuses = append(statuses, *m.status(rule))
+	}
+	m.mu.Unlock()
+
+	app.WriteJSON(w, http.StatusOK, statuses)
+}
+
+func (m *RulesModule) handleRun(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+	name := r.PathValue("name")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 && !json.Valid(body) {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	engine := m.engine
+	var rule *Rule
+	if engine != nil {
+		for _, candidate := range engine.rules {
+			if candidate.Name == name {
+				rule = &candidate
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+	if rule == nil {
+		http.Error(w, "Unknown or disabled rule", http.StatusNotFound)
+		return
+	}
+
+	// The conditions and templates of the actions may read the subject
+	subject := r.URL.Query().Get("subject")
+	switch {
+	case subject == "" && strings.ContainsAny(rule.Trigger.Subject, "*>"):
+		http.Error(w, "The trigger of the rule has wildcards, the subject parameter is required", http.StatusBadRequest)
+		return
+	case subject == "":
+		subject = rule.Trigger.Subject
+	case !app.ValidPublishSubject(subject) || !app.SubjectMatches(rule.Trigger.Subject, subject):
+		http.Error(w, "The subject doesn't match the trigger of the rule", http.StatusBadRequest)
+		return
+	}
+	if !m.allowed(w, r, pub, *rule) {
+		return
+	}
+
+	slog.Info("running rule on request", "module", m.Name(), "rule", name, "subject", subject, "remote_addr", r.RemoteAddr)
+	m.fire(engine, *rule, Event{Subject: subject, Data: body})
+
+	m.mu.Lock()
+	status := *m.status(*rule)
+	m.mu.Unlock()
+	app.WriteJSON(w, http.StatusAccepted, status)
+}
+
+// simulateRequest is the body of the simulate endpoint. Events are either
+// given or read from a stream.
+type simulateRequest struct {
+	Events []RecordedEvent `json:"events"`
+	Stream string          `json:"stream"`
+	Filter string          `json:"filter"`
+	// Duration before now or RFC 3339 time
+	Since string `json:"since"`
+	Limit int    `json:"limit"`
+	// Only simulate these rules
+	Rules    []string `json:"rules"`
+	Disabled bool     `json:"disabled"`
+	// Values replacing those of the current state
+	State map[string]any `json:"state"`
+}
+
+var simulateRequestSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"events":   app.Schema{"type": "array", "items": recordedEventSchema},
+		"stream":   app.Schema{"type": "string"},
+		"filter":   app.Schema{"type": "string"},
+		"since":    app.Schema{"type": "string"},
+		"limit":    app.Schema{"type": "integer", "minimum": 0, "maximum": maxSimulatedEvents},
+		"rules":    app.Schema{"type": "array", "items": app.Schema{"type": "string"}},
+		"disabled": app.Schema{"type": "boolean"},
+		"state":    app.Schema{"type": "object"},
+	},
+}
+
+// handleSimulate replays events through the rules, starting from the
+// current state.
+func (m *RulesModule) handleSimulate(pub app.Publisher, w http.ResponseWriter, r *http.Request) {
+	var req simulateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		return
+	}
+	if (req.Stream == "") == (req.Events == nil) {
+		http.Error(w, "Exactly one of events or stream is required", http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 || req.Limit > maxSimulatedEvents {
+		http.Error(w, fmt.Sprintf("Limit must be between 0 and %d", maxSimulatedEvents), http.StatusBadRequest)
+		return
+	}
+
+	var events EventReader
+	if req.Stream == "" {
+		events = (*sliceReader)(&req.Events)
+	} else {
+		opts := StreamOptions{Stream: req.Stream, Filter: req.Filter, Limit: req.Limit}
+		if opts.Limit == 0 {
+			opts.Limit = maxSimulatedEvents
+		}
+		if req.Since != "" {
+			since, err := ParseSince(req.Since, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts.Since = since
+		}
+		js, err := pub.JetStream()
+		if err != nil {
+			http.Error(w, "JetStream is not available", http.StatusServiceUnavailable)
+			return
+		}
+		reader, err := NewStreamReader(js, opts)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			http.Error(w, "Unknown stream", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to read stream", "module", m.Name(), "stream", req.Stream, "error", err)
+			http.Error(w, "Error reading stream", http.StatusBadGateway)
+			return
+		}
+		defer reader.Close()
+		events = reader
+	}
+
+	m.mu.Lock()
+	config := m.config
+	m.mu.Unlock()
+	state := m.state.Snapshot()
+	maps.Copy(state, req.State)
+
+	opts := SimulateOptions{Rules: req.Rules, Disabled: req.Disabled, State: state}
+	report, err := simulate(r.Context(), config, opts, events)
+	if errors.Is(err, ErrUnknownRule) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("simulation failed", "module", m.Name(), "error", err)
+		http.Error(w, "Error reading events", http.StatusBadGateway)
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, report)
+}
+
+func (m *RulesModule) handleGetState(w http.ResponseWriter, _ *http.Request) {
+	app.WriteJSON(w, http.StatusOK, m.state.Snapshot())
+}
+
+// handleSetState sets the value of a key to the JSON body, or deletes it.
+func (m *RulesModule) handleSetState(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+	key := r.PathValue("key")
+
+	// The state steers the conditions and actions of every rule
+	m.mu.Lock()
+	var rules []Rule
+	if m.engine != nil {
+		rules = m.engine.rules
+	}
+	m.mu.Unlock()
+	if !m.allowed(w, r, pub, rules...) {
+		return
+	}
+
+	var value any
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&value); err != nil {
+			http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	m.state.Set(key, value)
+	slog.Info("state updated", "module", m.Name(), "key", key, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowed reports whether the client may run the actions of rules,
+// authenticated clients having to be allowed the subjects they send to.
+func (m *RulesModule) allowed(w http.ResponseWriter, r *http.Request, pub app.Publisher, rules ...Rule) bool {
+	principal, authenticated := app.PrincipalFromContext(r.Context())
+	if !authenticated {
+		return true
+	}
+	for _, rule := range rules {
+		for _, subject := range actionSubjects(rule) {
+			// References that don't resolve make their action fail
+			if resolved, err := pub.ResolveSubject(subject); err == nil {
+				subject = resolved
+			}
+			if !principal.Allows(subject) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				slog.Warn("rule subject not allowed for principal",
+					"module", m.Name(),
+					"rule", rule.Name,
+					"subject", subject,
+					"principal", principal.Name,
+					"auth_method", principal.Method,
+				)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// actionSubjects returns the subjects the actions of rule may send messages
+// to. The tokens of a subject from its first template on are unknown until
+// rendered, they are replaced by ">".
+func actionSubjects(rule Rule) []string {
+	var subjects []string
+	for _, action := range rule.Actions {
+		var subject string
+		switch {
+		case action.Publish != nil:
+			subject = action.Publish.Subject
+		case action.Request != nil:
+			subject = action.Request.Subject
+		case action.Timer != nil:
+			subject = action.Timer.Subject
+		default:
+			continue
+		}
+		if i := strings.Index(subject, "{{"); i >= 0 {
+			subject = subject[:strings.LastIndex(subject[:i], ".")+1] + ">"
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects
+}
@@ -0,0 +1,254 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+var ErrUnknownRule = errors.New("unknown rule")
+
+// SimulateOptions selects the rules of a simulation and its initial state.
+type SimulateOptions struct {
+	// Only simulate these rules, all of them when empty
+	Rules []string
+	// Simulate disabled rules too, as if they were enabled
+	Disabled bool
+	// Initial shared state. The initial values of the config are added for
+	// the keys it doesn't have.
+	State map[string]any
+}
+
+// SimulationReport tells what rules would have done with recorded events.
+type SimulationReport struct {
+	// Number of events replayed
+	Events int             `json:"events"`
+	Runs   []SimulatedRun  `json:"runs"`
+	Rules  []SimulatedRule `json:"rules"`
+	// Shared state once every event was replayed
+	State map[string]any `json:"state"`
+}
+
+// SimulatedRun is a rule fired by an event.
+type SimulatedRun struct {
+	Rule    string     `json:"rule"`
+	Subject string     `json:"subject"`
+	Time    *time.Time `json:"time,omitempty"`
+	Payload any        `json:"payload"`
+	// Actions that would have been run, up to the failing one
+	Actions []SimulatedAction `json:"actions"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// SimulatedAction is a side effect of a simulated run.
+type SimulatedAction struct {
+	// One of publish, request, http, delay, timer or cancel_timer
+	Type    string `json:"type"`
+	Key     string `json:"key,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Method  string `json:"method,omitempty"`
+	URL     string `json:"url,omitempty"`
+	// Payload of messages, body of HTTP requests
+	Payload any `json:"payload,omitempty"`
+	// Delay of delays and timers
+	Delay string `json:"delay,omitempty"`
+}
+
+// SimulatedRule counts what a rule did in a simulation.
+type SimulatedRule struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Matched int    `json:"matched"`
+	Failed  int    `json:"failed"`
+}
+
+var simulationReportSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"events": app.Schema{"type": "integer"},
+		"runs": app.Schema{"type": "array", "items": app.Schema{
+			"type": "object",
+			"properties": map[string]any{
+				"rule":    app.Schema{"type": "string"},
+				"subject": app.Schema{"type": "string"},
+				"time":    app.Schema{"type": "string", "format": "date-time"},
+				"payload": app.Schema{},
+				"actions": app.Schema{"type": "array", "items": app.Schema{
+					"type": "object",
+					"properties": map[string]any{
+						"type":    app.Schema{"type": "string", "enum": []any{"publish", "request", "http", "delay", "timer", "cancel_timer"}},
+						"key":     app.Schema{"type": "string"},
+						"subject": app.Schema{"type": "string"},
+						"method":  app.Schema{"type": "string"},
+						"url":     app.Schema{"type": "string"},
+						"payload": app.Schema{},
+						"delay":   app.Schema{"type": "string"},
+					},
+				}},
+				"error": app.Schema{"type": "string"},
+			},
+		}},
+		"rules": app.Schema{"type": "array", "items": app.Schema{
+			"type": "object",
+			"properties": map[string]any{
+				"name":    app.Schema{"type": "string"},
+				"enabled": app.Schema{"type": "boolean"},
+				"matched": app.Schema{"type": "integer"},
+				"failed":  app.Schema{"type": "integer"},
+			},
+		}},
+		"state": app.Schema{"type": "object"},
+	},
+}
+
+// recorder is the Executor of simulations: it records the side effects of
+// the actions instead of performing them. Requests get an empty response,
+// HTTP calls an empty 200 response, delays don't wait and timers don't fire.
+type recorder struct {
+	actions []SimulatedAction
+}
+
+func (r *recorder) Publish(subject string, data []byte) error {
+	r.actions = append(r.actions, SimulatedAction{Type: "publish", Subject: subject, Payload: decode(data)})
+	return nil
+}
+
+func (r *recorder) Request(subject string, data []byte, _ time.Duration) ([]byte, error) {
+	r.actions = append(r.actions, SimulatedAction{Type: "request", Subject: subject, Payload: decode(data)})
+	return nil, nil
+}
+
+func (r *recorder) Do(req *http.Request) (int, []byte, error) {
+	action := SimulatedAction{Type: "http", Method: req.Method, URL: req.URL.String()}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return 0, nil, err
+		}
+		action.Payload = decode(body)
+	}
+	r.actions = append(r.actions, action)
+	return http.StatusOK, nil, nil
+}
+
+func (r *recorder) Sleep(ctx context.Context, d time.Duration) error {
+	r.actions = append(r.actions, SimulatedAction{Type: "delay", Delay: d.String()})
+	return ctx.Err()
+}
+
+func (r *recorder) Schedule(key, subject string, data []byte, after time.Duration) error {
+	r.actions = append(r.actions, SimulatedAction{Type: "timer", Key: key, Subject: subject, Payload: decode(data), Delay: after.String()})
+	return nil
+}
+
+func (r *recorder) CancelTimer(key string) error {
+	r.actions = append(r.actions, SimulatedAction{Type: "cancel_timer", Key: key})
+	return nil
+}
+
+// SimulateConfig replays events through the rules of the config of a rules
+// module, see simulate.
+func SimulateConfig(ctx context.Context, name string, config map[string]any, opts SimulateOptions, events EventReader) (*SimulationReport, error) {
+	cfg, err := parseConfig(name, config)
+	if err != nil {
+		return nil, err
+	}
+	return simulate(ctx, cfg, opts, events)
+}
+
+// SimulateFiles replays events through the rules of rules files, see
+// simulate.
+func SimulateFiles(ctx context.Context, patterns []string, opts SimulateOptions, events EventReader) (*SimulationReport, error) {
+	fileRules, err := LoadFiles(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return simulate(ctx, rulesConfig{Rules: fileRules}, opts, events)
+}
+
+// simulate replays events through the rules of config with their actions
+// recorded instead of run. Events are replayed in order, each run completing
+// before the next one starts whatever the mode of its rule, so set actions
+// are seen by the next events. Messages published by the actions and timers
+// don't trigger rules, and triggers are neither debounced nor throttled.
+func simulate(ctx context.Context, config rulesConfig, opts SimulateOptions, events EventReader) (*SimulationReport, error) {
+	for _, name := range opts.Rules {
+		if !slices.ContainsFunc(config.Rules, func(rule Rule) bool { return rule.Name == name }) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownRule, name)
+		}
+	}
+
+	report := &SimulationReport{Runs: []SimulatedRun{}, Rules: []SimulatedRule{}}
+	stats := make(map[string]*SimulatedRule)
+	selected := make([]Rule, 0, len(config.Rules))
+	for _, rule := range config.Rules {
+		if len(opts.Rules) > 0 && !slices.Contains(opts.Rules, rule.Name) {
+			continue
+		}
+		if !rule.IsEnabled() && !opts.Disabled {
+			continue
+		}
+		report.Rules = append(report.Rules, SimulatedRule{Name: rule.Name, Enabled: rule.IsEnabled()})
+		enabled := true
+		rule.Enabled = &enabled
+		selected = append(selected, rule)
+	}
+	for i := range report.Rules {
+		stats[report.Rules[i].Name] = &report.Rules[i]
+	}
+	config.Rules = selected
+
+	state := NewState()
+	for key, value := range opts.State {
+		state.Set(key, value)
+	}
+	exec := &recorder{}
+	engine := NewEngine(config, state, exec, slog.With("simulation", true))
+	triggers := engine.Triggers()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		recorded, err := events.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ev, err := recorded.event()
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", report.Events+1, err)
+		}
+		report.Events++
+
+		// Each trigger is subscribed to separately, as by the module
+		for _, trigger := range triggers {
+			if !app.SubjectMatches(trigger.Subject, ev.Subject) {
+				continue
+			}
+			for _, rule := range engine.Match(trigger, ev) {
+				exec.actions = []SimulatedAction{}
+				run := SimulatedRun{Rule: rule.Name, Subject: ev.Subject, Time: recorded.Time, Payload: decode(ev.Data)}
+				stats[rule.Name].Matched++
+				if err := engine.Run(ctx, rule, ev); err != nil {
+					run.Error = err.Error()
+					stats[rule.Name].Failed++
+				}
+				run.Actions = exec.actions
+				report.Runs = append(report.Runs, run)
+			}
+		}
+	}
+
+	report.State = state.Snapshot()
+	return report, nil
+}
@@ -0,0 +1,128 @@
+package scenes
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+var ErrInvalidScene = errors.New("invalid scene")
+
+// scenesConfig is the module configuration as found in ModuleConfig.Config.
+type scenesConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section.
+	// Authenticated clients may only run the scenes whose subjects they are
+	// allowed.
+	Auth bool `mapstructure:"auth"`
+	// A request to <subject>.<name> runs the scene called name and gets its
+	// report as response. Empty to only run scenes over HTTP.
+	Subject string `mapstructure:"subject" validate:"subject"`
+	// Default timeout of the steps
+	Timeout time.Duration `mapstructure:"timeout" validate:"min=0"`
+	Scenes  []Scene       `mapstructure:"scenes"`
+}
+
+// Scene is a named group of NATS requests run as one, e.g. "movie night".
+type Scene struct {
+	Name        string `mapstructure:"name" validate:"required,pattern=^[A-Za-z0-9_-]+$"`
+	Description string `mapstructure:"description"`
+	// Send the requests of the steps all at once instead of one after the
+	// other
+	Parallel bool `mapstructure:"parallel"`
+	// Run the next steps when a step fails. Steps running in parallel always
+	// run.
+	ContinueOnError bool   `mapstructure:"continue_on_error"`
+	Steps           []Step `mapstructure:"steps" validate:"required"`
+}
+
+// Step is a NATS request of a scene. It succeeds when a response is received
+// in time that isn't an error of the NATS micro services API.
+type Step struct {
+	// Defaults to the subject
+	Name    string `mapstructure:"name"`
+	Subject string `mapstructure:"subject" validate:"required,subject"`
+	// Encoded as JSON, sent empty when omitted
+	Payload any `mapstructure:"payload"`
+	// Defaults to the timeout of the module
+	Timeout time.Duration `mapstructure:"timeout" validate:"min=0"`
+	// Request undoing the step, sent when a step of the scene fails
+	Compensate *Request `mapstructure:"compensate"`
+}
+
+// Request is a NATS request undoing a step.
+type Request struct {
+	Subject string `mapstructure:"subject"`
+	// Encoded as JSON, sent empty when omitted
+	Payload any `mapstructure:"payload"`
+	// Defaults to the timeout of the step
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func parseConfig(name string, config map[string]any) (scenesConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, scenesConfig{
+		Subject: "scenes.run",
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Scenes {
+		scene := &cfg.Scenes[i]
+		if err := scene.validate(); err != nil {
+			return cfg, fmt.Errorf("%w %s: %v", ErrInvalidScene, scene.Name, err)
+		}
+		if seen[scene.Name] {
+			return cfg, fmt.Errorf("%w: duplicate name %q", ErrInvalidScene, scene.Name)
+		}
+		seen[scene.Name] = true
+
+		for j := range scene.Steps {
+			step := &scene.Steps[j]
+			if step.Name == "" {
+				step.Name = step.Subject
+			}
+			if step.Timeout == 0 {
+				step.Timeout = cfg.Timeout
+			}
+			if step.Compensate != nil && step.Compensate.Timeout == 0 {
+				step.Compensate.Timeout = step.Timeout
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// validate checks what the tags of the scene fields can't express.
+func (s Scene) validate() error {
+	names := make(map[string]bool)
+	for i, step := range s.Steps {
+		name := step.Name
+		if name == "" {
+			name = step.Subject
+		}
+		if names[name] {
+			return fmt.Errorf("steps[%d]: duplicate name %q, name the steps sending to the same subject", i, name)
+		}
+		names[name] = true
+
+		if step.Compensate == nil {
+			continue
+		}
+		if !app.ValidPublishSubject(step.Compensate.Subject) {
+			return fmt.Errorf("steps[%d]: invalid compensate subject %q", i, step.Compensate.Subject)
+		}
+		if step.Compensate.Timeout < 0 {
+			return fmt.Errorf("steps[%d]: compensate timeout must be positive", i)
+		}
+	}
+	return nil
+}
+
+// ConfigSchema describes the scenes configuration.
+func (m *ScenesModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(scenesConfig{})
+}
@@ -0,0 +1,433 @@
+package scenes
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+var (
+	ErrUnknownScene = errors.New("unknown scene")
+	ErrSceneRunning = errors.New("scene already running")
+)
+
+// Status of scenes, steps and compensations
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	// The step didn't run, a previous step failed
+	StatusSkipped = "skipped"
+)
+
+// Report tells how a run of a scene went.
+type Report struct {
+	Scene string `json:"scene"`
+	// Failed when a step failed
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Steps    []Result  `json:"steps"`
+	// Requests undoing the steps that succeeded when a step failed, in the
+	// order they were sent
+	Compensations []Result `json:"compensations,omitempty"`
+}
+
+// Result is the outcome of a request of a scene.
+type Result struct {
+	Step     string `json:"step"`
+	Subject  string `json:"subject"`
+	Status   string `json:"status"`
+	Duration string `json:"duration,omitempty"`
+	Response any    `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var resultSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"step":     app.Schema{"type": "string"},
+		"subject":  app.Schema{"type": "string"},
+		"status":   app.Schema{"type": "string", "enum": []any{StatusSucceeded, StatusFailed, StatusSkipped}},
+		"duration": app.Schema{"type": "string"},
+		"response": app.Schema{},
+		"error":    app.Schema{"type": "string"},
+	},
+}
+
+var reportSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"scene":         app.Schema{"type": "string"},
+		"status":        app.Schema{"type": "string", "enum": []any{StatusSucceeded, StatusFailed}},
+		"started":       app.Schema{"type": "string", "format": "date-time"},
+		"duration":      app.Schema{"type": "string"},
+		"steps":         app.Schema{"type": "array", "items": resultSchema},
+		"compensations": app.Schema{"type": "array", "items": resultSchema},
+	},
+}
+
+// SceneStatus describes a scene and its last run.
+type SceneStatus struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Parallel    bool    `json:"parallel"`
+	Steps       int     `json:"steps"`
+	Running     bool    `json:"running"`
+	LastRun     *Report `json:"last_run,omitempty"`
+}
+
+var sceneStatusSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"name":        app.Schema{"type": "string"},
+		"description": app.Schema{"type": "string"},
+		"parallel":    app.Schema{"type": "boolean"},
+		"steps":       app.Schema{"type": "integer"},
+		"running":     app.Schema{"type": "boolean"},
+		"last_run":    reportSchema,
+	},
+}
+
+func init() {
+	app.Register("scenes", func(name string) app.Module { return &ScenesModule{name: name} })
+}
+
+// ScenesModule runs scenes, named groups of NATS requests such as "movie
+// night" or "leaving home", over HTTP or NATS. A scene doesn't run twice at
+// the same time, and when one of its steps fails the steps that succeeded are
+// undone by their compensating requests.
+type ScenesModule struct {
+	name string
+
+	mu      sync.Mutex
+	config  scenesConfig
+	running map[string]bool
+	// Taken over by the instance replacing the module, see KeepState
+	lastRun map[string]*Report
+}
+
+func (m *ScenesModule) Name() string {
+	return m.name
+}
+
+func (m *ScenesModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	if m.running == nil {
+		m.running = make(map[string]bool)
+		m.lastRun = make(map[string]*Report)
+	}
+	return nil
+}
+
+// KeepState takes over the last runs of the scenes of the previous instance
+// of the module. Its runs going on still end on it.
+func (m *ScenesModule) KeepState(previous app.Module) {
+	prev, ok := previous.(*ScenesModule)
+	if !ok {
+		return
+	}
+	prev.mu.Lock()
+	lastRun := maps.Clone(prev.lastRun)
+	prev.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRun = lastRun
+}
+
+func (m *ScenesModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the scenes with their last run",
+			Response: app.Schema{"type": "array", "items": sceneStatusSchema},
+		},
+		{
+			Method:   "POST",
+			Path:     "/{name}",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { m.handleRun(w, r, pub) },
+			Auth:     m.config.Auth,
+			Summary:  "Run a scene and report the outcome of each step, with status 502 when a step failed",
+			Response: reportSchema,
+		},
+	}
+}
+
+// MsgHandlers answers the requests to run scenes, with their report. Errors
+// are reported as by the NATS micro services API.
+func (m *ScenesModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	if m.config.Subject == "" {
+		return nil
+	}
+	return []app.MsgHandler{
+		{
+			Subject: m.config.Subject + ".*",
+			Handler: func(msg *nats.Msg) {
+				// Scenes take a while, don't hold the other requests
+				go m.handleRequest(msg, pub)
+			},
+		},
+	}
+}
+
+// scene returns the scene called name.
+func (m *ScenesModule) scene(name string) (Scene, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, scene := range m.config.Scenes {
+		if scene.Name == name {
+			return scene, true
+		}
+	}
+	return Scene{}, false
+}
+
+// run runs scene unless it is already running.
+func (m *ScenesModule) run(scene Scene, pub app.Publisher) (*Report, error) {
+	m.mu.Lock()
+	if m.running[scene.Name] {
+		m.mu.Unlock()
+		return nil, ErrSceneRunning
+	}
+	m.running[scene.Name] = true
+	m.mu.Unlock()
+
+	report := runScene(scene, pub)
+
+	m.mu.Lock()
+	delete(m.running, scene.Name)
+	m.lastRun[scene.Name] = report
+	m.mu.Unlock()
+
+	logger := slog.With("module", m.Name(), "scene", scene.Name)
+	if report.Status == StatusFailed {
+		logger.Warn("scene failed", "duration", report.Duration, "compensations", len(report.Compensations))
+	} else {
+		logger.Info("scene succeeded", "duration", report.Duration)
+	}
+	return report, nil
+}
+
+// runScene sends the requests of the steps of scene, then the compensating
+// requests of the steps that succeeded, in reverse order, if a step failed.
+func runScene(scene Scene, pub app.Publisher) *Report {
+	report := &Report{Scene: scene.Name, Status: StatusSucceeded, Started: time.Now()}
+	report.Steps = make([]Result, len(scene.Steps))
+
+	if scene.Parallel {
+		var wg sync.WaitGroup
+		for i, step := range scene.Steps {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				report.Steps[i] = request(pub, step.Name, step.Subject, step.Payload, step.Timeout)
+			}()
+		}
+		wg.Wait()
+	} else {
+		failed := false
+		for i, step := range scene.Steps {
+			if failed && !scene.ContinueOnError {
+				report.Steps[i] = Result{Step: step.Name, Subject: step.Subject, Status: StatusSkipped}
+				continue
+			}
+			report.Steps[i] = request(pub, step.Name, step.Subject, step.Payload, step.Timeout)
+			failed = failed || report.Steps[i].Status == StatusFailed
+		}
+	}
+
+	for _, result := range report.Steps {
+		if result.Status == StatusFailed {
+			report.Status = StatusFailed
+		}
+	}
+	if report.Status == StatusFailed {
+		for i := len(scene.Steps) - 1; i >= 0; i-- {
+			step := scene.Steps[i]
+			if report.Steps[i].Status != StatusSucceeded || step.Compensate == nil {
+				continue
+			}
+			compensate := step.Compensate
+			report.Compensations = append(report.Compensations, request(pub, step.Name, compensate.Subject, compensate.Payload, compensate.Timeout))
+		}
+	}
+
+	report.Duration = time.Since(report.Started).Round(time.Millisecond).String()
+	return report
+}
+
+// request sends payload, encoded as JSON, to subject and waits for the
+// response. subject may be a reference such as device:lamp, see
+// app.SubjectResolver.
+func request(pub app.Publisher, name, subject string, payload any, timeout time.Duration) Result {
+	result := Result{Step: name, Subject: subject, Status: StatusFailed}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	resolved, err := pub.ResolveSubject(subject)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	msg, err := pub.RequestWithTimeout(resolved, data, timeout)
+	result.Duration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if len(msg.Data) > 0 {
+		var response any
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			response = string(msg.Data)
+		}
+		result.Response = response
+	}
+	if description := msg.Header.Get(micro.ErrorHeader); description != "" {
+		result.Error = description
+		if code := msg.Header.Get(micro.ErrorCodeHeader); code != "" {
+			result.Error = code + " " + description
+		}
+		return result
+	}
+	result.Status = StatusSucceeded
+	return result
+}
+
+func (m *ScenesModule) handleList(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	statuses := make([]SceneStatus, 0, len(m.config.Scenes))
+	for _, scene := range m.config.Scenes {
+		statuses = append(statuses, SceneStatus{
+			Name:        scene.Name,
+			Description: scene.Description,
+			Parallel:    scene.Parallel,
+			Steps:       len(scene.Steps),
+			Running:     m.running[scene.Name],
+			LastRun:     m.lastRun[scene.Name],
+		})
+	}
+	m.mu.Unlock()
+
+	app.WriteJSON(w, http.StatusOK, statuses)
+}
+
+func (m *ScenesModule) handleRun(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+	name := r.PathValue("name")
+	scene, ok := m.scene(name)
+	if !ok {
+		http.Error(w, "Unknown scene", http.StatusNotFound)
+		return
+	}
+
+	// Authenticated clients may only send what they could send themselves
+	if principal, authenticated := app.PrincipalFromContext(r.Context()); authenticated {
+		for _, subject := range sceneSubjects(scene) {
+			// References that don't resolve make their step fail
+			if resolved, err := pub.ResolveSubject(subject); err == nil {
+				subject = resolved
+			}
+			if !principal.Allows(subject) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				slog.Warn("scene subject not allowed for principal",
+					"module", m.Name(),
+					"scene", name,
+					"subject", subject,
+					"principal", principal.Name,
+					"auth_method", principal.Method,
+				)
+				return
+			}
+		}
+	}
+
+	slog.Info("running scene on request", "module", m.Name(), "scene", name, "remote_addr", r.RemoteAddr)
+	report, err := m.run(scene, pub)
+	if err != nil {
+		http.Error(w, "Scene already running", http.StatusConflict)
+		return
+	}
+	status := http.StatusOK
+	if report.Status == StatusFailed {
+		status = http.StatusBadGateway
+	}
+	app.WriteJSON(w, status, report)
+}
+
+func (m *ScenesModule) handleRequest(msg *nats.Msg, pub app.Publisher) {
+	name := msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]
+
+	var report *Report
+	scene, ok := m.scene(name)
+	err := ErrUnknownScene
+	if ok {
+		slog.Info("running scene on NATS request", "module", m.Name(), "scene", name)
+		report, err = m.run(scene, pub)
+	}
+	if msg.Reply == "" {
+		return
+	}
+
+	response := nats.NewMsg(msg.Reply)
+	switch {
+	case errors.Is(err, ErrUnknownScene):
+		setError(response, http.StatusNotFound, err)
+	case err != nil:
+		setError(response, http.StatusConflict, err)
+	default:
+		if report.Status == StatusFailed {
+			setError(response, http.StatusBadGateway, errors.New("scene failed"))
+		}
+		response.Data, _ = json.Marshal(report)
+	}
+	if err := msg.RespondMsg(response); err != nil {
+		slog.Error("failed to respond", "module", m.Name(), "scene", name, "error", err)
+	}
+}
+
+// setError marks msg as an error response of the NATS micro services API.
+func setError(msg *nats.Msg, code int, err error) {
+	msg.Header.Set(micro.ErrorCodeHeader, strconv.Itoa(code))
+	msg.Header.Set(micro.ErrorHeader, err.Error())
+}
+
+// sceneSubjects returns the subjects scene may send requests to.
+func sceneSubjects(scene Scene) []string {
+	var subjects []string
+	for _, step := range scene.Steps {
+		subjects = append(subjects, step.Subject)
+		if step.Compensate != nil {
+			subjects = append(subjects, step.Compensate.Subject)
+		}
+	}
+	return subjects
+}
@@ -0,0 +1,170 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+)
+
+var ErrInvalidJob = errors.New("invalid job")
+
+// schedulerConfig is the module configuration as found in ModuleConfig.Config.
+type schedulerConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section
+	Auth bool `mapstructure:"auth"`
+	// Where sun events are computed, in degrees, north and east being
+	// positive. Required by sun schedules.
+	Latitude  *float64 `mapstructure:"latitude"`
+	Longitude *float64 `mapstructure:"longitude"`
+	// Time zone of cron schedules, e.g. Europe/Paris. Defaults to the local
+	// time zone.
+	Timezone string `mapstructure:"timezone"`
+	// JetStream key-value bucket keeping the last run of the jobs, created if
+	// needed
+	Bucket string `mapstructure:"bucket" validate:"pattern=^[A-Za-z0-9_-]+$"`
+	// Runs missed while surserver was stopped are only caught up within that
+	// delay
+	CatchUpWindow time.Duration `mapstructure:"catch_up_window" validate:"min=0"`
+	Jobs          []Job         `mapstructure:"jobs"`
+
+	loc *time.Location
+}
+
+// Job publishes a message on a schedule: a cron expression, a fixed
+// interval, or a sun event.
+type Job struct {
+	Name        string `mapstructure:"name" validate:"required,pattern=^[A-Za-z0-9_-]+$"`
+	Description string `mapstructure:"description"`
+	// Defaults to true
+	Enabled *bool `mapstructure:"enabled"`
+	// Exactly one of cron, every and sun is required
+	// Cron expression, e.g. "30 7 * * mon-fri" or @daily, see parseCron
+	Cron string `mapstructure:"cron"`
+	// Fixed interval, counted from the last run or from the start
+	Every time.Duration `mapstructure:"every" validate:"min=0"`
+	Sun   *SunEvent     `mapstructure:"sun"`
+	// NATS subject of the message
+	Subject string `mapstructure:"subject" validate:"required,subject"`
+	// Encoded as JSON. Defaults to {"job": name, "scheduled": time, "catch_up": bool}.
+	Payload any `mapstructure:"payload"`
+	// On start, publish once the last run missed while surserver was stopped,
+	// if it is within catch_up_window
+	CatchUp bool `mapstructure:"catch_up"`
+
+	schedule schedule
+}
+
+// SunEvent is a sun event, shifted by an offset, e.g. 30 minutes before
+// sunset with offset -30m.
+type SunEvent struct {
+	Event  string        `mapstructure:"event" validate:"required,oneof=sunrise sunset dawn dusk"`
+	Offset time.Duration `mapstructure:"offset"`
+}
+
+// schedule computes the runs of a job.
+type schedule interface {
+	// next returns the first run after t, or the zero time if there is none
+	next(t time.Time) time.Time
+	String() string
+}
+
+// everySchedule runs at a fixed interval.
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func (s everySchedule) String() string {
+	return "every " + time.Duration(s).String()
+}
+
+func parseConfig(name string, config map[string]any) (schedulerConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, schedulerConfig{
+		Bucket:        "scheduler",
+		CatchUpWindow: 24 * time.Hour,
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.loc = time.Local
+	if cfg.Timezone != "" {
+		if cfg.loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return cfg, fmt.Errorf("invalid timezone %q: %w", cfg.Timezone, err)
+		}
+	}
+	if cfg.Latitude != nil && (*cfg.Latitude < -90 || *cfg.Latitude > 90) {
+		return cfg, fmt.Errorf("latitude must be between -90 and 90")
+	}
+	if cfg.Longitude != nil && (*cfg.Longitude < -180 || *cfg.Longitude > 180) {
+		return cfg, fmt.Errorf("longitude must be between -180 and 180")
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Jobs {
+		job := &cfg.Jobs[i]
+		if err := cfg.compile(job); err != nil {
+			return cfg, fmt.Errorf("%w %s: %v", ErrInvalidJob, job.Name, err)
+		}
+		if seen[job.Name] {
+			return cfg, fmt.Errorf("%w: duplicate name %q", ErrInvalidJob, job.Name)
+		}
+		seen[job.Name] = true
+	}
+	return cfg, nil
+}
+
+// compile checks the schedule of job and sets job.schedule.
+func (c schedulerConfig) compile(job *Job) error {
+	set := 0
+	for _, isSet := range []bool{job.Cron != "", job.Every != 0, job.Sun != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of cron, every or sun is required")
+	}
+
+	switch {
+	case job.Cron != "":
+		cron, err := parseCron(job.Cron, c.loc)
+		if err != nil {
+			return err
+		}
+		if cron.next(time.Now()).IsZero() {
+			return fmt.Errorf("cron expression %q never matches", job.Cron)
+		}
+		job.schedule = cron
+	case job.Every != 0:
+		if job.Every < time.Second {
+			return fmt.Errorf("every must be at least 1s")
+		}
+		job.schedule = everySchedule(job.Every)
+	default:
+		if _, ok := sunZeniths[job.Sun.Event]; !ok {
+			return fmt.Errorf("sun event must be one of %s, %s, %s or %s", SunRise, SunSet, SunDawn, SunDusk)
+		}
+		if c.Latitude == nil || c.Longitude == nil {
+			return fmt.Errorf("sun schedules require the latitude and longitude of the module")
+		}
+		if job.Sun.Offset <= -12*time.Hour || job.Sun.Offset >= 12*time.Hour {
+			return fmt.Errorf("sun offset must be within 12 hours")
+		}
+		job.schedule = &sunSchedule{event: job.Sun.Event, offset: job.Sun.Offset, lat: *c.Latitude, lon: *c.Longitude, loc: c.loc}
+	}
+	return nil
+}
+
+// IsEnabled reports whether the job is enabled.
+func (j Job) IsEnabled() bool {
+	return j.Enabled == nil || *j.Enabled
+}
+
+// ConfigSchema describes the scheduler configuration.
+func (m *SchedulerModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(schedulerConfig{})
+}
@@ -0,0 +1,235 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a cron expression: minute, hour, day of month, month and
+// day of week fields, in a time zone.
+type cronSchedule struct {
+	src                           string
+	minute, hour, dom, month, dow bitset
+	loc                           *time.Location
+	// The day fields start with *, see dayMatches
+	anyDom, anyDow bool
+}
+
+// bitset holds the values of a field, bit i for value i.
+type bitset uint64
+
+func (b bitset) has(i int) bool {
+	return b&(1<<uint(i)) != 0
+}
+
+// cronField describes the values allowed in a field.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression of 5 fields, such as "30 7 * * mon-fri",
+// or one of @yearly, @monthly, @weekly, @daily and @hourly. Fields are lists
+// of values, ranges (1-5) and steps (*/15, 8-18/2); months and days of week
+// may be written with their first three letters.
+func parseCron(src string, loc *time.Location) (*cronSchedule, error) {
+	expanded := src
+	if strings.HasPrefix(src, "@") {
+		var ok bool
+		if expanded, ok = cronDescriptors[strings.ToLower(src)]; !ok {
+			return nil, fmt.Errorf("unknown cron descriptor %q", src)
+		}
+	}
+
+	fields := strings.Fields(expanded)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields: minute, hour, day of month, month and day of week", src)
+	}
+
+	var sets [5]bitset
+	for i, field := range fields {
+		set, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", src, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday is both 0 and 7
+	if sets[4].has(7) {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		src:    src,
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		loc:    loc,
+		anyDom: strings.HasPrefix(fields[2], "*"),
+		anyDow: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse parses a field, a comma separated list of values, ranges and steps.
+func (f cronField) parse(field string) (bitset, error) {
+	var set bitset
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepText, f.name)
+			}
+			step = n
+		}
+
+		var low, high int
+		switch {
+		case rng == "*":
+			low, high = f.min, f.max
+		case strings.Contains(rng, "-"):
+			lowText, highText, _ := strings.Cut(rng, "-")
+			var err error
+			if low, err = f.value(lowText); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(highText); err != nil {
+				return 0, err
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q in %s", rng, f.name)
+			}
+		default:
+			var err error
+			if low, err = f.value(rng); err != nil {
+				return 0, err
+			}
+			high = low
+			// 5/15 means from 5 to the end, every 15
+			if hasStep {
+				high = f.max
+			}
+		}
+
+		for i := low; i <= high; i += step {
+			set |= 1 << uint(i)
+		}
+	}
+	return set, nil
+}
+
+// value parses a number or a name of the field.
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid %s %q, expected %d to %d", f.name, text, f.min, f.max)
+	}
+	return n, nil
+}
+
+func (s *cronSchedule) String() string {
+	return "cron " + s.src
+}
+
+// next returns the first time matching the expression after t, or the zero
+// time if there is none within 5 years, e.g. for February 30. As in cron,
+// matching local times skipped when clocks move forward run when they move.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case !s.month.has(int(t.Month())):
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+		case !s.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+		case !s.hour.has(t.Hour()):
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+		case !s.minute.has(t.Minute()):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// Skipped local times, when clocks move forward, may not advance
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		if moved := s.skipped(t, next); !moved.IsZero() {
+			return moved
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// skipped returns when clocks moved forward between from and to, if they
+// skipped a local time matching the expression, or the zero time. The local
+// times between from and to that were not skipped must not match.
+func (s *cronSchedule) skipped(from, to time.Time) time.Time {
+	wallFrom, wallTo := wallClock(from), wallClock(to)
+	if wallTo.Sub(wallFrom) <= to.Sub(from) {
+		return time.Time{}
+	}
+	for w := wallFrom.Add(time.Minute); w.Before(wallTo); w = w.Add(time.Minute) {
+		if !s.month.has(int(w.Month())) || !s.dayMatches(w) || !s.hour.has(w.Hour()) || !s.minute.has(w.Minute()) {
+			continue
+		}
+		// The first minute after w on the clocks
+		t := from.Add(time.Minute)
+		for !wallClock(t).After(w) {
+			t = t.Add(time.Minute)
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// wallClock returns the local time of t in UTC, so durations between local
+// times ignore the changes of offset.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// dayMatches reports whether the day of t matches. As in cron, when both
+// day fields are restricted the day matches either of them.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dow
+	case s.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s: %v", name, err)
+	}
+	return loc
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		src string
+		// Expected error, empty when the expression is valid
+		wantErr string
+	}{
+		{src: "* * * * *"},
+		{src: "30 7 * * mon-fri"},
+		{src: "*/15 8-18/2 1,15 jan-jun SUN"},
+		{src: "5/15 * * * 7"},
+		{src: "0 0 29 2 *"},
+		{src: "@daily"},
+		{src: "@Hourly"},
+		{src: "@never", wantErr: "unknown cron descriptor"},
+		{src: "* * * *", wantErr: "must have 5 fields"},
+		{src: "* * * * * *", wantErr: "must have 5 fields"},
+		{src: "60 * * * *", wantErr: "invalid minute"},
+		{src: "* 24 * * *", wantErr: "invalid hour"},
+		{src: "* * 0 * *", wantErr: "invalid day of month"},
+		{src: "* * * 13 *", wantErr: "invalid month"},
+		{src: "* * * * 8", wantErr: "invalid day of week"},
+		{src: "* * * foo *", wantErr: "invalid month"},
+		{src: "5-1 * * * *", wantErr: "invalid range"},
+		{src: "*/0 * * * *", wantErr: "invalid step"},
+		{src: "*/x * * * *", wantErr: "invalid step"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := parseCron(tt.src, time.UTC)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("got error %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	paris := mustLoadLocation(t, "Europe/Paris")
+	at := func(s string) time.Time {
+		t.Helper()
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", s, paris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		src  string
+		from time.Time
+		// Expected runs after from, in order
+		want []time.Time
+	}{
+		{"30 7 * * mon-fri", at("2026-06-19 07:30"), []time.Time{at("2026-06-22 07:30"), at("2026-06-23 07:30")}},
+		{"*/20 * * * *", at("2026-06-19 07:41"), []time.Time{at("2026-06-19 08:00"), at("2026-06-19 08:20")}},
+		{"0 0 29 2 *", at("2026-06-19 00:00"), []time.Time{at("2028-02-29 00:00")}},
+		// Either day field matches when both are restricted
+		{"0 12 1 * sun", at("2026-06-29 00:00"), []time.Time{at("2026-07-01 12:00"), at("2026-07-05 12:00")}},
+		{"@monthly", at("2026-12-15 10:00"), []time.Time{at("2027-01-01 00:00")}},
+		// Clocks move forward from 2:00 to 3:00 on 2026-03-29 in Paris, the
+		// skipped runs happen at 3:00, once
+		{"30 2 * * *", at("2026-03-28 12:00"), []time.Time{at("2026-03-29 03:00"), at("2026-03-30 02:30")}},
+		{"15,45 2 * * *", at("2026-03-29 01:50"), []time.Time{at("2026-03-29 03:00"), at("2026-03-30 02:15")}},
+		{"0 * * * *", at("2026-03-29 01:30"), []time.Time{at("2026-03-29 03:00"), at("2026-03-29 04:00")}},
+		{"30 3 * * *", at("2026-03-29 01:00"), []time.Time{at("2026-03-29 03:30")}},
+		// Clocks move back from 3:00 to 2:00 on 2026-10-25
+		{"0 4 * * *", at("2026-10-24 12:00"), []time.Time{at("2026-10-25 04:00")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			s, err := parseCron(tt.src, paris)
+			if err != nil {
+				t.Fatalf("parseCron: %v", err)
+			}
+			from := tt.from
+			for _, want := range tt.want {
+				got := s.next(from)
+				if !got.Equal(want) {
+					t.Fatalf("next(%s) = %s, want %s", from, got, want)
+				}
+				from = got
+			}
+		})
+	}
+}
+
+func TestCronNever(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *", time.UTC)
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+	if got := s.next(time.Now()); !got.IsZero() {
+		t.Errorf("next = %s, want the zero time", got)
+	}
+}
@@ -0,0 +1,399 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+)
+
+// The loop checks the time at least that often, so runs are on time after the
+// clock changes or the host wakes up
+const maxWait = time.Minute
+
+// Missed runs are searched among that many runs at most, e.g. for a job
+// running every second
+const maxMissedRuns = 100000
+
+// JobStatus describes a job and its runs.
+type JobStatus struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schedule    string `json:"schedule"`
+	Subject     string `json:"subject"`
+	Enabled     bool   `json:"enabled"`
+	// Scheduled time of the next and the last run
+	NextRun *time.Time `json:"next_run,omitempty"`
+	LastRun *time.Time `json:"last_run,omitempty"`
+	// Runs since surserver started, including manual runs
+	Runs      int    `json:"runs"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+var jobStatusSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"name":        app.Schema{"type": "string"},
+		"description": app.Schema{"type": "string"},
+		"schedule":    app.Schema{"type": "string"},
+		"subject":     app.Schema{"type": "string"},
+		"enabled":     app.Schema{"type": "boolean"},
+		"next_run":    app.Schema{"type": "string", "format": "date-time"},
+		"last_run":    app.Schema{"type": "string", "format": "date-time"},
+		"runs":        app.Schema{"type": "integer"},
+		"last_error":  app.Schema{"type": "string"},
+	},
+}
+
+// lastRun is the value kept in the bucket for each job.
+type lastRun struct {
+	Scheduled time.Time `json:"scheduled"`
+	Published time.Time `json:"published"`
+}
+
+func init() {
+	app.Register("scheduler", func(name string) app.Module { return &SchedulerModule{name: name} })
+}
+
+// SchedulerModule publishes messages on schedules: cron expressions, fixed
+// intervals and sun events. The last run of each job is kept in a JetStream
+// key-value bucket, so runs missed while surserver was stopped can be caught
+// up.
+type SchedulerModule struct {
+	name string
+
+	mu     sync.Mutex
+	config schedulerConfig
+	jobs   map[string]*JobStatus
+	// Stops the loop running the jobs, and the channel closed once it stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (m *SchedulerModule) Name() string {
+	return m.name
+}
+
+func (m *SchedulerModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityJetStream}}
+}
+
+func (m *SchedulerModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	m.jobs = make(map[string]*JobStatus, len(cfg.Jobs))
+	for _, job := range cfg.Jobs {
+		m.jobs[job.Name] = &JobStatus{
+			Name:        job.Name,
+			Description: job.Description,
+			Schedule:    job.schedule.String(),
+			Subject:     job.Subject,
+			Enabled:     job.IsEnabled(),
+		}
+	}
+	return nil
+}
+
+func (m *SchedulerModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the jobs with their next and last runs",
+			Response: app.Schema{"type": "array", "items": jobStatusSchema},
+		},
+		{
+			Method:   "POST",
+			Path:     "/{name}/run",
+			Handler:  func(w http.ResponseWriter, r *http.Request) { m.handleRun(w, r, pub) },
+			Auth:     m.config.Auth,
+			Summary:  "Publish the message of a job now, without changing its schedule",
+			Response: jobStatusSchema,
+		},
+	}
+}
+
+// MsgHandlers starts running the jobs. The scheduler doesn't subscribe to
+// anything.
+func (m *SchedulerModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.cancel, m.done = cancel, done
+	go func() {
+		defer close(done)
+		m.run(ctx, pub, m.config)
+	}()
+	return nil
+}
+
+// Stop stops running the jobs.
+func (m *SchedulerModule) Stop() {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	m.cancel, m.done = nil, nil
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// run publishes the messages of the enabled jobs of config on schedule, until
+// ctx is done.
+func (m *SchedulerModule) run(ctx context.Context, pub app.Publisher, config schedulerConfig) {
+	logger := slog.With("module", m.Name())
+
+	kv, err := pub.KeyValue(nats.KeyValueConfig{Bucket: config.Bucket, Description: "Last runs of the scheduler jobs"})
+	if err != nil {
+		logger.Error("failed to open the bucket of the last runs, missed runs won't be caught up", "bucket", config.Bucket, "error", err)
+		kv = nil
+	}
+
+	now := time.Now()
+	jobs := make(map[string]Job)
+	next := make(map[string]time.Time)
+	for _, job := range config.Jobs {
+		if !job.IsEnabled() {
+			continue
+		}
+		jobs[job.Name] = job
+
+		last := loadLastRun(kv, job.Name, logger)
+		if last != nil {
+			m.update(job.Name, func(status *JobStatus) { status.LastRun = &last.Scheduled })
+		}
+		if missed := missedRun(job.schedule, last, now); job.CatchUp && !missed.IsZero() && now.Sub(missed) <= config.CatchUpWindow {
+			logger.Info("catching up missed run", "job", job.Name, "scheduled", missed)
+			m.publish(pub, kv, job, missed, true, logger)
+		}
+		next[job.Name] = firstRun(job.schedule, last, now)
+		m.setNextRun(job.Name, next[job.Name])
+	}
+
+	for {
+		name, at := earliest(next)
+		wait := maxWait
+		if !at.IsZero() {
+			wait = min(time.Until(at), maxWait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if at.IsZero() || time.Now().Before(at) {
+			continue
+		}
+
+		job := jobs[name]
+		m.publish(pub, kv, job, at, false, logger)
+
+		// Skip the runs that are already late, e.g. after the host slept
+		following := job.schedule.next(at)
+		if now := time.Now(); !following.IsZero() && !following.After(now) {
+			following = job.schedule.next(now)
+		}
+		next[name] = following
+		m.setNextRun(name, following)
+	}
+}
+
+// publish publishes the message of the run of job scheduled at, and keeps it
+// as its last run once published, so a failed run can still be caught up.
+func (m *SchedulerModule) publish(pub app.Publisher, kv nats.KeyValue, job Job, scheduled time.Time, catchUp bool, logger *slog.Logger) {
+	err := publishJob(pub, job, scheduled, catchUp)
+	if err != nil {
+		logger.Error("failed to publish job", "job", job.Name, "subject", job.Subject, "error", err)
+	} else {
+		logger.Debug("published job", "job", job.Name, "subject", job.Subject, "scheduled", scheduled)
+	}
+
+	m.update(job.Name, func(status *JobStatus) {
+		status.Runs++
+		status.LastRun = &scheduled
+		status.LastError = ""
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+
+	if kv == nil || err != nil {
+		return
+	}
+	data, _ := json.Marshal(lastRun{Scheduled: scheduled, Published: time.Now()})
+	if _, err := kv.Put(job.Name, data); err != nil {
+		logger.Warn("failed to keep the last run", "job", job.Name, "error", err)
+	}
+}
+
+// publishJob publishes the message of job, with the default payload unless
+// the job has one.
+func publishJob(pub app.Publisher, job Job, scheduled time.Time, catchUp bool) error {
+	payload := job.Payload
+	if payload == nil {
+		payload = map[string]any{"job": job.Name, "scheduled": scheduled, "catch_up": catchUp}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return pub.Publish(job.Subject, data)
+}
+
+// loadLastRun returns the last run of a job kept in kv, nil if there is none.
+func loadLastRun(kv nats.KeyValue, name string, logger *slog.Logger) *lastRun {
+	if kv == nil {
+		return nil
+	}
+	entry, err := kv.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		logger.Warn("failed to get the last run", "job", name, "error", err)
+		return nil
+	}
+	var last lastRun
+	if err := json.Unmarshal(entry.Value(), &last); err != nil {
+		logger.Warn("invalid last run", "job", name, "error", err)
+		return nil
+	}
+	return &last
+}
+
+// missedRun returns the latest run of s after last and until now, or the zero
+// time if there is none.
+func missedRun(s schedule, last *lastRun, now time.Time) time.Time {
+	if last == nil {
+		return time.Time{}
+	}
+	var missed time.Time
+	for t, i := s.next(last.Scheduled), 0; !t.IsZero() && !t.After(now) && i < maxMissedRuns; t, i = s.next(t), i+1 {
+		missed = t
+	}
+	return missed
+}
+
+// firstRun returns the first run of s after now. Intervals go on from the
+// last run.
+func firstRun(s schedule, last *lastRun, now time.Time) time.Time {
+	every, ok := s.(everySchedule)
+	if !ok || last == nil || last.Scheduled.After(now) {
+		return s.next(now)
+	}
+	interval := time.Duration(every)
+	return last.Scheduled.Add((now.Sub(last.Scheduled)/interval + 1) * interval)
+}
+
+// earliest returns the job with the earliest run in next.
+func earliest(next map[string]time.Time) (string, time.Time) {
+	var name string
+	var at time.Time
+	for candidate, t := range next {
+		if t.IsZero() {
+			continue
+		}
+		if at.IsZero() || t.Before(at) || (t.Equal(at) && candidate < name) {
+			name, at = candidate, t
+		}
+	}
+	return name, at
+}
+
+// update calls fn with the status of the job called name.
+func (m *SchedulerModule) update(name string, fn func(status *JobStatus)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status, ok := m.jobs[name]; ok {
+		fn(status)
+	}
+}
+
+func (m *SchedulerModule) setNextRun(name string, at time.Time) {
+	m.update(name, func(status *JobStatus) {
+		status.NextRun = nil
+		if !at.IsZero() {
+			status.NextRun = &at
+		}
+	})
+}
+
+func (m *SchedulerModule) handleList(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	statuses := make([]JobStatus, 0, len(m.config.Jobs))
+	for _, job := range m.config.Jobs {
+		statuses = append(statuses, *m.jobs[job.Name])
+	}
+	m.mu.Unlock()
+
+	app.WriteJSON(w, http.StatusOK, statuses)
+}
+
+func (m *SchedulerModule) handleRun(w http.ResponseWriter, r *http.Request, pub app.Publisher) {
+	name := r.PathValue("name")
+
+	m.mu.Lock()
+	var job *Job
+	for _, candidate := range m.config.Jobs {
+		if candidate.Name == name {
+			job = &candidate
+			break
+		}
+	}
+	m.mu.Unlock()
+	if job == nil {
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+
+	if principal, authenticated := app.PrincipalFromContext(r.Context()); authenticated && !principal.Allows(job.Subject) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		slog.Warn("job subject not allowed for principal",
+			"module", m.Name(),
+			"job", name,
+			"subject", job.Subject,
+			"principal", principal.Name,
+			"auth_method", principal.Method,
+		)
+		return
+	}
+
+	slog.Info("running job on request", "module", m.Name(), "job", name, "remote_addr", r.RemoteAddr)
+	now := time.Now()
+	if err := publishJob(pub, *job, now, false); err != nil {
+		http.Error(w, "Error publishing message", http.StatusBadGateway)
+		return
+	}
+
+	// The job may be gone if the module was reinitialized meanwhile
+	result := JobStatus{Name: name, Subject: job.Subject, Runs: 1, LastRun: &now}
+	m.update(name, func(status *JobStatus) {
+		status.Runs++
+		status.LastRun = &now
+		status.LastError = ""
+		result = *status
+	})
+	app.WriteJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMissedRun(t *testing.T) {
+	now := time.Date(2026, 6, 21, 12, 10, 0, 0, time.UTC)
+	hourly, err := parseCron("0 * * * *", time.UTC)
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		schedule schedule
+		last     *lastRun
+		want     time.Time
+	}{
+		{"never ran", hourly, nil, time.Time{}},
+		{"ran on time", hourly, &lastRun{Scheduled: now.Add(-10 * time.Minute)}, time.Time{}},
+		{"missed runs, the latest is kept", hourly, &lastRun{Scheduled: now.Add(-5 * time.Hour)}, now.Add(-10 * time.Minute)},
+		{"interval", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(-150 * time.Minute)}, now.Add(-30 * time.Minute)},
+		{"interval ran on time", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(-30 * time.Minute)}, time.Time{}},
+		{"last run in the future", hourly, &lastRun{Scheduled: now.Add(time.Hour)}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missedRun(tt.schedule, tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstRun(t *testing.T) {
+	now := time.Date(2026, 6, 21, 12, 10, 0, 0, time.UTC)
+	hourly, err := parseCron("0 * * * *", time.UTC)
+	if err != nil {
+		t.Fatalf("parseCron: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		schedule schedule
+		last     *lastRun
+		want     time.Time
+	}{
+		{"cron", hourly, nil, now.Add(50 * time.Minute)},
+		{"cron ignores the last run", hourly, &lastRun{Scheduled: now.Add(-5 * time.Hour)}, now.Add(50 * time.Minute)},
+		{"interval never ran", everySchedule(time.Hour), nil, now.Add(time.Hour)},
+		{"interval goes on from the last run", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(-150 * time.Minute)}, now.Add(30 * time.Minute)},
+		{"interval ran on time", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(-20 * time.Minute)}, now.Add(40 * time.Minute)},
+		{"interval run exactly now", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(-time.Hour)}, now.Add(time.Hour)},
+		{"last run in the future", everySchedule(time.Hour), &lastRun{Scheduled: now.Add(time.Minute)}, now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstRun(tt.schedule, tt.last, now); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
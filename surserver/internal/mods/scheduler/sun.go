@@ -0,0 +1,155 @@
+package scheduler
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Sun events
+const (
+	SunRise = "sunrise"
+	SunSet  = "sunset"
+	// Civil dawn and dusk, when the sun is 6° below the horizon
+	SunDawn = "dawn"
+	SunDusk = "dusk"
+)
+
+// Zenith angles of the sun events, in degrees. Sunrise and sunset account for
+// the refraction of the atmosphere and the radius of the sun.
+var sunZeniths = map[string]float64{
+	SunRise: 90.833,
+	SunSet:  90.833,
+	SunDawn: 96,
+	SunDusk: 96,
+}
+
+// sunSchedule is a sun event at a location, shifted by an offset.
+type sunSchedule struct {
+	event    string
+	offset   time.Duration
+	lat, lon float64
+	loc      *time.Location
+}
+
+func (s *sunSchedule) String() string {
+	if s.offset == 0 {
+		return s.event
+	}
+	sign := "+"
+	if s.offset < 0 {
+		sign = ""
+	}
+	return fmt.Sprintf("%s %s%s", s.event, sign, s.offset)
+}
+
+// next returns the first event after t, plus the offset, or the zero time if
+// there is none within a year, e.g. a polar night without dawn.
+func (s *sunSchedule) next(t time.Time) time.Time {
+	// Start the day before, for events moved to the next day by the offset
+	local := t.In(s.loc)
+	day := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 368; i++ {
+		event, ok := sunEvent(day.AddDate(0, 0, i), s.lat, s.lon, s.event)
+		if !ok {
+			continue
+		}
+		if at := event.Add(s.offset); at.After(t) {
+			return at.In(s.loc)
+		}
+	}
+	return time.Time{}
+}
+
+// sunEvent returns the time of a sun event on the day of date (its year,
+// month and day) at latitude lat and longitude lon, in degrees, north and
+// east being positive. ok is false when the event doesn't happen that day,
+// e.g. no sunset in a polar day.
+//
+// The computation is the one of the NOAA solar calculator, accurate to a
+// minute between latitudes 72° north and south.
+func sunEvent(date time.Time, lat, lon float64, event string) (at time.Time, ok bool) {
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	jd := float64(midnight.Unix())/86400 + 2440587.5
+	rising := event == SunRise || event == SunDawn
+
+	// Compute at noon, then again at the time found, as the position of the
+	// sun changes during the day
+	minutes, ok := sunEventUTC(jd+0.5, lat, lon, sunZeniths[event], rising)
+	if !ok {
+		return at, false
+	}
+	if minutes, ok = sunEventUTC(jd+minutes/1440, lat, lon, sunZeniths[event], rising); !ok {
+		return at, false
+	}
+	return midnight.Add(time.Duration(minutes * float64(time.Minute))).Truncate(time.Second), true
+}
+
+// sunEventUTC returns the minutes after midnight UTC of the day of julian
+// day jd when the sun reaches zenith, in the morning when rising.
+func sunEventUTC(jd, lat, lon, zenith float64, rising bool) (float64, bool) {
+	t := (jd - 2451545) / 36525
+	declination := sunDeclination(t)
+
+	latRad, declRad := radians(lat), radians(declination)
+	cosHourAngle := math.Cos(radians(zenith))/(math.Cos(latRad)*math.Cos(declRad)) - math.Tan(latRad)*math.Tan(declRad)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return 0, false
+	}
+	hourAngle := degrees(math.Acos(cosHourAngle))
+	if !rising {
+		hourAngle = -hourAngle
+	}
+	return 720 - 4*(lon+hourAngle) - equationOfTime(t), true
+}
+
+// The following functions take the julian century t since J2000.
+
+func sunGeomMeanLong(t float64) float64 {
+	return math.Mod(280.46646+t*(36000.76983+t*0.0003032), 360)
+}
+
+func sunGeomMeanAnomaly(t float64) float64 {
+	return 357.52911 + t*(35999.05029-0.0001537*t)
+}
+
+func earthOrbitEccentricity(t float64) float64 {
+	return 0.016708634 - t*(0.000042037+0.0000001267*t)
+}
+
+func sunApparentLong(t float64) float64 {
+	m := radians(sunGeomMeanAnomaly(t))
+	center := math.Sin(m)*(1.914602-t*(0.004817+0.000014*t)) + math.Sin(2*m)*(0.019993-0.000101*t) + math.Sin(3*m)*0.000289
+	trueLong := sunGeomMeanLong(t) + center
+	return trueLong - 0.00569 - 0.00478*math.Sin(radians(125.04-1934.136*t))
+}
+
+func obliquityCorrection(t float64) float64 {
+	meanObliquity := 23 + (26+(21.448-t*(46.815+t*(0.00059-t*0.001813)))/60)/60
+	return meanObliquity + 0.00256*math.Cos(radians(125.04-1934.136*t))
+}
+
+func sunDeclination(t float64) float64 {
+	return degrees(math.Asin(math.Sin(radians(obliquityCorrection(t))) * math.Sin(radians(sunApparentLong(t)))))
+}
+
+// equationOfTime returns the difference between apparent and mean solar
+// time, in minutes.
+func equationOfTime(t float64) float64 {
+	y := math.Pow(math.Tan(radians(obliquityCorrection(t))/2), 2)
+	l0 := radians(sunGeomMeanLong(t))
+	e := earthOrbitEccentricity(t)
+	m := radians(sunGeomMeanAnomaly(t))
+
+	eq := y*math.Sin(2*l0) - 2*e*math.Sin(m) + 4*e*y*math.Sin(m)*math.Cos(2*l0) -
+		0.5*y*y*math.Sin(4*l0) - 1.25*e*e*math.Sin(2*m)
+	return degrees(eq) * 4
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func degrees(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// Coordinates of Paris and Tromsø, in degrees
+const (
+	parisLat, parisLon   = 48.8566, 2.3522
+	tromsoLat, tromsoLon = 69.6496, 18.956
+)
+
+func TestSunEvent(t *testing.T) {
+	paris := mustLoadLocation(t, "Europe/Paris")
+	tests := []struct {
+		date     string
+		lat, lon float64
+		event    string
+		// Expected local time in Paris, empty when the event doesn't happen
+		want string
+	}{
+		{"2026-06-21", parisLat, parisLon, SunRise, "05:46"},
+		{"2026-06-21", parisLat, parisLon, SunSet, "21:58"},
+		{"2026-12-21", parisLat, parisLon, SunRise, "08:41"},
+		{"2026-12-21", parisLat, parisLon, SunSet, "16:56"},
+		{"2026-06-21", parisLat, parisLon, SunDawn, "05:04"},
+		{"2026-06-21", parisLat, parisLon, SunDusk, "22:41"},
+		// Polar day and night
+		{"2026-06-21", tromsoLat, tromsoLon, SunSet, ""},
+		{"2026-12-21", tromsoLat, tromsoLon, SunRise, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.date+" "+tt.event, func(t *testing.T) {
+			date, _ := time.Parse(time.DateOnly, tt.date)
+			got, ok := sunEvent(date, tt.lat, tt.lon, tt.event)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("got %s, want no %s", got, tt.event)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("got no %s", tt.event)
+			}
+			want, _ := time.ParseInLocation(time.DateOnly+" 15:04", tt.date+" "+tt.want, paris)
+			// The computation is accurate to a minute
+			if diff := got.Sub(want); diff < -time.Minute || diff > time.Minute {
+				t.Errorf("got %s, want %s", got.In(paris).Format("15:04:05"), tt.want)
+			}
+		})
+	}
+}
+
+func TestSunNext(t *testing.T) {
+	paris := mustLoadLocation(t, "Europe/Paris")
+	s := &sunSchedule{event: SunSet, offset: -30 * time.Minute, lat: parisLat, lon: parisLon, loc: paris}
+
+	from := time.Date(2026, 6, 21, 21, 0, 0, 0, paris)
+	first := s.next(from)
+	if first.Day() != 21 || first.Hour() != 21 || first.Minute() < 27 || first.Minute() > 29 {
+		t.Errorf("next(%s) = %s, want 30 minutes before sunset", from, first)
+	}
+	// The run of the day is over
+	if second := s.next(first); second.Day() != 22 {
+		t.Errorf("next(%s) = %s, want the next day", first, second)
+	}
+}
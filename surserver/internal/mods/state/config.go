@@ -0,0 +1,102 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+)
+
+var ErrInvalidSource = errors.New("invalid source")
+
+// Entity IDs are keys of the bucket and tokens of the history subjects
+var entityRe = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// Names the expressions of sources may refer to
+var sourceNames = []string{"subject", "tokens", "payload"}
+
+// stateConfig is the module configuration as found in ModuleConfig.Config.
+type stateConfig struct {
+	// Require authentication on the HTTP endpoints, see the auth section
+	Auth bool `mapstructure:"auth"`
+	// JetStream key-value bucket keeping the last value of the entities,
+	// created if needed
+	Bucket string `mapstructure:"bucket" validate:"pattern=^[A-Za-z0-9_-]+$"`
+	// JetStream stream keeping the changes of the entities, created if needed.
+	// Changes are published on <history_subject>.<entity>.
+	Stream         string `mapstructure:"stream" validate:"pattern=^[A-Za-z0-9_-]+$"`
+	HistorySubject string `mapstructure:"history_subject" validate:"subject"`
+	// How long changes are kept in the history
+	Retention time.Duration `mapstructure:"retention" validate:"min=0"`
+	// Histories with more points are downsampled to at most that many
+	MaxPoints int      `mapstructure:"max_points" validate:"min=1"`
+	Sources   []Source `mapstructure:"sources"`
+}
+
+// Source is a subject whose messages are readings of an entity.
+type Source struct {
+	// Wildcards allowed, or a reference such as device:thermostat:state
+	Subject string `mapstructure:"subject" validate:"required,pattern=^[^$\\s]+$"`
+	// Template of the entity ID, e.g. "{{ tokens[1] }}.temperature", reading
+	// subject, tokens and payload. Defaults to the subject of the message.
+	Entity string `mapstructure:"entity"`
+	// Expression of the value, e.g. payload.temperature, reading subject,
+	// tokens and payload. Defaults to the payload.
+	Value string `mapstructure:"value"`
+
+	entity *expr.Template
+	value  *expr.Expr
+}
+
+func parseConfig(name string, config map[string]any) (stateConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, stateConfig{
+		Bucket:         "state",
+		Stream:         "STATE_HISTORY",
+		HistorySubject: "state.history",
+		Retention:      30 * 24 * time.Hour,
+		MaxPoints:      500,
+	})
+	if err != nil {
+		return cfg, err
+	}
+	for i := range cfg.Sources {
+		if err := cfg.Sources[i].validate(cfg.HistorySubject); err != nil {
+			return cfg, fmt.Errorf("%w %d (%s): %v", ErrInvalidSource, i, cfg.Sources[i].Subject, err)
+		}
+	}
+	return cfg, nil
+}
+
+// validate compiles the expressions of the source, and checks it doesn't
+// read the history, which would record its own changes.
+func (s *Source) validate(historySubject string) error {
+	if app.SubjectsOverlap(s.Subject, historySubject+".>") {
+		return fmt.Errorf("subject matches the history subjects %s.>", historySubject)
+	}
+	if s.Entity != "" {
+		entity, err := expr.ParseTemplate(s.Entity, sourceNames...)
+		if err != nil {
+			return fmt.Errorf("entity %q: %w", s.Entity, err)
+		}
+		if entity.IsLiteral() && !entityRe.MatchString(s.Entity) {
+			return fmt.Errorf("entity %q may only contain letters, digits, - and _ separated by dots", s.Entity)
+		}
+		s.entity = entity
+	}
+	if s.Value != "" {
+		value, err := expr.Compile(s.Value, sourceNames...)
+		if err != nil {
+			return fmt.Errorf("value %q: %w", s.Value, err)
+		}
+		s.value = value
+	}
+	return nil
+}
+
+// ConfigSchema describes the state configuration.
+func (m *StateModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(stateConfig{})
+}
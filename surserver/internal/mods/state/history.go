@@ -0,0 +1,183 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/nats-io/nats.go"
+)
+
+// How long to wait for the next change of a history before assuming there
+// is none left
+const readTimeout = 2 * time.Second
+
+// Point is a value of an entity at a time. Downsampled points aggregate the
+// values of an interval starting at Time: numbers are averaged, other values
+// are the last one of the interval.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value any       `json:"value"`
+	// Downsampled points only: the number of values of the interval, and the
+	// extremes of numbers
+	Count int      `json:"count,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+
+	// Sum of the values, while they are all numbers
+	sum     float64
+	numeric bool
+}
+
+var pointSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"time":  app.Schema{"type": "string", "format": "date-time"},
+		"value": app.Schema{},
+		"count": app.Schema{"type": "integer"},
+		"min":   app.Schema{"type": "number"},
+		"max":   app.Schema{"type": "number"},
+	},
+}
+
+// History is the changes of an entity between two times.
+type History struct {
+	Entity string    `json:"entity"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	// Length of the intervals of downsampled points, empty when the points are
+	// the recorded changes
+	Interval string  `json:"interval,omitempty"`
+	Points   []Point `json:"points"`
+}
+
+var historySchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"entity":   app.Schema{"type": "string"},
+		"from":     app.Schema{"type": "string", "format": "date-time"},
+		"to":       app.Schema{"type": "string", "format": "date-time"},
+		"interval": app.Schema{"type": "string"},
+		"points":   app.Schema{"type": "array", "items": pointSchema},
+	},
+}
+
+// change is a message of the history stream.
+type change struct {
+	Value any `json:"value"`
+}
+
+// downsampler collects the points of a history. Unless an interval is given,
+// it keeps the recorded changes until there are more than maxPoints, then
+// downsamples them to at most maxPoints intervals between from and to.
+type downsampler struct {
+	from, to  time.Time
+	interval  time.Duration
+	maxPoints int
+	points    []Point
+}
+
+func (d *downsampler) add(t time.Time, value any) {
+	if d.interval > 0 {
+		d.aggregate(t, value)
+		return
+	}
+	d.points = append(d.points, Point{Time: t, Value: value})
+	if len(d.points) <= d.maxPoints {
+		return
+	}
+
+	d.interval = autoInterval(d.from, d.to, d.maxPoints)
+	raw := d.points
+	d.points = nil
+	for _, p := range raw {
+		d.aggregate(p.Time, p.Value)
+	}
+}
+
+// aggregate adds value to the point of the interval of t. Values are added in
+// time order.
+func (d *downsampler) aggregate(t time.Time, value any) {
+	start := d.from.Add(t.Sub(d.from).Truncate(d.interval))
+	if n := len(d.points); n == 0 || !d.points[n-1].Time.Equal(start) {
+		d.points = append(d.points, Point{Time: start, numeric: true})
+	}
+	p := &d.points[len(d.points)-1]
+	p.Count++
+
+	number, ok := value.(float64)
+	p.numeric = p.numeric && ok
+	if !p.numeric {
+		p.Value, p.Min, p.Max = value, nil, nil
+		return
+	}
+	p.sum += number
+	p.Value = p.sum / float64(p.Count)
+	if p.Min == nil || number < *p.Min {
+		p.Min = &number
+	}
+	if p.Max == nil || number > *p.Max {
+		p.Max = &number
+	}
+}
+
+// autoInterval returns the shortest whole number of seconds splitting from to
+// to in at most maxPoints intervals.
+func autoInterval(from, to time.Time, maxPoints int) time.Duration {
+	interval := (to.Sub(from) + time.Duration(maxPoints) - 1) / time.Duration(maxPoints)
+	if rounded := interval.Truncate(time.Second); rounded < interval {
+		interval = rounded + time.Second
+	}
+	return interval
+}
+
+// readHistory returns the changes recorded on subject between from and to,
+// downsampled with interval, or when zero automatically once there are more
+// than maxPoints. It also returns the interval of the downsampled points.
+func readHistory(js nats.JetStreamContext, stream, subject string, from, to time.Time, interval time.Duration, maxPoints int) ([]Point, time.Duration, error) {
+	d := &downsampler{from: from, to: to, interval: interval, maxPoints: maxPoints}
+
+	last, err := js.GetLastMsg(stream, subject)
+	if errors.Is(err, nats.ErrMsgNotFound) {
+		return d.points, d.interval, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("stream %s: %w", stream, err)
+	}
+	if last.Time.Before(from) {
+		return d.points, d.interval, nil
+	}
+
+	sub, err := js.SubscribeSync(subject, nats.BindStream(stream), nats.OrderedConsumer(), nats.StartTime(from))
+	if err != nil {
+		return nil, 0, fmt.Errorf("stream %s: %w", stream, err)
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	for {
+		msg, err := sub.NextMsg(readTimeout)
+		if errors.Is(err, nats.ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("stream %s: %w", stream, err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, 0, fmt.Errorf("stream %s: %w", stream, err)
+		}
+		if meta.Timestamp.After(to) {
+			break
+		}
+		var c change
+		if err := json.Unmarshal(msg.Data, &c); err == nil {
+			d.add(meta.Timestamp.UTC(), c.Value)
+		}
+		if meta.NumPending == 0 || meta.Sequence.Stream >= last.Sequence {
+			break
+		}
+	}
+	return d.points, d.interval, nil
+}
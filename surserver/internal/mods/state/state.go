@@ -0,0 +1,443 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+	"github.com/nats-io/nats.go"
+)
+
+// The last values are loaded within that delay when the module starts
+const loadTimeout = 5 * time.Second
+
+// Histories cover that period before now when from isn't given
+const defaultHistoryPeriod = 24 * time.Hour
+
+var (
+	ErrUnknownEntity = errors.New("unknown entity")
+	errNoStorage     = errors.New("the bucket or the stream of the states is not available")
+)
+
+func init() {
+	app.Register("state", func(name string) app.Module { return &StateModule{name: name} })
+}
+
+// StateModule remembers what sensors and devices report: it subscribes to the
+// subjects of its sources, keeps the last value of each entity in a JetStream
+// key-value bucket, and records the changes of values in a JetStream stream,
+// served as histories downsampled to a maximum number of points.
+type StateModule struct {
+	name string
+
+	mu     sync.Mutex
+	config stateConfig
+	kv     nats.KeyValue
+	js     nats.JetStreamContext
+	// Last values by entity
+	states map[string]State
+	// Serialize the writes of the states and changes of each entity, by entity
+	writes map[string]*sync.Mutex
+}
+
+// State is the last known value of an entity.
+type State struct {
+	Entity string `json:"entity"`
+	Value  any    `json:"value"`
+	// Subject of the last reading
+	Subject string `json:"subject"`
+	// Time of the last reading, and of the last change of the value
+	Updated time.Time `json:"updated"`
+	Changed time.Time `json:"changed"`
+}
+
+var stateSchema = app.Schema{
+	"type": "object",
+	"properties": map[string]any{
+		"entity":  app.Schema{"type": "string"},
+		"value":   app.Schema{},
+		"subject": app.Schema{"type": "string"},
+		"updated": app.Schema{"type": "string", "format": "date-time"},
+		"changed": app.Schema{"type": "string", "format": "date-time"},
+	},
+}
+
+func (m *StateModule) Name() string {
+	return m.name
+}
+
+func (m *StateModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityJetStream}}
+}
+
+func (m *StateModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	if m.writes == nil {
+		m.writes = make(map[string]*sync.Mutex)
+	}
+	return nil
+}
+
+func (m *StateModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	return []app.HTTPHandler{
+		{
+			Method:   "GET",
+			Path:     "",
+			Handler:  m.handleList,
+			Auth:     m.config.Auth,
+			Summary:  "List the last values of the entities, filtered by the prefix query parameter",
+			Response: app.Schema{"type": "array", "items": stateSchema},
+		},
+		{
+			Method:   "GET",
+			Path:     "/{entity}",
+			Handler:  m.handleGet,
+			Auth:     m.config.Auth,
+			Summary:  "Get the last value of an entity",
+			Response: stateSchema,
+		},
+		{
+			Method:   "GET",
+			Path:     "/{entity}/history",
+			Handler:  m.handleHistory,
+			Auth:     m.config.Auth,
+			Summary:  "Get the changes of an entity between the from and to query parameters, downsampled by interval",
+			Response: historySchema,
+		},
+	}
+}
+
+// MsgHandlers opens the bucket and the stream, loads the last values, and
+// records the readings of the sources.
+func (m *StateModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	logger := slog.With("module", m.Name())
+	if err := m.open(pub); err != nil {
+		logger.Error("failed to open the storage of the states", "error", err)
+		return nil
+	}
+
+	m.mu.Lock()
+	sources := m.config.Sources
+	m.mu.Unlock()
+
+	handlers := make([]app.MsgHandler, 0, len(sources))
+	for _, source := range sources {
+		subject, err := pub.ResolveSubject(source.Subject)
+		if err != nil {
+			logger.Error("ignoring source", "subject", source.Subject, "error", err)
+			continue
+		}
+		handlers = append(handlers, app.MsgHandler{Subject: subject, Handler: func(msg *nats.Msg) {
+			if err := m.record(source, msg); err != nil {
+				logger.Warn("failed to record reading", "subject", msg.Subject, "error", err)
+			}
+		}})
+	}
+	return handlers
+}
+
+// open opens the bucket and the stream, creating or updating them, and loads
+// the last values of the bucket.
+func (m *StateModule) open(pub app.Publisher) error {
+	m.mu.Lock()
+	cfg := m.config
+	m.kv, m.js = nil, nil
+	m.mu.Unlock()
+
+	js, err := pub.JetStream()
+	if err != nil {
+		return err
+	}
+	streamConfig := &nats.StreamConfig{
+		Name:        cfg.Stream,
+		Description: "Changes of the states of entities",
+		Subjects:    []string{cfg.HistorySubject + ".>"},
+		MaxAge:      cfg.Retention,
+		Storage:     nats.FileStorage,
+	}
+	if _, err = js.StreamInfo(cfg.Stream); errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(streamConfig)
+	} else if err == nil {
+		_, err = js.UpdateStream(streamConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("stream %s: %w", cfg.Stream, err)
+	}
+
+	kv, err := pub.KeyValue(nats.KeyValueConfig{Bucket: cfg.Bucket, Description: "Last values of entities"})
+	if err != nil {
+		return fmt.Errorf("bucket %s: %w", cfg.Bucket, err)
+	}
+	states, err := load(kv)
+	if err != nil {
+		return fmt.Errorf("bucket %s: %w", cfg.Bucket, err)
+	}
+
+	m.mu.Lock()
+	m.kv, m.js, m.states = kv, js, states
+	m.mu.Unlock()
+	slog.Info("states loaded", "module", m.Name(), "entities", len(states))
+	return nil
+}
+
+// load returns the states of the bucket.
+func load(kv nats.KeyValue) (map[string]State, error) {
+	watcher, err := kv.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	states := make(map[string]State)
+	timeout := time.After(loadTimeout)
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// The initial values were all received
+			if entry == nil {
+				return states, nil
+			}
+			var state State
+			if err := json.Unmarshal(entry.Value(), &state); err != nil {
+				slog.Warn("invalid state", "entity", entry.Key(), "error", err)
+				continue
+			}
+			states[entry.Key()] = state
+		case <-timeout:
+			return states, fmt.Errorf("states still loading after %s", loadTimeout)
+		}
+	}
+}
+
+// record stores the reading of a source received in msg.
+func (m *StateModule) record(source Source, msg *nats.Msg) error {
+	tokens := make([]any, 0)
+	for _, token := range strings.Split(msg.Subject, ".") {
+		tokens = append(tokens, token)
+	}
+	env := map[string]any{"subject": msg.Subject, "tokens": tokens, "payload": decode(msg.Data)}
+
+	entity := msg.Subject
+	if source.entity != nil {
+		value, err := source.entity.Render(env)
+		if err != nil {
+			return fmt.Errorf("entity: %w", err)
+		}
+		entity = expr.String(value)
+	}
+	if !entityRe.MatchString(entity) {
+		return fmt.Errorf("invalid entity %q", entity)
+	}
+
+	value := env["payload"]
+	if source.value != nil {
+		var err error
+		if value, err = source.value.Eval(env); err != nil {
+			return fmt.Errorf("value: %w", err)
+		}
+	}
+	return m.update(entity, msg.Subject, value, time.Now().UTC())
+}
+
+// update stores the value of entity, and records it in the history when it
+// changed. The updates of an entity are written in order.
+func (m *StateModule) update(entity, subject string, value any, now time.Time) error {
+	m.mu.Lock()
+	write, ok := m.writes[entity]
+	if !ok {
+		write = new(sync.Mutex)
+		m.writes[entity] = write
+	}
+	m.mu.Unlock()
+	write.Lock()
+	defer write.Unlock()
+
+	m.mu.Lock()
+	kv, js, historySubject := m.kv, m.js, m.config.HistorySubject
+	if kv == nil || js == nil {
+		m.mu.Unlock()
+		return errNoStorage
+	}
+	previous, known := m.states[entity]
+	changed := !known || !expr.Equal(previous.Value, value)
+	state := State{Entity: entity, Value: value, Subject: subject, Updated: now, Changed: previous.Changed}
+	if changed {
+		state.Changed = now
+	}
+	m.states[entity] = state
+	m.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if _, err := kv.Put(entity, data); err != nil {
+		return fmt.Errorf("storing state of %s: %w", entity, err)
+	}
+	if !changed {
+		return nil
+	}
+	data, err = json.Marshal(change{Value: value})
+	if err != nil {
+		return err
+	}
+	if _, err := js.Publish(historySubject+"."+entity, data); err != nil {
+		return fmt.Errorf("recording change of %s: %w", entity, err)
+	}
+	return nil
+}
+
+// list returns the states of the entities starting with prefix, sorted by
+// entity.
+func (m *StateModule) list(prefix string) []State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]State, 0, len(m.states))
+	for entity, state := range m.states {
+		if strings.HasPrefix(entity, prefix) {
+			states = append(states, state)
+		}
+	}
+	slices.SortFunc(states, func(a, b State) int { return strings.Compare(a.Entity, b.Entity) })
+	return states
+}
+
+// get returns the state of entity.
+func (m *StateModule) get(entity string) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[entity]
+	if !ok {
+		return State{}, fmt.Errorf("%w %q", ErrUnknownEntity, entity)
+	}
+	return state, nil
+}
+
+// history returns the changes of entity between from and to, see readHistory.
+func (m *StateModule) history(entity string, from, to time.Time, interval time.Duration) (History, error) {
+	if _, err := m.get(entity); err != nil {
+		return History{}, err
+	}
+	m.mu.Lock()
+	js, cfg := m.js, m.config
+	m.mu.Unlock()
+	if js == nil {
+		return History{}, errNoStorage
+	}
+
+	points, interval, err := readHistory(js, cfg.Stream, cfg.HistorySubject+"."+entity, from, to, interval, cfg.MaxPoints)
+	if err != nil {
+		return History{}, err
+	}
+	history := History{Entity: entity, From: from, To: to, Points: points}
+	if history.Points == nil {
+		history.Points = []Point{}
+	}
+	if interval > 0 {
+		history.Interval = interval.String()
+	}
+	return history, nil
+}
+
+func (m *StateModule) handleList(w http.ResponseWriter, r *http.Request) {
+	app.WriteJSON(w, http.StatusOK, m.list(r.URL.Query().Get("prefix")))
+}
+
+func (m *StateModule) handleGet(w http.ResponseWriter, r *http.Request) {
+	state, err := m.get(r.PathValue("entity"))
+	if err != nil {
+		http.Error(w, "Unknown entity", http.StatusNotFound)
+		return
+	}
+	app.WriteJSON(w, http.StatusOK, state)
+}
+
+func (m *StateModule) handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now().UTC()
+	from, to := now.Add(-defaultHistoryPeriod), now
+	var err error
+	if s := query.Get("from"); s != "" {
+		if from, err = parseTime(s, now); err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if to, err = parseTime(s, now); err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "Invalid period: from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	maxPoints := m.config.MaxPoints
+	m.mu.Unlock()
+	var interval time.Duration
+	if s := query.Get("interval"); s != "" {
+		interval, err = time.ParseDuration(s)
+		if err != nil || interval <= 0 {
+			http.Error(w, "Invalid interval: expected a positive duration such as 5m", http.StatusBadRequest)
+			return
+		}
+		if shortest := autoInterval(from, to, maxPoints); interval < shortest {
+			http.Error(w, fmt.Sprintf("Invalid interval: at most %d points may be returned, use an interval of at least %s", maxPoints, shortest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := m.history(r.PathValue("entity"), from, to, interval)
+	switch {
+	case errors.Is(err, ErrUnknownEntity):
+		http.Error(w, "Unknown entity", http.StatusNotFound)
+	case errors.Is(err, errNoStorage):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err != nil:
+		slog.Error("failed to read history", "module", m.Name(), "error", err)
+		http.Error(w, "Error reading the history", http.StatusInternalServerError)
+	default:
+		app.WriteJSON(w, http.StatusOK, history)
+	}
+}
+
+// parseTime parses a time in RFC 3339 format, or a duration before now such
+// as 24h.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errors.New("expected a duration such as 24h or a time such as 2024-06-01T12:00:00Z")
+	}
+	return t.UTC(), nil
+}
+
+// decode returns the JSON value of data, or data as a string when it isn't
+// JSON.
+func decode(data []byte) any {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return string(data)
+	}
+	return value
+}
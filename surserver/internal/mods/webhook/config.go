@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/app/expr"
+	"github.com/lstep/surroundhome/surserver/internal/jsonpath"
+)
+
+// Signature schemes supported by endpoints
+const (
+	SchemeNone       = "none"
+	SchemeHMACSHA256 = "hmac-sha256"
+	SchemeBasic      = "basic"
+)
+
+var (
+	ErrInvalidEndpoint  = errors.New("invalid webhook endpoint")
+	ErrMissingSignature = errors.New("missing signature")
+	ErrBadSignature     = errors.New("signature mismatch")
+	ErrBadCredentials   = errors.New("invalid credentials")
+)
+
+// webhookConfig is the module configuration as found in ModuleConfig.Config.
+type webhookConfig struct {
+	// Maximum size in bytes of a webhook body.
+	MaxBodySize int64      `mapstructure:"max_body_size" validate:"min=1"`
+	Endpoints   []Endpoint `mapstructure:"endpoints"`
+}
+
+// Endpoint defines a webhook receiver.
+type Endpoint struct {
+	Name string `mapstructure:"name" validate:"required"`
+	// Path of the endpoint, below /webhook (or /<name> for another instance)
+	Path string     `mapstructure:"path" validate:"required,pattern=^/"`
+	Auth AuthConfig `mapstructure:"auth"`
+	// Subject the payload is published to
+	Subject string `mapstructure:"subject" validate:"required,subject"`
+	// Optional JSON path of a payload value appended to the subject as its last token,
+	// e.g. subject "home.github" and subject_path "action" publish to "home.github.opened"
+	SubjectPath string    `mapstructure:"subject_path"`
+	Transform   Transform `mapstructure:"transform"`
+}
+
+// AuthConfig defines how the sender of a webhook is verified.
+type AuthConfig struct {
+	// One of none, hmac-sha256 or basic. Required, even to disable verification
+	Scheme string `mapstructure:"scheme" validate:"required,oneof=none hmac-sha256 basic"`
+	// hmac-sha256: header carrying the hex encoded signature of the body, and its prefix
+	// (e.g. X-Hub-Signature-256 and "sha256=" for GitHub)
+	Header string `mapstructure:"header"`
+	Prefix string `mapstructure:"prefix"`
+	Secret string `mapstructure:"secret"`
+	// basic: expected credentials
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// Transform reshapes the payload before it is published. Without fields, set
+// nor expr, the payload is published as received.
+type Transform struct {
+	// Output field -> JSON path in the received payload
+	Fields map[string]string `mapstructure:"fields"`
+	// Static output fields
+	Set map[string]any `mapstructure:"set"`
+	// Expression computing the published payload, instead of fields and set.
+	// It reads the received payload as payload and the first value of each
+	// header as headers, e.g. {event: headers["X-Github-Event"], repository:
+	// payload.repository.full_name}. See package expr.
+	Expr string `mapstructure:"expr"`
+
+	compiled *expr.Expr
+}
+
+func parseConfig(name string, config map[string]any) (webhookConfig, error) {
+	cfg, err := app.DecodeConfig(name, config, webhookConfig{
+		MaxBodySize: 1 << 20, // 1MB
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Endpoints {
+		endpoint := &cfg.Endpoints[i]
+		if err := endpoint.validate(); err != nil {
+			return cfg, err
+		}
+		if seen[endpoint.Path] {
+			return cfg, fmt.Errorf("%w: duplicate path %q", ErrInvalidEndpoint, endpoint.Path)
+		}
+		seen[endpoint.Path] = true
+	}
+
+	return cfg, nil
+}
+
+// validate checks what the tags of the endpoint fields can't express, and
+// compiles the transform expression.
+func (e *Endpoint) validate() error {
+	if _, err := jsonpath.Parse(e.SubjectPath); err != nil {
+		return fmt.Errorf("%w %s: %w", ErrInvalidEndpoint, e.Name, err)
+	}
+	for field, path := range e.Transform.Fields {
+		if _, err := jsonpath.Parse(path); err != nil {
+			return fmt.Errorf("%w %s: transform field %q: %w", ErrInvalidEndpoint, e.Name, field, err)
+		}
+	}
+	if e.Transform.Expr != "" {
+		if len(e.Transform.Fields) > 0 || len(e.Transform.Set) > 0 {
+			return fmt.Errorf("%w %s: transform expr can't be combined with fields or set", ErrInvalidEndpoint, e.Name)
+		}
+		compiled, err := expr.Compile(e.Transform.Expr, "payload", "headers")
+		if err != nil {
+			return fmt.Errorf("%w %s: transform expr: %w", ErrInvalidEndpoint, e.Name, err)
+		}
+		e.Transform.compiled = compiled
+	}
+
+	switch e.Auth.Scheme {
+	case SchemeHMACSHA256:
+		if e.Auth.Header == "" || e.Auth.Secret == "" {
+			return fmt.Errorf("%w %s: hmac-sha256 requires a header and a secret", ErrInvalidEndpoint, e.Name)
+		}
+	case SchemeBasic:
+		if e.Auth.Username == "" || e.Auth.Password == "" {
+			return fmt.Errorf("%w %s: basic requires a username and a password", ErrInvalidEndpoint, e.Name)
+		}
+	}
+
+	return nil
+}
+
+// verify checks the webhook was sent by the expected service.
+func (a AuthConfig) verify(r *http.Request, body []byte) error {
+	switch a.Scheme {
+	case SchemeHMACSHA256:
+		header := r.Header.Get(a.Header)
+		if header == "" {
+			return ErrMissingSignature
+		}
+		signature, err := hex.DecodeString(strings.TrimPrefix(header, a.Prefix))
+		if err != nil {
+			return ErrBadSignature
+		}
+		mac := hmac.New(sha256.New, []byte(a.Secret))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrBadSignature
+		}
+	case SchemeBasic:
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return ErrBadCredentials
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+		if !userOK || !passOK {
+			return ErrBadCredentials
+		}
+	}
+	return nil
+}
+
+func (t Transform) apply(payload any, header http.Header) (any, error) {
+	if t.compiled != nil {
+		headers := make(map[string]any, len(header))
+		for key, values := range header {
+			headers[key] = values[0]
+		}
+		return t.compiled.Eval(map[string]any{"payload": payload, "headers": headers})
+	}
+	if len(t.Fields) == 0 && len(t.Set) == 0 {
+		return payload, nil
+	}
+
+	out := make(map[string]any, len(t.Fields)+len(t.Set))
+	for field, path := range t.Fields {
+		if value, ok := jsonpath.Get(payload, path); ok {
+			out[field] = value
+		}
+	}
+	for field, value := range t.Set {
+		out[field] = value
+	}
+	return out, nil
+}
+
+// ConfigSchema describes the webhook module configuration.
+func (m *WebhookModule) ConfigSchema() app.Schema {
+	return app.SchemaOf(webhookConfig{})
+}
@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lstep/surroundhome/surserver/internal/app"
+	"github.com/lstep/surroundhome/surserver/internal/jsonpath"
+)
+
+// WebhookModule receives webhooks from external services and publishes them
+// as NATS messages.
+type WebhookModule struct {
+	// Name of the instance, "webhook" unless configured with type: webhook under another name
+	name string
+
+	// Init replaces it while the handlers of the previous config serve
+	mu     sync.Mutex
+	config webhookConfig
+}
+
+var tokenSanitizer = regexp.MustCompile(`[.*>\s]+`)
+
+func init() {
+	app.Register("webhook", func(name string) app.Module { return &WebhookModule{name: name} })
+}
+
+func (m *WebhookModule) Name() string {
+	return m.name
+}
+
+// Dependencies declares webhooks are received by the HTTP server.
+func (m *WebhookModule) Dependencies() app.Dependencies {
+	return app.Dependencies{Capabilities: []app.Capability{app.CapabilityHTTP}}
+}
+
+func (m *WebhookModule) Init(config map[string]any) error {
+	cfg, err := parseConfig(m.Name(), config)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	return nil
+}
+
+// HTTPHandlers registers one handler per configured endpoint.
+func (m *WebhookModule) HTTPHandlers(pub app.Publisher) []app.HTTPHandler {
+	handlers := make([]app.HTTPHandler, 0, len(m.config.Endpoints))
+	for _, endpoint := range m.config.Endpoints {
+		handlers = append(handlers, app.HTTPHandler{
+			Method:  "POST",
+			Path:    endpoint.Path,
+			Handler: withEndpoint(m.handleWebhook, endpoint, pub),
+			Summary: fmt.Sprintf("Receive the %s webhook and publish it to %s", endpoint.Name, endpoint.Subject),
+			Request: app.Schema{"type": "object"},
+			Status:  http.StatusAccepted,
+		})
+	}
+	return handlers
+}
+
+func (m *WebhookModule) MsgHandlers(pub app.Publisher) []app.MsgHandler {
+	return nil
+}
+
+func withEndpoint(h func(http.ResponseWriter, *http.Request, Endpoint, app.Publisher), endpoint Endpoint, pub app.Publisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, endpoint, pub)
+	}
+}
+
+func (m *WebhookModule) handleWebhook(w http.ResponseWriter, r *http.Request, endpoint Endpoint, pub app.Publisher) {
+	logger := slog.With("endpoint", endpoint.Name, "remote_addr", r.RemoteAddr)
+	logger.Info("received webhook", "path", r.URL.Path)
+
+	m.mu.Lock()
+	maxBodySize := m.config.MaxBodySize
+	m.mu.Unlock()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+		}
+		logger.Error("failed to read request body", "error", err)
+		return
+	}
+	defer r.Body.Close()
+
+	// Verify the caller before looking at the payload
+	if err := endpoint.Auth.verify(r, body); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logger.Warn("webhook verification failed", "scheme", endpoint.Auth.Scheme, "error", err)
+		return
+	}
+
+	var payload any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid JSON in request body", http.StatusBadRequest)
+		logger.Error("invalid JSON in request body", "error", err)
+		return
+	}
+
+	subject := endpoint.Subject
+	if endpoint.SubjectPath != "" {
+		value, ok := jsonpath.Get(payload, endpoint.SubjectPath)
+		token := tokenSanitizer.ReplaceAllString(strings.TrimSpace(jsonpath.String(value)), "_")
+		if !ok || token == "" {
+			http.Error(w, "Missing "+endpoint.SubjectPath+" in payload", http.StatusUnprocessableEntity)
+			logger.Error("subject path not found in payload", "subject_path", endpoint.SubjectPath)
+			return
+		}
+		subject += "." + token
+	}
+
+	transformed, err := endpoint.Transform.apply(payload, r.Header)
+	if err != nil {
+		http.Error(w, "Error transforming payload", http.StatusUnprocessableEntity)
+		logger.Error("failed to transform payload", "error", err)
+		return
+	}
+
+	data, err := json.Marshal(transformed)
+	if err != nil {
+		http.Error(w, "Error encoding payload", http.StatusInternalServerError)
+		logger.Error("failed to encode payload", "error", err)
+		return
+	}
+
+	if err := pub.Publish(subject, data); err != nil {
+		http.Error(w, "Error publishing event", http.StatusInternalServerError)
+		logger.Error("failed to publish to NATS", "subject", subject, "error", err)
+		return
+	}
+
+	logger.Info("published webhook", "subject", subject, "payload_size", len(data))
+	w.WriteHeader(http.StatusAccepted)
+}